@@ -0,0 +1,152 @@
+package shawell
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/knakk/digest"
+)
+
+// AuthMethod selects how a SparqlEndpoint authenticates itself against the store
+type AuthMethod string
+
+const (
+	// AuthDigest uses HTTP digest authentication, the default of GetSparqlEndpoint
+	AuthDigest AuthMethod = "digest"
+	// AuthBasic uses HTTP basic authentication
+	AuthBasic AuthMethod = "basic"
+	// AuthBearer sends a bearer token, as used for OAuth2
+	AuthBearer AuthMethod = "bearer"
+	// AuthNone sends no credentials, apart from client certificates and extra headers
+	AuthNone AuthMethod = "none"
+)
+
+// GetAuthMethod parses the name of an authentication method, with the empty string selecting
+// AuthDigest
+func GetAuthMethod(name string) (AuthMethod, error) {
+	switch m := AuthMethod(strings.ToLower(name)); m {
+	case "":
+		return AuthDigest, nil
+	case AuthDigest, AuthBasic, AuthBearer, AuthNone:
+		return m, nil
+	default:
+		return "", &UnsupportedFeatureError{Feature: "authentication method " + name}
+	}
+}
+
+// Auth collects the credentials a SparqlEndpoint uses for both its query and update endpoint.
+// The bearer token is taken from Token, or else from the environment variable TokenEnv, or
+// else from TokenFile. The file is read anew for each request, so that refreshed tokens are
+// picked up during long validation runs.
+type Auth struct {
+	Method   AuthMethod
+	Username string // for AuthDigest and AuthBasic
+	Password string
+
+	Token     string // for AuthBearer
+	TokenEnv  string
+	TokenFile string
+
+	CertFile string // client certificate and key in PEM format, for mutual TLS
+	KeyFile  string
+	CAFile   string // certificates used to verify the server instead of the system ones
+
+	Headers map[string]string // added to every request
+}
+
+// SetAuth replaces the authentication of the endpoint
+func (s *SparqlEndpoint) SetAuth(auth Auth) error {
+	transport, err := auth.transport()
+	if err != nil {
+		return err
+	}
+
+	s.client = &http.Client{Transport: transport}
+	return nil
+}
+
+// transport produces the round tripper adding the credentials to each request
+func (a Auth) transport() (http.RoundTripper, error) {
+	base := http.DefaultTransport.(*http.Transport).Clone()
+
+	if a.CertFile != "" || a.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(a.CertFile, a.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		base.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	if a.CAFile != "" {
+		pem, err := os.ReadFile(a.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, &ParseError{Term: a.CAFile, Err: errors.New("no certificates found")}
+		}
+		if base.TLSClientConfig == nil {
+			base.TLSClientConfig = &tls.Config{}
+		}
+		base.TLSClientConfig.RootCAs = pool
+	}
+
+	method, err := GetAuthMethod(string(a.Method))
+	if err != nil {
+		return nil, err
+	}
+
+	out := &authTransport{base: base, headers: a.Headers}
+	switch method {
+	case AuthDigest:
+		out.base = &digest.Transport{Username: a.Username, Password: a.Password, Transport: base}
+	case AuthBasic:
+		out.username, out.password, out.basic = a.Username, a.Password, true
+	case AuthBearer:
+		out.token, out.tokenFile = a.Token, a.TokenFile
+		if out.token == "" && a.TokenEnv != "" {
+			out.token = os.Getenv(a.TokenEnv)
+		}
+		if out.token == "" && out.tokenFile == "" {
+			return nil, errors.New("bearer authentication without token")
+		}
+	}
+
+	return out, nil
+}
+
+// authTransport adds the headers and credentials to each request
+type authTransport struct {
+	base               http.RoundTripper
+	headers            map[string]string
+	basic              bool
+	username, password string
+	token, tokenFile   string
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+
+	switch {
+	case t.basic:
+		req.SetBasicAuth(t.username, t.password)
+	case t.token != "":
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	case t.tokenFile != "":
+		token, err := os.ReadFile(t.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,280 @@
+package shawell
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	rdf "github.com/cem-okulmus/rdf2go-1"
+)
+
+// CacheReporter is implemented by endpoints caching query results, reporting how many queries
+// were answered from the cache and how many had to be sent on
+type CacheReporter interface {
+	CacheStats() (hits, misses int64)
+}
+
+// CachingEndpoint wraps another endpoint, memoising the results of queries by their text, as
+// validation poses many of its target queries repeatedly. Insert, Add and ClearGraph change the
+// data and thus empty the cache.
+//
+// Optionally, results are also kept on disk across runs. As the cache cannot detect changes of
+// the data itself, the entries are keyed by a version given by the caller, such as the ETag or
+// revision of the data graph, which needs to change whenever the data or the selection of
+// graphs does.
+type CachingEndpoint struct {
+	inner   Endpoint
+	dir     string // no disk cache if empty
+	version string
+
+	mu         sync.Mutex
+	results    map[string]cachedTable
+	generation int // number of updates of the data so far, part of the keys on disk
+	hits       int64
+	misses     int64
+}
+
+// cachedTable is a copy of a query result, kept apart from the tables handed out, which the
+// callers may modify
+type cachedTable struct {
+	header []string
+	rows   [][]rdf.Term
+}
+
+// GetCachingEndpoint wraps the endpoint with a cache. If dir is non-empty, results are also
+// stored there, keyed by the version of the data graph, which must then be given as well.
+func GetCachingEndpoint(ep Endpoint, dir, version string) (*CachingEndpoint, error) {
+	if dir != "" {
+		if version == "" {
+			return nil, errors.New("disk cache without version of the data graph")
+		}
+		err := os.MkdirAll(dir, 0o755)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &CachingEndpoint{
+		inner:   ep,
+		dir:     dir,
+		version: version,
+		results: make(map[string]cachedTable),
+	}, nil
+}
+
+// Unwrap returns the endpoint the queries are sent to
+func (c *CachingEndpoint) Unwrap() Endpoint { return c.inner }
+
+// CacheStats returns the number of queries answered from the cache, and the number of queries
+// sent to the wrapped endpoint
+func (c *CachingEndpoint) CacheStats() (hits, misses int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.hits, c.misses
+}
+
+func (c *CachingEndpoint) GetGraph() string { return c.inner.GetGraph() }
+
+func (c *CachingEndpoint) Answer(ctx context.Context, ns Shape, targets []SparqlQueryFlat) (Table[rdf.Term], error) {
+	var queries []string
+	for i := range targets {
+		queries = append(queries, ns.ToSparql(c.inner.GetGraph(), targets[i]).String())
+	}
+
+	out, err := c.cached(strings.Join(queries, "\n#\n"), func() (Table[rdf.Term], error) {
+		return c.inner.Answer(ctx, ns, targets)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return GetGroupedTable(out), nil
+}
+
+func (c *CachingEndpoint) Query(ctx context.Context, query SparqlQuery) (Table[rdf.Term], error) {
+	return c.cached(query.String(), func() (Table[rdf.Term], error) {
+		return c.inner.Query(ctx, query)
+	})
+}
+
+func (c *CachingEndpoint) QueryFlat(ctx context.Context, query SparqlQueryFlat) (Table[rdf.Term], error) {
+	return c.cached(query.String(), func() (Table[rdf.Term], error) {
+		return c.inner.QueryFlat(ctx, query)
+	})
+}
+
+func (c *CachingEndpoint) QueryString(ctx context.Context, query string) (Table[rdf.Term], error) {
+	return c.cached(query, func() (Table[rdf.Term], error) {
+		return c.inner.QueryString(ctx, query)
+	})
+}
+
+func (c *CachingEndpoint) Insert(ctx context.Context, input *rdf.Graph, fromGraph string) error {
+	defer c.invalidate()
+	return c.inner.Insert(ctx, input, fromGraph)
+}
+
+func (c *CachingEndpoint) Add(ctx context.Context, input *rdf.Graph, graph string) error {
+	defer c.invalidate()
+	return c.inner.Add(ctx, input, graph)
+}
+
+func (c *CachingEndpoint) ClearGraph(ctx context.Context, fromGraph string) error {
+	defer c.invalidate()
+	return c.inner.ClearGraph(ctx, fromGraph)
+}
+
+// invalidate drops the results in memory after the data was changed. The entries on disk are
+// kept, since they are keyed by the number of changes: a run repeating the same updates on the
+// same version of the data may use them again.
+func (c *CachingEndpoint) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.results = make(map[string]cachedTable)
+	c.generation++
+}
+
+// cached returns a copy of the cached result of the query, or else runs it and caches the result
+func (c *CachingEndpoint) cached(query string, run func() (Table[rdf.Term], error)) (Table[rdf.Term], error) {
+	c.mu.Lock()
+	entry, ok := c.results[query]
+	generation := c.generation
+	c.mu.Unlock()
+
+	if !ok && c.dir != "" {
+		entry, ok = c.load(query, generation)
+	}
+	if ok {
+		c.mu.Lock()
+		c.hits++
+		c.results[query] = entry
+		c.mu.Unlock()
+		return entry.table(), nil
+	}
+
+	out, err := run()
+	if err != nil {
+		return nil, err
+	}
+	entry = copyTable(out)
+
+	c.mu.Lock()
+	c.misses++
+	if c.generation == generation { // results from before an update are outdated
+		c.results[query] = entry
+	}
+	c.mu.Unlock()
+
+	if c.dir != "" {
+		err = c.store(query, generation, entry)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+func copyTable(t Table[rdf.Term]) cachedTable {
+	out := cachedTable{header: append([]string(nil), t.GetHeader()...)}
+	for row := range t.IterRows() {
+		out.rows = append(out.rows, append([]rdf.Term(nil), row...))
+	}
+	return out
+}
+
+func (e cachedTable) table() *TableSimple[rdf.Term] {
+	out := &TableSimple[rdf.Term]{header: append([]string(nil), e.header...)}
+	for _, row := range e.rows {
+		out.AddRow(append([]rdf.Term(nil), row...))
+	}
+	return out
+}
+
+// cacheFile is the form in which results are stored on disk
+type cacheFile struct {
+	Query  string
+	Header []string
+	Rows   [][]cacheTerm
+}
+
+type cacheTerm struct {
+	Kind     termKind
+	Value    string
+	Lang     string `json:",omitempty"`
+	Datatype string `json:",omitempty"`
+}
+
+func (c *CachingEndpoint) path(query string, generation int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprint(c.version, "\n", generation, "\n", query)))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// load reads the result of the query from disk, if it was stored there before
+func (c *CachingEndpoint) load(query string, generation int) (cachedTable, bool) {
+	content, err := os.ReadFile(c.path(query, generation))
+	if err != nil {
+		return cachedTable{}, false
+	}
+
+	var file cacheFile
+	if json.Unmarshal(content, &file) != nil || file.Query != query {
+		return cachedTable{}, false
+	}
+
+	out := cachedTable{header: file.Header}
+	for _, row := range file.Rows {
+		tuple := make([]rdf.Term, len(row))
+		for i, t := range row {
+			tuple[i] = memTerm{kind: t.Kind, value: t.Value, lang: t.Lang, datatype: t.Datatype}.toRDF()
+		}
+		out.rows = append(out.rows, tuple)
+	}
+	return out, true
+}
+
+// store writes the result of the query to disk, via a temporary file so that concurrent runs
+// never read incomplete results
+func (c *CachingEndpoint) store(query string, generation int, entry cachedTable) error {
+	file := cacheFile{Query: query, Header: entry.header}
+	for _, row := range entry.rows {
+		tuple := make([]cacheTerm, len(row))
+		for i, t := range row {
+			term, err := memTermFromRDF(t)
+			if err != nil {
+				return err
+			}
+			tuple[i] = cacheTerm{Kind: term.kind, Value: term.value, Lang: term.lang, Datatype: term.datatype}
+		}
+		file.Rows = append(file.Rows, tuple)
+	}
+
+	content, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(c.dir, "result-*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), c.path(query, generation))
+}
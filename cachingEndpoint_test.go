@@ -0,0 +1,134 @@
+package shawell
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	rdf "github.com/cem-okulmus/rdf2go-1"
+)
+
+// TestCachingEndpoint checks that repeated queries are answered from the cache, that updates
+// empty it, and that results stored on disk are only used for the same version of the data
+func TestCachingEndpoint(t *testing.T) {
+	ctx := context.Background()
+	data := rdf.NewGraph("http://example.org/")
+	err := data.Parse(strings.NewReader(memoryTestData), "text/turtle")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ep, err := GetMemoryEndpoint(nil, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	cache, err := GetCachingEndpoint(ep, dir, "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cache.Insert(ctx, data, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const query = "SELECT ?x { ?x <http://example.org/knows> ?y }"
+	for i := 0; i < 2; i++ {
+		table, err := cache.QueryString(ctx, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if table.Len() != 2 {
+			t.Errorf("got %d rows, want 2", table.Len())
+		}
+		table.AddRow([]rdf.Term{res("http://example.org/added")}) // must not reach the cache
+	}
+	if hits, misses := cache.CacheStats(); hits != 1 || misses != 1 {
+		t.Errorf("got %d hits and %d misses, want 1 and 1", hits, misses)
+	}
+
+	err = cache.Add(ctx, data, "<http://example.org/other>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cache.QueryString(ctx, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, misses := cache.CacheStats(); misses != 2 {
+		t.Errorf("got %d misses after update, want 2", misses)
+	}
+
+	// results on disk are found by a new cache in front of an empty endpoint, for the same
+	// version and number of updates only
+	cases := []struct {
+		version string
+		want    int
+	}{
+		{"v1", 2},
+		{"v2", 0},
+	}
+	for _, tc := range cases {
+		empty, err := GetMemoryEndpoint(nil, "", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache, err := GetCachingEndpoint(empty, dir, tc.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.invalidate() // stands in for the upload of the data
+
+		table, err := cache.QueryString(ctx, query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if table.Len() != tc.want {
+			t.Errorf("version %s: got %d rows, want %d", tc.version, table.Len(), tc.want)
+		}
+	}
+}
+
+// TestCachingValidation checks that validating via a cache produces the same report, with the
+// target queries posed repeatedly answered from the cache
+func TestCachingValidation(t *testing.T) {
+	ctx := context.Background()
+	doc, err := ReadFile("resources/W3_SHACL_Test_Suite_Core/property/nodeKind-001.ttl")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var results []string
+	var cache *CachingEndpoint
+	for _, cached := range []bool{false, true} {
+		var ep Endpoint
+		ep, err = GetMemoryEndpoint(nil, "", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached {
+			cache, err = GetCachingEndpoint(ep, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ep = cache
+		}
+		err = ep.Insert(ctx, doc, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		report, err := Validate(ctx, doc, ep, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, reportResults(report))
+	}
+
+	if results[1] != results[0] {
+		t.Errorf("got results\n%v\nwant\n%v", results[1], results[0])
+	}
+	if hits, _ := cache.CacheStats(); hits == 0 {
+		t.Error("no query answered from the cache")
+	}
+}
@@ -0,0 +1,456 @@
+// shawell - SHAcl (with) WELLfounded (semantics)
+// Command-line front end to the shawell validator.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	rdf "github.com/cem-okulmus/rdf2go-1"
+	"github.com/cem-okulmus/shawell"
+)
+
+const _sh = "http://www.w3.org/ns/shacl#"
+
+func check(e error) {
+	if e != nil {
+		fmt.Fprintln(os.Stderr, "Error:", e)
+		os.Exit(1)
+	}
+}
+
+// headerFlags collects the values of a repeated flag of the form "Name: value"
+type headerFlags map[string]string
+
+func (h headerFlags) String() string {
+	var out []string
+	for k, v := range h {
+		out = append(out, k+": "+v)
+	}
+	return strings.Join(out, ", ")
+}
+
+func (h headerFlags) Set(value string) error {
+	name, content, ok := strings.Cut(value, ":")
+	if !ok {
+		return fmt.Errorf("header %q not of the form \"Name: value\"", value)
+	}
+	h[strings.TrimSpace(name)] = strings.TrimSpace(content)
+	return nil
+}
+
+// graphName encloses the IRI of a named graph given on the command line in angle brackets
+func graphName(iri string) string {
+	if iri == "" || strings.HasPrefix(iri, "<") {
+		return iri
+	}
+	return "<" + iri + ">"
+}
+
+func main() {
+	// ==============================================
+	// Command-Line Argument Parsing
+
+	flagSet := flag.NewFlagSet("shawell", flag.ExitOnError)
+
+	// input flags
+	endpointAddress := flagSet.String("endpoint", "", "The URL to a SPARQL endpoint.")
+	endpointUpdateAddress := flagSet.String("endpointUpdate", "",
+		"The URL to a SPARQL endpoint used for updating the data.")
+	shapesPath := flagSet.String("shapes", "", "The file path to a SHACL document holding the shapes graph.")
+	shaclDocPath := flagSet.String("shaclDoc", "", "Alias of -shapes.")
+	shapesGraph := flagSet.String("shapesGraph", "",
+		"Read the shapes graph from the given named graph of the endpoint, instead of a file.")
+	shapesQuery := flagSet.String("shapesQuery", "",
+		"A file holding a CONSTRUCT query that produces the shapes graph from the endpoint, used instead of a file.")
+	dataPath := flagSet.String("data", "",
+		"Comma-separated list of Turtle or N-Triples files containing the data graph. "+
+			"Without -endpoint, validation is performed in memory; otherwise the files are "+
+			"uploaded to the endpoint for the duration of the validation.")
+	graph := flagSet.String("graph", "", "Validate only the data in the given named graph.")
+	graphs := flagSet.String("graphs", "",
+		"Comma-separated list of named graphs whose merge is validated, added to all queries as FROM clauses.")
+	dlvLoc := flagSet.String("dlv", "",
+		"The location of a DLV binary used to evaluate recursive SHACL. "+
+			"If left empty, the built-in well-founded solver is used.")
+	dataIncluded := flagSet.Bool("dataIncluded", false,
+		"Set this to true if the SHACL document also contains the data to be checked.")
+	username := flagSet.String("user", "", "The username needed to access endpoint.")
+	password := flagSet.String("password", "", "The password needed to access endpoint.")
+	authMethod := flagSet.String("auth", string(shawell.AuthDigest),
+		"The authentication used for the endpoint: digest, basic, bearer or none.")
+	token := flagSet.String("token", "", "The bearer token used with -auth bearer.")
+	tokenEnv := flagSet.String("tokenEnv", "",
+		"The environment variable holding the bearer token used with -auth bearer.")
+	tokenFile := flagSet.String("tokenFile", "",
+		"A file holding the bearer token used with -auth bearer, read anew for each request.")
+	certFile := flagSet.String("cert", "", "A client certificate (PEM) used for mutual TLS.")
+	keyFile := flagSet.String("key", "", "The key (PEM) of the client certificate.")
+	caFile := flagSet.String("caCert", "", "Certificates (PEM) used to verify the endpoint.")
+	headers := make(headerFlags)
+	flagSet.Var(headers, "header",
+		"An HTTP header of the form \"Name: value\" added to each request. Can be repeated.")
+	debug := flagSet.Bool("debug", false, "Activacting debugging features.")
+	poseQuery := flagSet.String("poseTestQuery", "",
+		"A query to run and return the results. Used for testing/debug purposes.")
+	omitVR := flagSet.Bool("omitVR", false,
+		"Omits outputting the Validation Report. Note that it will still be produced internally.")
+	outputVR := flagSet.String("outputVR", "",
+		"A filepath used to export the Validation Report in turtle notation. "+
+			"Using this and -omitVR at same time is superflous.")
+	forceLP := flagSet.Bool("forceLP", false, "Force the translation into logic programs.")
+	acceptUndefined := flagSet.Bool("acceptUndefined", false,
+		"Do not count targets whose shape is undefined under well-founded semantics as failures.")
+	semantics := flagSet.String("semantics", string(shawell.WellFounded),
+		"The semantics used for recursive SHACL: wellfounded, stable-brave, stable-cautious or supported.")
+	rules := flagSet.Bool("rules", false,
+		"Execute the SHACL rules (sh:rule) of the document before validation.")
+	inferenceGraph := flagSet.String("inferenceGraph", shawell.DefaultInferenceGraph,
+		"The named graph receiving the triples inferred by rules.")
+	timeout := flagSet.Duration("timeout", 0,
+		"Abort the validation after the given duration (e.g. 30m). No limit if zero.")
+	queryTimeout := flagSet.Duration("queryTimeout", shawell.DefaultQueryTimeout,
+		"Abort any single query sent to the endpoint after the given duration. No limit if zero.")
+	retries := flagSet.Int("retries", shawell.DefaultRetryPolicy.MaxRetries,
+		"How often a failed query is retried if the endpoint is unreachable or overloaded.")
+	retryBackoff := flagSet.Duration("retryBackoff", shawell.DefaultRetryPolicy.InitialBackoff,
+		"The wait before the first retry of a query, doubled for each further retry.")
+	breakerThreshold := flagSet.Int("breakerThreshold", shawell.DefaultRetryPolicy.BreakerThreshold,
+		"Abort the validation once this many requests to the endpoint failed in a row. Disabled if zero.")
+	breakerCooldown := flagSet.Duration("breakerCooldown", shawell.DefaultRetryPolicy.BreakerCooldown,
+		"Try the endpoint again this long after -breakerThreshold was reached. Never if zero.")
+	batchSize := flagSet.Int("batchSize", shawell.DefaultBatchSize,
+		"The number of triples uploaded to the endpoint per request, as done with -dataIncluded.")
+	graphStore := flagSet.String("graphStore", "",
+		"The URL of a SPARQL 1.1 Graph Store Protocol endpoint, used for uploading data if given.")
+	resultsFormat := flagSet.String("resultsFormat", string(shawell.ResultsJSON),
+		"The format in which query results are asked for: json, xml or tsv.")
+	pageSize := flagSet.Int("pageSize", 0,
+		"Fetch the results of the validation queries in pages of this many solutions. No paging if 0.")
+	targetChunkSize := flagSet.Int("targetChunkSize", shawell.DefaultTargetChunkSize,
+		"Bind the materialised targets in the queries of the shapes and the validation report via VALUES clauses of this many targets. "+
+			"If negative, the target queries are embedded instead.")
+	parallel := flagSet.Int("parallel", 1,
+		"The number of queries for conditional answers sent to the endpoint concurrently.")
+	profile := flagSet.String("profile", "",
+		"Write the time, size and origin of each query to this file, as CSV if it ends in .csv, else as JSON.")
+	slowQuery := flagSet.Duration("slowQuery", 0,
+		"Print the queries taking at least this long to stderr, with the shape they were produced for.")
+	unoptimized := flagSet.Bool("unoptimized", false,
+		"Send the generated queries without the optimization pass merging and simplifying them.")
+	dialect := flagSet.String("dialect", "generic",
+		"The store validated against, whose problematic SPARQL constructs are avoided: generic, graphdb, fuseki, virtuoso, blazegraph or oxigraph.")
+	closureDepth := flagSet.Int("closureDepth", 0,
+		"Unroll the closures p* and p+ of property paths into this many steps, for stores evaluating them too slowly. "+
+			"Violations only reachable via longer paths are missed. No unrolling if 0.")
+	compareOptimizer := flagSet.Bool("compareOptimizer", false,
+		"Validate once without and once with the optimization pass, printing the query times of both runs.")
+	cache := flagSet.Bool("cache", false, "Answer repeated queries from a cache instead of the endpoint.")
+	cacheDir := flagSet.String("cacheDir", "",
+		"A directory keeping cached query results across runs. Requires -cacheVersion.")
+	cacheVersion := flagSet.String("cacheVersion", "",
+		"The version (e.g. ETag or revision) of the data graph, which the results cached on disk are valid for.")
+
+	// input flags demo purposes
+
+	demoOutputOnlyLP := flagSet.Bool("demoOutputLP", false, "Outputs only the produced LPs.")
+
+	demoOutputQueries := flagSet.Bool("demoOutputQueries", false, "Outputs only the produced SPARQL queries.")
+
+	usingUpdateEndpoint := false
+
+	flagSet.Parse(os.Args[1:])
+
+	offline := *endpointAddress == "" && (*dataPath != "" || *dataIncluded)
+
+	if *shapesPath == "" {
+		shapesPath = shaclDocPath
+	}
+	shapesSources := 0
+	for _, source := range []string{*shapesPath, *shapesGraph, *shapesQuery} {
+		if source != "" {
+			shapesSources++
+		}
+	}
+
+	if (*endpointAddress == "" && !offline) || shapesSources != 1 {
+		fmt.Println("Input args: " + strings.Join(os.Args, " "))
+		flagSet.Usage()
+		os.Exit(-1)
+	}
+	if *graph != "" && *graphs != "" {
+		check(fmt.Errorf("-graph and -graphs cannot be used together"))
+	}
+	if *dataIncluded && *shapesPath == "" {
+		check(fmt.Errorf("-dataIncluded requires the shapes graph to be read from a file"))
+	}
+	if *compareOptimizer && (*cache || *cacheDir != "") {
+		check(fmt.Errorf("-compareOptimizer cannot be combined with -cache, as the second run would be answered from it"))
+	}
+	upload := *dataIncluded || (!offline && *dataPath != "")
+	if upload && (*graph != "" || *graphs != "") {
+		check(fmt.Errorf("data uploaded to the endpoint cannot be combined with -graph or -graphs"))
+	}
+
+	if *endpointUpdateAddress != "" {
+		usingUpdateEndpoint = true // using a system like GraphDB that expects different endpoints
+	}
+
+	// END Command-Line Argument Parsing
+	// ==============================================
+
+	if !*debug { // the skipped parts of the shapes graph are only logged when debugging
+		log.SetOutput(io.Discard)
+	}
+
+	// abort pending queries when the process is interrupted or terminated
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var vrOutFile io.Writer
+	if *outputVR != "" {
+		f, err := os.OpenFile(*outputVR, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		check(err)
+		defer f.Close()
+		vrOutFile = f
+	}
+
+	var dataset shawell.Dataset
+	if *graphs != "" {
+		dataset.Default = strings.Split(*graphs, ",")
+	}
+
+	var endpoint shawell.Endpoint
+	var err error
+
+	if offline {
+		var dataFiles []string
+		if *dataPath != "" && !*dataIncluded { // else uploaded with the shapes document below
+			dataFiles = strings.Split(*dataPath, ",")
+		}
+		var memoryEndpoint *shawell.MemoryEndpoint
+		memoryEndpoint, err = shawell.GetMemoryEndpoint(dataFiles, graphName(*graph), *debug)
+		check(err)
+
+		memoryEndpoint.SetDataset(dataset)
+		endpoint = memoryEndpoint
+	} else {
+		var sparqlEndpoint *shawell.SparqlEndpoint
+		sparqlEndpoint, err = shawell.GetSparqlEndpoint(
+			*endpointAddress,
+			*endpointUpdateAddress,
+			*username,
+			*password,
+			*debug,
+			usingUpdateEndpoint,
+			graphName(*graph),
+			*queryTimeout,
+		)
+		check(err)
+
+		method, err := shawell.GetAuthMethod(*authMethod)
+		check(err)
+		err = sparqlEndpoint.SetAuth(shawell.Auth{
+			Method:    method,
+			Username:  *username,
+			Password:  *password,
+			Token:     *token,
+			TokenEnv:  *tokenEnv,
+			TokenFile: *tokenFile,
+			CertFile:  *certFile,
+			KeyFile:   *keyFile,
+			CAFile:    *caFile,
+			Headers:   headers,
+		})
+		check(err)
+
+		policy := shawell.DefaultRetryPolicy
+		policy.MaxRetries = *retries
+		policy.InitialBackoff = *retryBackoff
+		policy.BreakerThreshold = *breakerThreshold
+		policy.BreakerCooldown = *breakerCooldown
+		sparqlEndpoint.SetRetryPolicy(policy)
+		sparqlEndpoint.SetUpload(shawell.UploadOptions{BatchSize: *batchSize, GraphStore: *graphStore})
+		sparqlEndpoint.SetDataset(dataset)
+		sparqlEndpoint.SetPageSize(*pageSize)
+		format, err := shawell.GetResultsFormat(*resultsFormat)
+		check(err)
+		sparqlEndpoint.SetResultsFormat(format)
+		endpoint = sparqlEndpoint
+	}
+
+	var profiler *shawell.ProfilingEndpoint
+	if *profile != "" || *slowQuery > 0 {
+		profiler = shawell.GetProfilingEndpoint(endpoint, *slowQuery, os.Stderr)
+		endpoint = profiler // within the cache, so that only queries sent on are recorded
+	}
+
+	if *cache || *cacheDir != "" {
+		endpoint, err = shawell.GetCachingEndpoint(endpoint, *cacheDir, *cacheVersion)
+		check(err)
+	}
+
+	// Test Query routine
+	if *poseQuery != "" {
+		queryFile, err := os.ReadFile(*poseQuery)
+		check(err)
+
+		_, err = endpoint.QueryString(ctx, string(queryFile))
+		check(err)
+
+		form := url.Values{}
+		form.Set("query", string(queryFile))
+		arg := form.Encode()
+
+		fmt.Println("Argument: ", arg)
+
+		os.Exit(0)
+	}
+
+	var g2 *rdf.Graph
+	switch {
+	case *shapesPath != "":
+		shaclDoc, err := os.Open(*shapesPath)
+		check(err)
+		defer shaclDoc.Close()
+
+		g2 = rdf.NewGraph(_sh)
+		err = g2.Parse(shaclDoc, "text/turtle")
+		check(err)
+
+		err = shawell.GetNameSpace(shaclDoc)
+		check(err)
+	case *shapesGraph != "":
+		g2, err = shawell.LoadGraph(ctx, endpoint, graphName(*shapesGraph))
+		check(err)
+	default:
+		query, err := os.ReadFile(*shapesQuery)
+		check(err)
+		g2, err = shawell.ConstructGraph(ctx, endpoint, string(query))
+		check(err)
+	}
+
+	// check if data needs to be inserted into Endpoint
+	if upload {
+		uploadGraph := rdf.NewGraph(_sh)
+		name := "<" + _sh + "data>"
+		if *dataIncluded {
+			basename := filepath.Base(*shapesPath)
+			name = "<" + _sh + strings.TrimSuffix(basename, filepath.Ext(basename)) + ">"
+			uploadGraph.Merge(g2)
+		}
+		if *dataPath != "" { // kept in the same graph as the shapes document
+			for _, file := range strings.Split(*dataPath, ",") {
+				data, err := shawell.ReadFile(file)
+				check(err)
+				uploadGraph.Merge(data)
+			}
+		}
+		res := endpoint.Insert(ctx, uploadGraph, name)
+		check(res)
+	}
+
+	sem, err := shawell.GetSemantics(*semantics)
+	check(err)
+	dial, err := shawell.GetDialect(*dialect)
+	check(err)
+
+	opts := shawell.Options{
+		Output:       os.Stdout,
+		ReportOutput: vrOutFile,
+		Debug:        *debug,
+		OmitReport:   *omitVR,
+		ForceLP:      *forceLP,
+		OnlyLP:       *demoOutputOnlyLP,
+		OnlyQueries:  *demoOutputQueries,
+		ClearGraph:   upload,
+		DLV:          *dlvLoc,
+
+		AcceptUndefined: *acceptUndefined,
+		Semantics:       sem,
+		Rules:           *rules,
+		InferenceGraph:  *inferenceGraph,
+		Timeout:         *timeout,
+		Parallel:        *parallel,
+		Unoptimized:     *unoptimized,
+		TargetChunkSize: *targetChunkSize,
+		Dialect:         dial,
+		ClosureDepth:    *closureDepth,
+	}
+
+	var before, after *shawell.ProfilingEndpoint
+	if *compareOptimizer {
+		quiet := opts // the report is only written by the optimized run
+		quiet.Output, quiet.ReportOutput = nil, nil
+		quiet.ClearGraph, quiet.Unoptimized = false, true
+
+		before = shawell.GetProfilingEndpoint(endpoint, 0, nil)
+		_, err = shawell.Validate(ctx, g2, before, quiet)
+		check(err)
+
+		after = shawell.GetProfilingEndpoint(endpoint, 0, nil)
+		endpoint = after
+		opts.Unoptimized = false
+	}
+
+	// Main Routine
+	_, err = shawell.Validate(ctx, g2, endpoint, opts)
+	if *compareOptimizer && err == nil {
+		writeComparison(os.Stdout, shawell.CompareTimings(before.Stats(), after.Stats()))
+	}
+	if *profile != "" { // also written if validation failed, e.g. after a timeout
+		check(writeProfile(profiler, *profile))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Validation failed:", err)
+		os.Exit(1)
+	}
+}
+
+// writeComparison prints the query times of the runs without and with the optimization pass
+func writeComparison(w io.Writer, comparisons []shawell.TimingComparison) {
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+
+	fmt.Fprintln(w, "Query times without and with the optimization pass:")
+	var before, after time.Duration
+	for _, c := range comparisons {
+		origin := c.Shape + ", " + c.Constraint
+		if c.Target != "" {
+			origin += ", target " + c.Target
+		}
+		fmt.Fprintf(w, "%-50s: %10.3f ms (%d queries) -> %10.3f ms (%d queries)\n",
+			origin, ms(c.Before), c.BeforeQueries, ms(c.After), c.AfterQueries)
+		before += c.Before
+		after += c.After
+	}
+	fmt.Fprintf(w, "%-50s: %10.3f ms -> %10.3f ms\n", "Total", ms(before), ms(after))
+}
+
+// writeProfile exports the statistics of the queries to the file
+func writeProfile(profiler *shawell.ProfilingEndpoint, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(strings.ToLower(path), ".csv") {
+		err = profiler.WriteCSV(f)
+	} else {
+		err = profiler.WriteJSON(f)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -1,6 +1,7 @@
-package main
+package shawell
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
@@ -224,17 +225,8 @@ func TestCompliance(t *testing.T) {
 func Compliance(t *testing.T) EARLReport {
 	var tests []string = CoreTests()
 
-	dlv = "bin/dlv"
-
-	endpoint := GetSparqlEndpoint(
-		"http://localhost:7200/repositories/graphdb",
-		"http://localhost:7200/repositories/graphdb/statements",
-		"",
-		"",
-		false,
-		true,
-		"",
-	)
+	endpoint, err := GetMemoryEndpoint(nil, "", false)
+	check(err)
 
 	countPassed := 0
 	countPartial := 0
@@ -247,7 +239,7 @@ func Compliance(t *testing.T) EARLReport {
 		developer:           res("https://github.com/cem-okulmus"),
 	}
 
-	earlInfo := "Sparql engine being used: GraphDB 10.3.3"
+	earlInfo := "Sparql engine being used: shaWell in-memory endpoint"
 
 	for _, testStringCompact := range tests {
 
@@ -264,8 +256,9 @@ func Compliance(t *testing.T) EARLReport {
 		err = g2.Parse(shaclDoc, "text/turtle")
 		check(err)
 
-		prefixes = make(map[string]string) // reset
-		GetNameSpace(shaclDoc)
+		prefixes.reset()
+		err = GetNameSpace(shaclDoc)
+		check(err)
 
 		var VR *ValidationReport
 
@@ -278,17 +271,17 @@ func Compliance(t *testing.T) EARLReport {
 
 		basename := filepath.Base(testString)
 		fileName := strings.TrimSuffix(basename, filepath.Ext(basename))
-		res := endpoint.Insert(g2, "<"+_sh+fileName+">")
+		res := endpoint.Insert(context.Background(), g2, "<"+_sh+fileName+">")
 		check(res)
 		graphName = "<" + _sh + fileName + ">"
-		parsedDoc := GetShaclDocument(g2, graphName, endpoint, false)
+		parsedDoc, err := GetShaclDocument(g2, graphName, endpoint, false)
+		check(err)
 		parsedDoc.debug = false
-		activeDoc = &parsedDoc
 
 		var isomorph bool
-		dataincluded := true
-		actual := answerShacl(endpoint, parsedDoc,
-			&dataincluded, false, false, nil, true, false)
+		actual, err := answerShacl(context.Background(), endpoint, parsedDoc,
+			Options{ForceLP: false, ClearGraph: true})
+		check(err)
 
 		result := actual.conforms == VR.conforms
 
@@ -360,17 +353,8 @@ func TestLogicProgram(t *testing.T) {
 func LogicProgram(t *testing.T) EARLReport {
 	var tests []string = CoreTests()
 
-	dlv = "bin/dlv"
-
-	endpoint := GetSparqlEndpoint(
-		"http://localhost:7200/repositories/graphdb",
-		"http://localhost:7200/repositories/graphdb/statements",
-		"",
-		"",
-		false,
-		true,
-		"",
-	)
+	endpoint, err := GetMemoryEndpoint(nil, "", false)
+	check(err)
 
 	countPassed := 0
 	countPartial := 0
@@ -383,7 +367,7 @@ func LogicProgram(t *testing.T) EARLReport {
 		developer:           res("https://github.com/cem-okulmus"),
 	}
 
-	earlInfo := "Sparql engine being used: GraphDB 10.3.3"
+	earlInfo := "Sparql engine being used: shaWell in-memory endpoint"
 
 	for _, testStringCompact := range tests {
 
@@ -399,8 +383,9 @@ func LogicProgram(t *testing.T) EARLReport {
 		err = g2.Parse(shaclDoc, "text/turtle")
 		check(err)
 
-		prefixes = make(map[string]string) // reset
-		GetNameSpace(shaclDoc)
+		prefixes.reset()
+		err = GetNameSpace(shaclDoc)
+		check(err)
 
 		var VR *ValidationReport
 		var isomorph bool
@@ -413,16 +398,16 @@ func LogicProgram(t *testing.T) EARLReport {
 
 		basename := filepath.Base(testString)
 		fileName := strings.TrimSuffix(basename, filepath.Ext(basename))
-		res := endpoint.Insert(g2, "<"+_sh+fileName+">")
+		res := endpoint.Insert(context.Background(), g2, "<"+_sh+fileName+">")
 		check(res)
 		graphName = "<" + _sh + fileName + ">"
-		parsedDoc := GetShaclDocument(g2, graphName, endpoint, false)
+		parsedDoc, err := GetShaclDocument(g2, graphName, endpoint, false)
+		check(err)
 		parsedDoc.debug = false
-		activeDoc = &parsedDoc
 
-		dataincluded := true
-		actual := answerShacl(endpoint, parsedDoc,
-			&dataincluded, false, false, nil, true, true)
+		actual, err := answerShacl(context.Background(), endpoint, parsedDoc,
+			Options{ForceLP: true, ClearGraph: true})
+		check(err)
 
 		result := actual.conforms == VR.conforms
 
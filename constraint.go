@@ -1,6 +1,7 @@
-package main
+package shawell
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -21,13 +22,30 @@ type ValidationReport struct {
 	results     []ValidationResult // resutls
 }
 
+// Conforms reports whether the data graph conforms to the shapes graph.
+func (v *ValidationReport) Conforms() bool { return v.conforms }
+
+// Results returns the individual validation results of the report.
+func (v *ValidationReport) Results() []ValidationResult { return v.results }
+
+// Undefined returns the results for targets whose shape is undefined under well-founded
+// semantics, as can happen for recursive shapes such as one negating itself.
+func (v *ValidationReport) Undefined() (out []ValidationResult) {
+	for i := range v.results {
+		if v.results[i].Undefined() {
+			out = append(out, v.results[i])
+		}
+	}
+	return out
+}
+
 func ExtractValidationReport(graph *rdf2go.Graph) (out *ValidationReport, err error) {
 	var tmp ValidationReport
 	var parsedResults []ValidationResult
 	out = &tmp
 
 	// this part only works for test suite stuff
-	_sht := prefixes["sht:"] // living dangerously
+	_sht := prefixes.get("sht:") // living dangerously
 	found := graph.One(nil, res(_rdf+"type"), res(_sht+"Validate"))
 	if found != nil {
 		// fmt.Println("Prefixes: ", prefixes)
@@ -93,7 +111,7 @@ func ExtractValidationReport(graph *rdf2go.Graph) (out *ValidationReport, err er
 
 func NilIfBlank(input rdf2go.Term) rdf2go.Term {
 	switch input.(type) {
-	case rdf2go.BlankNode, *rdf2go.BlankNode:
+	case rdf2go.BlankNode, *rdf2go.BlankNode, unboundTerm:
 		return nil
 	default:
 		return input
@@ -171,9 +189,9 @@ func ExtractValidationResult(sub rdf2go.Term, graph *rdf2go.Graph) (out *Validat
 
 func (v ValidationReport) String() string {
 	var sb strings.Builder
-	_sht := prefixes["sht:"] // living dangerously
-	_mf := prefixes["mf:"]   // continuing to live dangerously
-	_xsd := prefixes["xsd:"] // continuing to live dangerously
+	_sht := prefixes.get("sht:") // living dangerously
+	_mf := prefixes.get("mf:")   // continuing to live dangerously
+	_xsd := prefixes.get("xsd:") // continuing to live dangerously
 
 	if v.testName != nil {
 		sb.WriteString(v.testName.String() + " \n")
@@ -231,6 +249,41 @@ type ValidationResult struct {
 	detail                    *ComplexResult
 }
 
+// FocusNode returns the focus node that caused the result.
+func (v ValidationResult) FocusNode() rdf2go.Term { return v.focusNode }
+
+// ResultPath returns the path of the property shape that caused the result, nil if not
+// produced by a property shape.
+func (v ValidationResult) ResultPath() PropertyPath { return v.pathName }
+
+// Value returns the value node that caused the result, nil if not applicable.
+func (v ValidationResult) Value() rdf2go.Term { return v.value }
+
+// SourceShape returns the shape the focus node was validated against.
+func (v ValidationResult) SourceShape() rdf2go.Term { return v.sourceShape }
+
+// SourceConstraintComponent returns the constraint component that caused the result.
+func (v ValidationResult) SourceConstraintComponent() rdf2go.Term {
+	return v.sourceConstraintComponent
+}
+
+// Severity returns the severity of the result, which defaults to sh:Violation.
+func (v ValidationResult) Severity() rdf2go.Term {
+	if v.severity == nil {
+		return res(_sh + "Violation")
+	}
+	return v.severity
+}
+
+// Undefined reports whether the result marks a target whose shape is neither true nor false
+// under well-founded semantics. Such results carry the severity shawell:Undefined.
+func (v ValidationResult) Undefined() bool {
+	return v.severity != nil && v.severity.RawValue() == _shawell+"Undefined"
+}
+
+// Messages returns the messages of the result, keyed by their language tag.
+func (v ValidationResult) Messages() map[string]rdf2go.Term { return v.message }
+
 type ComplexResult struct{}
 
 func QuotedString(input string) (out bool) {
@@ -367,7 +420,7 @@ func (vr ValidationResult) StringGeneric(comparison bool) string {
 
 // Constraint are used for validation, to allow checking if individual constraints are satisfied
 type Constraint interface {
-	SparqlCheck(ep endpoint, obj string, path PropertyPath, shapeName rdf2go.Term, target SparqlQueryFlat) (bool, []ValidationResult)
+	SparqlCheck(ctx context.Context, ep Endpoint, obj string, path PropertyPath, shapeName rdf2go.Term, target SparqlQueryFlat) (bool, []ValidationResult, error)
 }
 
 type ConstraintInstantiation struct {
@@ -380,7 +433,7 @@ type ConstraintInstantiation struct {
 	message    map[string]rdf2go.Term
 }
 
-func (c ConstraintInstantiation) SparqlCheck(ep endpoint) (allValid bool, out []ValidationResult) {
+func (c ConstraintInstantiation) SparqlCheck(ctx context.Context, ep Endpoint) (allValid bool, out []ValidationResult, err error) {
 	allValid = true
 
 	for i := range c.targets {
@@ -390,7 +443,15 @@ func (c ConstraintInstantiation) SparqlCheck(ep endpoint) (allValid bool, out []
 		// fmt.Println("@@@@@@@@@@@@@@@@@@@")
 
 		targetQuery := TargetsToQueries([]TargetExpression{c.targets[i]})
-		valid, report := c.constraint.SparqlCheck(ep, c.obj, c.path, c.shapeName, targetQuery[0])
+		ctx := withQueryOrigin(ctx, QueryOrigin{
+			Shape:      c.shapeName.RawValue(),
+			Constraint: fmt.Sprint(c.constraint),
+			Target:     c.targets[i].String(),
+		})
+		valid, report, err := c.constraint.SparqlCheck(ctx, ep, c.obj, c.path, c.shapeName, targetQuery[0])
+		if err != nil {
+			return false, nil, err
+		}
 		if !valid {
 			allValid = false
 			out = append(out, report...)
@@ -398,13 +459,15 @@ func (c ConstraintInstantiation) SparqlCheck(ep endpoint) (allValid bool, out []
 	}
 
 	for i := range out { // pass on the message and severity
-		out[i].message = c.message
+		if out[i].message == nil { // keep messages produced by the constraint itself
+			out[i].message = c.message
+		}
 		out[i].severity = c.severity
 	}
 
 	out = removeDuplicateVR(out)
 
-	return allValid, out
+	return allValid, out, nil
 }
 
 // GetShape determins which kind of shape (if at all) the given term is,
@@ -527,7 +590,7 @@ type ValueTypeConstraint struct {
 	id   int64       // used to create unique references in Sparql translation
 }
 
-func (v ValueTypeConstraint) SparqlCheck(ep endpoint, obj string, path PropertyPath, shapeNames rdf2go.Term, target SparqlQueryFlat) (result bool, reports []ValidationResult) {
+func (v ValueTypeConstraint) SparqlCheck(ctx context.Context, ep Endpoint, obj string, path PropertyPath, shapeNames rdf2go.Term, target SparqlQueryFlat) (result bool, reports []ValidationResult, err error) {
 	// focusNode = obj
 	// path = path
 	// value .. must be extracted from query
@@ -538,29 +601,31 @@ func (v ValueTypeConstraint) SparqlCheck(ep endpoint, obj string, path PropertyP
 	// fmt.Println("RUNNING VALUETYPE SPARQLCHECK")
 	// fmt.Println("||||||||||||||||||||||||||||||||||||")
 
-	targetLine := fmt.Sprint("{\n\t", target.StringPrefix(false), "\n\t}")
+	targetLine := target.pattern()
 	result = true
 	body := v.SparqlBodyValidation(obj, path)
 	uniqObj := fmt.Sprint(obj, v.id)
-	var header []string
+	var header []projection
 	focusNodeisValueNode := false
 
 	if obj == "?sub" {
 		focusNodeisValueNode = true
-		header = []string{obj, "?indirect0"}
+		header = project(obj, "?indirect0")
 	} else {
-		header = []string{"?sub", uniqObj, "?indirect0"}
+		header = project("?sub", uniqObj, "?indirect0")
 	}
 
 	checkQuery := SparqlQuery{
 		head:   header,
 		target: targetLine,
-		body:   []string{body},
-		group:  []string{},
+		body:   body,
 		graph:  ep.GetGraph(),
 	}
 
-	table := ep.Query(checkQuery)
+	table, err := ep.Query(ctx, checkQuery)
+	if err != nil {
+		return false, nil, err
+	}
 
 	iterChan := table.IterRows()
 
@@ -597,7 +662,7 @@ func (v ValueTypeConstraint) SparqlCheck(ep endpoint, obj string, path PropertyP
 		// }
 	}
 
-	return result, reports
+	return result, reports, nil
 }
 
 func (v ValueTypeConstraint) String() string {
@@ -610,87 +675,74 @@ func (v ValueTypeConstraint) String() string {
 	return _sh + "datatype " + v.term.String()
 }
 
-func (v ValueTypeConstraint) SparqlBody(obj string, path PropertyPath) (out string) {
+func (v ValueTypeConstraint) SparqlBody(obj string, path PropertyPath) (out []patternElement) {
 	// uniqObj := obj + strconv.Itoa(int(v.vt)) + v.term.RawValue()
 	uniqObj := fmt.Sprint(obj, v.id)
+	values := func(inner ...patternElement) *filterPattern {
+		return filterNotExists(append([]patternElement{triple(queryVar("?sub"), path, queryVar(uniqObj))}, inner...)...)
+	}
+
 	switch v.vt {
 	case class: // UNIVERSAL PROPERTY
 
 		if path != nil { // PROPERTY SHAPE
-			out = fmt.Sprint("FILTER NOT EXISTS { ?sub ", path.PropertyString(), " ", uniqObj,
-				" . FILTER NOT EXISTS {", uniqObj, " rdf:type/rdfs:subClassOf* ",
-				v.term.String(), "} . }.")
+			out = append(out, values(filterNotExists(triple(queryVar(uniqObj), classPath, constTerm(v.term)))))
 		} else { // NODE SHAPE
-			out = obj + " rdf:type/rdfs:subClassOf* " + v.term.String() + "."
+			out = append(out, triple(queryVar(obj), classPath, constTerm(v.term)))
 		}
 
 	case nodeKind: // UNIVERSAL PROPERTY
 		if path != nil { // PROPERTY SHAPE
-
-			inner := ""
-			switch v.term.RawValue() {
-			case _sh + "IRI":
-				inner = "FILTER ( !isIRI(" + uniqObj + ") ) ."
-			case _sh + "BlankNodeOrIRI":
-				inner = "FILTER ( !isIRI(" + uniqObj + ") && !isBlank(" + uniqObj + " ) ) ."
-			case _sh + "IRIOrLiteral":
-				inner = "FILTER ( !isIRI(" + uniqObj + ") && !isLiteral(" + uniqObj + " ) ) ."
-			case _sh + "Literal":
-				inner = "FILTER ( !isLiteral(" + uniqObj + ") ) ."
-			case _sh + "BlankNode":
-				inner = "FILTER ( !isBlank(" + uniqObj + ") ) ."
-			case _sh + "BlankNodeOrLiteral":
-				inner = "FILTER ( !isBlank(" + uniqObj + ") && !isLiteral(" + uniqObj + ") ) ."
+			var inner []patternElement
+			if tests := nodeKindTests(v.term); len(tests) > 0 {
+				var negated []sparqlExpr
+				for _, test := range tests {
+					negated = append(negated, notExpr(call(test, exprVar(uniqObj))))
+				}
+				inner = append(inner, filter(andExpr(negated...)))
 			}
 
-			out = fmt.Sprint("FILTER NOT EXISTS { ?sub ", path.PropertyString(), " ", uniqObj, " . ", inner, "}")
+			out = append(out, values(inner...))
 
-		} else { // NODE SHAPE
-			switch v.term.RawValue() {
-			case _sh + "IRI":
-				out = "FILTER ( isIRI(" + obj + ") ) ."
-			case _sh + "BlankNodeOrIRI":
-				out = "FILTER ( isIRI(" + obj + ") || isBlank(" + obj + " ) ) ."
-			case _sh + "IRIOrLiteral":
-				out = "FILTER ( isIRI(" + obj + ") || isLiteral(" + obj + " ) ) ."
-			case _sh + "Literal":
-				out = "FILTER ( isLiteral(" + obj + ") ) ."
-			case _sh + "BlankNode":
-				out = "FILTER ( isBlank(" + obj + ") ) ."
-			case _sh + "BlankNodeOrLiteral":
-				out = "FILTER ( isBlank(" + obj + ") || isLiteral(" + obj + ") ) ."
+		} else if tests := nodeKindTests(v.term); len(tests) > 0 { // NODE SHAPE
+			var kinds []sparqlExpr
+			for _, test := range tests {
+				kinds = append(kinds, call(test, exprVar(obj)))
 			}
+			out = append(out, filter(orExpr(kinds...)))
 		}
 
 	case datatype: // UNIVERSAL PROPERTY
 
 		if RecognisedDatatype(v.term) { // recognised data type
 			if path != nil {
-				b4 := fmt.Sprint("( (datatype(", uniqObj, ") = xsd:string ) || (datatype(", uniqObj, ") != ", v.term.String(), " )) ||")
-				if v.term.RawValue() == _xsd+"string" {
-					b4 = ""
+				u := exprVar(uniqObj)
+				var inner sparqlExpr = compare("!=", cast(v.term, call("STR", u)), u)
+				if v.term.RawValue() != _xsd+"string" {
+					inner = orExpr(
+						compare("=", call("DATATYPE", u), constOf(res(_xsd+"string"))),
+						compare("!=", call("DATATYPE", u), constOf(v.term)),
+						inner,
+					)
 				}
-				// inner := "FILTER ( datatype( " + uniqObj + ") != " + v.term.RawValue() + " ) ."
-				inner := fmt.Sprint("FILTER ( ", b4, " ", v.term.String(), "(str(", uniqObj, ")) != ", uniqObj, " ) .")
 
-				out = fmt.Sprint("FILTER NOT EXISTS { ?sub ", path.PropertyString(), " ", uniqObj, " . ", inner, "}")
+				out = append(out, values(filter(inner)))
 			} else {
-				b4 := fmt.Sprint("( (datatype(", obj, ") = xsd:string ) || (datatype(", obj, ") = ", v.term.String(), " )) &&")
-				if v.term.RawValue() == _xsd+"string" {
-					b4 = ""
+				o := exprVar(obj)
+				var check sparqlExpr = compare("=", cast(v.term, call("STR", o)), o)
+				if v.term.RawValue() != _xsd+"string" {
+					check = andExpr(orExpr(
+						compare("=", call("DATATYPE", o), constOf(res(_xsd+"string"))),
+						compare("=", call("DATATYPE", o), constOf(v.term)),
+					), check)
 				}
-				// out = "FILTER (     datatype( " + obj + ") = " + v.term.RawValue() + " ) ."
-				out = fmt.Sprint("FILTER ( ", b4, " ", v.term.String(), "(str(", obj, ")) = ", obj, " ) .")
+				out = append(out, filter(check))
 			}
 		} else {
 			if path != nil {
-				inner := "FILTER ( datatype( " + uniqObj + ") != " + v.term.String() + " ) ."
-				// inner := fmt.Sprint("FILTER ( ", v.term.String(), "(str(", uniqObj, ")) != ", obj, " ) .")
-
-				out = fmt.Sprint("FILTER NOT EXISTS { ?sub ", path.PropertyString(), " ", uniqObj, " . ", inner, "}")
+				out = append(out, values(filter(compare("!=", call("DATATYPE", exprVar(uniqObj)), constOf(v.term)))))
 			} else {
-				out = "FILTER (     datatype( " + obj + ") = " + v.term.String() + " ) ."
-				// out = fmt.Sprint("FILTER ( ", v.term.String(), "(str(", obj, ")) = ", obj, " ) .")
+				out = append(out, filter(compare("=", call("DATATYPE", exprVar(obj)), constOf(v.term))))
 			}
 		}
 
@@ -699,97 +751,48 @@ func (v ValueTypeConstraint) SparqlBody(obj string, path PropertyPath) (out stri
 	return out
 }
 
-func (v ValueTypeConstraint) SparqlBodyValidation(obj string, path PropertyPath) (out string) {
+func (v ValueTypeConstraint) SparqlBodyValidation(obj string, path PropertyPath) (out []patternElement) {
 	// uniqObj := obj + strconv.Itoa(int(v.vt)) + v.term.RawValue()
 	uniqObj := fmt.Sprint(obj, v.id)
+	checked := obj // the variable of the checked value nodes
+	if path != nil {
+		checked = uniqObj
+		out = append(out, triple(queryVar("?sub"), path, queryVar(uniqObj)))
+	}
+	x := exprVar(checked)
+
 	switch v.vt {
 	case class: // UNIVERSAL PROPERTY
-
-		if path != nil { // PROPERTY SHAPE
-			out = fmt.Sprint("?sub ", path.PropertyString(), " ", uniqObj,
-				" . FILTER NOT EXISTS {", uniqObj, " rdf:type/rdfs:subClassOf* ",
-				v.term.String(), "} . ")
-		} else { // NODE SHAPE
-			out = "FILTER NOT EXISTS {" + obj + " rdf:type/rdfs:subClassOf* " + v.term.String() + ". }"
-		}
+		out = append(out, filterNotExists(triple(queryVar(checked), classPath, constTerm(v.term))))
 
 	case nodeKind: // UNIVERSAL PROPERTY
-		if path != nil { // PROPERTY SHAPE
-
-			inner := ""
-			switch v.term.RawValue() {
-			case _sh + "IRI":
-				inner = "FILTER ( !isIRI(" + uniqObj + ") ) ."
-			case _sh + "BlankNodeOrIRI":
-				inner = "FILTER ( !isIRI(" + uniqObj + ") && !isBlank(" + uniqObj + " ) ) ."
-			case _sh + "IRIOrLiteral":
-				inner = "FILTER ( !isIRI(" + uniqObj + ") && !isLiteral(" + uniqObj + " ) ) ."
-			case _sh + "Literal":
-				inner = "FILTER ( !isLiteral(" + uniqObj + ") ) ."
-			case _sh + "BlankNode":
-				inner = "FILTER ( !isBlank(" + uniqObj + ") ) ."
-			case _sh + "BlankNodeOrLiteral":
-				inner = "FILTER ( !isBlank(" + uniqObj + ") && !isLiteral(" + uniqObj + ")) ."
-			}
-
-			out = fmt.Sprint("?sub ", path.PropertyString(), " ", uniqObj, " . ", inner)
-
-		} else { // NODE SHAPE
-			switch v.term.RawValue() {
-			case _sh + "IRI":
-				out = "FILTER ( !isIRI(" + obj + ") ) ."
-			case _sh + "BlankNodeOrIRI":
-				out = "FILTER ( !isIRI(" + obj + ") && !isBlank(" + obj + " ) ) ."
-			case _sh + "IRIOrLiteral":
-				out = "FILTER ( !isIRI(" + obj + ") && !isLiteral(" + obj + " ) ) ."
-			case _sh + "Literal":
-				out = "FILTER ( !isLiteral(" + obj + ") ) ."
-			case _sh + "BlankNode":
-				out = "FILTER ( !isBlank(" + obj + ")  ) ."
-			case _sh + "BlankNodeOrLiteral":
-				out = "FILTER ( !isBlank(" + obj + ") && !isLiteral(" + obj + ") ) ."
+		if tests := nodeKindTests(v.term); len(tests) > 0 {
+			var negated []sparqlExpr
+			for _, test := range tests {
+				negated = append(negated, notExpr(call(test, x)))
 			}
+			out = append(out, filter(andExpr(negated...)))
 		}
 
 	case datatype: // UNIVERSAL PROPERTY
+		wrongType := compare("!=", call("DATATYPE", x), constOf(v.term))
 
 		if RecognisedDatatype(v.term) { //  recognised data types
-
-			if path != nil {
-				var inner string
-				if v.term.RawValue() == _xsd+"string" {
-					inner = "FILTER ( datatype( " + uniqObj + ") != " + v.term.String() + " ) ."
+			if v.term.RawValue() == _xsd+"string" {
+				if path != nil {
+					out = append(out, filter(wrongType))
 				} else {
-					b4b4 := fmt.Sprint("( (datatype(", uniqObj, ") != xsd:string ) && (datatype(", uniqObj, ") != ", v.term.String(), " )) ||")
-					b4 := fmt.Sprint("BIND (", v.term.String(), "(str(", uniqObj, ")) AS ?OfType", v.id, " ).\n")
-
-					// inner := "FILTER ( datatype( " + uniqObj + ") != " + v.term.RawValue() + " ) ."
-					inner = b4 + fmt.Sprint("FILTER ( ", b4b4, " !BOUND(?OfType", v.id, ")).")
+					out = append(out, filter(orExpr(notExpr(call("ISLITERAL", x)), wrongType)))
 				}
-
-				out = fmt.Sprint(" ?sub ", path.PropertyString(), " ", uniqObj, " . ", inner)
 			} else {
-				if v.term.RawValue() == _xsd+"string" {
-					out = "FILTER ( !isLiteral(" + obj + ") ||  datatype( " + obj + ") != " + v.term.String() + " ) ."
-				} else {
-					b4b4 := fmt.Sprint("( (datatype(", obj, ") != xsd:string ) && (datatype(", obj, ") != ", v.term.String(), " )) ||")
-					b4 := fmt.Sprint("BIND (", v.term.String(), "(str(", obj, ")) AS ?OfType", v.id, " ).\n")
-					out = b4 + fmt.Sprint("FILTER ( ", b4b4, " !BOUND(?OfType", v.id, ")).")
-				}
+				ofType := fmt.Sprint("?OfType", v.id)
+				out = append(out, bind(cast(v.term, call("STR", x)), ofType), filter(orExpr(andExpr(
+					compare("!=", call("DATATYPE", x), constOf(res(_xsd+"string"))),
+					wrongType,
+				), notExpr(call("BOUND", exprVar(ofType))))))
 			}
 		} else {
-			if path != nil {
-				// b4 := fmt.Sprint("BIND (", v.term.String(), "(str(", uniqObj, ")) AS ?OfType", v.id, " ).\n")
-
-				inner := "FILTER ( !isLiteral(" + uniqObj + ") || datatype( " + uniqObj + ") != " + v.term.String() + " ) ."
-				// inner := fmt.Sprint("FILTER ( !BOUND(?OfType", v.id, ")).")
-
-				out = fmt.Sprint(" ?sub ", path.PropertyString(), " ", uniqObj, " . ", inner)
-			} else {
-				// b4 := fmt.Sprint("BIND (", v.term.String(), "(str(", obj, ")) AS ?OfType", v.id, " ).\n")
-				out = "FILTER ( !isLiteral(" + obj + ") ||  datatype( " + obj + ") != " + v.term.String() + " ) ."
-				// out = b4 + fmt.Sprint("FILTER ( !BOUND(?OfType", v.id, ")).")
-			}
+			out = append(out, filter(orExpr(notExpr(call("ISLITERAL", x)), wrongType)))
 		}
 
 	}
@@ -797,6 +800,26 @@ func (v ValueTypeConstraint) SparqlBodyValidation(obj string, path PropertyPath)
 	return out
 }
 
+// nodeKindTests returns the built-in functions testing for the kinds of nodes allowed by the
+// node kind
+func nodeKindTests(kind rdf2go.Term) []string {
+	switch kind.RawValue() {
+	case _sh + "IRI":
+		return []string{"ISIRI"}
+	case _sh + "BlankNodeOrIRI":
+		return []string{"ISIRI", "ISBLANK"}
+	case _sh + "IRIOrLiteral":
+		return []string{"ISIRI", "ISLITERAL"}
+	case _sh + "Literal":
+		return []string{"ISLITERAL"}
+	case _sh + "BlankNode":
+		return []string{"ISBLANK"}
+	case _sh + "BlankNodeOrLiteral":
+		return []string{"ISBLANK", "ISLITERAL"}
+	}
+	return nil
+}
+
 // ExtractValueTypeConstraint gets the input rdf2go graph and a goal term and tries to
 // extract a ValueTypeConstraint (sh:class, sh:dataType or sh:dataType) from it
 func ExtractValueTypeConstraint(graph *rdf2go.Graph, triple *rdf2go.Triple) (out ValueTypeConstraint, err error) {
@@ -855,36 +878,38 @@ func (v ValueRangeConstraint) GetSubConstraints() []Constraint {
 	return []Constraint{}
 }
 
-func (v ValueRangeConstraint) SparqlCheck(ep endpoint, obj string, path PropertyPath, shapeNames rdf2go.Term, target SparqlQueryFlat) (result bool, reports []ValidationResult) {
+func (v ValueRangeConstraint) SparqlCheck(ctx context.Context, ep Endpoint, obj string, path PropertyPath, shapeNames rdf2go.Term, target SparqlQueryFlat) (result bool, reports []ValidationResult, err error) {
 	// focusNode = obj
 	// path = path
 	// value .. must be extracted from query
 	// sourceShape ... Unkown
 	// sourceConstraintComponent .. known
 
-	targetLine := fmt.Sprint("{\n\t", target.StringPrefix(false), "\n\t}")
+	targetLine := target.pattern()
 	result = true
 	body := v.SparqlBodyValidation(obj, path)
 	uniqObj := fmt.Sprint(obj, v.id)
-	var header []string
+	var header []projection
 	focusNodeisValueNode := false
 
 	if obj == "?sub" {
 		focusNodeisValueNode = true
-		header = []string{obj, "?indirect0"}
+		header = project(obj, "?indirect0")
 	} else {
-		header = []string{"?sub", uniqObj, "?indirect0"}
+		header = project("?sub", uniqObj, "?indirect0")
 	}
 
 	checkQuery := SparqlQuery{
 		head:   header,
 		target: targetLine,
-		body:   []string{body},
-		group:  []string{},
+		body:   body,
 		graph:  ep.GetGraph(),
 	}
 
-	table := ep.Query(checkQuery)
+	table, err := ep.Query(ctx, checkQuery)
+	if err != nil {
+		return false, nil, err
+	}
 
 	iterChan := table.IterRows()
 
@@ -922,94 +947,67 @@ func (v ValueRangeConstraint) SparqlCheck(ep endpoint, obj string, path Property
 		// }
 	}
 
-	return result, reports
+	return result, reports, nil
 }
 
-func (v ValueRangeConstraint) SparqlBody(obj string, path PropertyPath) (out string) {
+func (v ValueRangeConstraint) SparqlBody(obj string, path PropertyPath) (out []patternElement) {
 	// uniqObj := obj + strconv.Itoa(int(v.vr)) + strconv.Itoa(v.value)
 	uniqObj := fmt.Sprint(obj, v.id)
 
+	var op string // the comparison of the bound to the values in range
 	switch v.vr {
 	case minExcl: // UNIVERSAL PROPERTY
-		if path != nil {
-			inner := fmt.Sprint("BIND( ", v.value, " < ", uniqObj, "  AS ?result", v.id, " ) . FILTER ( !bound(?result", v.id, ") || !(?result", v.id, " )) .")
-			out = fmt.Sprint("FILTER NOT EXISTS { ?sub ", path.PropertyString(), " ", uniqObj, " . ", inner, "}")
-		} else {
-			out = fmt.Sprint("FILTER ( ", v.value, " < ", obj, ") .")
-		}
+		op = "<"
 	case maxExcl: // UNIVERSAL PROPERTY
-		if path != nil {
-			inner := fmt.Sprint("BIND( ", v.value, " > ", uniqObj, "  AS ?result", v.id, " ) . FILTER ( !bound(?result", v.id, ") || !(?result", v.id, " )) .")
-			out = fmt.Sprint("FILTER NOT EXISTS { ?sub ", path.PropertyString(), " ", uniqObj, " . ", inner, "}")
-		} else {
-			out = fmt.Sprint("FILTER ( ", v.value, " > ", obj, ") .")
-		}
+		op = ">"
 	case minIncl: // UNIVERSAL PROPERTY
-		if path != nil {
-			inner := fmt.Sprint("BIND( ", v.value, " <= ", uniqObj, "  AS ?result", v.id, " ) . FILTER ( !bound(?result", v.id, ") || !(?result", v.id, " )) .")
-			out = fmt.Sprint("FILTER NOT EXISTS { ?sub ", path.PropertyString(), " ", uniqObj, " . ", inner, "}")
-		} else {
-			out = fmt.Sprint("FILTER ( ", v.value, " <= ", obj, ") .")
-		}
-
+		op = "<="
 	case maxInclu: // UNIVERSAL PROPERTY
+		op = ">="
+	}
 
-		if path != nil {
-			inner := fmt.Sprint("BIND( ", v.value, " >= ", uniqObj, "  AS ?result", v.id, " ) . FILTER ( !bound(?result", v.id, ") || !(?result", v.id, " )) .")
-			out = fmt.Sprint("FILTER NOT EXISTS { ?sub ", path.PropertyString(), " ", uniqObj, " . ", inner, "}")
-		} else {
-			out = fmt.Sprint("FILTER ( ", v.value, " >= ", obj, ") .")
-		}
+	if path != nil {
+		result := fmt.Sprint("?result", v.id)
+		out = append(out, filterNotExists(
+			triple(queryVar("?sub"), path, queryVar(uniqObj)),
+			bind(compare(op, constOf(v.value), exprVar(uniqObj)), result),
+			filter(orExpr(notExpr(call("BOUND", exprVar(result))), notExpr(exprVar(result)))),
+		))
+	} else {
+		out = append(out, filter(compare(op, constOf(v.value), exprVar(obj))))
 	}
 
 	return out
 }
 
-func (v ValueRangeConstraint) SparqlBodyValidation(obj string, path PropertyPath) (out string) {
+func (v ValueRangeConstraint) SparqlBodyValidation(obj string, path PropertyPath) (out []patternElement) {
 	// uniqObj := obj + strconv.Itoa(int(v.vt)) + v.term.RawValue()
 	uniqObj := fmt.Sprint(obj, v.id)
 
-	var b4 string
-
+	checked := obj // the variable of the checked value nodes
 	if path != nil {
-		b4 = fmt.Sprint("BIND ((", uniqObj, ") > (", v.value, ") AS ?IsNum", v.id, " ).\n")
-	} else {
-		b4 = fmt.Sprint("BIND ((", obj, ") > (", v.value, ") AS ?IsNum", v.id, " ).\n")
+		checked = uniqObj
+		out = append(out, triple(queryVar("?sub"), path, queryVar(uniqObj)))
 	}
 
+	var op string // the comparison of the bound to the values out of range
 	switch v.vr {
 	case minExcl: // UNIVERSAL PROPERTY
-		if path != nil {
-			inner := b4 + fmt.Sprint("FILTER ( !BOUND(?IsNum", v.id, ") || ", v.value, " >= ", uniqObj, ") .")
-			out = fmt.Sprint("?sub ", path.PropertyString(), " ", uniqObj, " . ", inner)
-		} else {
-			out = b4 + fmt.Sprint("FILTER ( !BOUND(?IsNum", v.id, ") || ", v.value, " >= ", obj, ") .")
-		}
+		op = ">="
 	case maxExcl: // UNIVERSAL PROPERTY
-		if path != nil {
-			inner := b4 + fmt.Sprint("FILTER ( !BOUND(?IsNum", v.id, ") ||  ", v.value, " <= ", uniqObj, ") .")
-			out = fmt.Sprint("?sub ", path.PropertyString(), " ", uniqObj, " . ", inner)
-		} else {
-			out = b4 + fmt.Sprint("FILTER ( !BOUND(?IsNum", v.id, ") ||  ", v.value, " <= ", obj, ") .")
-		}
+		op = "<="
 	case minIncl: // UNIVERSAL PROPERTY
-		if path != nil {
-			inner := b4 + fmt.Sprint("FILTER ( !BOUND(?IsNum", v.id, ") ||  ", v.value, " > ", uniqObj, ") .")
-			out = fmt.Sprint("?sub ", path.PropertyString(), " ", uniqObj, " . ", inner)
-		} else {
-			out = b4 + fmt.Sprint("FILTER ( !BOUND(?IsNum", v.id, ") ||   ", v.value, " > ", obj, ") .")
-		}
-
+		op = ">"
 	case maxInclu: // UNIVERSAL PROPERTY
-
-		if path != nil {
-			inner := b4 + fmt.Sprint("FILTER ( !BOUND(?IsNum", v.id, ") ||  ", v.value, " < ", uniqObj, ") .")
-			out = fmt.Sprint("?sub ", path.PropertyString(), " ", uniqObj, " . ", inner)
-		} else {
-			out = b4 + fmt.Sprint("FILTER ( !BOUND(?IsNum", v.id, ") ||  ", v.value, " < ", obj, ") .")
-		}
+		op = "<"
 	}
 
+	isNum := fmt.Sprint("?IsNum", v.id)
+	out = append(out,
+		bind(compare(">", exprVar(checked), constOf(v.value)), isNum),
+		filter(orExpr(notExpr(call("BOUND", exprVar(isNum))), compare(op, constOf(v.value), exprVar(checked)))),
+	)
+
 	return out
 }
 
@@ -1046,9 +1044,9 @@ const (
 type StringBasedConstraint struct {
 	sb         StringBased
 	length     int
-	pattern    string
-	flags      string
-	langs      []string
+	pattern    rdf2go.Term
+	flags      rdf2go.Term // nil if not given
+	langs      []rdf2go.Term
 	uniqueLang bool  // property shapes ony
 	id         int64 // used to create unique references in Sparql translation
 }
@@ -1057,7 +1055,7 @@ func (v StringBasedConstraint) GetSubConstraints() []Constraint {
 	return []Constraint{}
 }
 
-func (v StringBasedConstraint) SparqlCheck(ep endpoint, obj string, path PropertyPath, shapeNames rdf2go.Term, target SparqlQueryFlat) (result bool, reports []ValidationResult) {
+func (v StringBasedConstraint) SparqlCheck(ctx context.Context, ep Endpoint, obj string, path PropertyPath, shapeNames rdf2go.Term, target SparqlQueryFlat) (result bool, reports []ValidationResult, err error) {
 	// focusNode = obj
 	// path = path
 	// value .. must be extracted from query
@@ -1070,31 +1068,34 @@ func (v StringBasedConstraint) SparqlCheck(ep endpoint, obj string, path Propert
 		uniqLangCase = true
 	}
 
-	targetLine := fmt.Sprint("{\n\t", target.StringPrefix(false), "\n\t}")
+	targetLine := target.pattern()
 	result = true
 	body := v.SparqlBodyValidation(obj, path)
 	uniqObj := fmt.Sprint(obj, v.id)
-	var header []string
+	var header []projection
 	focusNodeisValueNode := false
 
 	if obj == "?sub" {
 		focusNodeisValueNode = true
-		header = []string{obj, "?indirect0"}
+		header = project(obj, "?indirect0")
 	} else if uniqLangCase {
-		header = []string{"?sub", "( lang(" + uniqObj + ") AS ?lang) ", "?indirect0"}
+		header = append(project("?sub"), projectAs(call("LANG", exprVar(uniqObj)), "?lang"))
+		header = append(header, project("?indirect0")...)
 	} else {
-		header = []string{"?sub", uniqObj, "?indirect0"}
+		header = project("?sub", uniqObj, "?indirect0")
 	}
 
 	checkQuery := SparqlQuery{
 		head:   header,
 		target: targetLine,
-		body:   []string{body},
-		group:  []string{},
+		body:   body,
 		graph:  ep.GetGraph(),
 	}
 
-	table := ep.Query(checkQuery)
+	table, err := ep.Query(ctx, checkQuery)
+	if err != nil {
+		return false, nil, err
+	}
 	iterChan := table.IterRows()
 
 	for row := range iterChan {
@@ -1136,7 +1137,7 @@ func (v StringBasedConstraint) SparqlCheck(ep endpoint, obj string, path Propert
 		// }
 	}
 
-	return result, reports
+	return result, reports, nil
 }
 
 func (v StringBasedConstraint) String() string {
@@ -1148,181 +1149,146 @@ func (v StringBasedConstraint) String() string {
 	case pattern:
 		return fmt.Sprint(_sh, "pattern ", v.pattern)
 	case langIn:
-		return fmt.Sprint(_sh, "languageIn (", strings.Join(v.langs, " "), ")")
+		var langs []string
+		for i := range v.langs {
+			langs = append(langs, v.langs[i].String())
+		}
+		return fmt.Sprint(_sh, "languageIn (", strings.Join(langs, " "), ")")
 	}
 	return fmt.Sprint(_sh, "uniqueLang ", v.uniqueLang)
 }
 
-func (v StringBasedConstraint) SparqlBody(obj string, path PropertyPath) (out string) {
+func (v StringBasedConstraint) SparqlBody(obj string, path PropertyPath) (out []patternElement) {
 	// uniqObj := obj + strconv.Itoa(int(v.sb)) + strconv.Itoa(v.length) + v.pattern + v.flags
 	uniqObj := fmt.Sprint(obj, v.id)
+	u, o := exprVar(uniqObj), exprVar(obj)
+	values := func(inner ...patternElement) *filterPattern {
+		return filterNotExists(append([]patternElement{triple(queryVar("?sub"), path, queryVar(uniqObj))}, inner...)...)
+	}
 
 	switch v.sb {
 	case minLen: // UNIVERSAL PROPERTY
 		if path != nil { // PROPERTY SHAPE
-			inner := fmt.Sprint("FILTER (STRLEN(str(", uniqObj, ")) < ", v.length, ") .")
-			out = fmt.Sprint("FILTER NOT EXISTS { ?sub ", path.PropertyString(), " ", uniqObj, " . ", inner, "}")
+			out = append(out, values(filter(compare("<", call("STRLEN", call("STR", u)), intOf(v.length)))))
 		} else { // NODE SHAPE
-			out = fmt.Sprint("FILTER (STRLEN(str(", obj, ")) >= ", v.length, ") .")
+			out = append(out, filter(compare(">=", call("STRLEN", call("STR", o)), intOf(v.length))))
 		}
 	case maxLen: // UNIVERSAL PROPERTY
 
 		if path != nil { // PROPERTY SHAPE
-			inner := fmt.Sprint("FILTER (STRLEN(str(", uniqObj, ")) > ", v.length, ") .")
-			out = fmt.Sprint("FILTER NOT EXISTS { ?sub ", path.PropertyString(), " ", uniqObj, " . ", inner, "}")
+			out = append(out, values(filter(compare(">", call("STRLEN", call("STR", u)), intOf(v.length)))))
 		} else { // NODE SHAPE
-			out = fmt.Sprint("FILTER (STRLEN(str(", obj, ")) <= ", v.length, ") .")
+			out = append(out, filter(compare("<=", call("STRLEN", call("STR", o)), intOf(v.length))))
 		}
 
 	case pattern: // UNIVERSAL PROPERTY
-		// v.pattern = strings.ReplaceAll(v.pattern, "\\", "\\\\")
 		if path != nil {
-			inner := ""
-			if len(v.flags) != 0 {
-				inner = fmt.Sprint("FILTER (isBlank(" + uniqObj + ") || !regex(str(" + uniqObj + "), " + v.pattern + ", " + v.flags + ") )")
-			} else {
-				inner = fmt.Sprint("FILTER (isBlank(" + uniqObj + ") || !regex(str(" + uniqObj + "), " + v.pattern + ") )")
-			}
-
-			out = fmt.Sprint("FILTER NOT EXISTS { ?sub ", path.PropertyString(), " ", uniqObj, " . ", inner, "}")
+			out = append(out, values(filter(orExpr(call("ISBLANK", u), notExpr(v.regex(u))))))
 		} else {
-			if len(v.flags) != 0 {
-				out = fmt.Sprint("FILTER (!isBlank(" + obj + ") && regex(str(" + obj + "), " + v.pattern + ", " + v.flags + ") )")
-			} else {
-				out = fmt.Sprint("FILTER (!isBlank(" + obj + ") && regex(str(" + obj + "), " + v.pattern + ") )")
-			}
+			out = append(out, filter(andExpr(notExpr(call("ISBLANK", o)), v.regex(o))))
 		}
 	case langIn: // Universal Property
 
 		if path != nil { // Property Shape
-
-			var langChecks []string
-
-			for i := range v.langs {
-				langChecks = append(langChecks, fmt.Sprint("langMatches(lang(", uniqObj, "),", v.langs[i], ")"))
-			}
-			inner := fmt.Sprint("FILTER (  ", strings.Join(langChecks, " || "), " ) .")
-			out = fmt.Sprint("FILTER NOT EXISTS { ?sub ", path.PropertyString(), " ", uniqObj, " . ", inner, "}")
+			out = append(out, values(filter(orExpr(v.langMatches(u, false)...))))
 		} else { // Node Shape
-
-			var langChecks []string
-
-			for i := range v.langs {
-				langChecks = append(langChecks, fmt.Sprint("langMatches(lang(", obj, "),", v.langs[i], ")"))
-			}
-
-			out = fmt.Sprint("FILTER (  ", strings.Join(langChecks, " || "), "   ) .")
+			out = append(out, filter(orExpr(v.langMatches(o, false)...)))
 		}
 	case uniqLang: // Universal Property
 
 		if path != nil { // Property Shape
-
-			innerInner := fmt.Sprint(
-				"BIND(lang(", uniqObj, ") AS ?lang1", v.id, "). ",
-				"BIND(lang(", uniqObj, "B) AS ?lang2", v.id, ").",
-				"FILTER ( ", uniqObj, " != ", uniqObj, "B && ?lang2", v.id, " = ?lang1", v.id, " && ?lang1", v.id, " != \"\").")
-
-			inner := fmt.Sprint(" ?sub ", path.PropertyString(), " ", uniqObj, "B .", innerInner)
-
-			out = fmt.Sprint("FILTER NOT EXISTS { ?sub ", path.PropertyString(), " ", uniqObj, " . ", inner, "}")
-		} else {
-			out = "" // nothing to do for NodeShape, since it cannot violate this constraint
-		}
+			out = append(out, values(v.sameLang(uniqObj, path)...))
+		} // nothing to do for NodeShape, since it cannot violate this constraint
 
 	}
 
 	return out
 }
 
-func (v StringBasedConstraint) SparqlBodyValidation(obj string, path PropertyPath) (out string) {
+func (v StringBasedConstraint) SparqlBodyValidation(obj string, path PropertyPath) (out []patternElement) {
 	// uniqObj := obj + strconv.Itoa(int(v.sb)) + strconv.Itoa(v.length) + v.pattern + v.flags
 	uniqObj := fmt.Sprint(obj, v.id)
 
+	if path == nil && v.sb == uniqLang {
+		return nil // nothing to do for NodeShape, since it cannot violate this constraint
+	}
+
+	checked := obj // the variable of the checked value nodes
+	if path != nil {
+		checked = uniqObj
+		out = append(out, triple(queryVar("?sub"), path, queryVar(uniqObj)))
+	}
+	x := exprVar(checked)
+
 	switch v.sb {
 	case minLen: // UNIVERSAL PROPERTY
-		if path != nil { // PROPERTY SHAPE
-			inner := fmt.Sprint("FILTER ( isBlank(", uniqObj, ") || STRLEN(str(", uniqObj, ")) < ", v.length, ") .")
-			out = fmt.Sprint("?sub ", path.PropertyString(), " ", uniqObj, " . ", inner)
-		} else { // NODE SHAPE
-			out = fmt.Sprint("FILTER ( isBlank(", obj, ")  || STRLEN(str(", obj, ")) < ", v.length, ") .")
-		}
+		out = append(out, filter(orExpr(call("ISBLANK", x), compare("<", call("STRLEN", call("STR", x)), intOf(v.length)))))
 	case maxLen: // UNIVERSAL PROPERTY
-
-		if path != nil { // PROPERTY SHAPE
-			inner := fmt.Sprint("FILTER ( isBlank(", uniqObj, ") || STRLEN(str(", uniqObj, ")) > ", v.length, ") .")
-			out = fmt.Sprint("?sub ", path.PropertyString(), " ", uniqObj, " . ", inner)
-		} else { // NODE SHAPE
-			out = fmt.Sprint("FILTER ( isBlank(", obj, ") || STRLEN(str(", obj, ")) > ", v.length, ") .")
-		}
-
+		out = append(out, filter(orExpr(call("ISBLANK", x), compare(">", call("STRLEN", call("STR", x)), intOf(v.length)))))
 	case pattern: // UNIVERSAL PROPERTY
-		// v.pattern = strings.ReplaceAll(v.pattern, "\\", "\\\\")
-		if path != nil {
-			inner := ""
-			if len(v.flags) != 0 {
-				inner = fmt.Sprint("FILTER (isBlank(" + uniqObj + ") || !regex(str(" + uniqObj + "), " + v.pattern + ", " + v.flags + ") )")
-			} else {
-				inner = fmt.Sprint("FILTER (isBlank(" + uniqObj + ") || !regex(str(" + uniqObj + "), " + v.pattern + ") )")
-			}
-
-			out = fmt.Sprint("?sub ", path.PropertyString(), " ", uniqObj, " . ", inner)
-		} else {
-			if len(v.flags) != 0 {
-				out = fmt.Sprint("FILTER (isBlank(" + obj + ") || !regex(str(" + obj + "), " + v.pattern + ", " + v.flags + ") )")
-			} else {
-				out = fmt.Sprint("FILTER (isBlank(" + obj + ") || !regex(str(" + obj + "), " + v.pattern + ") )")
-			}
-		}
+		out = append(out, filter(orExpr(call("ISBLANK", x), notExpr(v.regex(x)))))
 	case langIn: // Universal Propety
-
-		if path != nil { // Property Shape
-
-			var langChecks []string
-
-			for i := range v.langs {
-				langChecks = append(langChecks, fmt.Sprint("!langMatches(lang(", uniqObj, "),", v.langs[i], ")"))
-			}
-
-			b4 := fmt.Sprint("BIND (lang(", uniqObj, ") AS ?lang", v.id, ").\n")
-			inner := b4 + fmt.Sprint("FILTER ( !bound(?lang", v.id, ") || ", strings.Join(langChecks, " && "), "  ) .")
-			out = fmt.Sprint("?sub ", path.PropertyString(), " ", uniqObj, " . ", inner)
-		} else { // Node Shape
-
-			var langChecks []string
-
-			for i := range v.langs {
-				langChecks = append(langChecks, fmt.Sprint("!langMatches(lang(", obj, "),", v.langs[i], ")"))
-			}
-
-			b4 := fmt.Sprint("BIND (lang(", obj, ") AS ?lang", v.id, ").\n")
-			out = b4 + fmt.Sprint("FILTER ( !bound(?lang", v.id, ") || ", strings.Join(langChecks, " &&"), "  ) .")
-		}
+		lang := fmt.Sprint("?lang", v.id)
+		out = append(out, bind(call("LANG", x), lang),
+			filter(orExpr(notExpr(call("BOUND", exprVar(lang))), andExpr(v.langMatches(x, true)...))))
 	case uniqLang:
-		if path != nil { // Property Shape
-			innerInner := fmt.Sprint(
-				"BIND(lang(", uniqObj, ") AS ?lang1", v.id, "). ",
-				"BIND(lang(", uniqObj, "B) AS ?lang2", v.id, ").",
-				"FILTER ( ", uniqObj, " != ", uniqObj, "B && ?lang2", v.id, " = ?lang1", v.id, " && ?lang1", v.id, " != \"\").")
+		out = append(out, v.sameLang(uniqObj, path)...)
+	}
 
-			inner := fmt.Sprint(" ?sub ", path.PropertyString(), " ", uniqObj, "B .", innerInner)
+	return out
+}
 
-			out = fmt.Sprint("?sub ", path.PropertyString(), " ", uniqObj, " . ", inner)
-		}
+// regex matches the string of the value against the pattern
+func (v StringBasedConstraint) regex(value sparqlExpr) callExpr {
+	args := []sparqlExpr{call("STR", value), constOf(v.pattern)}
+	if v.flags != nil {
+		args = append(args, constOf(v.flags))
 	}
+	return call("REGEX", args...)
+}
 
+// langMatches matches the language tag of the value against each of the languages, or tells
+// that it does not match if negated
+func (v StringBasedConstraint) langMatches(value sparqlExpr, negated bool) (out []sparqlExpr) {
+	for i := range v.langs {
+		var match sparqlExpr = call("LANGMATCHES", call("LANG", value), constOf(v.langs[i]))
+		if negated {
+			match = notExpr(match)
+		}
+		out = append(out, match)
+	}
 	return out
 }
 
+// sameLang finds another value of the path with the same language tag as the value
+func (v StringBasedConstraint) sameLang(uniqObj string, path PropertyPath) []patternElement {
+	lang1, lang2 := fmt.Sprint("?lang1", v.id), fmt.Sprint("?lang2", v.id)
+	return []patternElement{
+		triple(queryVar("?sub"), path, queryVar(uniqObj+"B")),
+		bind(call("LANG", exprVar(uniqObj)), lang1),
+		bind(call("LANG", exprVar(uniqObj+"B")), lang2),
+		filter(andExpr(
+			compare("!=", exprVar(uniqObj), exprVar(uniqObj+"B")),
+			compare("=", exprVar(lang2), exprVar(lang1)),
+			compare("!=", exprVar(lang1), stringOf("")),
+		)),
+	}
+}
+
 func ExtractStringBasedConstraint(graph *rdf2go.Graph, triple *rdf2go.Triple) (out StringBasedConstraint, err error) {
 	id := getCount()
 	switch triple.Predicate.RawValue() {
 	case _sh + "minLength":
 		val, err := strconv.Atoi(triple.Object.RawValue())
-		check(err)
+		if err != nil {
+			return out, err
+		}
 		out = StringBasedConstraint{sb: minLen, length: val, id: id}
 	case _sh + "maxLength":
 		val, err := strconv.Atoi(triple.Object.RawValue())
-		check(err)
+		if err != nil {
+			return out, err
+		}
 		out = StringBasedConstraint{sb: maxLen, length: val, id: id}
 	case _sh + "pattern":
 		// check if "sh:flags" defined:
@@ -1330,14 +1296,14 @@ func ExtractStringBasedConstraint(graph *rdf2go.Graph, triple *rdf2go.Triple) (o
 		if flags != nil {
 			out = StringBasedConstraint{
 				sb:      pattern,
-				pattern: triple.Object.String(),
-				flags:   flags.Object.String(),
+				pattern: triple.Object,
+				flags:   flags.Object,
 				id:      id,
 			}
 		} else {
 			out = StringBasedConstraint{
 				sb:      pattern,
-				pattern: triple.Object.String(),
+				pattern: triple.Object,
 				id:      id,
 			}
 		}
@@ -1375,7 +1341,7 @@ func ExtractStringBasedConstraint(graph *rdf2go.Graph, triple *rdf2go.Triple) (o
 			case _rdf + "first":
 				foundFirst = true
 
-				out.langs = append(out.langs, listTriples[i].Object.String())
+				out.langs = append(out.langs, listTriples[i].Object)
 			case _rdf + "rest":
 				foundRest = true
 				newTriples := graph.All(listTriples[i].Object, nil, nil)
@@ -1417,7 +1383,7 @@ func (v PropertyPairConstraint) GetSubConstraints() []Constraint {
 	return []Constraint{}
 }
 
-func (v PropertyPairConstraint) SparqlCheck(ep endpoint, obj string, path PropertyPath, shapeNames rdf2go.Term, target SparqlQueryFlat) (result bool, reports []ValidationResult) {
+func (v PropertyPairConstraint) SparqlCheck(ctx context.Context, ep Endpoint, obj string, path PropertyPath, shapeNames rdf2go.Term, target SparqlQueryFlat) (result bool, reports []ValidationResult, err error) {
 	// focusNode = obj
 	// path = path
 	// value .. must be extracted from query
@@ -1433,33 +1399,35 @@ func (v PropertyPairConstraint) SparqlCheck(ep endpoint, obj string, path Proper
 		lessThanCase = true
 	}
 
-	targetLine := fmt.Sprint("{\n\t", target.StringPrefix(false), "\n\t}")
+	targetLine := target.pattern()
 	result = true
 	body := v.SparqlBodyValidation(obj, path)
 	uniqObj := fmt.Sprint(obj, v.id)
-	var header []string
+	var header []projection
 
 	if path == nil {
-		header = []string{"?sub", uniqObj, "?indirect0"} // only consider equals and disjoint
+		header = project("?sub", uniqObj, "?indirect0") // only consider equals and disjoint
 	} else {
 		if inEqualsCase {
-			header = []string{"?sub", uniqObj + "A", uniqObj + "B", "?indirect0"}
+			header = project("?sub", uniqObj+"A", uniqObj+"B", "?indirect0")
 		} else if lessThanCase {
-			header = []string{"?sub", uniqObj, uniqObj + "B", "?indirect0"}
+			header = project("?sub", uniqObj, uniqObj+"B", "?indirect0")
 		} else {
-			header = []string{"?sub", uniqObj, "?indirect0"}
+			header = project("?sub", uniqObj, "?indirect0")
 		}
 	}
 
 	checkQuery := SparqlQuery{
 		head:   header,
 		target: targetLine,
-		body:   []string{body},
-		group:  []string{},
+		body:   body,
 		graph:  ep.GetGraph(),
 	}
 
-	table := ep.Query(checkQuery)
+	table, err := ep.Query(ctx, checkQuery)
+	if err != nil {
+		return false, nil, err
+	}
 	iterChan := table.IterRows()
 
 	for row := range iterChan {
@@ -1490,14 +1458,12 @@ func (v PropertyPairConstraint) SparqlCheck(ep endpoint, obj string, path Proper
 			var nodeToCheckA rdf2go.Term
 			var nodeToCheckB rdf2go.Term
 
-			_, ok := row[1].(rdf2go.BlankNode)
-			if !ok {
+			if !isUnbound(row[1]) {
 				haveValueA = true
 				nodeToCheckA = row[1]
 			}
 
-			_, ok = row[2].(rdf2go.BlankNode)
-			if !ok {
+			if !isUnbound(row[2]) {
 				haveValueB = true
 				nodeToCheckB = row[2]
 			}
@@ -1521,8 +1487,7 @@ func (v PropertyPairConstraint) SparqlCheck(ep endpoint, obj string, path Proper
 
 			var nodeToCheck rdf2go.Term
 
-			_, ok := row[1].(rdf2go.BlankNode)
-			if ok {
+			if isUnbound(row[1]) {
 				nodeToCheck = report.focusNode
 			} else {
 				nodeToCheck = row[1]
@@ -1548,7 +1513,7 @@ func (v PropertyPairConstraint) SparqlCheck(ep endpoint, obj string, path Proper
 
 	}
 
-	return result, reports
+	return result, reports, nil
 }
 
 func (v PropertyPairConstraint) String() string {
@@ -1567,110 +1532,107 @@ func (v PropertyPairConstraint) String() string {
 // to capture the meaning of the corresponding SHACL constraint. obj provides the object to be
 // constrained, this will differ between node and property shapes, and path  is non-empty if
 // called by a property shape.
-func (v PropertyPairConstraint) SparqlBody(obj string, path PropertyPath) (out string) {
+func (v PropertyPairConstraint) SparqlBody(obj string, path PropertyPath) (out []patternElement) {
 	// uniqObj := obj + strconv.Itoa(int(v.pp)) + v.term.RawValue()
 	uniqObj := fmt.Sprint(obj, v.id)
+	sub, other := queryVar("?sub"), SimplePath{path: v.term}
 
 	switch v.pp {
 	case equals: // Universal Property: set equality between value nodes and objects reachable via equals
-		other := v.term.String()
 		if path != nil {
 
 			// implemented via two not exists: one testing that A ⊆ B and another testing B ⊆ A
-			out1 := fmt.Sprint("FILTER NOT EXISTS { ?sub ", other, " ", uniqObj, "A . FILTER NOT EXISTS { ?sub ", path.PropertyString(), " ", uniqObj, "A .} . } .\n")
-			out2 := fmt.Sprint("FILTER NOT EXISTS { ?sub ", path.PropertyString(), " ", uniqObj, "B . FILTER NOT EXISTS { ?sub ", other, " ", uniqObj, "B .} . } .")
-			out = out1 + out2
+			out = append(out,
+				filterNotExists(triple(sub, other, queryVar(uniqObj+"A")),
+					filterNotExists(triple(sub, path, queryVar(uniqObj+"A")))),
+				filterNotExists(triple(sub, path, queryVar(uniqObj+"B")),
+					filterNotExists(triple(sub, other, queryVar(uniqObj+"B")))),
+			)
 		} else {
-			b4 := fmt.Sprint(obj, " ", other, " ", obj, ". ")
-			out = fmt.Sprint(b4, " FILTER NOT EXISTS { ", obj, " ", other, " ", uniqObj, " . FILTER ( ", obj, " != ", uniqObj, " ) . } .")
+			out = append(out, triple(queryVar(obj), other, queryVar(obj)),
+				filterNotExists(triple(queryVar(obj), other, queryVar(uniqObj)),
+					filter(compare("!=", exprVar(obj), exprVar(uniqObj)))))
 		}
 
 	case disjoint: // Universal Property: set of value nodes and those reachable by disjoint must be distinct
-		other := v.term.String()
 		if path != nil {
 			// implemented via one exists: one testing that A∩B = ∅
-			out = fmt.Sprint("FILTER NOT EXISTS { ?sub ", path.PropertyString(), " ", uniqObj, " . ?sub ", other, " ", uniqObj, " . } .")
+			out = append(out, filterNotExists(triple(sub, path, queryVar(uniqObj)), triple(sub, other, queryVar(uniqObj))))
 		} else { // NON-STANDARD: implementing this since the Test Suite supports it (for some reason)
-			out = fmt.Sprint("FILTER NOT EXISTS { ", obj, " ", other, " ", uniqObj, " . FILTER ( ", obj, " = ", uniqObj, ") .  } .")
+			out = append(out, filterNotExists(triple(queryVar(obj), other, queryVar(uniqObj)),
+				filter(compare("=", exprVar(obj), exprVar(uniqObj)))))
 		}
 
-	case lessThan: // Universal: there is no value node with value higher or equal than those reachable by lessThan
+	case lessThan, lessThanOrEquals: // Universal: there is no value node with value higher (or equal) than those reachable by lessThan(OrEquals)
 		// if path == nil {
 		// 	log.Panicln("Standard Violating and unsupported use of sh:lessThan inside  NodeShapde.")
 		// }
 
-		other := v.term.String()
-
-		// implemented via one exists: one testing that A∩B = ∅
-		out = fmt.Sprint("FILTER NOT EXISTS { ?sub ", path.PropertyString(), " ", uniqObj, " . ?sub ", other, " ", uniqObj, "B . BIND ( ", uniqObj, " < ", uniqObj, "B AS ?result", v.id, ") .  FILTER (!bound(?result", v.id, ") || !(?result", v.id, ")) .  } .")
-	case lessThanOrEquals: // Universal: there is no value node with value higher than those reachable by lessThan
-		// if path == nil {
-		// 	log.Panicln("Standard Violating and unsupported use of sh:lessThanOrEquals inside  NodeShapde.")
-		// }
-		other := v.term.String()
-
 		// implemented via one exists: one testing that A∩B = ∅
-		out = fmt.Sprint("FILTER NOT EXISTS { ?sub ", path.PropertyString(), " ", uniqObj, " . ?sub ", other, " ", uniqObj, "B . BIND ( ", uniqObj, " <= ", uniqObj, "B AS ?result", v.id, ") .  FILTER (!bound(?result", v.id, ") || !(?result", v.id, ")) .  } .")
+		out = append(out, filterNotExists(v.compared(uniqObj, path)...))
 	}
 
 	return out
 }
 
-func (v PropertyPairConstraint) SparqlBodyValidation(obj string, path PropertyPath) (out string) {
+func (v PropertyPairConstraint) SparqlBodyValidation(obj string, path PropertyPath) (out []patternElement) {
 	// uniqObj := obj + strconv.Itoa(int(v.pp)) + v.term.RawValue()
 	uniqObj := fmt.Sprint(obj, v.id)
+	sub, other := queryVar("?sub"), SimplePath{path: v.term}
 
 	switch v.pp {
 	case equals: // Universal Property: set equality between value nodes and objects reachable via equals
-		other := v.term.String()
 		if path != nil {
 
 			// implemented via two not exists: one testing that A ⊆ B and another testing B ⊆ A
-			out1 := fmt.Sprint("?sub ", other, " ", uniqObj, "A . FILTER NOT EXISTS { ?sub ", path.PropertyString(), " ", uniqObj, "A .} . ")
-			out2 := fmt.Sprint("?sub ", path.PropertyString(), " ", uniqObj, "B . FILTER NOT EXISTS { ?sub ", other, " ", uniqObj, "B .} . ")
-
-			out = fmt.Sprint("OPTIONAL { ", out1, "} OPTIONAL {", out2, " } FILTER ( BOUND (", uniqObj, "A) || BOUND(", uniqObj, "B) ) ")
+			out = append(out,
+				optional(triple(sub, other, queryVar(uniqObj+"A")),
+					filterNotExists(triple(sub, path, queryVar(uniqObj+"A")))),
+				optional(triple(sub, path, queryVar(uniqObj+"B")),
+					filterNotExists(triple(sub, other, queryVar(uniqObj+"B")))),
+				filter(orExpr(call("BOUND", exprVar(uniqObj+"A")), call("BOUND", exprVar(uniqObj+"B")))),
+			)
 		} else { // NON-STANDARD: implementing this since the Test Suite supports it (for some reason)
-
-			inner := fmt.Sprint("FILTER ( !BOUND(", uniqObj, ") || ", uniqObj, " != ", obj, "  ).")
-			out1 := fmt.Sprint(obj, " ", other, " ", uniqObj, " . ")
-
-			out = fmt.Sprint("OPTIONAL {", out1, "} ", inner)
+			out = append(out, optional(triple(queryVar(obj), other, queryVar(uniqObj))),
+				filter(orExpr(notExpr(call("BOUND", exprVar(uniqObj))), compare("!=", exprVar(uniqObj), exprVar(obj)))))
 		}
 
 	case disjoint: // Universal Property: set of value nodes and those reachable by disjoint must be distinct
-		other := v.term.String()
 		if path != nil {
 			// implemented via one exists: one testing that A∩B = ∅
-			out = fmt.Sprint("?sub ", path.PropertyString(), " ", uniqObj, " . ?sub ", other, " ", uniqObj, " .")
+			out = append(out, triple(sub, path, queryVar(uniqObj)), triple(sub, other, queryVar(uniqObj)))
 		} else { // NON-STANDARD: implementing this since the Test Suite supports it (for some reason)
-			inner := fmt.Sprint("FILTER ( ", uniqObj, " = ", obj, "  ).")
-			out = fmt.Sprint(obj, " ", other, " ", uniqObj, ". ", inner)
+			out = append(out, triple(queryVar(obj), other, queryVar(uniqObj)),
+				filter(compare("=", exprVar(uniqObj), exprVar(obj))))
 		}
 
-	case lessThan: // Universal: there is no value node with value higher or equal than those reachable by lessThan
+	case lessThan, lessThanOrEquals: // Universal: there is no value node with value higher (or equal) than those reachable by lessThan(OrEquals)
 		// if path == nil {
 		// 	log.Panicln("Standard Violating and unsupported use of sh:lessThan inside  NodeShapde.")
 		// }
-		other := v.term.String()
 
 		// implemented via one exists: one testing that A∩B = ∅
-		// out = fmt.Sprint("?sub ", other, " ", uniqObj, " . FILTER( ", other, " <= ", obj, " ) .")
-
-		out = fmt.Sprint("?sub ", path.PropertyString(), " ", uniqObj, " . ?sub ", other, " ", uniqObj, "B . BIND ( ", uniqObj, " < ", uniqObj, "B AS ?result", v.id, ") .  FILTER (!bound(?result", v.id, ") || !(?result", v.id, ")) .")
-	case lessThanOrEquals: // Universal: there is no value node with value higher than those reachable by lessThan
-		// if path == nil {
-		// 	log.Panicln("Standard Violating and unsupported use of sh:lessThanOrEquals inside  NodeShapde.")
-		// }
-		other := v.term.String()
+		out = append(out, v.compared(uniqObj, path)...)
+	}
 
-		// implemented via one exists: one testing that A∩B = ∅
-		// out = fmt.Sprint("?sub ", other, " ", uniqObj, " . FILTER( ", other, " < ", obj, " )  .")
+	return out
+}
 
-		out = fmt.Sprint("?sub ", path.PropertyString(), " ", uniqObj, " . ?sub ", other, " ", uniqObj, "B . BIND ( ", uniqObj, " <= ", uniqObj, "B AS ?result", v.id, ") .  FILTER (!bound(?result", v.id, ") || !(?result", v.id, ")) .")
+// compared finds the pairs of value nodes and values of the other property that are not in
+// order, for sh:lessThan and sh:lessThanOrEquals
+func (v PropertyPairConstraint) compared(uniqObj string, path PropertyPath) []patternElement {
+	op := "<"
+	if v.pp == lessThanOrEquals {
+		op = "<="
 	}
+	result := fmt.Sprint("?result", v.id)
 
-	return out
+	return []patternElement{
+		triple(queryVar("?sub"), path, queryVar(uniqObj)),
+		triple(queryVar("?sub"), SimplePath{path: v.term}, queryVar(uniqObj+"B")),
+		bind(compare(op, exprVar(uniqObj), exprVar(uniqObj+"B")), result),
+		filter(orExpr(notExpr(call("BOUND", exprVar(result))), notExpr(exprVar(result)))),
+	}
 }
 
 func ExtractPropertyPairConstraint(graph *rdf2go.Graph, triple *rdf2go.Triple) (out PropertyPairConstraint, err error) {
@@ -1705,7 +1667,7 @@ type OtherConstraint struct {
 	oc           Other
 	graph        *rdf2go.Graph // needed for path extraction for the closedness constraint
 	closed       bool
-	allowedPaths *[]string
+	allowedPaths *[]PropertyPath
 	terms        []rdf2go.Term // overloaded, for in/hasValue this collects the terms to match, for closed
 	// it matches the ignoredProperties
 	id int64 // used to create unique references in Sparql translation
@@ -1715,40 +1677,42 @@ func (v OtherConstraint) GetSubConstraints() []Constraint {
 	return []Constraint{}
 }
 
-func (v OtherConstraint) SparqlCheck(ep endpoint, obj string, path PropertyPath, shapeNames rdf2go.Term, target SparqlQueryFlat) (result bool, reports []ValidationResult) {
+func (v OtherConstraint) SparqlCheck(ctx context.Context, ep Endpoint, obj string, path PropertyPath, shapeNames rdf2go.Term, target SparqlQueryFlat) (result bool, reports []ValidationResult, err error) {
 	// focusNode = obj
 	// path = path
 	// value .. must be extracted from query
 	// sourceShape ... Unkown
 	// sourceConstraintComponent .. known
 
-	targetLine := fmt.Sprint("{\n\t", target.StringPrefix(false), "\n\t}")
+	targetLine := target.pattern()
 	result = true
 	body := v.SparqlBodyValidation(obj, path)
 	uniqObj := fmt.Sprint(obj, v.id)
-	var header []string
+	var header []projection
 	focusNodeisValueNode := false
 
 	if v.oc == closed {
-		header = []string{"?sub", "?path", "?ClosedObjTest", "?indirect0"}
+		header = project("?sub", "?path", "?ClosedObjTest", "?indirect0")
 	} else {
 		if obj == "?sub" {
 			focusNodeisValueNode = true
-			header = []string{obj, "?indirect0"}
+			header = project(obj, "?indirect0")
 		} else {
-			header = []string{"?sub", uniqObj, "?indirect0"}
+			header = project("?sub", uniqObj, "?indirect0")
 		}
 	}
 
 	checkQuery := SparqlQuery{
 		head:   header,
 		target: targetLine,
-		body:   []string{body},
-		group:  []string{},
+		body:   body,
 		graph:  ep.GetGraph(),
 	}
 
-	table := ep.Query(checkQuery)
+	table, err := ep.Query(ctx, checkQuery)
+	if err != nil {
+		return false, nil, err
+	}
 	iterChan := table.IterRows()
 
 	for row := range iterChan {
@@ -1801,7 +1765,7 @@ func (v OtherConstraint) SparqlCheck(ep endpoint, obj string, path PropertyPath,
 
 	// fmt.Println("OTHER: returning this many reports:", len(reports))
 
-	return result, reports
+	return result, reports, nil
 }
 
 func (v OtherConstraint) String() string {
@@ -1832,89 +1796,69 @@ func (v OtherConstraint) String() string {
 	return fmt.Sprint(_sh, "in ", sb.String())
 }
 
-func (v OtherConstraint) SparqlBody(obj string, path PropertyPath) (out string) {
+func (v OtherConstraint) SparqlBody(obj string, path PropertyPath) (out []patternElement) {
 	uniqObj := fmt.Sprint(obj, v.id)
 
 	switch v.oc {
 	case in: // Univereal Property: every value node must be \in terms
-		var inList []string
-
-		for i := range v.terms {
-			inList = append(inList, v.terms[i].String())
-		}
 		if path != nil { // Property Shape
-
-			inner := fmt.Sprint("FILTER ( ", uniqObj, " NOT IN (", strings.Join(inList, ", "), ") ) .")
-			out = fmt.Sprint("FILTER NOT EXISTS { ?sub ", path.PropertyString(), " ", uniqObj, " . ", inner, "}")
+			out = append(out, filterNotExists(triple(queryVar("?sub"), path, queryVar(uniqObj)),
+				filter(inList(exprVar(uniqObj), v.terms, true))))
 		} else { // Node Shape
-			out = fmt.Sprint("FILTER ( ", obj, "  IN (", strings.Join(inList, ", "), ") ) .")
+			out = append(out, filter(inList(exprVar(obj), v.terms, false)))
 		}
 	case hasValue: // Existential Property: there _must_ exist a value that
 		if path != nil { // Property Shape
-			inner := fmt.Sprint("FILTER ( ", uniqObj, " IN (", v.terms[0].String(), ") ) .")
-			out = fmt.Sprint("FILTER EXISTS { ?sub ", path.PropertyString(), " ", uniqObj, " . ", inner, "}")
+			out = append(out, filterExists(triple(queryVar("?sub"), path, queryVar(uniqObj)),
+				filter(inList(exprVar(uniqObj), v.terms[:1], false))))
 		} else { // Node Shape
-			out = fmt.Sprint("FILTER ( ", obj, " IN (", v.terms[0].String(), ") ) .")
+			out = append(out, filter(inList(exprVar(obj), v.terms[:1], false)))
 		}
 	case closed: // Universal  Property: every path reachable from focusNode must be in allowed
-
-		var finalAllow []string
-
-		printf := "FILTER NOT EXISTS {\n\t\t %s \n\t }"
-
-		for _, s := range *(v.allowedPaths) {
-			finalAllow = append(finalAllow, fmt.Sprintf(printf, "?sub "+s+" ?ClosedObjTest ."))
-		}
-		for i := range v.terms {
-			finalAllow = append(finalAllow, fmt.Sprintf(printf, "?sub "+v.terms[i].String()+" ?ClosedObjTest ."))
-		}
-
-		inner := strings.Join(finalAllow, "\n\t")
-		out = fmt.Sprint("FILTER NOT EXISTS { \n\t ?sub ?path ?ClosedObjTest . \n\t", inner, "\n\t}")
+		out = append(out, filterNotExists(v.disallowed()...))
 	}
 
 	return out
 }
 
-func (v OtherConstraint) SparqlBodyValidation(obj string, path PropertyPath) (out string) {
+func (v OtherConstraint) SparqlBodyValidation(obj string, path PropertyPath) (out []patternElement) {
 	uniqObj := fmt.Sprint(obj, v.id)
 	switch v.oc {
 	case in: // Univereal Property: every value node must be \in terms
-		var inList []string
-
-		for i := range v.terms {
-			inList = append(inList, v.terms[i].String())
-		}
 		if path != nil { // Property Shape
-
-			inner := fmt.Sprint("FILTER ( ", uniqObj, " NOT IN (", strings.Join(inList, ", "), ") ) .")
-			out = fmt.Sprint("?sub ", path.PropertyString(), " ", uniqObj, " . ", inner)
+			out = append(out, triple(queryVar("?sub"), path, queryVar(uniqObj)),
+				filter(inList(exprVar(uniqObj), v.terms, true)))
 		} else { // Node Shape
-			out = fmt.Sprint("FILTER ( ", obj, "  NOT IN (", strings.Join(inList, ", "), ") ) .")
+			out = append(out, filter(inList(exprVar(obj), v.terms, true)))
 		}
 	case hasValue: // Existential Property: there _must_ exist a value that
 		if path != nil { // Property Shape
-			inner := fmt.Sprint("FILTER ( ", uniqObj, " IN (", v.terms[0].String(), ") ) .")
-			out = fmt.Sprint("FILTER NOT EXISTS { ?sub ", path.PropertyString(), " ", uniqObj, " . ", inner, "}")
+			out = append(out, filterNotExists(triple(queryVar("?sub"), path, queryVar(uniqObj)),
+				filter(inList(exprVar(uniqObj), v.terms[:1], false))))
 		} else { // Node Shape
-			out = fmt.Sprint("FILTER ( ", obj, " NOT IN (", v.terms[0].String(), ") ) .")
+			out = append(out, filter(inList(exprVar(obj), v.terms[:1], true)))
 		}
 
 	case closed: // Universal  Property: every path reachable from focusNode must be in allowed
+		out = append(out, v.disallowed()...)
+	}
 
-		var finalAllow []string
+	return out
+}
 
-		printf := "FILTER NOT EXISTS {\n\t\t %s \n\t }"
+// disallowed finds the triples of the focus node whose object is reachable neither via one of
+// the allowed paths nor via an ignored property
+func (v OtherConstraint) disallowed() []patternElement {
+	sub, test := queryVar("?sub"), queryVar("?ClosedObjTest")
+	out := []patternElement{&triplesBlock{triples: []triplePattern{
+		{subject: sub, predicate: queryVar("?path"), object: test},
+	}}}
 
-		for _, s := range *(v.allowedPaths) {
-			finalAllow = append(finalAllow, fmt.Sprintf(printf, "?sub "+s+" ?ClosedObjTest ."))
-		}
-		for i := range v.terms {
-			finalAllow = append(finalAllow, fmt.Sprintf(printf, "?sub "+v.terms[i].String()+" ?ClosedObjTest ."))
-		}
-
-		inner := strings.Join(finalAllow, "\n\t")
-		out = fmt.Sprint("?sub ?path ?ClosedObjTest . \n\t", inner)
+	for _, allowed := range *(v.allowedPaths) {
+		out = append(out, filterNotExists(triple(sub, allowed, test)))
+	}
+	for i := range v.terms {
+		out = append(out, filterNotExists(triple(sub, SimplePath{path: v.terms[i]}, test)))
 	}
 
 	return out
@@ -2018,43 +1962,47 @@ func ExtractOtherConstraint(graph *rdf2go.Graph, triple *rdf2go.Triple) (out Oth
 
 // TODO: make sure the same targeLine is never cached twice
 
-var targetCache map[string]Table[rdf2go.Term] = make(map[string]Table[rdf2go.Term])
-
-func GetTableForLogicalConstraints(ep endpoint, path PropertyPath, propertyName string, targets []SparqlQueryFlat) (out Table[rdf2go.Term]) {
+func GetTableForLogicalConstraints(ctx context.Context, ep Endpoint, path PropertyPath, propertyName string, targets []SparqlQueryFlat) (out Table[rdf2go.Term], err error) {
 	if len(targets) == 0 {
-		return &GroupedTable[rdf2go.Term]{}
+		return &GroupedTable[rdf2go.Term]{}, nil
 	}
+	run := runOf(ctx)
 	// out = &TableSimple[rdf2go.Term]{}
 	if path != nil {
 		for i := range targets {
-			pathBody := "?sub " + path.PropertyString() + " ?obj ."
+			pathBody := triple(queryVar("?sub"), path, queryVar("?obj"))
 
-			groupConcat := fmt.Sprint("( ?obj AS ?", propertyName, " )")
+			groupConcat := projectAs(exprVar("?obj"), propertyName)
 
-			targetLine := fmt.Sprint("{\n\t", targets[i].StringPrefix(false), "\n\t}")
+			targetLine := targets[i].pattern()
 
 			checkQuery := SparqlQuery{
-				head:   []string{"?sub", groupConcat},
+				head:   append(project("?sub"), groupConcat),
 				target: targetLine,
-				body:   []string{pathBody},
+				body:   []patternElement{pathBody},
 				graph:  ep.GetGraph(),
 			}
 
 			var tmp Table[rdf2go.Term]
 
-			if cache, ok := targetCache[checkQuery.String()]; ok {
+			if cache, ok := run.cachedTable(checkQuery.algebra(true).String()); ok {
 				tmp = cache
 			} else {
-				tmp = ep.Query(checkQuery)
-				targetCache[checkQuery.String()] = tmp
+				tmp, err = ep.Query(ctx, checkQuery)
+				if err != nil {
+					return nil, err
+				}
+				run.cacheTable(checkQuery.algebra(true).String(), tmp)
 			}
 
 			// fmt.Println("Table before merge ", tmp)
 			if out == nil {
 				out = tmp
 			} else {
-				err := out.Merge(tmp) // assume this is what as intended here
-				check(err)
+				err = out.Merge(tmp) // assume this is what as intended here
+				if err != nil {
+					return nil, err
+				}
 			}
 
 			// fmt.Println("Table after merge ", out)
@@ -2062,10 +2010,10 @@ func GetTableForLogicalConstraints(ep endpoint, path PropertyPath, propertyName
 	} else {
 		for i := range targets {
 
-			targetLine := fmt.Sprint("{\n\t", targets[i].StringPrefix(false), "\n\t}")
+			targetLine := targets[i].pattern()
 
 			checkQuery := SparqlQuery{
-				head:   []string{"?sub"},
+				head:   project("?sub"),
 				target: targetLine,
 				// body:   []string{targetLine},
 				graph: ep.GetGraph(),
@@ -2073,22 +2021,27 @@ func GetTableForLogicalConstraints(ep endpoint, path PropertyPath, propertyName
 
 			var tmp Table[rdf2go.Term]
 
-			if cache, ok := targetCache[checkQuery.String()]; ok {
+			if cache, ok := run.cachedTable(checkQuery.algebra(true).String()); ok {
 				tmp = cache
 			} else {
-				tmp = ep.Query(checkQuery)
-				targetCache[checkQuery.String()] = tmp
+				tmp, err = ep.Query(ctx, checkQuery)
+				if err != nil {
+					return nil, err
+				}
+				run.cacheTable(checkQuery.algebra(true).String(), tmp)
 			}
 			if out == nil {
 				out = tmp
 			} else {
-				err := out.Merge(tmp) // assume this is what as intended here
-				check(err)
+				err = out.Merge(tmp) // assume this is what as intended here
+				if err != nil {
+					return nil, err
+				}
 			}
 		}
 	}
 
-	return GetGroupedTable(out)
+	return GetGroupedTable(out), nil
 }
 
 type AndListConstraint struct {
@@ -2507,13 +2460,13 @@ type CardinalityConstraints struct {
 	num int  // the number on which it is consrained
 }
 
-func (v CardinalityConstraints) SparqlCheck(ep endpoint, obj string, path PropertyPath, shapeNames rdf2go.Term, target SparqlQueryFlat) (result bool, reports []ValidationResult) {
-	targetLine := fmt.Sprint("{\n\t", target.StringPrefix(false), "\n\t}")
+func (v CardinalityConstraints) SparqlCheck(ctx context.Context, ep Endpoint, obj string, path PropertyPath, shapeNames rdf2go.Term, target SparqlQueryFlat) (result bool, reports []ValidationResult, err error) {
+	targetLine := target.pattern()
 	result = true
-	body := fmt.Sprint("?sub ", path.PropertyString(), " ", obj, ".")
+	var body patternElement = triple(queryVar("?sub"), path, queryVar(obj))
 
 	if v.min {
-		body = "OPTIONAL {\n\t" + body + "\n\t}"
+		body = optional(body)
 	}
 
 	var countConst CountingSubQuery
@@ -2539,15 +2492,18 @@ func (v CardinalityConstraints) SparqlCheck(ep endpoint, obj string, path Proper
 	// }
 
 	checkQuery := SparqlQuery{
-		head:       []string{"?sub"},
+		head:       project("?sub"),
 		target:     targetLine,
-		body:       []string{body},
+		body:       []patternElement{body},
 		subqueries: []CountingSubQuery{countConst},
 		graph:      ep.GetGraph(),
 		group:      []string{"?sub"},
 	}
 
-	table := ep.Query(checkQuery)
+	table, err := ep.Query(ctx, checkQuery)
+	if err != nil {
+		return false, nil, err
+	}
 	iterChan := table.IterRows()
 
 	for row := range iterChan {
@@ -2569,7 +2525,7 @@ func (v CardinalityConstraints) SparqlCheck(ep endpoint, obj string, path Proper
 		result = false
 	}
 
-	return result, reports
+	return result, reports, nil
 }
 
 type PropertyPath interface {
@@ -2577,6 +2533,15 @@ type PropertyPath interface {
 	PropertyRDF() string
 }
 
+// nestedPropertyString produces the SPARQL syntax of a path nested within another, enclosing
+// complex paths in parentheses
+func nestedPropertyString(p PropertyPath) string {
+	if _, ok := p.(SimplePath); ok {
+		return p.PropertyString()
+	}
+	return "(" + p.PropertyString() + ")"
+}
+
 type SimplePath struct {
 	path rdf2go.Term
 }
@@ -2594,7 +2559,7 @@ type InversePath struct {
 }
 
 func (i InversePath) PropertyString() string {
-	return "^" + i.path.PropertyString()
+	return "^" + nestedPropertyString(i.path)
 }
 
 func (i InversePath) PropertyRDF() string {
@@ -2608,7 +2573,7 @@ type SequencePath struct {
 func (s SequencePath) PropertyString() string {
 	var out []string
 	for i := range s.paths {
-		out = append(out, s.paths[i].PropertyString())
+		out = append(out, nestedPropertyString(s.paths[i]))
 	}
 	return strings.Join(out, "/")
 }
@@ -2628,7 +2593,7 @@ type AlternativePath struct {
 func (a AlternativePath) PropertyString() string {
 	var out []string
 	for i := range a.paths {
-		out = append(out, a.paths[i].PropertyString())
+		out = append(out, nestedPropertyString(a.paths[i]))
 	}
 	return strings.Join(out, "|")
 }
@@ -2650,7 +2615,7 @@ func (z ZerOrMorePath) PropertyRDF() string {
 }
 
 func (z ZerOrMorePath) PropertyString() string {
-	return z.path.PropertyRDF() + "*"
+	return nestedPropertyString(z.path) + "*"
 }
 
 type OneOrMorePath struct {
@@ -2658,11 +2623,11 @@ type OneOrMorePath struct {
 }
 
 func (o OneOrMorePath) PropertyString() string {
-	return o.path.PropertyString() + "+"
+	return nestedPropertyString(o.path) + "+"
 }
 
 func (o OneOrMorePath) PropertyRDF() string {
-	return fmt.Sprint("[ <", _sh, "oneoOrMorePath> ", o.path.PropertyRDF(), " ]")
+	return fmt.Sprint("[ <", _sh, "oneOrMorePath> ", o.path.PropertyRDF(), " ]")
 }
 
 type ZerOrOnePath struct {
@@ -2670,7 +2635,7 @@ type ZerOrOnePath struct {
 }
 
 func (o ZerOrOnePath) PropertyString() string {
-	return o.path.PropertyString() + "?"
+	return nestedPropertyString(o.path) + "?"
 }
 
 func (o ZerOrOnePath) PropertyRDF() string {
@@ -2678,105 +2643,106 @@ func (o ZerOrOnePath) PropertyRDF() string {
 }
 
 // ExtractPropertyPath takes the input graph, and one value term from an sh:path constraint,
-// and extracts the `full` property path
+// and extracts the `full` property path. Paths can be nested arbitrarily, and malformed paths
+// and SHACL lists, as well as paths containing themselves, are reported as ParseError.
 func ExtractPropertyPath(graph *rdf2go.Graph, initTerm rdf2go.Term) (out PropertyPath, err error) {
-	// fmt.Println("Term: ", initTerm)
+	return extractPropertyPath(graph, initTerm, make(map[string]bool))
+}
 
-	// check if term is a blank
+// extractPropertyPath extracts the path, with visiting holding the path nodes it is nested in
+func extractPropertyPath(graph *rdf2go.Graph, initTerm rdf2go.Term, visiting map[string]bool) (out PropertyPath, err error) {
 	switch initTerm.(type) {
 	case *rdf2go.BlankNode:
-		// fmt.Println("Got a blank node! ", initTerm)
-		// decide which complex case we are in
-		triple := graph.One(initTerm, nil, nil)
-		// fmt.Println("Gotten triple: ", triple)
-		switch triple.Predicate.RawValue() {
-		case _sh + "inversePath":
-			further := triple.Object
+		if visiting[initTerm.String()] {
+			return out, &ParseError{Term: initTerm.String(), Err: errors.New("path contains itself")}
+		}
+		visiting[initTerm.String()] = true
+		defer delete(visiting, initTerm.String()) // the same path may still be used side by side
 
-			pathRec, err2 := ExtractPropertyPath(graph, further)
-			if err2 != nil {
-				return out, err2
+		if graph.One(initTerm, res(_rdf+"first"), nil) != nil { // a sequence path
+			paths, err := extractPathList(graph, initTerm, visiting)
+			if err != nil {
+				return out, err
 			}
-			out = InversePath{path: pathRec}
-		case _sh + "alternativePath":
-			further := triple.Object
-			pathRec, err2 := ExtractPropertyPath(graph, further)
-			if err2 != nil {
-				return out, err2
+			if len(paths) < 2 {
+				return out, &ParseError{Term: initTerm.String(), Err: errors.New("sequence path with less than two members")}
 			}
-			sequence := pathRec.(SequencePath)
-			out = AlternativePath(sequence)
-		case _sh + "zeroOrMorePath":
-			further := triple.Object
-			pathRec, err2 := ExtractPropertyPath(graph, further)
-			if err2 != nil {
-				return out, err2
+			return SequencePath{paths: paths}, nil
+		}
+
+		// all other complex paths are blank nodes with exactly one triple
+		triples := graph.All(initTerm, nil, nil)
+		if len(triples) != 1 {
+			return out, &ParseError{Term: initTerm.String(), Err: fmt.Errorf("path node with %d triples instead of one", len(triples))}
+		}
+		triple := triples[0]
+
+		if triple.Predicate.RawValue() == _sh+"alternativePath" {
+			paths, err := extractPathList(graph, triple.Object, visiting)
+			if err != nil {
+				return out, err
 			}
+			if len(paths) < 2 {
+				return out, &ParseError{Term: initTerm.String(), Err: errors.New("alternative path with less than two members")}
+			}
+			return AlternativePath{paths: paths}, nil
+		}
+
+		pathRec, err := extractPropertyPath(graph, triple.Object, visiting)
+		if err != nil {
+			return out, err
+		}
+		switch triple.Predicate.RawValue() {
+		case _sh + "inversePath":
+			out = InversePath{path: pathRec}
+		case _sh + "zeroOrMorePath":
 			out = ZerOrMorePath{path: pathRec}
 		case _sh + "oneOrMorePath":
-			further := triple.Object
-			pathRec, err2 := ExtractPropertyPath(graph, further)
-			if err2 != nil {
-				return out, err2
-			}
 			out = OneOrMorePath{path: pathRec}
 		case _sh + "zeroOrOnePath":
-			further := triple.Object
-			pathRec, err2 := ExtractPropertyPath(graph, further)
-			if err2 != nil {
-				return out, err2
-			}
 			out = ZerOrOnePath{path: pathRec}
-		case _rdf + "first", _rdf + "rest":
-			allTriples := graph.All(initTerm, nil, nil) // get both triples
-			var paths []PropertyPath
-
-			foundFirst := false
-			foundRest := false
-			foundNil := false
-
-			for i := 0; i < len(allTriples); i++ {
-				// fmt.Println("Current triple: ", allTriples[i])
-				switch allTriples[i].Predicate.RawValue() {
-				case _rdf + "nil": // to cover the edge case that we get a top level nil somehow
-					// log.Panicln("Invalid SHACL List, cannot have rdf:nil in predicate position")
-					return out, errors.New("invalid SHACL List, cannot have rdf:nil in predicate position")
-					// foundNil = true
-				case _rdf + "first":
-					foundFirst = true
-
-					pathNext, err2 := ExtractPropertyPath(graph, allTriples[i].Object)
-					if err2 != nil {
-						return out, err2
-					}
+		default:
+			return out, &ParseError{Term: initTerm.String(), Err: errors.New("unknown path predicate " + triple.Predicate.String())}
+		}
+	case *rdf2go.Resource:
+		if initTerm.RawValue() == _rdf+"nil" {
+			return out, &ParseError{Term: initTerm.String(), Err: errors.New("empty list used as path")}
+		}
+		out = SimplePath{path: initTerm}
+	default:
+		return out, &ParseError{Term: initTerm.String(), Err: errors.New("literal used as path")}
+	}
+	return out, nil
+}
 
-					curr := pathNext
+// extractPathList extracts the paths in the SHACL list starting at the given node, in order
+func extractPathList(graph *rdf2go.Graph, list rdf2go.Term, visiting map[string]bool) (paths []PropertyPath, err error) {
+	visited := make(map[string]bool)
 
-					paths = append(paths, curr)
-					// fmt.Println("Gotten path , ", curr)
-				case _rdf + "rest":
-					foundRest = true
-					newTriples := graph.All(allTriples[i].Object, nil, nil)
-					allTriples = append(allTriples, newTriples...) // wonder if this works
-					// fmt.Println("Adding ", len(newTriples), " new triples based on term", allTriples[i].Object)
-				}
-			}
-
-			if !foundFirst && !foundRest && !foundNil {
-				// log.Panicln("Invalid Sequence structure in graph")
-				return out, errors.New("invalid Sequence structure in graph")
-			}
+	for node := list; node.RawValue() != _rdf+"nil"; {
+		if _, ok := node.(*rdf2go.BlankNode); !ok {
+			return nil, &ParseError{Term: node.String(), Err: errors.New("invalid SHACL list, member node is not a blank node")}
+		}
+		if visited[node.String()] {
+			return nil, &ParseError{Term: node.String(), Err: errors.New("invalid SHACL list, list is cyclic")}
+		}
+		visited[node.String()] = true
 
-			out = SequencePath{paths: paths}
+		firsts := graph.All(node, res(_rdf+"first"), nil)
+		rests := graph.All(node, res(_rdf+"rest"), nil)
+		if len(firsts) != 1 || len(rests) != 1 {
+			return nil, &ParseError{Term: node.String(), Err: fmt.Errorf(
+				"invalid SHACL list, %d values for rdf:first and %d for rdf:rest instead of one each", len(firsts), len(rests))}
+		}
 
+		path, err := extractPropertyPath(graph, firsts[0].Object, visiting)
+		if err != nil {
+			return nil, err
 		}
-	default: // we are in the simple path case
-		// fmt.Printf("I don't know about type %T!\n", v)
-		// fmt.Print("Simple Path ", initTerm)
-		out = SimplePath{path: initTerm}
+		paths = append(paths, path)
+		node = rests[0].Object
 	}
-	// fmt.Println("Found pp: ", out.PropertyString())
-	return out, nil
+	return paths, nil
 }
 
 func (s *ShaclDocument) GetPropertyShape(graph *rdf2go.Graph, term rdf2go.Term) (*PropertyShape, error) {
@@ -2816,15 +2782,18 @@ func (s *ShaclDocument) GetPropertyShape(graph *rdf2go.Graph, term rdf2go.Term)
 			out.name = triples[i].Object.RawValue()
 		case _sh + "minCount":
 			val, err := strconv.Atoi(triples[i].Object.RawValue())
-			check(err)
+			if err != nil {
+				return nil, &ParseError{Term: term.String(), Err: err}
+			}
 			if val > 0 {
 				out.universalOnly = false
 			}
 			out.minCount = val
 		case _sh + "maxCount":
 			val, err := strconv.Atoi(triples[i].Object.RawValue())
-
-			check(err)
+			if err != nil {
+				return nil, &ParseError{Term: term.String(), Err: err}
+			}
 			out.maxCount = val
 		}
 	}
@@ -2849,7 +2818,7 @@ func (s *ShaclDocument) GetPropertyShape(graph *rdf2go.Graph, term rdf2go.Term)
 	}
 
 	if !foundPath {
-		log.Panicln("Defined PropertyShape without path: ", term)
+		return nil, &ParseError{Term: term.String(), Err: errors.New("defined PropertyShape without path")}
 	}
 	if out.name == "" {
 		// out.name = fmt.Sprint("Property", id)
@@ -2888,6 +2857,10 @@ func (t TargetIndirect) String() string {
 		out = "(TargetClass) "
 	case TargetNode:
 		out = "(TargetNode) "
+	case TargetSparql:
+		out = "(TargetSparql) "
+	case TargetValues:
+		out = "(TargetValues) "
 	}
 
 	if t.indirection != nil {
@@ -2939,6 +2912,21 @@ func (t TargetNode) String() string {
 	return t.node.RawValue()
 }
 
+// TargetValues selects a chunk of the materialised targets of a shape, bound via a VALUES
+// clause instead of the target query that produced them
+type TargetValues struct {
+	nodes []rdf2go.Term
+}
+
+func (t TargetValues) Target() {}
+
+func (t TargetValues) String() string {
+	if len(t.nodes) == 0 {
+		return "no materialised targets"
+	}
+	return fmt.Sprint(len(t.nodes), " materialised targets from ", t.nodes[0].RawValue())
+}
+
 func ExtractTargetExpression(graph *rdf2go.Graph, triple *rdf2go.Triple) (out TargetExpression, err error) {
 	switch triple.Predicate.RawValue() {
 	case _sh + "targetNode":
@@ -2949,6 +2937,11 @@ func ExtractTargetExpression(graph *rdf2go.Graph, triple *rdf2go.Triple) (out Ta
 		out = TargetObjectsOf{triple.Object}
 	case _sh + "targetSubjectsOf":
 		out = TargetSubjectOf{triple.Object}
+	case _sh + "target":
+		out, err = ExtractSparqlTarget(graph, triple)
+		if err != nil {
+			return nil, err
+		}
 	default:
 		// log.Panicln("Triple is not proper value type const. ", triple)
 		return out, errors.New(fmt.Sprint("Triple is not proper value type const. ", triple))
@@ -2957,34 +2950,42 @@ func ExtractTargetExpression(graph *rdf2go.Graph, triple *rdf2go.Triple) (out Ta
 	return out, nil
 }
 
+// GetTargetTerm produces the pattern of the target as text, with all IRIs written in full
 func GetTargetTerm(t TargetExpression) string {
-	var queryBody string
+	w := newSparqlWriter(nil)
+	for _, e := range targetPattern(t) {
+		w.element(e)
+	}
+	return strings.TrimSpace(w.sb.String())
+}
+
+// targetPattern produces the pattern binding ?sub to the nodes of the target
+func targetPattern(t TargetExpression) (out []patternElement) {
 	switch t := t.(type) {
 	case TargetIndirect:
-		var after string
 		if t.indirection != nil {
-			after = fmt.Sprint("\n?indirect", t.level, " ", (*t.indirection).PropertyString(), " ?sub .")
-			return (strings.ReplaceAll(GetTargetTerm(t.actual), "?sub", fmt.Sprint("?indirect", t.level))) + after
+			indirect := fmt.Sprint("?indirect", t.level)
+			actual := selectQuery(group(targetPattern(t.actual)...))
+			out = renameVars(actual, map[string]string{"sub": strings.TrimPrefix(indirect, "?")}).where.elements
+			return append(out, triple(queryVar(indirect), *t.indirection, queryVar("?sub")))
 		} else {
-			return GetTargetTerm(t.actual)
+			return targetPattern(t.actual)
 		}
 	case TargetClass:
-		queryBody = "?sub <http://www.w3.org/1999/02/22-rdf-syntax-ns#type>/<http://www.w3.org/2000/01/rdf-schema#subClassOf>* NODE ."
-		queryBody = strings.ReplaceAll(queryBody, "NODE", t.class.String())
-
+		out = append(out, triple(queryVar("?sub"), classPath, constTerm(t.class)))
 	case TargetNode:
-		queryBody = " BIND (NODE AS ?sub)"
-		queryBody = strings.ReplaceAll(queryBody, "NODE", t.node.String())
+		out = append(out, bind(constOf(t.node), "?sub"))
 	case TargetSubjectOf:
-		queryBody = "  ?sub NODE ?obj ."
-		queryBody = strings.ReplaceAll(queryBody, "NODE", t.path.String())
-
+		out = append(out, triple(queryVar("?sub"), SimplePath{path: t.path}, queryVar("?obj")))
 	case TargetObjectsOf:
-		queryBody = " ?obj NODE ?sub ."
-		queryBody = strings.ReplaceAll(queryBody, "NODE", t.path.String())
+		out = append(out, triple(queryVar("?obj"), SimplePath{path: t.path}, queryVar("?sub")))
+	case TargetSparql:
+		out = append(out, verbatim(t.prebind()))
+	case TargetValues:
+		out = append(out, values("?sub", t.nodes))
 	}
 
-	return queryBody
+	return out
 }
 
 // GetNodeShape takes as input an rdf2go graph and a term signifying a NodeShape
@@ -3018,16 +3019,16 @@ func (s *ShaclDocument) GetNodeShape(graph *rdf2go.Graph, term rdf2go.Term, insi
 	triples := graph.All(term, nil, nil) // this back-conversion here is needed (for some reason)
 	var deps []dependency
 
-	var allowedPaths []string
+	var allowedPaths []PropertyPath
 
 	for i := range triples {
 		switch triples[i].Predicate.RawValue() {
 		// target expressions
-		case _sh + "targetClass", _sh + "targetNode", _sh + "targetObjectsOf", _sh + "targetSubjectsOf":
+		case _sh + "targetClass", _sh + "targetNode", _sh + "targetObjectsOf", _sh + "targetSubjectsOf",
+			_sh + "target":
 			te, err2 := ExtractTargetExpression(graph, triples[i])
 			if err2 != nil {
-				log.Println(err2)
-				continue
+				return nil, err2
 			}
 			out.target = append(out.target, te)
 		// ValueTypes constraints
@@ -3080,7 +3081,7 @@ func (s *ShaclDocument) GetNodeShape(graph *rdf2go.Graph, term rdf2go.Term, insi
 
 			out.properties = append(out.properties, pshape)
 
-			allowedPaths = append(allowedPaths, pshape.path.PropertyString())
+			allowedPaths = append(allowedPaths, pshape.path)
 		// logic-based constraints
 		case _sh + "and":
 			ac, err2 := s.ExtractAndListConstraint(graph, triples[i])
@@ -3158,6 +3159,22 @@ func (s *ShaclDocument) GetNodeShape(graph *rdf2go.Graph, term rdf2go.Term, insi
 
 				out.others = append(out.others, oc)
 			}
+		// SPARQL-based constraints
+		case _sh + "sparql":
+			sc, err2 := ExtractSparqlConstraint(graph, triples[i])
+			if err2 != nil {
+				return nil, err2
+			}
+			out.sparqls = append(out.sparqls, sc)
+		// SHACL-AF rules
+		case _sh + "rule":
+			rule, err2 := ExtractRule(graph, triples[i], &out)
+			if err2 != nil {
+				return nil, err2
+			}
+			if rule != nil {
+				out.rules = append(out.rules, rule)
+			}
 		case _sh + "severity":
 			out.severity = triples[i].Object
 		case _sh + "message":
@@ -3191,6 +3208,15 @@ func (s *ShaclDocument) GetNodeShape(graph *rdf2go.Graph, term rdf2go.Term, insi
 		}
 	}
 
+	// custom constraint components, recognised by their parameters
+	for _, c := range s.components {
+		scs, err2 := c.Instantiate(graph, term, insideProp != nil)
+		if err2 != nil {
+			return nil, err2
+		}
+		out.sparqls = append(out.sparqls, scs...)
+	}
+
 	qualName = out.GetQualName()
 	if insideProp != nil {
 		viaPath = &insideProp.path
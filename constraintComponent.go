@@ -0,0 +1,167 @@
+package shawell
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cem-okulmus/rdf2go-1"
+)
+
+// ConstraintComponent is a custom constraint component (sh:ConstraintComponent), as defined in
+// Section 6 of the SHACL standard. A shape uses the component if it has values for all of its
+// mandatory parameters, which are then pre-bound in the SPARQL query of the validator.
+type ConstraintComponent struct {
+	IRI               rdf2go.Term
+	parameters        []componentParameter
+	validator         *componentValidator // used if no more specific validator is given
+	nodeValidator     *componentValidator // used for node shapes
+	propertyValidator *componentValidator // used for property shapes
+}
+
+type componentParameter struct {
+	path     rdf2go.Term
+	name     string // the local name of the path, used as variable in the validators
+	optional bool
+}
+
+// componentValidator is either a SPARQLSelectValidator or a SPARQLAskValidator
+type componentValidator struct {
+	query   string // the SELECT query, or the pattern of the ASK query
+	ask     bool
+	message map[string]rdf2go.Term
+}
+
+// ExtractConstraintComponents parses all constraint components declared in the shapes graph
+func ExtractConstraintComponents(graph *rdf2go.Graph) (out []*ConstraintComponent, err error) {
+	for _, t := range graph.All(nil, ResA, res(_sh+"ConstraintComponent")) {
+		c := &ConstraintComponent{IRI: t.Subject}
+
+		for _, p := range graph.All(t.Subject, res(_sh+"parameter"), nil) {
+			path := graph.One(p.Object, res(_sh+"path"), nil)
+			if path == nil {
+				return nil, &ParseError{Term: c.IRI.String(), Err: errors.New("parameter without sh:path")}
+			}
+
+			param := componentParameter{path: path.Object, name: localName(path.Object.RawValue())}
+			if o := graph.One(p.Object, res(_sh+"optional"), nil); o != nil {
+				param.optional = o.Object.RawValue() == "true"
+			}
+			c.parameters = append(c.parameters, param)
+		}
+		if len(c.parameters) == 0 {
+			return nil, &ParseError{Term: c.IRI.String(), Err: errors.New("constraint component without parameters")}
+		}
+
+		validators := []struct {
+			predicate string
+			validator **componentValidator
+		}{
+			{_sh + "validator", &c.validator},
+			{_sh + "nodeValidator", &c.nodeValidator},
+			{_sh + "propertyValidator", &c.propertyValidator},
+		}
+		for _, v := range validators {
+			found := graph.One(t.Subject, res(v.predicate), nil)
+			if found == nil {
+				continue
+			}
+			*v.validator, err = extractValidator(graph, found.Object)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		out = append(out, c)
+	}
+
+	return out, nil
+}
+
+func extractValidator(graph *rdf2go.Graph, node rdf2go.Term) (out *componentValidator, err error) {
+	out = &componentValidator{message: extractMessages(graph, node)}
+
+	if graph.One(node, res(_sh+"ask"), nil) == nil {
+		out.query, err = extractSparqlQuery(graph, node, _sh+"select")
+		return out, err
+	}
+
+	query, err := extractSparqlQuery(graph, node, _sh+"ask")
+	if err != nil {
+		return nil, err
+	}
+	pattern := askQuery.FindStringSubmatch(query)
+	if pattern == nil {
+		return nil, &ParseError{Term: node.String(), Err: errors.New("sh:ask is not an ASK query")}
+	}
+	out.query, out.ask = pattern[1], true
+
+	return out, nil
+}
+
+// localName returns the part of the IRI after the last '#' or '/'
+func localName(iri string) string {
+	return iri[strings.LastIndexAny(iri, "#/")+1:]
+}
+
+// Instantiate produces the constraints the given shape uses via this component, one for each
+// combination of parameter values. Nothing is returned if a mandatory parameter has no value.
+func (c *ConstraintComponent) Instantiate(graph *rdf2go.Graph, shape rdf2go.Term, property bool) (out []SparqlConstraint, err error) {
+	combinations := []map[string]rdf2go.Term{{}}
+	found := false
+
+	for _, p := range c.parameters {
+		values := graph.All(shape, res(p.path.RawValue()), nil)
+		if len(values) == 0 {
+			if !p.optional {
+				return nil, nil
+			}
+			continue
+		}
+		found = true
+
+		var next []map[string]rdf2go.Term
+		for _, comb := range combinations {
+			for _, v := range values {
+				tmp := map[string]rdf2go.Term{p.name: v.Object}
+				for k := range comb {
+					tmp[k] = comb[k]
+				}
+				next = append(next, tmp)
+			}
+		}
+		combinations = next
+	}
+	if !found {
+		return nil, nil
+	}
+
+	validator := c.nodeValidator
+	if property {
+		validator = c.propertyValidator
+	}
+	if validator == nil {
+		validator = c.validator
+	}
+	if validator == nil {
+		return nil, &UnsupportedFeatureError{
+			Feature: fmt.Sprint("constraint component ", c.IRI, " without suitable validator"),
+			Term:    shape.String(),
+		}
+	}
+
+	for _, params := range combinations {
+		out = append(out, SparqlConstraint{
+			node:      c.IRI,
+			shape:     shape,
+			component: c.IRI,
+			params:    params,
+			query:     validator.query,
+			ask:       validator.ask,
+			message:   validator.message,
+			id:        getCount(),
+		})
+	}
+
+	return out, nil
+}
@@ -0,0 +1,134 @@
+package shawell
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	rdf "github.com/cem-okulmus/rdf2go-1"
+)
+
+const pathTestPrefixes = `
+@prefix ex: <http://example.org/> .
+@prefix sh: <http://www.w3.org/ns/shacl#> .
+@prefix rdf: <http://www.w3.org/1999/02/22-rdf-syntax-ns#> .
+`
+
+// extractTestPath extracts the path of ex:s from the triples, given in Turtle
+func extractTestPath(t *testing.T, turtle string) (PropertyPath, error) {
+	t.Helper()
+
+	graph := rdf.NewGraph("http://example.org/")
+	err := graph.Parse(strings.NewReader(pathTestPrefixes+turtle), "text/turtle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	triple := graph.One(res("http://example.org/s"), res(_sh+"path"), nil)
+	if triple == nil {
+		t.Fatal("no path in ", turtle)
+	}
+	return ExtractPropertyPath(graph, triple.Object)
+}
+
+// TestExtractPropertyPath checks that nested paths are extracted, and that their RDF form is
+// extracted into the same path again
+func TestExtractPropertyPath(t *testing.T) {
+	cases := []struct{ turtle, want string }{
+		{`ex:s sh:path ex:p .`, `<http://example.org/p>`},
+		{`ex:s sh:path ( ex:p ex:q ex:r ) .`, `<http://example.org/p>/<http://example.org/q>/<http://example.org/r>`},
+		{`ex:s sh:path [ sh:inversePath ( ex:p ex:q ) ] .`, `^(<http://example.org/p>/<http://example.org/q>)`},
+		{
+			`ex:s sh:path [ sh:alternativePath ( [ sh:inversePath ( ex:p ex:q ) ] ( ex:r [ sh:inversePath ex:p ] ) ) ] .`,
+			`(^(<http://example.org/p>/<http://example.org/q>))|(<http://example.org/r>/(^<http://example.org/p>))`,
+		},
+		{
+			`ex:s sh:path ( [ sh:zeroOrMorePath [ sh:alternativePath ( ex:p ex:q ) ] ] [ sh:oneOrMorePath [ sh:inversePath ex:r ] ] [ sh:zeroOrOnePath ( ex:p ex:q ) ] ) .`,
+			`((<http://example.org/p>|<http://example.org/q>)*)/((^<http://example.org/r>)+)/((<http://example.org/p>/<http://example.org/q>)?)`,
+		},
+		{`ex:s sh:path ( _:x _:x ) . _:x sh:inversePath ex:p .`, `(^<http://example.org/p>)/(^<http://example.org/p>)`},
+	}
+
+	for i, tc := range cases {
+		path, err := extractTestPath(t, tc.turtle)
+		if err != nil {
+			t.Errorf("case %d: %v", i, err)
+			continue
+		}
+		if got := path.PropertyString(); got != tc.want {
+			t.Errorf("case %d: got path %v, want %v", i, got, tc.want)
+		}
+		if _, err := parseSparql("SELECT * { ?s " + path.PropertyString() + " ?o }"); err != nil {
+			t.Errorf("case %d: path %v is not valid SPARQL: %v", i, path.PropertyString(), err)
+		}
+
+		again, err := extractTestPath(t, "ex:s sh:path "+path.PropertyRDF()+" .")
+		if err != nil {
+			t.Errorf("case %d: %v for RDF form %v", i, err, path.PropertyRDF())
+			continue
+		}
+		if got := again.PropertyString(); got != tc.want {
+			t.Errorf("case %d: got path %v from RDF form %v, want %v", i, got, path.PropertyRDF(), tc.want)
+		}
+	}
+}
+
+// TestExtractMalformedPath checks that malformed paths and lists, including paths containing
+// themselves, are reported as ParseError
+func TestExtractMalformedPath(t *testing.T) {
+	cases := []string{
+		`ex:s sh:path _:l1 . _:l1 rdf:first ex:p ; rdf:rest _:l2 . _:l2 rdf:first ex:q .`,
+		`ex:s sh:path _:l1 . _:l1 rdf:first ex:p ; rdf:rest _:l2 . _:l2 rdf:first ex:q ; rdf:rest _:l1 .`,
+		`ex:s sh:path _:l1 . _:l1 rdf:first ex:p, ex:q ; rdf:rest rdf:nil .`,
+		`ex:s sh:path _:l1 . _:l1 rdf:first ex:p ; rdf:rest ex:l2 . ex:l2 rdf:first ex:q ; rdf:rest rdf:nil .`,
+		`ex:s sh:path ( ex:p ) .`,
+		`ex:s sh:path rdf:nil .`,
+		`ex:s sh:path [ sh:alternativePath ex:p ] .`,
+		`ex:s sh:path [ sh:inversePath ex:p ; sh:zeroOrOnePath ex:q ] .`,
+		`ex:s sh:path [ ex:unknownPath ex:p ] .`,
+		`ex:s sh:path "p" .`,
+		`ex:s sh:path _:p . _:p sh:inversePath _:p .`,
+		`ex:s sh:path _:p . _:p sh:zeroOrMorePath [ sh:inversePath _:p ] .`,
+		`ex:s sh:path _:l1 . _:l1 rdf:first _:l1 ; rdf:rest _:l2 . _:l2 rdf:first ex:q ; rdf:rest rdf:nil .`,
+		`ex:s sh:path [ sh:alternativePath _:l1 ] . _:l1 rdf:first ex:p ; rdf:rest _:l2 . _:l2 rdf:first _:l1 ; rdf:rest rdf:nil .`,
+	}
+
+	for i, turtle := range cases {
+		path, err := extractTestPath(t, turtle)
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("case %d: got path %v and error %v, want a ParseError", i, path, err)
+		}
+	}
+}
+
+// TestValidateNestedPath checks the values reached via an inverse of a sequence path
+func TestValidateNestedPath(t *testing.T) {
+	shapes := `
+@prefix ex: <http://example.org/> .
+@prefix sh: <http://www.w3.org/ns/shacl#> .
+
+ex:TargetShape a sh:NodeShape ;
+	sh:targetNode ex:c, ex:d ;
+	sh:property [ sh:path [ sh:inversePath ( ex:p ex:q ) ] ; sh:minCount 1 ; sh:in ( ex:a ) ] .
+`
+	data := `
+@prefix ex: <http://example.org/> .
+
+ex:a ex:p ex:b .
+ex:b ex:q ex:c .
+ex:e ex:q ex:d .
+ex:d ex:p ex:c .
+`
+	report := validateTurtle(t, shapes, data, Options{})
+
+	var focus []string
+	for _, r := range report.Results() {
+		focus = append(focus, r.FocusNode().String())
+		if got, want := r.ResultPath().PropertyString(), "^(<http://example.org/p>/<http://example.org/q>)"; got != want {
+			t.Errorf("got result path %v, want %v", got, want)
+		}
+	}
+	if len(focus) != 1 || focus[0] != "<http://example.org/d>" {
+		t.Errorf("got results for %v, want ex:d only", focus)
+	}
+}
@@ -0,0 +1,347 @@
+package shawell
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Dialect describes the constructs of SPARQL a triple store has trouble with, be it by rejecting
+// them or by answering them wrongly. The generated queries are rewritten in the algebra to avoid
+// these constructs, always into equivalent ones, so that the dialect never changes the report.
+type Dialect struct {
+	Name string
+
+	// GRAPH patterns are not nested within sub-queries, but only enclose them
+	NoGraphInSubquery bool
+
+	// COUNT(DISTINCT) is not used within grouped sub-queries; the distinct values are selected
+	// by a further sub-query and counted by COUNT instead
+	NoCountDistinct bool
+
+	// the language ranges of sh:languageIn are matched by comparing the tags, instead of
+	// calling langMatches
+	NoLangMatches bool
+
+	// the flags of sh:pattern are given inline within the regular expression, instead of as
+	// third argument of regex
+	NoRegexFlags bool
+
+	// if positive, the paths p* and p+ are unrolled into sequences of p? of this length; set
+	// from Options.ClosureDepth, as it does change the report
+	closureDepth int
+}
+
+// The dialects of the stores shaWell is used with
+var (
+	// Generic follows the SPARQL 1.1 standard, without avoiding any construct
+	Generic = Dialect{Name: "generic"}
+	// Fuseki follows the standard closely
+	Fuseki = Dialect{Name: "fuseki"}
+	// Oxigraph follows the standard closely
+	Oxigraph = Dialect{Name: "oxigraph"}
+	// GraphDB evaluates COUNT(DISTINCT) over OPTIONAL patterns slowly
+	GraphDB = Dialect{Name: "graphdb", NoCountDistinct: true}
+	// Virtuoso mishandles GRAPH patterns within sub-queries, COUNT(DISTINCT) over OPTIONAL
+	// patterns and language ranges
+	Virtuoso = Dialect{
+		Name:              "virtuoso",
+		NoGraphInSubquery: true,
+		NoCountDistinct:   true,
+		NoLangMatches:     true,
+	}
+	// Blazegraph ignores the flags of regex
+	Blazegraph = Dialect{Name: "blazegraph", NoRegexFlags: true}
+)
+
+// GetDialect returns the dialect of the given name, with the empty string selecting Generic
+func GetDialect(name string) (Dialect, error) {
+	if name == "" {
+		return Generic, nil
+	}
+	for _, d := range []Dialect{Generic, Fuseki, Oxigraph, GraphDB, Virtuoso, Blazegraph} {
+		if strings.EqualFold(d.Name, name) {
+			return d, nil
+		}
+	}
+	return Dialect{}, &UnsupportedFeatureError{Feature: "dialect " + name}
+}
+
+// rewrite rewrites the query to avoid the constructs of the dialect. It returns the number of
+// closures unrolled, whose answers may be incomplete.
+func (d Dialect) rewrite(q *sparqlQuery) (unrolled int) {
+	if d.NoGraphInSubquery {
+		dropNestedGraphs(q.where, nil, false)
+	}
+
+	forEachQuery(q, func(q *sparqlQuery) {
+		if d.NoCountDistinct {
+			countDistinctSubquery(q)
+		}
+	})
+
+	forEachGroup(q.where, func(g *groupPattern) {
+		for _, e := range g.elements {
+			switch e := e.(type) {
+			case *filterPattern:
+				e.expr = mapExpr(e.expr, d.rewriteExpr)
+			case *bindPattern:
+				e.expr = mapExpr(e.expr, d.rewriteExpr)
+			case *triplesBlock:
+				if d.closureDepth <= 0 {
+					continue
+				}
+				for i := range e.triples {
+					if e.triples[i].path != nil {
+						e.triples[i].path = d.unroll(e.triples[i].path, &unrolled)
+					}
+				}
+			}
+		}
+	})
+
+	return unrolled
+}
+
+// dropNestedGraphs replaces the GRAPH patterns within sub-queries by their groups, if they
+// select the graph already selected by an enclosing GRAPH pattern
+func dropNestedGraphs(g *groupPattern, graph *patternTerm, inSubquery bool) {
+	for i, e := range g.elements {
+		switch e := e.(type) {
+		case *graphPattern:
+			if inSubquery && graph != nil && !e.graph.isVar() && !graph.isVar() && e.graph.term == graph.term {
+				g.elements[i] = e.group
+			}
+			dropNestedGraphs(e.group, &e.graph, inSubquery)
+		case *groupPattern:
+			dropNestedGraphs(e, graph, inSubquery)
+		case *subSelectPattern:
+			dropNestedGraphs(e.query.where, graph, true)
+		case *optionalPattern:
+			dropNestedGraphs(e.group, graph, inSubquery)
+		case *minusPattern:
+			dropNestedGraphs(e.group, graph, inSubquery)
+		case *unionPattern:
+			for _, b := range e.branches {
+				dropNestedGraphs(b, graph, inSubquery)
+			}
+		}
+	}
+}
+
+// countDistinctSubquery rewrites a grouped query counting the distinct values of a single
+// variable, as in
+//
+//	SELECT ?sub (COUNT(DISTINCT ?obj) AS ?count) { P } GROUP BY ?sub
+//
+// into one counting the solutions of a sub-query selecting the distinct values instead:
+//
+//	SELECT ?sub (COUNT(?obj) AS ?count) { SELECT DISTINCT ?sub ?obj { P } } GROUP BY ?sub
+func countDistinctSubquery(q *sparqlQuery) {
+	if q.star || len(q.groupBy) == 0 || len(q.having) > 0 {
+		return
+	}
+
+	var count *aggregateExpr
+	var vars []string
+	for _, p := range q.groupBy {
+		if p.expr != nil {
+			return
+		}
+		vars = append(vars, p.variable)
+	}
+	for _, p := range q.project {
+		if p.expr == nil {
+			continue
+		}
+		agg, ok := p.expr.(*aggregateExpr)
+		if !ok || count != nil || agg.name != "COUNT" || !agg.distinct || agg.star {
+			return
+		}
+		counted, ok := agg.expr.(varExpr)
+		if !ok {
+			return
+		}
+		count = agg
+		vars = append(vars, counted.name)
+	}
+	if count == nil {
+		return
+	}
+
+	inner := selectQuery(q.where, vars...)
+	inner.distinct = true
+	q.where = group(subquery(inner))
+	count.distinct = false
+}
+
+// rewriteExpr replaces the calls of langMatches and regex the dialect has trouble with
+func (d Dialect) rewriteExpr(e sparqlExpr) sparqlExpr {
+	call, ok := e.(callExpr)
+	if !ok {
+		return e
+	}
+
+	switch {
+	case call.name == "LANGMATCHES" && len(call.args) == 2 && d.NoLangMatches:
+		langRange, ok := call.args[1].(constExpr)
+		if !ok || langRange.term.kind != literalKind {
+			return e
+		}
+		tag := call.args[0]
+		if langRange.term.value == "*" {
+			return binaryExpr{op: "!=", left: tag, right: constExpr{term: literalTerm("", "", "")}}
+		}
+		lower := strings.ToLower(langRange.term.value)
+		lcase := callExpr{name: "LCASE", args: []sparqlExpr{tag}}
+		return binaryExpr{
+			op:    "||",
+			left:  binaryExpr{op: "=", left: lcase, right: constExpr{term: literalTerm(lower, "", "")}},
+			right: callExpr{name: "STRSTARTS", args: []sparqlExpr{lcase, constExpr{term: literalTerm(lower+"-", "", "")}}},
+		}
+	case call.name == "REGEX" && len(call.args) == 3 && d.NoRegexFlags:
+		pattern, okP := call.args[1].(constExpr)
+		flags, okF := call.args[2].(constExpr)
+		if !okP || !okF || pattern.term.kind != literalKind || flags.term.kind != literalKind {
+			return e
+		}
+
+		expr, inline := pattern.term.value, ""
+		for _, flag := range flags.term.value {
+			if flag == 'q' { // the pattern is matched literally
+				expr = regexp.QuoteMeta(expr)
+			} else {
+				inline += string(flag)
+			}
+		}
+		if inline != "" {
+			expr = "(?" + inline + ")" + expr
+		}
+		return callExpr{name: "REGEX", args: []sparqlExpr{call.args[0], constExpr{term: literalTerm(expr, "", "")}}}
+	}
+	return e
+}
+
+// unroll replaces the closures within the path by sequences of optional steps, counting them
+func (d Dialect) unroll(p pathExpr, unrolled *int) pathExpr {
+	switch p := p.(type) {
+	case inversePath:
+		return inversePath{path: d.unroll(p.path, unrolled)}
+	case sequencePath:
+		out := sequencePath{}
+		for _, s := range p.paths {
+			out.paths = append(out.paths, d.unroll(s, unrolled))
+		}
+		return out
+	case alternativePath:
+		out := alternativePath{}
+		for _, s := range p.paths {
+			out.paths = append(out.paths, d.unroll(s, unrolled))
+		}
+		return out
+	case modPath:
+		inner := d.unroll(p.path, unrolled)
+		if p.mod == '?' {
+			return modPath{path: inner, mod: '?'}
+		}
+		*unrolled++
+
+		var steps []pathExpr
+		if p.mod == '+' {
+			steps = append(steps, inner)
+		}
+		for len(steps) < d.closureDepth {
+			steps = append(steps, modPath{path: inner, mod: '?'})
+		}
+		if len(steps) == 1 {
+			return steps[0]
+		}
+		return sequencePath{paths: steps}
+	}
+	return p
+}
+
+// mapExpr applies f to the expression and all expressions nested within it, bottom up. The
+// groups of EXISTS are left to forEachGroup.
+func mapExpr(e sparqlExpr, f func(sparqlExpr) sparqlExpr) sparqlExpr {
+	switch e := e.(type) {
+	case binaryExpr:
+		return f(binaryExpr{op: e.op, left: mapExpr(e.left, f), right: mapExpr(e.right, f)})
+	case unaryExpr:
+		return f(unaryExpr{op: e.op, expr: mapExpr(e.expr, f)})
+	case inExpr:
+		out := inExpr{expr: mapExpr(e.expr, f), negated: e.negated}
+		for _, l := range e.list {
+			out.list = append(out.list, mapExpr(l, f))
+		}
+		return f(out)
+	case callExpr:
+		out := callExpr{name: e.name, cast: e.cast}
+		for _, a := range e.args {
+			out.args = append(out.args, mapExpr(a, f))
+		}
+		return f(out)
+	}
+	return f(e)
+}
+
+// forEachQuery calls f for the query and all sub-queries nested within it
+func forEachQuery(q *sparqlQuery, f func(*sparqlQuery)) {
+	f(q)
+	forEachGroup(q.where, func(g *groupPattern) {
+		for _, e := range g.elements {
+			if sub, ok := e.(*subSelectPattern); ok {
+				f(sub.query)
+			}
+		}
+	})
+}
+
+// forEachGroup calls f for the group and all groups nested within it, including those of
+// sub-queries and EXISTS filters
+func forEachGroup(g *groupPattern, f func(*groupPattern)) {
+	f(g)
+
+	for _, e := range g.elements {
+		switch e := e.(type) {
+		case *groupPattern:
+			forEachGroup(e, f)
+		case *subSelectPattern:
+			forEachGroup(e.query.where, f)
+		case *optionalPattern:
+			forEachGroup(e.group, f)
+		case *minusPattern:
+			forEachGroup(e.group, f)
+		case *unionPattern:
+			for _, b := range e.branches {
+				forEachGroup(b, f)
+			}
+		case *graphPattern:
+			forEachGroup(e.group, f)
+		case *filterPattern:
+			forEachExistsGroup(e.expr, f)
+		case *bindPattern:
+			forEachExistsGroup(e.expr, f)
+		}
+	}
+}
+
+func forEachExistsGroup(e sparqlExpr, f func(*groupPattern)) {
+	switch e := e.(type) {
+	case existsExpr:
+		forEachGroup(e.group, f)
+	case binaryExpr:
+		forEachExistsGroup(e.left, f)
+		forEachExistsGroup(e.right, f)
+	case unaryExpr:
+		forEachExistsGroup(e.expr, f)
+	case inExpr:
+		forEachExistsGroup(e.expr, f)
+		for _, l := range e.list {
+			forEachExistsGroup(l, f)
+		}
+	case callExpr:
+		for _, a := range e.args {
+			forEachExistsGroup(a, f)
+		}
+	}
+}
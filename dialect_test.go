@@ -0,0 +1,155 @@
+package shawell
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestDialects checks that the rewrites of each dialect do not change the report
+func TestDialects(t *testing.T) {
+	shapes := `
+@prefix ex: <http://example.org/> .
+@prefix sh: <http://www.w3.org/ns/shacl#> .
+
+ex:PersonShape a sh:NodeShape ;
+	sh:targetClass ex:Person ;
+	sh:property [ sh:path ex:name ; sh:minCount 1 ; sh:maxCount 1 ; sh:pattern "^A" ; sh:flags "i" ] ;
+	sh:property [ sh:path ex:code ; sh:pattern "a.c" ; sh:flags "q" ] ;
+	sh:property [ sh:path ex:label ; sh:languageIn ( "en" "de" ) ] ;
+	sh:property [ sh:path [ sh:zeroOrMorePath ex:knows ] ; sh:class ex:Person ] ;
+	sh:property [ sh:path [ sh:oneOrMorePath ex:knows ] ; sh:maxCount 2 ] .
+`
+	data := `
+@prefix ex: <http://example.org/> .
+@prefix rdfs: <http://www.w3.org/2000/01/rdf-schema#> .
+
+ex:Student rdfs:subClassOf ex:Person .
+ex:a a ex:Person ; ex:name "anna" ; ex:code "a.c" ; ex:label "a"@en-GB ; ex:knows ex:b .
+ex:b a ex:Student ; ex:name "Bob", "Alf" ; ex:code "abc" ; ex:label "b"@fr ; ex:knows ex:c .
+ex:c a ex:Person ; ex:label "c"@DE, "c" ; ex:knows ex:d .
+ex:d ex:name "dora" .
+`
+
+	want := reportResults(validateTurtle(t, shapes, data, Options{}))
+	if want == "" {
+		t.Fatal("got no results")
+	}
+	for _, d := range []Dialect{Fuseki, Oxigraph, GraphDB, Virtuoso, Blazegraph} {
+		got := reportResults(validateTurtle(t, shapes, data, Options{Dialect: d}))
+		if got != want {
+			t.Errorf("dialect %v: got results\n%v\nwant\n%v", d.Name, got, want)
+		}
+	}
+}
+
+// TestDialectRewrites checks the rewritten expressions and sub-queries of the dialects
+func TestDialectRewrites(t *testing.T) {
+	cases := []struct {
+		dialect    Dialect
+		query      string
+		want, lose []string // parts of the rewritten query present, and no longer present
+	}{
+		{
+			Blazegraph, `SELECT ?x { ?x ?p ?o FILTER (regex(str(?o), "a.c", "qi")) }`,
+			[]string{`REGEX(STR(?o), "(?i)a\\.c")`}, []string{`"qi"`},
+		},
+		{
+			Generic, `SELECT ?x { ?x ?p ?o FILTER (regex(str(?o), "a", "i")) }`,
+			[]string{`REGEX(STR(?o), "a", "i")`}, nil,
+		},
+		{
+			Virtuoso, `SELECT ?x { ?x ?p ?o FILTER (langMatches(lang(?o), "*") || langMatches(lang(?o), "EN")) }`,
+			[]string{`(LANG(?o) != "")`, `STRSTARTS(LCASE(LANG(?o)), "en-")`}, []string{"LANGMATCHES"},
+		},
+		{
+			GraphDB, `SELECT ?s { { SELECT ?s (COUNT(DISTINCT ?o) AS ?c) { ?s ?p ?x OPTIONAL { ?s ?q ?o } } GROUP BY ?s } }`,
+			[]string{"SELECT DISTINCT ?s ?o", "(COUNT(?o) AS ?c)"}, []string{"COUNT(DISTINCT"},
+		},
+		{
+			Virtuoso, `SELECT ?s { GRAPH <http://g> { { SELECT ?s { GRAPH <http://g> { ?s ?p ?o } } } } }`,
+			[]string{"GRAPH <http://g>"}, nil,
+		},
+	}
+
+	for i, tc := range cases {
+		q, err := parseSparql(tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.dialect.rewrite(q)
+		query := q.String()
+
+		for _, part := range tc.want {
+			if !strings.Contains(query, part) {
+				t.Errorf("case %d: got query without %v\n%s", i, part, query)
+			}
+		}
+		for _, part := range tc.lose {
+			if strings.Contains(query, part) {
+				t.Errorf("case %d: got query still containing %v\n%s", i, part, query)
+			}
+		}
+		if strings.Count(query, "GRAPH") > 1 {
+			t.Errorf("case %d: got nested GRAPH in query\n%s", i, query)
+		}
+	}
+
+	if _, err := GetDialect("sqlite"); err == nil {
+		t.Error("got no error for an unknown dialect")
+	}
+	if d, err := GetDialect("GraphDB"); err != nil || d.Name != GraphDB.Name {
+		t.Errorf("got dialect %v, %v, want graphdb", d.Name, err)
+	}
+}
+
+// TestClosureDepth checks that closures are only unrolled if asked for, in which case the
+// violations hidden by the unrolling are warned about
+func TestClosureDepth(t *testing.T) {
+	shapes := `
+@prefix ex: <http://example.org/> .
+@prefix sh: <http://www.w3.org/ns/shacl#> .
+
+ex:C0Shape a sh:NodeShape ;
+	sh:targetClass ex:C0 ;
+	sh:property [ sh:path ex:name ; sh:minCount 1 ] .
+`
+	var data strings.Builder
+	data.WriteString("@prefix ex: <http://example.org/> .\n@prefix rdfs: <http://www.w3.org/2000/01/rdf-schema#> .\n")
+	for i := 1; i <= 12; i++ {
+		fmt.Fprintf(&data, "ex:C%d rdfs:subClassOf ex:C%d .\n", i, i-1)
+	}
+	data.WriteString("ex:a a ex:C12 .\n")
+
+	for _, d := range []Dialect{Generic, Virtuoso, Blazegraph} {
+		report := validateTurtle(t, shapes, data.String(), Options{Dialect: d})
+		if report.Conforms() || len(report.Results()) != 1 {
+			t.Errorf("dialect %v: got %d results, want the violation of ex:a", d.Name, len(report.Results()))
+		}
+	}
+
+	var out bytes.Buffer
+	report := validateTurtle(t, shapes, data.String(), Options{Dialect: Virtuoso, ClosureDepth: 8, Output: &out})
+	if !report.Conforms() {
+		t.Errorf("got %d results, want the violation beyond the unrolled depth missed", len(report.Results()))
+	}
+	if !strings.Contains(out.String(), "Warning: unrolled") {
+		t.Error("got no warning about the unrolled closures")
+	}
+
+	q, err := parseSparql(`SELECT ?s { ?s <http://example.org/p>* ?o FILTER EXISTS { ?o ^<http://example.org/p>+ ?s } }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := (Dialect{closureDepth: 3}).rewrite(q); n != 2 {
+		t.Errorf("got %d closures unrolled, want 2", n)
+	}
+	query := q.String()
+	if strings.ContainsAny(query, "*+") {
+		t.Errorf("got closures left in query\n%s", query)
+	}
+	if got := strings.Count(query, "<http://example.org/p>"); got != 6 {
+		t.Errorf("got %d steps, want 6, in query\n%s", got, query)
+	}
+}
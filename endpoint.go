@@ -1,8 +1,12 @@
-package main
+package shawell
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 	"sort"
 	"strings"
 	"time"
@@ -10,8 +14,6 @@ import (
 	rdf "github.com/cem-okulmus/rdf2go-1"
 
 	"golang.org/x/exp/constraints"
-
-	"github.com/knakk/sparql"
 )
 
 // Sorted has complexity: O(n * log(n)), a needs to be sorted
@@ -30,220 +32,361 @@ func SortedGeneric[T constraints.Ordered](a []T, b []T) []T {
 	return set
 }
 
-type endpoint interface {
-	Answer(ns Shape, target []SparqlQueryFlat) Table[rdf.Term]
-	Query(s SparqlQuery) Table[rdf.Term]
-	QueryFlat(s SparqlQueryFlat) Table[rdf.Term]
-	QueryString(s string) Table[rdf.Term]
-	Insert(input *rdf.Graph, fromGraph string) error
-	ClearGraph(fromGraph string) error
+// Endpoint abstracts over the store holding the data graph. All queries produced during
+// validation are sent to it. The context of each call allows aborting the run, with any
+// queries still in flight being cancelled.
+type Endpoint interface {
+	Answer(ctx context.Context, ns Shape, target []SparqlQueryFlat) (Table[rdf.Term], error)
+	Query(ctx context.Context, s SparqlQuery) (Table[rdf.Term], error)
+	QueryFlat(ctx context.Context, s SparqlQueryFlat) (Table[rdf.Term], error)
+	QueryString(ctx context.Context, s string) (Table[rdf.Term], error)
+	Insert(ctx context.Context, input *rdf.Graph, fromGraph string) error
+	Add(ctx context.Context, input *rdf.Graph, graph string) error
+	ClearGraph(ctx context.Context, fromGraph string) error
 	GetGraph() string
 }
 
+// innerEndpoint returns the endpoint behind any caches and profiling wrapping it
+func innerEndpoint(ep Endpoint) Endpoint {
+	for {
+		w, ok := ep.(interface{ Unwrap() Endpoint })
+		if !ok {
+			return ep
+		}
+		ep = w.Unwrap()
+	}
+}
+
+// DefaultQueryTimeout is the time a SPARQL endpoint is given to answer a single query or update
+const DefaultQueryTimeout = 600 * time.Second
+
 type SparqlEndpoint struct {
-	repo           *sparql.Repo
-	repoUpdate     *sparql.Repo
+	client         *http.Client
+	address        string
+	updateAddress  string
 	fromGraph      string
 	debug          bool
 	updateEndpoint bool
+	queryTimeout   time.Duration // no timeout if zero
+	retryPolicy    RetryPolicy
+	retryState     retryState
+	upload         UploadOptions
+	dataset        Dataset
+	pageSize       int // no paging if zero
+	resultsFormat  ResultsFormat
 }
 
-func GetSparqlEndpoint(address, updateAddr, username, password string, debug, update bool, graph string) *SparqlEndpoint {
-	repo, err := sparql.NewRepo(address,
-		sparql.DigestAuth(username, password),
-		sparql.Timeout(time.Second*600),
-	)
-	check(err)
-
-	var repoUpdate *sparql.Repo
-
+// GetSparqlEndpoint produces an endpoint sending its queries to the given address, using
+// digest authentication (other methods can be chosen via SetAuth). If update is set, updates
+// are sent to updateAddr instead. Each query or update is cancelled after queryTimeout, unless
+// it is zero. Failed queries are retried according to DefaultRetryPolicy.
+func GetSparqlEndpoint(address, updateAddr, username, password string, debug, update bool, graph string,
+	queryTimeout time.Duration,
+) (*SparqlEndpoint, error) {
+	_, err := url.ParseRequestURI(address)
+	if err != nil {
+		return nil, err
+	}
 	if update {
-		repoUpdate, err = sparql.NewRepo(updateAddr,
-			sparql.DigestAuth(username, password),
-			sparql.Timeout(time.Second*600),
-		)
-		check(err)
+		_, err = url.ParseRequestURI(updateAddr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	transport, err := Auth{Method: AuthDigest, Username: username, Password: password}.transport()
+	if err != nil {
+		return nil, err
 	}
 
 	return &SparqlEndpoint{
-		repo:           repo,
-		repoUpdate:     repoUpdate,
+		client:         &http.Client{Transport: transport},
+		address:        address,
+		updateAddress:  updateAddr,
 		debug:          debug,
 		updateEndpoint: update,
 		fromGraph:      graph,
-	}
+		queryTimeout:   queryTimeout,
+		retryPolicy:    DefaultRetryPolicy,
+	}, nil
 }
 
 func (s *SparqlEndpoint) GetGraph() string { return s.fromGraph }
 
-func (s *SparqlEndpoint) ClearGraph(fromGraph string) (out error) {
-	if fromGraph == "" {
-		out = errors.New("need to provide a graph for the Clear command")
-		return out
-	}
+// SetDataset restricts the queries produced during validation to the given dataset, which is
+// added to them as FROM and FROM NAMED clauses. Queries posed via QueryString are sent as is.
+func (s *SparqlEndpoint) SetDataset(d Dataset) { s.dataset = d }
+
+// SetPageSize makes the endpoint fetch the results of the queries produced during validation in
+// pages of at most n solutions, ordered by the projected variables, so that endpoints limiting
+// the size of results can still answer them. Queries posed via QueryString are sent as is.
+// The pages of the conditional answers of shapes are grouped by focus node as they are
+// received, so that only a single page and the distinct values of each focus node are held in
+// memory; the results of other queries are collected in full.
+func (s *SparqlEndpoint) SetPageSize(n int) { s.pageSize = n }
+
+// SetResultsFormat chooses the format in which the results of queries are asked for. Endpoints
+// may still answer in any of the other supported formats.
+func (s *SparqlEndpoint) SetResultsFormat(f ResultsFormat) { s.resultsFormat = f }
+
+// statusError is returned if the endpoint answers with a status other than 200, 201 or 204
+type statusError struct {
+	code   int
+	status string
+	body   string
+}
 
-	if s.updateEndpoint {
-		out = s.repoUpdate.Update(fmt.Sprint("CLEAR GRAPH ", fromGraph))
-	} else {
-		_, out = s.repo.Query(fmt.Sprint("CLEAR GRAPH ", fromGraph))
-	}
+func (e *statusError) Error() string {
+	return fmt.Sprint("SPARQL request failed: ", e.status, " ", e.body)
+}
 
-	return out
+// post sends the query (or update, depending on the form key) to the address, and returns the
+// body of the response
+func (s *SparqlEndpoint) post(ctx context.Context, address, key, query string) ([]byte, error) {
+	return s.send(ctx, http.MethodPost, address, "application/x-www-form-urlencoded", "", form(key, query))
 }
 
-// Insert takes as input an RDF graph, and inserts it into the Sparql Endpoint
-func (s *SparqlEndpoint) Insert(input *rdf.Graph, fromGraph string) (out error) {
-	// extract graph name (this assumes we only use this for W3C test suites w/ fixed format)
+func form(key, query string) string {
+	values := url.Values{}
+	values.Set(key, query)
+	return values.Encode()
+}
 
-	if fromGraph != "" {
-		s.fromGraph = fromGraph
-	}
+// send performs a single request and returns the body of the response
+func (s *SparqlEndpoint) send(ctx context.Context, method, address, contentType, accept, body string) ([]byte, error) {
+	var content []byte
+	err := s.do(ctx, method, address, contentType, accept, body, func(resp *http.Response) (err error) {
+		content, err = io.ReadAll(resp.Body)
+		return err
+	})
+	return content, err
+}
 
-	// clear graph first
+// do performs a single request, handing the response to read if it was successful. The request
+// is cancelled once the context is done or the per-query timeout has passed.
+func (s *SparqlEndpoint) do(ctx context.Context, method, address, contentType, accept, body string,
+	read func(*http.Response) error,
+) error {
+	if s.queryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.queryTimeout)
+		defer cancel()
+	}
 
-	// fmt.Println("Attempting clear: ", s.fromGraph)
-	err := s.ClearGraph(s.fromGraph)
+	req, err := http.NewRequestWithContext(ctx, method, address, strings.NewReader(body))
 	if err != nil {
 		return err
 	}
-	// fmt.Println("Passed Clear")
-
-	var sb strings.Builder
+	req.Header.Set("Content-Type", contentType)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
 
-	for k, v := range prefixes {
-		sb.WriteString("PREFIX " + k + " <" + v + ">\n")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
 	}
+	defer resp.Body.Close()
 
-	sb.WriteString("INSERT  DATA { \n")
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+	default:
+		content, _ := io.ReadAll(resp.Body)
+		return &statusError{code: resp.StatusCode, status: resp.Status, body: strings.TrimSpace(string(content))}
+	}
 
-	sb.WriteString(fmt.Sprint("GRAPH ", s.fromGraph, " { \n"))
+	return read(resp)
+}
 
-	for triple := range input.IterTriples() {
-		sb.WriteString(fmt.Sprint(triple.Subject, " ", triple.Predicate, " ", triple.Object, ". \n"))
+// query sends a SELECT query and parses its results while they are received, retrying it if
+// it fails
+func (s *SparqlEndpoint) query(ctx context.Context, query string) (*TableSimple[rdf.Term], error) {
+	var out *TableSimple[rdf.Term]
+	err := s.withRetries(ctx, query, func() error {
+		out = &TableSimple[rdf.Term]{} // drop the rows of failed attempts
+		return s.do(ctx, http.MethodPost, s.address, "application/x-www-form-urlencoded",
+			s.resultsFormat.accept(), form("query", query), func(resp *http.Response) error {
+				body := &countingReader{r: resp.Body}
+				defer func() { addQueryBytes(ctx, body.n) }()
+				return readResults(resp.Header.Get("Content-Type"), body, out)
+			})
+	})
+	if err != nil {
+		return nil, &EndpointError{Query: query, Err: err}
 	}
+	return out, nil
+}
 
-	sb.WriteString("} \n }")
-
-	insertString := sb.String()
+// queryPages sends a SELECT query, rendered for the given page, page by page as set via
+// SetPageSize, until a page is not full. Queries that cannot be split into pages are sent once.
+// Each page is handed to add as soon as it is received, and not kept after.
+func (s *SparqlEndpoint) queryPages(ctx context.Context, render func(page queryPage) string,
+	add func(page *TableSimple[rdf.Term]) error,
+) error {
+	page := queryPage{limit: s.pageSize}
+	for {
+		query := render(page)
+		table, err := s.query(ctx, query)
+		if err != nil {
+			return err
+		}
+		if err = add(table); err != nil {
+			return err
+		}
+		if page.limit <= 0 || table.Len() < page.limit || query == render(queryPage{}) {
+			return nil
+		}
+		page.offset += page.limit
+	}
+}
 
-	// fmt.Println(de)
-	if s.debug {
-		fmt.Println("INSERT String \n ", insertString)
+// collectPages sends a SELECT query page by page, collecting the pages into a single table
+func (s *SparqlEndpoint) collectPages(ctx context.Context, render func(page queryPage) string) (*TableSimple[rdf.Term], error) {
+	var out *TableSimple[rdf.Term]
+	err := s.queryPages(ctx, render, func(page *TableSimple[rdf.Term]) error {
+		if out == nil {
+			out = page
+			return nil
+		}
+		return out.Merge(page)
+	})
+	if err != nil {
+		return nil, err
 	}
+	return out, nil
+}
 
+// update sends an update, either to the update endpoint, if one is used, or else to the query
+// endpoint
+func (s *SparqlEndpoint) update(ctx context.Context, update string) error {
+	var err error
 	if s.updateEndpoint {
-		err = s.repoUpdate.Update(insertString)
+		_, err = s.post(ctx, s.updateAddress, "update", update)
 	} else {
-		_, err = s.repo.Query(insertString)
+		_, err = s.post(ctx, s.address, "query", update)
 	}
 
 	if err != nil {
-		out = err
-	} else {
-		out = nil
+		return &EndpointError{Query: update, Err: err}
+	}
+	return nil
+}
+
+func (s *SparqlEndpoint) ClearGraph(ctx context.Context, fromGraph string) error {
+	if fromGraph == "" {
+		return errors.New("need to provide a graph for the Clear command")
+	}
+
+	return s.update(ctx, fmt.Sprint("CLEAR GRAPH ", fromGraph))
+}
+
+// Insert takes as input an RDF graph, and inserts it into the Sparql Endpoint, replacing the
+// previous content of the named graph. The triples are uploaded as set via SetUpload.
+func (s *SparqlEndpoint) Insert(ctx context.Context, input *rdf.Graph, fromGraph string) error {
+	// extract graph name (this assumes we only use this for W3C test suites w/ fixed format)
+
+	if fromGraph != "" {
+		s.fromGraph = fromGraph
 	}
+	if s.fromGraph == "" {
+		return errors.New("need to provide a graph for the Insert command")
+	}
+
+	return s.uploadGraph(ctx, input, s.fromGraph, true)
+}
 
-	return out
+// Add inserts the triples of the RDF graph into the given named graph of the Sparql Endpoint,
+// keeping its previous content. Unlike Insert, the graph used for validation is not changed.
+func (s *SparqlEndpoint) Add(ctx context.Context, input *rdf.Graph, graph string) error {
+	return s.uploadGraph(ctx, input, graph, false)
 }
 
 // Answer takes as input a NodeShape, and runs its Sparql query against the endpoint
 // In case of multiple targets, each target produces its own query, and results are concatenated
-func (s *SparqlEndpoint) Answer(ns Shape, targets []SparqlQueryFlat) Table[rdf.Term] {
-	var out Table[rdf.Term]
+// The results are grouped page by page as they are received (see AddGroupedRows).
+func (s *SparqlEndpoint) Answer(ctx context.Context, ns Shape, targets []SparqlQueryFlat) (Table[rdf.Term], error) {
+	out := &GroupedTable[rdf.Term]{}
 
 	// repeat this for each individual target, and collect the results
 	for i := range targets {
 		query := ns.ToSparql(s.fromGraph, targets[i])
+		query.dataset = s.dataset
 
 		if s.debug {
 			fmt.Println("Answer query:  \n", query)
 		}
 
-		// fmt.Sprint("adding the query ", query.String())
-		QueryStore = append(QueryStore, query.String())
-		res, err := s.repo.Query(query.String())
+		runOf(ctx).storeQuery(query)
+		err := s.queryPages(ctx, func(page queryPage) string {
+			query.page = page
+			return query.text(ctx)
+		}, func(page *TableSimple[rdf.Term]) error {
+			if s.debug {
+				fmt.Println("Output : \n, ", page)
+			}
+			return out.AddGroupedRows(page)
+		})
 		if err != nil {
-			fmt.Println("Query in question:\n ", query)
-			panic(err)
-		}
-
-		tmp := GetTable(res)
-
-		if s.debug {
-			fmt.Println("Output : \n, ", tmp)
-		}
-
-		if out == nil {
-			out = tmp
-		} else {
-			err := out.Merge(tmp)
-			check(err)
+			return nil, err
 		}
 	}
 
-	tmp := GetGroupedTable(out)
 	if s.debug {
-		fmt.Println("Output Final : \n, ", tmp)
+		fmt.Println("Output Final : \n, ", out)
 	}
 
-	return tmp
+	return out, nil
 }
 
-func (s *SparqlEndpoint) Query(query SparqlQuery) Table[rdf.Term] {
+func (s *SparqlEndpoint) Query(ctx context.Context, query SparqlQuery) (Table[rdf.Term], error) {
+	query.dataset = s.dataset
 	// query := ns.ToSparql()
-	res, err := s.repo.Query(query.String())
+	out, err := s.collectPages(ctx, func(page queryPage) string {
+		query.page = page
+		return query.text(ctx)
+	})
 	if err != nil {
-		fmt.Println("Query in question:\n ", query.String())
-		panic(err)
+		return nil, err
 	}
 
 	if s.debug {
 		fmt.Println("Query:  \n", query)
-	}
-
-	out := GetTable(res)
-
-	if s.debug {
 		fmt.Println("Output: \n, ", out)
 	}
 
 	// out.query = query
-	return out
+	return out, nil
 }
 
-func (s *SparqlEndpoint) QueryFlat(query SparqlQueryFlat) Table[rdf.Term] {
+func (s *SparqlEndpoint) QueryFlat(ctx context.Context, query SparqlQueryFlat) (Table[rdf.Term], error) {
+	query.dataset = s.dataset
 	// query := ns.ToSparql()
-	res, err := s.repo.Query(query.String())
+	out, err := s.collectPages(ctx, func(page queryPage) string {
+		query.page = page
+		return query.text(ctx)
+	})
 	if err != nil {
-		fmt.Println("Query in question:\n ", query.String())
-		panic(err)
-	}
-	if s.debug {
-		fmt.Println("QueryFlat:  \n", query)
+		return nil, err
 	}
 
-	out := GetTable(res)
-
 	if s.debug {
+		fmt.Println("QueryFlat:  \n", query)
 		fmt.Println("Output: \n, ", out)
 	}
 
 	// out.query = query
-	return out
+	return out, nil
 }
 
-func (s *SparqlEndpoint) QueryString(query string) Table[rdf.Term] {
-	// query := ns.ToSparql()
-	res, err := s.repo.Query(query)
+func (s *SparqlEndpoint) QueryString(ctx context.Context, query string) (Table[rdf.Term], error) {
+	out, err := s.query(ctx, query)
 	if err != nil {
-		fmt.Println("Query in question:\n ", query)
-		panic(err)
+		return nil, err
 	}
-	out := GetTable(res)
 
 	if s.debug {
 		fmt.Println("Output: \n, ", out)
 	}
 
-	return out
+	return out, nil
 }
@@ -0,0 +1,619 @@
+package shawell
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	rdf "github.com/cem-okulmus/rdf2go-1"
+	"github.com/knakk/sparql"
+)
+
+const endpointTestResults = `{
+	"head": { "vars": [ "sub" ] },
+	"results": { "bindings": [ { "sub": { "type": "uri", "value": "http://example.org/a" } } ] }
+}`
+
+// TestSparqlEndpointTimeout checks that queries to a SPARQL endpoint are aborted once their
+// context is cancelled or the per-query timeout has passed
+func TestSparqlEndpointTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("query") == "slow" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/sparql-results+json")
+		io.WriteString(w, endpointTestResults)
+	}))
+	defer server.Close()
+
+	ep, err := GetSparqlEndpoint(server.URL, "", "", "", false, false, "", 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := ep.QueryString(context.Background(), "SELECT ?sub WHERE { ?sub ?p ?o }")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Len() != 1 {
+		t.Errorf("got %d rows, want 1", table.Len())
+	}
+
+	_, err = ep.QueryString(context.Background(), "slow")
+	var epErr *EndpointError
+	if !errors.As(err, &epErr) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want per-query timeout", err)
+	}
+
+	ep.queryTimeout = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	_, err = ep.QueryString(ctx, "slow")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want cancellation", err)
+	}
+}
+
+// TestSparqlEndpointRetry checks that queries are retried while the endpoint is overloaded, and
+// that the circuit breaker stops all queries after repeated failures, until a query let through
+// after the cooldown succeeds
+func TestSparqlEndpointRetry(t *testing.T) {
+	var failures int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.FormValue("query") == "invalid":
+			http.Error(w, "syntax error", http.StatusBadRequest)
+		case atomic.AddInt64(&failures, -1) >= 0:
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		default:
+			io.WriteString(w, endpointTestResults)
+		}
+	}))
+	defer server.Close()
+
+	ep, err := GetSparqlEndpoint(server.URL, "", "", "", false, false, "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep.SetRetryPolicy(RetryPolicy{MaxRetries: 3, InitialBackoff: time.Millisecond, BreakerThreshold: 3,
+		BreakerCooldown: 50 * time.Millisecond})
+
+	atomic.StoreInt64(&failures, 2)
+	_, err = ep.QueryString(context.Background(), "SELECT ?sub WHERE { ?sub ?p ?o }")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := ep.Retries(); len(r) != 1 || r[0].Retries != 2 || r[0].Failed {
+		t.Errorf("got retries %v, want a single query retried twice", r)
+	}
+
+	_, err = ep.QueryString(context.Background(), "invalid")
+	if err == nil || len(ep.Retries()) != 1 {
+		t.Errorf("got error %v and retries %v, want failure without retry", err, ep.Retries())
+	}
+
+	atomic.StoreInt64(&failures, 100)
+	_, err = ep.QueryString(context.Background(), "SELECT ?sub WHERE { ?sub ?p ?o }")
+	if err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("got error %v, want the failure of the endpoint", err)
+	}
+	_, err = ep.QueryString(context.Background(), "SELECT ?sub WHERE { ?sub ?p ?o }")
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("got error %v, want %v", err, ErrCircuitOpen)
+	}
+
+	time.Sleep(60 * time.Millisecond) // the probe fails, so the breaker opens again
+	_, err = ep.QueryString(context.Background(), "SELECT ?sub WHERE { ?sub ?p ?o }")
+	if err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("got error %v, want the failure of the endpoint", err)
+	}
+	_, err = ep.QueryString(context.Background(), "SELECT ?sub WHERE { ?sub ?p ?o }")
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("got error %v, want %v", err, ErrCircuitOpen)
+	}
+
+	atomic.StoreInt64(&failures, 0)
+	time.Sleep(60 * time.Millisecond) // the probe succeeds, so the breaker closes
+	for i := 0; i < 2; i++ {
+		_, err = ep.QueryString(context.Background(), "SELECT ?sub WHERE { ?sub ?p ?o }")
+		if err != nil {
+			t.Errorf("got error %v, want the breaker closed", err)
+		}
+	}
+
+	ep.resetRetries()
+	if r := ep.Retries(); len(r) != 0 {
+		t.Errorf("got retries %v after reset, want none", r)
+	}
+}
+
+// TestSparqlEndpointAuth checks that the credentials and headers of the authentication are
+// sent with each request
+func TestSparqlEndpointAuth(t *testing.T) {
+	var got string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Authorization") + " " + r.Header.Get("X-Tenant")
+		io.WriteString(w, endpointTestResults)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		auth Auth
+		want string
+	}{
+		{Auth{Method: AuthBasic, Username: "user", Password: "pass"}, "Basic dXNlcjpwYXNz "},
+		{Auth{Method: AuthBearer, TokenFile: tokenFile}, "Bearer secret "},
+		{Auth{Method: AuthNone, Headers: map[string]string{"X-Tenant": "shapes"}}, " shapes"},
+	}
+
+	for _, tc := range cases {
+		ep, err := GetSparqlEndpoint(server.URL, "", "", "", false, false, "", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.auth.CAFile = caFile
+		if err := ep.SetAuth(tc.auth); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = ep.QueryString(context.Background(), "SELECT ?sub WHERE { ?sub ?p ?o }")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("%v: got %q, want %q", tc.auth.Method, got, tc.want)
+		}
+	}
+}
+
+const uploadTestData = `
+@prefix ex: <http://example.org/> .
+
+ex:a ex:name "Say \"hi\"\nand \\ leave"@en ; ex:age 42 ; ex:knows [ ex:name "anon" ; ex:knows [ ex:age 7 ] ] .
+ex:b ex:knows ex:a .
+`
+
+// TestSparqlEndpointUpload checks the upload of graphs in batches, via the Graph Store Protocol
+// and via INSERT DATA as fallback, keeping blank nodes in one batch and escaping literals
+func TestSparqlEndpointUpload(t *testing.T) {
+	input := rdf.NewGraph("http://example.org/")
+	err := input.Parse(strings.NewReader(uploadTestData), "text/turtle")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var requests []string
+	var uploaded []*rdf.Graph
+	graphStore := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/store" {
+			if !graphStore {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			requests = append(requests, r.Method+" "+r.URL.Query().Get("graph"))
+			g := rdf.NewGraph("http://example.org/")
+			if err := g.Parse(r.Body, "text/turtle"); err != nil {
+				t.Error(err)
+			}
+			uploaded = append(uploaded, g)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		update := r.FormValue("update")
+		requests = append(requests, strings.Fields(update)[0])
+	}))
+	defer server.Close()
+
+	ep, err := GetSparqlEndpoint(server.URL, server.URL+"/update", "", "", false, true, "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep.SetUpload(UploadOptions{BatchSize: 2, GraphStore: server.URL + "/store"})
+
+	err = ep.Insert(context.Background(), input, "<http://example.org/data>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "PUT http://example.org/data,POST http://example.org/data,POST http://example.org/data"
+	if strings.Join(requests, ",") != want {
+		t.Errorf("got requests %v, want %v", requests, want)
+	}
+	total := 0
+	for _, g := range uploaded {
+		total += g.Len()
+		for triple := range g.IterTriples() {
+			if triple.Predicate.RawValue() == "http://example.org/name" && !isBlank(triple.Subject) {
+				if triple.Object.RawValue() != "Say \"hi\"\nand \\ leave" {
+					t.Errorf("got literal %q after upload", triple.Object.RawValue())
+				}
+			}
+		}
+	}
+	if total != input.Len() || uploaded[0].Len() != 4 {
+		t.Errorf("got %d triples, %d in the first batch, want %d, with the blank nodes in the first",
+			total, uploaded[0].Len(), input.Len())
+	}
+
+	requests, graphStore = nil, false
+	err = ep.Add(context.Background(), input, "<http://example.org/data>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "INSERT,INSERT,INSERT"
+	if strings.Join(requests, ",") != want {
+		t.Errorf("got requests %v, want %v", requests, want)
+	}
+}
+
+const resultsTestJSON = `{
+	"head": { "vars": [ "s", "o" ] },
+	"results": { "bindings": [
+		{ "s": { "type": "uri", "value": "http://example.org/a" },
+		  "o": { "type": "literal", "value": "a\tb" } },
+		{ "s": { "type": "bnode", "value": "b0" },
+		  "o": { "type": "literal", "value": "hallo", "xml:lang": "de" } },
+		{ "s": { "type": "uri", "value": "http://example.org/c" },
+		  "o": { "type": "typed-literal", "value": "1", "datatype": "http://www.w3.org/2001/XMLSchema#integer" } },
+		{ "s": { "type": "uri", "value": "http://example.org/d" } }
+	] }
+}`
+
+const resultsTestXML = `<?xml version="1.0"?>
+<sparql xmlns="http://www.w3.org/2005/sparql-results#">
+	<head> <variable name="s"/> <variable name="o"/> </head>
+	<results>
+		<result>
+			<binding name="s"><uri>http://example.org/a</uri></binding>
+			<binding name="o"><literal>a&#9;b</literal></binding>
+		</result>
+		<result>
+			<binding name="s"><bnode>b0</bnode></binding>
+			<binding name="o"><literal xml:lang="de">hallo</literal></binding>
+		</result>
+		<result>
+			<binding name="s"><uri>http://example.org/c</uri></binding>
+			<binding name="o"><literal datatype="http://www.w3.org/2001/XMLSchema#integer">1</literal></binding>
+		</result>
+		<result>
+			<binding name="s"><uri>http://example.org/d</uri></binding>
+		</result>
+	</results>
+</sparql>`
+
+const resultsTestTSV = "?s\t?o\n" +
+	"<http://example.org/a>\t\"a\\tb\"\n" +
+	"_:b0\t\"hallo\"@de\n" +
+	"<http://example.org/c>\t1\n" +
+	"<http://example.org/d>\t\n"
+
+// resultsString renders the table with unbound values marked as such, as their blank nodes are
+// fresh for each parse
+func resultsString(table Table[rdf.Term]) string {
+	var sb strings.Builder
+	sb.WriteString(strings.Join(table.GetHeader(), " "))
+	for row := range table.IterRows() {
+		sb.WriteString("\n")
+		for _, term := range row {
+			if isUnbound(term) {
+				sb.WriteString("UNDEF ")
+				continue
+			}
+			sb.WriteString(fmt.Sprintf("%#v ", term))
+		}
+	}
+	return sb.String()
+}
+
+// TestReadResults checks that results parsed while streaming produce the same tables as GetTable
+func TestReadResults(t *testing.T) {
+	res, err := sparql.ParseJSON(strings.NewReader(resultsTestJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := resultsString(GetTable(res))
+
+	bodies := map[string]string{
+		"application/sparql-results+json":          resultsTestJSON,
+		"application/sparql-results+xml":           resultsTestXML,
+		"text/tab-separated-values; charset=utf-8": resultsTestTSV,
+	}
+	for contentType, body := range bodies {
+		table := &TableSimple[rdf.Term]{}
+		err = readResults(contentType, strings.NewReader(body), table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resultsString(table); got != want {
+			t.Errorf("%s: got table\n%v\nwant\n%v", contentType, got, want)
+		}
+	}
+
+	// CSV loses the types of terms, so its results are refused rather than guessed at
+	table := &TableSimple[rdf.Term]{}
+	err = readResults("text/csv", strings.NewReader("s,o\r\nhttp://example.org/c,1\r\n"), table)
+	var unsupported *UnsupportedFeatureError
+	if !errors.As(err, &unsupported) || table.Len() != 0 {
+		t.Errorf("got error %v and table\n%v\nwant CSV refused", err, resultsString(table))
+	}
+
+	// the results must match the header of the table they are added to
+	err = readResults("text/tab-separated-values", strings.NewReader("?x\n"), table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = readResults("text/tab-separated-values", strings.NewReader(resultsTestTSV), table)
+	if err == nil {
+		t.Error("results with other variables added to table")
+	}
+}
+
+// TestSparqlEndpointPaging checks that validating with results fetched in pages produces the
+// same report as fetching them at once
+func TestSparqlEndpointPaging(t *testing.T) {
+	data := rdf.NewGraph("http://example.org/")
+	err := data.Parse(strings.NewReader(componentTestData), "text/turtle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shapes := rdf.NewGraph("http://example.org/")
+	err = shapes.Parse(strings.NewReader(componentTestShapes), "text/turtle")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem, err := GetMemoryEndpoint(nil, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mem.Insert(context.Background(), data, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paged int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.FormValue("query")
+		if strings.Contains(query, "\nLIMIT ") {
+			atomic.AddInt64(&paged, 1)
+		}
+		table, err := mem.QueryString(r.Context(), query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/tab-separated-values")
+		writeTSVResults(t, w, table)
+	}))
+	defer server.Close()
+
+	var results []string
+	for _, pageSize := range []int{0, 2} {
+		ep, err := GetSparqlEndpoint(server.URL, "", "", "", false, false, "", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ep.SetPageSize(pageSize)
+
+		report, err := Validate(context.Background(), shapes, ep, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, reportResults(report))
+	}
+
+	if results[1] != results[0] {
+		t.Errorf("got results\n%v\nwant\n%v", results[1], results[0])
+	}
+	if paged == 0 {
+		t.Error("no query sent in pages")
+	}
+}
+
+// TestAddGroupedRows checks that grouping a result page by page yields the same groups as
+// grouping it at once, while keeping only the rows adding values to the groups
+func TestAddGroupedRows(t *testing.T) {
+	a, b := rdf.NewResource("http://example.org/a"), rdf.NewResource("http://example.org/b")
+	x, y := rdf.NewResource("http://example.org/x"), rdf.NewResource("http://example.org/y")
+	rows := [][]rdf.Term{{a, x, x}, {a, x, y}, {b, y, x}, {a, y, x}, {a, x, y}, {b, y, x}}
+
+	whole := GetGroupedTable[rdf.Term](&TableSimple[rdf.Term]{header: []string{"s", "p", "q"}, content: rows})
+	paged := &GroupedTable[rdf.Term]{}
+	for i := 0; i < len(rows); i += 2 {
+		err := paged.AddGroupedRows(&TableSimple[rdf.Term]{header: []string{"s", "p", "q"}, content: rows[i : i+2]})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if paged.Len() != 4 {
+		t.Errorf("got %d rows, want the 4 adding values", paged.Len())
+	}
+	for _, key := range []rdf.Term{a, b} {
+		for attr := 1; attr < 3; attr++ {
+			got, want := paged.GetGroupOfTarget(key, attr), whole.GetGroupOfTarget(key, attr)
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("got group %v of %v, %d, want %v", got, key, attr, want)
+			}
+		}
+	}
+	paged.Regroup()
+	if got, want := fmt.Sprint(paged.group), fmt.Sprint(whole.group); got != want {
+		t.Errorf("got groups %v after regrouping, want %v", got, want)
+	}
+
+	err := paged.AddGroupedRows(&TableSimple[rdf.Term]{header: []string{"s"}})
+	if err == nil {
+		t.Error("rows with another header added")
+	}
+}
+
+// writeTSVResults writes the table in the SPARQL TSV results format
+func writeTSVResults(t *testing.T, w io.Writer, table Table[rdf.Term]) {
+	var vars []string
+	for _, h := range table.GetHeader() {
+		vars = append(vars, "?"+h)
+	}
+	io.WriteString(w, strings.Join(vars, "\t")+"\n")
+
+	for row := range table.IterRows() {
+		var fields []string
+		for _, term := range row {
+			if isUnbound(term) {
+				fields = append(fields, "")
+				continue
+			}
+			m, err := memTermFromRDF(term)
+			if err != nil {
+				t.Error(err)
+			}
+			fields = append(fields, m.String())
+		}
+		io.WriteString(w, strings.Join(fields, "\t")+"\n")
+	}
+}
+
+// TestSparqlEndpointResultsFormat checks that results are asked for in the chosen format, and
+// understood in whichever format the endpoint answers with
+func TestSparqlEndpointResultsFormat(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch accept := r.Header.Get("Accept"); {
+		case strings.HasPrefix(accept, "application/sparql-results+xml"):
+			w.Header().Set("Content-Type", "application/sparql-results+xml")
+			io.WriteString(w, resultsTestXML)
+		case strings.HasPrefix(accept, "text/tab-separated-values"):
+			w.Header().Set("Content-Type", "text/tab-separated-values")
+			io.WriteString(w, resultsTestTSV)
+		default:
+			w.Header().Set("Content-Type", "application/sparql-results+json")
+			io.WriteString(w, resultsTestJSON)
+		}
+	}))
+	defer server.Close()
+
+	ep, err := GetSparqlEndpoint(server.URL, "", "", "", false, false, "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want string
+	for _, name := range []string{"json", "XML", "tsv"} {
+		format, err := GetResultsFormat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ep.SetResultsFormat(format)
+
+		table, err := ep.QueryString(context.Background(), "SELECT ?s ?o WHERE { ?s ?p ?o }")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := resultsString(table)
+		if want == "" {
+			want = got
+		}
+		if got != want {
+			t.Errorf("format %s: got table\n%v\nwant\n%v", name, got, want)
+		}
+	}
+
+	for _, name := range []string{"brtr", "csv"} {
+		_, err = GetResultsFormat(name)
+		var unsupported *UnsupportedFeatureError
+		if !errors.As(err, &unsupported) {
+			t.Errorf("got error %v for %s, want unsupported format", err, name)
+		}
+	}
+}
+
+// TestProfilingEndpoint checks that the queries of a validation are recorded with their origin,
+// and that slow queries are logged
+func TestProfilingEndpoint(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/sparql-results+json")
+		io.WriteString(w, endpointTestResults)
+	}))
+	defer server.Close()
+
+	ep, err := GetSparqlEndpoint(server.URL, "", "", "", false, false, "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var slowLog strings.Builder
+	profiler := GetProfilingEndpoint(ep, time.Nanosecond, &slowLog)
+
+	ctx := withQueryOrigin(context.Background(), QueryOrigin{Shape: "http://example.org/S"})
+	ctx = withQueryOrigin(ctx, QueryOrigin{Constraint: "rule"})
+	_, err = profiler.QueryString(ctx, "SELECT ?sub WHERE { ?sub ?p ?o }")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := profiler.Stats()
+	want := QueryOrigin{Shape: "http://example.org/S", Constraint: "rule"}
+	if len(stats) != 1 || stats[0].QueryOrigin != want || stats[0].Rows != 1 ||
+		stats[0].Bytes != int64(len(endpointTestResults)) {
+		t.Errorf("got stats %+v", stats)
+	}
+	if !strings.Contains(slowLog.String(), "http://example.org/S") {
+		t.Errorf("got slow query log %q", slowLog.String())
+	}
+
+	// validating via the profiler records the shapes the queries are produced for
+	shapes := rdf.NewGraph("http://example.org/")
+	err = shapes.Parse(strings.NewReader(componentTestShapes), "text/turtle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem, err := GetMemoryEndpoint(nil, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profiler = GetProfilingEndpoint(mem, 0, nil)
+	_, err = Validate(context.Background(), shapes, profiler, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range profiler.Stats() {
+		if s.Shape == "" || s.Constraint == "" {
+			t.Errorf("query without origin: %+v", s)
+		}
+	}
+
+	var csvOut strings.Builder
+	err = profiler.WriteCSV(&csvOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(strings.NewReader(csvOut.String())).ReadAll()
+	if err != nil || len(records) != len(profiler.Stats())+1 {
+		t.Errorf("got %d CSV records and error %v, want %d", len(records), err, len(profiler.Stats())+1)
+	}
+}
@@ -0,0 +1,66 @@
+package shawell
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrCircuitOpen is returned (wrapped in an EndpointError) for all queries to a SPARQL endpoint
+// once too many attempts have failed in a row, see RetryPolicy.
+var ErrCircuitOpen = errors.New("circuit breaker open after repeated failures of the endpoint")
+
+// EndpointError is returned whenever the SPARQL endpoint fails to answer a query or update.
+type EndpointError struct {
+	Query string // the query or update sent to the endpoint
+	Err   error  // the underlying error, as returned by the HTTP client
+}
+
+func (e *EndpointError) Error() string {
+	return fmt.Sprint("endpoint failed to answer query: ", e.Err)
+}
+
+func (e *EndpointError) Unwrap() error { return e.Err }
+
+// DLVError is returned if the logic program could not be solved, either due to DLV failing
+// to run, due to its output not being understood, or due to the built-in solver rejecting
+// the program.
+type DLVError struct {
+	Output string // the output produced by DLV, if any
+	Err    error
+}
+
+func (e *DLVError) Error() string {
+	return fmt.Sprint("solving logic program failed: ", e.Err)
+}
+
+func (e *DLVError) Unwrap() error { return e.Err }
+
+// UnsupportedFeatureError is returned when a SHACL document relies on a feature shaWell
+// cannot handle.
+type UnsupportedFeatureError struct {
+	Feature string // short description of the feature
+	Term    string // the shape or node using it, if known
+}
+
+func (e *UnsupportedFeatureError) Error() string {
+	if e.Term == "" {
+		return fmt.Sprint("unsupported feature: ", e.Feature)
+	}
+	return fmt.Sprint("unsupported feature: ", e.Feature, " (used at ", e.Term, ")")
+}
+
+// ParseError is returned when the SHACL document, or a result produced during validation,
+// is malformed.
+type ParseError struct {
+	Term string // the term at which parsing failed, if known
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	if e.Term == "" {
+		return fmt.Sprint("parse error: ", e.Err)
+	}
+	return fmt.Sprint("parse error at ", e.Term, ": ", e.Err)
+}
+
+func (e *ParseError) Unwrap() error { return e.Err }
@@ -5,13 +5,13 @@ go 1.20
 require (
 	github.com/cem-okulmus/rdf2go-1 v0.1.6
 	github.com/fatih/color v1.15.0
+	github.com/knakk/digest v0.0.0-20160404164910-fd45becddc49
 	github.com/knakk/rdf v0.0.0-20190304171630-8521bf4c5042
 	golang.org/x/exp v0.0.0-20230510235704-dd950f8aeaea
 )
 
 require (
 	github.com/cem-okulmus/gon3-1 v0.2.3 // indirect
-	github.com/knakk/digest v0.0.0-20160404164910-fd45becddc49 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.17 // indirect
 	golang.org/x/sys v0.6.0 // indirect
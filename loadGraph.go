@@ -0,0 +1,116 @@
+package shawell
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	rdf "github.com/cem-okulmus/rdf2go-1"
+)
+
+// constructKeyword separates the prologue of a CONSTRUCT query from the query itself
+var constructKeyword = regexp.MustCompile(`(?i)\bCONSTRUCT\b`)
+
+// LoadGraph fetches the triples of a named graph of the endpoint, as used for reading the
+// shapes graph from the store holding the data. If graph is empty, the default graph is fetched.
+func LoadGraph(ctx context.Context, ep Endpoint, graph string) (*rdf.Graph, error) {
+	where := "{ ?s ?p ?o }"
+	if graph != "" {
+		where = fmt.Sprint("{ GRAPH ", graphIRI(graph), " { ?s ?p ?o } }")
+	}
+
+	return ConstructGraph(ctx, ep, "CONSTRUCT { ?s ?p ?o } WHERE "+where)
+}
+
+// ConstructGraph runs a CONSTRUCT query against the endpoint and collects the produced triples.
+// As for SPARQL rules, the query is evaluated as a SELECT query over its WHERE clause, with the
+// template being instantiated for each solution.
+func ConstructGraph(ctx context.Context, ep Endpoint, query string) (*rdf.Graph, error) {
+	loc := constructKeyword.FindStringIndex(query)
+	if loc == nil {
+		return nil, &ParseError{Term: query, Err: errors.New("not a CONSTRUCT query")}
+	}
+	prologue := query[:loc[0]]
+	parts := constructQuery.FindStringSubmatch(query[loc[0]:])
+	if parts == nil {
+		return nil, &ParseError{Term: query, Err: errors.New("not a CONSTRUCT query")}
+	}
+
+	parsed, err := parseSparql(prologue + "SELECT * WHERE " + parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var template []triplePattern
+	for _, e := range parsed.where.elements {
+		block, ok := e.(*triplesBlock)
+		if !ok {
+			return nil, &ParseError{Term: query, Err: errors.New("invalid CONSTRUCT template")}
+		}
+		for _, tp := range block.triples {
+			if tp.path != nil {
+				return nil, &ParseError{Term: query, Err: errors.New("property path in CONSTRUCT template")}
+			}
+			template = append(template, tp)
+		}
+	}
+
+	table, err := ep.QueryString(ctx, prologue+"SELECT * WHERE "+parts[2])
+	if err != nil {
+		return nil, err
+	}
+	header := table.GetHeader()
+
+	out := rdf.NewGraph(_sh)
+	solution := 0
+	for row := range table.IterRows() {
+		solution++
+		bindings := make(map[string]rdf.Term)
+		for i, h := range header {
+			if !isUnbound(row[i]) {
+				bindings[strings.TrimPrefix(h, "?")] = row[i]
+			}
+		}
+
+		// blank nodes of the template are fresh for each solution
+		instantiate := func(p patternTerm) rdf.Term {
+			switch {
+			case p.isVar():
+				return bindings[p.variable]
+			case p.term.kind == blankKind:
+				return rdf.BlankNode{ID: fmt.Sprint(p.term.value, "_", solution)}
+			}
+			return p.term.toRDF()
+		}
+
+		for _, tp := range template {
+			t := validTriple(instantiate(tp.subject), instantiate(tp.predicate), instantiate(tp.object))
+			if t != nil {
+				out.Add(rdf.NewTriple(graphTerm(t.Subject), graphTerm(t.Predicate), graphTerm(t.Object)))
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// graphTerm converts a term of a query result into the form produced when parsing RDF files,
+// as expected when extracting shapes from a graph
+func graphTerm(term rdf.Term) rdf.Term {
+	switch t := term.(type) {
+	case rdf.Resource:
+		return rdf.NewResource(t.URI)
+	case rdf.BlankNode:
+		return rdf.NewBlankNode(strings.TrimPrefix(t.ID, "_:"))
+	case rdf.Literal:
+		switch {
+		case t.Language != "":
+			return rdf.NewLiteralWithLanguage(t.Value, t.Language)
+		case t.Datatype == nil || t.Datatype.RawValue() == "" || t.Datatype.RawValue() == _xsd+"string":
+			return rdf.NewLiteral(t.Value)
+		}
+		return rdf.NewLiteralWithDatatype(t.Value, rdf.NewResource(t.Datatype.RawValue()))
+	}
+	return term
+}
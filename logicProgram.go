@@ -1,9 +1,9 @@
-package main
+package shawell
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"os/exec"
 	"strings"
 
@@ -14,51 +14,6 @@ import (
 	"github.com/alecthomas/participle/lexer/ebnf"
 )
 
-// the hardcoded address to DLV
-var dlv string = "bin/dlv"
-var demoLP bool
-
-var (
-	renameMap  map[string]string
-	reverseMap map[string]string
-)
-
-func rewrite(term rdf.Term) string {
-	if demoLP {
-		return term.RawValue()
-	}
-
-	// check if already encoded
-	if _, ok := reverseMap[term.RawValue()]; ok {
-		return reverseMap[term.RawValue()]
-	}
-
-	newTerm := fmt.Sprint("term", theCount)
-	theCount++
-
-	reverseMap[term.RawValue()] = newTerm
-	renameMap[newTerm] = term.RawValue()
-
-	// testString := removeAbbr(strings.ToLower(term.RawValue()))
-	// rewriteSuccess := false
-
-	// for !rewriteSuccess {
-	// 	if oldTerm, ok := renameMap[testString]; ok {
-	// 		if oldTerm == term.RawValue() { // trying to encode the same string again
-	// 			// fmt.Println("found exsisting term", term.RawValue())
-	// 			return testString
-	// 		} else { // CONFLICT!
-	// 			// fmt.Println("Conflict: ", oldTerm, " ", term)
-	// 			testString = testString + "conflict"
-	// 			continue
-	// 		}
-	// 	}
-	// 	renameMap[testString] = term.RawValue()
-	// 	rewriteSuccess = true
-	// }
-	return newTerm
-}
-
 type rule struct {
 	head string
 	body []string
@@ -78,6 +33,7 @@ func (r rule) rewrite(replace, with string) rule {
 
 type program struct {
 	rules []rule
+	names *lpNames // decodes the constants of the answers into the terms they encode
 }
 
 func (p program) IsEmpty() bool {
@@ -92,25 +48,38 @@ const (
 )
 
 type DLVAnswer struct {
-	Negation  string   ` @"-"? `
-	Predicate string   ` @(Number|Ident|String) `
-	Constant  []string `"("  @ (( Number|Ident|String) ","?)*  ")" `
+	Negation  string   `parser:"@\"-\"?"`
+	Predicate string   `parser:"@(Number|Ident|String)"`
+	Constant  []string `parser:"\"(\"  @ (( Number|Ident|String) \",\"?)*  \")\""`
 }
 
 type DLVOutput struct {
-	Answers []DLVAnswer ` "True:" "{" ( @@ ","?)* "}" (String|Ident|Number|Punct) "{" (Number|Ident|String|Punct|"("|")"|","|" ")*  "}" `
+	Answers   []DLVAnswer `parser:"\"True:\" \"{\" ( @@ \",\"?)* \"}\""`
+	Undefined []DLVAnswer `parser:"\"Undefined:\" \"{\" ( @@ \",\"?)* \"}\""`
 }
 
+// ToTables returns the true atoms of the output as unary tables, one per predicate, with the
+// constants taken as IRIs as they are
 func (d DLVOutput) ToTables() (out []Table[rdf.Term]) {
+	return dlvAnswersToTables(d.Answers, nil)
+}
+
+// UndefinedTables returns the undefined atoms of the output as unary tables, one per predicate,
+// with the constants taken as IRIs as they are
+func (d DLVOutput) UndefinedTables() (out []Table[rdf.Term]) {
+	return dlvAnswersToTables(d.Undefined, nil)
+}
+
+func dlvAnswersToTables(answers []DLVAnswer, names *lpNames) (out []Table[rdf.Term]) {
 	answerMap := make(map[string][]string)
 
-	for i := range d.Answers {
+	for i := range answers {
 
-		if d.Answers[i].Negation != "" {
+		if answers[i].Negation != "" {
 			continue // skip negated results
 		}
 
-		p, v := d.Answers[i].Predicate, d.Answers[i].Constant
+		p, v := answers[i].Predicate, answers[i].Constant
 
 		prev, ok := answerMap[p]
 		if !ok {
@@ -126,12 +95,12 @@ func (d DLVOutput) ToTables() (out []Table[rdf.Term]) {
 		tmp.header = append(tmp.header, k)
 
 		// fmt.Println("Map content")
-		// for k, v := range renameMap {
+		// for k, v := range names.decode {
 		// 	fmt.Println("Key ", k, " Value ", v)
 		// }
 
 		for i := range v {
-			actualValue := renameMap[v[i]]
+			actualValue := names.original(v[i])
 			// fmt.Println("Actual Value ", actualValue, " of term ", v[i])
 			tmp.content = append(tmp.content, []rdf.Term{res(actualValue)})
 		}
@@ -142,12 +111,39 @@ func (d DLVOutput) ToTables() (out []Table[rdf.Term]) {
 	return out
 }
 
-// Answer sends the logic program to DLV, set to use well-founded semantics, and returns the output
-func (p program) Answer(debug bool) []Table[rdf.Term] {
+// Answer computes the model of the logic program under the given semantics, and returns its
+// true and its undefined atoms as unary tables, one per predicate. If the address dlv is set,
+// DLV is used for the computation of the well-founded model instead of the built-in solver.
+func (p program) Answer(ctx context.Context, dlv string, semantics Semantics, debug bool) (trueTables, undefTables []Table[rdf.Term], err error) {
 	if p.IsEmpty() {
-		return []Table[rdf.Term]{}
+		return []Table[rdf.Term]{}, []Table[rdf.Term]{}, nil
+	}
+
+	if dlv != "" {
+		if semantics != WellFounded && semantics != "" {
+			return nil, nil, &UnsupportedFeatureError{Feature: "solving with DLV under semantics " + string(semantics)}
+		}
+		return p.answerDLV(ctx, dlv, debug)
 	}
 
+	model, err := p.solve(ctx, semantics)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil { // the search was cancelled, not failed
+			return nil, nil, ctxErr
+		}
+		return nil, nil, &DLVError{Err: err}
+	}
+
+	if debug {
+		fmt.Println("----\n\n", model, "\n\n-------")
+	}
+
+	return model.ToTables(lpTrue, p.names), model.ToTables(lpUndefined, p.names), nil
+}
+
+// answerDLV sends the logic program to DLV, set to use well-founded semantics, and returns the output.
+// DLV is killed once the context is cancelled.
+func (p program) answerDLV(ctx context.Context, dlv string, debug bool) (trueTables, undefTables []Table[rdf.Term], err error) {
 	graphLexer := lexer.Must(ebnf.New(`
     Comment = ("%" | "//") { "\u0000"…"\uffff"-"\n" } .
     Ident = (digit| alpha | "_") { Punct |  "_" | alpha | digit } .
@@ -161,14 +157,19 @@ func (p program) Answer(debug bool) []Table[rdf.Term] {
     any = "\u0000"…"\uffff" .
     `))
 
-	cmd := exec.Command(dlv, "--wellfounded")
+	cmd := exec.CommandContext(ctx, dlv, "--wellfounded")
 
 	outLP := p.String()
 
 	cmd.Stdin = strings.NewReader(outLP)
 
 	out, err := cmd.Output()
-	check(err)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil { // DLV was killed, not failed
+			return nil, nil, ctxErr
+		}
+		return nil, nil, &DLVError{Output: string(out), Err: err}
+	}
 
 	outString := string(out)
 
@@ -185,11 +186,12 @@ func (p program) Answer(debug bool) []Table[rdf.Term] {
 	var parsedDLVOutput DLVOutput
 	err = parser.ParseString(outString, &parsedDLVOutput)
 	if err != nil {
-		fmt.Println("----\n\n", outLP, "\n\n-------")
-		log.Panicln("input for parser: ", outString, "\n \n", err)
+		return nil, nil, &DLVError{Output: outString, Err: err}
 	}
 
-	return parsedDLVOutput.ToTables()
+	trueTables = dlvAnswersToTables(parsedDLVOutput.Answers, p.names)
+	undefTables = dlvAnswersToTables(parsedDLVOutput.Undefined, p.names)
+	return trueTables, undefTables, nil
 }
 
 func (p program) String() string {
@@ -206,13 +208,7 @@ func (p program) String() string {
 	return sb.String()
 }
 
-var (
-	qual    int = 1
-	xoneVar int = 1
-	orVar   int = 1
-)
-
-func expandRules(valuesSlice []rdf.Term, indices []int, deps []dependency, header, element string) (out []rule) {
+func (n *lpNames) expandRules(valuesSlice []rdf.Term, indices []int, deps []dependency, header, element string) (out []rule) {
 	// valuesSlice := strings.Split(strings.ToLower(values.RawValue()), " ")
 
 	// for i := range valuesSlice {
@@ -231,7 +227,7 @@ func expandRules(valuesSlice []rdf.Term, indices []int, deps []dependency, heade
 
 			for _, ref := range deps[i].name {
 				for _, v := range valuesSlice {
-					body = append(body, fmt.Sprint(ref.GetLogName(), "(", rewrite(v), ")"))
+					body = append(body, fmt.Sprint(ref.GetLogName(), "(", n.rewrite(v), ")"))
 				}
 			}
 
@@ -252,12 +248,12 @@ func expandRules(valuesSlice []rdf.Term, indices []int, deps []dependency, heade
 
 			// var bodyOne []string
 			for _, v := range valuesSlice {
-				bodyOr = append(bodyOr, fmt.Sprint("OrShape", orVar, "(", rewrite(v), ")"))
+				bodyOr = append(bodyOr, fmt.Sprint("OrShape", n.orVar, "(", n.rewrite(v), ")"))
 
 				for _, ref := range deps[i].name {
 					orRules = append(orRules, rule{
-						head: fmt.Sprint("OrShape", orVar, "(", rewrite(v), ")"),
-						body: []string{fmt.Sprint(ref.ref.GetLogName(), "(", rewrite(v), ")")},
+						head: fmt.Sprint("OrShape", n.orVar, "(", n.rewrite(v), ")"),
+						body: []string{fmt.Sprint(ref.ref.GetLogName(), "(", n.rewrite(v), ")")},
 					})
 				}
 			}
@@ -284,7 +280,7 @@ func expandRules(valuesSlice []rdf.Term, indices []int, deps []dependency, heade
 
 			var body []string
 			for _, v := range valuesSlice {
-				body = append(body, fmt.Sprint("not ", ref, "(", rewrite(v), ")"))
+				body = append(body, fmt.Sprint("not ", ref, "(", n.rewrite(v), ")"))
 			}
 
 			if len(out) == 0 {
@@ -308,7 +304,7 @@ func expandRules(valuesSlice []rdf.Term, indices []int, deps []dependency, heade
 
 			var genericXONErules []rule
 
-			headXONEgeneric := fmt.Sprint("XONE_TERM_", xoneVar, "( VAR )")
+			headXONEgeneric := fmt.Sprint("XONE_TERM_", n.xoneVar, "( VAR )")
 
 			for k := range refs {
 				var body []string
@@ -329,16 +325,16 @@ func expandRules(valuesSlice []rdf.Term, indices []int, deps []dependency, heade
 
 			for v := range valuesSlice {
 				for r := range genericXONErules {
-					boundRules = append(boundRules, genericXONErules[r].rewrite("VAR", rewrite(valuesSlice[v])))
+					boundRules = append(boundRules, genericXONErules[r].rewrite("VAR", n.rewrite(valuesSlice[v])))
 				}
 			}
 
 			var specificXONErule rule
 
-			specificXONErule.head = fmt.Sprint("XONE_", xoneVar, "( ", element, " )")
+			specificXONErule.head = fmt.Sprint("XONE_", n.xoneVar, "( ", element, " )")
 
 			for v := range valuesSlice {
-				specificXONErule.body = append(specificXONErule.body, fmt.Sprint("XONE_TERM_", xoneVar, "( ", rewrite(valuesSlice[v]), " )"))
+				specificXONErule.body = append(specificXONErule.body, fmt.Sprint("XONE_TERM_", n.xoneVar, "( ", n.rewrite(valuesSlice[v]), " )"))
 			}
 
 			// attach the XONE shape predicate to all prior rules
@@ -357,13 +353,13 @@ func expandRules(valuesSlice []rdf.Term, indices []int, deps []dependency, heade
 			externalRules = append(externalRules, boundRules...)
 			externalRules = append(externalRules, specificXONErule)
 
-			xoneVar++
+			n.xoneVar++
 		case qualified: // will require crazy combinatorics
 			ref := deps[i].name[0].GetLogName() // like not, qualified can only have single reference
 
-			mark := fmt.Sprint("Qual", qual)
-			atLeast := fmt.Sprint("AtLeast", qual)
-			qual++
+			mark := fmt.Sprint("Qual", n.qual)
+			atLeast := fmt.Sprint("AtLeast", n.qual)
+			n.qual++
 
 			if len(out) == 0 {
 				// out = append(out, rule{head: head, body: []string{head}})
@@ -458,12 +454,12 @@ func expandRules(valuesSlice []rdf.Term, indices []int, deps []dependency, heade
 			externalRules = append(externalRules, qualifiedRule)
 			// attach facts to values to mark for counting
 			for i, v := range valuesSlice {
-				v_i := rewrite(v)
+				v_i := n.rewrite(v)
 				if i == 0 {
 					externalRules = append(externalRules,
 						rule{head: fmt.Sprint(mark, "(", 0, ", ", v_i, ")")})
 					if i != len(valuesSlice)-1 {
-						v_ii := rewrite(valuesSlice[i+1])
+						v_ii := n.rewrite(valuesSlice[i+1])
 						externalRules = append(externalRules, rule{
 							head: fmt.Sprint(mark, "(", v_i, ", ", v_ii, ")"),
 						})
@@ -474,7 +470,7 @@ func expandRules(valuesSlice []rdf.Term, indices []int, deps []dependency, heade
 						head: fmt.Sprint(mark, "(", v_i, ", ", 1, ")"),
 					})
 				} else {
-					v_ii := rewrite(valuesSlice[i+1])
+					v_ii := n.rewrite(valuesSlice[i+1])
 					externalRules = append(externalRules, rule{
 						head: fmt.Sprint(mark, "(", v_i, ", ", v_ii, ")"),
 					})
@@ -550,19 +546,20 @@ func (s ShaclDocument) GetLogNameFromQualName(name string) (string, error) {
 	return "", errors.New("no shape with this qualname found: " + name)
 }
 
-func (s ShaclDocument) TableToLP(tablePreCast Table[rdf.Term], deps []dependency, internalDeps bool) (out program) {
+func (s ShaclDocument) TableToLP(tablePreCast Table[rdf.Term], deps []dependency, internalDeps bool) (out program, err error) {
 	table, ok := tablePreCast.(*GroupedTable[rdf.Term])
 	if !ok {
-		log.Panicln("Passed a non-group Tabled")
+		return out, errors.New("passed a non-grouped table")
 	}
 
 	// fmt.Println("Transforming table: ", table.GetHeader())
 
 	header := table.GetHeader()
 	table.Regroup()
+	names := s.run.names
 
 	if len(table.group) < 1 && !internalDeps {
-		log.Panicln("Not provided a conditional table")
+		return out, errors.New("not provided a conditional table")
 	}
 
 	// if internalDeps {
@@ -570,7 +567,9 @@ func (s ShaclDocument) TableToLP(tablePreCast Table[rdf.Term], deps []dependency
 
 	// need to this nonsense, since the head variable needs more complex logic to handle (sadly)
 	headerName, err := s.GetLogNameFromQualName(header[0])
-	check(err)
+	if err != nil {
+		return out, err
+	}
 
 	head := headerName + " (  VAR )"
 	var body []string
@@ -601,7 +600,9 @@ func (s ShaclDocument) TableToLP(tablePreCast Table[rdf.Term], deps []dependency
 
 		// need to this nonsense, since the head variable needs more complex logic to handle (sadly)
 		attrName, err := s.GetLogNameFromQualName(attr)
-		check(err)
+		if err != nil {
+			return out, err
+		}
 
 		body = append(body, attrName+"( VAR )")
 
@@ -612,7 +613,7 @@ func (s ShaclDocument) TableToLP(tablePreCast Table[rdf.Term], deps []dependency
 			if deps[i].origin == attr {
 				_, ok := depMap[i]
 				if ok {
-					log.Panicln("multiple appearances of attr ", attr, " in header")
+					return out, errors.New("multiple appearances of attr " + attr + " in header")
 				}
 				matchingDepFound = true
 				depMap[i] = j
@@ -622,22 +623,20 @@ func (s ShaclDocument) TableToLP(tablePreCast Table[rdf.Term], deps []dependency
 		}
 
 		if !matchingDepFound {
-
-			s.debug = true
-			fmt.Println(s)
-
-			fmt.Println("Header: ", header)
-			fmt.Println("Dep origins: len(", len(deps), ") ")
-			for i := range deps {
-				fmt.Print(deps[i].origin, " ", "external: ", deps[i].external)
-				fmt.Println("Comp res", deps[i].origin == attr)
+			if s.debug {
+				fmt.Println("Header: ", header)
+				fmt.Println("Dep origins: len(", len(deps), ") ")
+				for i := range deps {
+					fmt.Print(deps[i].origin, " ", "external: ", deps[i].external)
+					fmt.Println("Comp res", deps[i].origin == attr)
+				}
 			}
-			log.Panicln("\nfor attribute ", attr, " there is no matching dependency")
+			return out, errors.New("for attribute " + attr + " there is no matching dependency")
 		}
 	}
 
 	if numMatched != len(deps) {
-		log.Panicln("Couldn't find a matching attribute for every dep")
+		return out, errors.New("couldn't find a matching attribute for every dep")
 	}
 
 	generalRule := rule{head: head, body: body}
@@ -649,12 +648,12 @@ func (s ShaclDocument) TableToLP(tablePreCast Table[rdf.Term], deps []dependency
 		iterChan := table.IterTargets()
 
 		for element := range iterChan {
-			generalRuleNew := generalRule.rewrite("VAR", rewrite(element))
+			generalRuleNew := generalRule.rewrite("VAR", names.rewrite(element))
 			out.rules = append(out.rules, generalRuleNew)
 
 			var tempRules []rule // collection of all rules generated so far
 			// expandRules for target if InternDep
-			tempRules = expandRules([]rdf.Term{element}, attrMap[0], deps, headerName+"INTERN", rewrite(element))
+			tempRules = names.expandRules([]rdf.Term{element}, attrMap[0], deps, headerName+"INTERN", names.rewrite(element))
 
 			out.rules = append(out.rules, tempRules...)
 		}
@@ -662,22 +661,24 @@ func (s ShaclDocument) TableToLP(tablePreCast Table[rdf.Term], deps []dependency
 		for element, groupMap := range table.group {
 			// element := row[0].RawValue()
 
-			generalRuleNew := generalRule.rewrite("VAR", rewrite(element))
+			generalRuleNew := generalRule.rewrite("VAR", names.rewrite(element))
 			out.rules = append(out.rules, generalRuleNew)
 
 			var tempRules []rule // collection of all rules generated so far
 
 			// expandRules for target if InternDep
 			if internalDeps {
-				tempRules = expandRules([]rdf.Term{element}, attrMap[0], deps, headerName+"INTERN", rewrite(element))
+				tempRules = names.expandRules([]rdf.Term{element}, attrMap[0], deps, headerName+"INTERN", names.rewrite(element))
 			}
 
 			// for _, groupMap := range  {
 			for index, values := range groupMap {
 				headerIndexName, err := s.GetLogNameFromQualName(header[index])
-				check(err)
+				if err != nil {
+					return out, err
+				}
 
-				tempRules = expandRules(values, attrMap[index], deps, headerIndexName, rewrite(element))
+				tempRules = names.expandRules(values, attrMap[index], deps, headerIndexName, names.rewrite(element))
 			}
 			// }
 
@@ -685,38 +686,40 @@ func (s ShaclDocument) TableToLP(tablePreCast Table[rdf.Term], deps []dependency
 		}
 	}
 
-	return out
+	return out, nil
 }
 
-// FactsToLP assumes that the input is a unary table, ie. with only one column, will panic otherwise
-func (s ShaclDocument) FactsToLP(table Table[rdf.Term]) (out program) {
+// FactsToLP assumes that the input is a unary table, ie. with only one column, will return an error otherwise
+func (s ShaclDocument) FactsToLP(table Table[rdf.Term]) (out program, err error) {
 	header := table.GetHeader()
 	if len(header) != 1 {
-		log.Panic("FactsToLP requires unary table as input.")
+		return out, errors.New("FactsToLP requires unary table as input")
 	}
 
 	// shape := header[0]
 
 	// need to this nonsense, since the head variable needs more complex logic to handle (sadly)
 	headerName, err := s.GetLogNameFromQualName(header[0])
-	check(err)
+	if err != nil {
+		return out, err
+	}
 
 	for row := range table.IterRows() {
-		out.rules = append(out.rules, rule{head: fmt.Sprint(headerName, "(", rewrite(row[0]), ")")})
+		out.rules = append(out.rules, rule{head: fmt.Sprint(headerName, "(", s.run.names.rewrite(row[0]), ")")})
 	}
 
-	return out
+	return out, nil
 }
 
-func (s ShaclDocument) GetOneLP(name string) (out program) {
+func (s ShaclDocument) GetOneLP(name string) (out program, err error) {
 	if !s.answered {
-		log.Panicln("Cannot produce logic programs, before conditional answers have been computed.")
+		return out, errors.New("cannot produce logic programs, before conditional answers have been computed")
 	}
 
 	shape, ok := s.shapeNames[name]
 
 	if !ok {
-		log.Panicln("Provided shape name does not exist in document.")
+		return out, errors.New("provided shape name " + name + " does not exist in document")
 	}
 
 	condTable, ok := s.condAnswers[name]
@@ -729,7 +732,7 @@ func (s ShaclDocument) GetOneLP(name string) (out program) {
 	// fmt.Println("~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~")
 
 	if !ok { // no cond Table means there is nothing to do
-		return out
+		return out, nil
 	}
 
 	deps := shape.GetDeps()
@@ -742,7 +745,7 @@ func (s ShaclDocument) GetOneLP(name string) (out program) {
 		}
 	}
 	if condTable.Len() == 0 {
-		return out // empty program, since nothing in Table
+		return out, nil // empty program, since nothing in Table
 	}
 
 	// check if it is indeed a conditional table
@@ -755,7 +758,9 @@ func (s ShaclDocument) GetOneLP(name string) (out program) {
 	return s.TableToLP(condTable, deps, areInternalDeps)
 }
 
-func (s ShaclDocument) GetAllLPs() (out program) {
+func (s ShaclDocument) GetAllLPs() (out program, err error) {
+	out.names = s.run.names
+
 	for name, value := range s.shapeNames {
 
 		// fmt.Println("Producing LP for shape ", value.GetQualName())
@@ -764,12 +769,15 @@ func (s ShaclDocument) GetAllLPs() (out program) {
 			continue
 		}
 
-		outTmp := s.GetOneLP(name)
+		outTmp, err := s.GetOneLP(name)
+		if err != nil {
+			return out, err
+		}
 
 		// fmt.Println("For shape ", value.GetQualName(), " I got the program ", outTmp, "  with ", len(outTmp.rules))
 
 		out.rules = append(out.rules, outTmp.rules...)
 	}
 
-	return out
+	return out, nil
 }
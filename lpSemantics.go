@@ -0,0 +1,328 @@
+package shawell
+
+import (
+	"context"
+	"fmt"
+)
+
+// This file contains the alternative semantics for recursive SHACL, as studied by Corman et
+// al. (supported models) and Andresel et al. (stable models). They are computed over the same
+// logic programs as the well-founded semantics, by enumerating the models of the ground
+// program via a simple backtracking search.
+
+// Semantics selects how the logic program produced from a recursive SHACL document is
+// evaluated, and thus which targets of recursive shapes are considered to conform.
+type Semantics string
+
+const (
+	// WellFounded uses the well-founded model, in which shapes may be undefined for a node
+	WellFounded Semantics = "wellfounded"
+	// StableBrave accepts a node for a shape if it has the shape in some stable model
+	StableBrave Semantics = "stable-brave"
+	// StableCautious accepts a node for a shape if it has the shape in all stable models
+	StableCautious Semantics = "stable-cautious"
+	// Supported accepts a node for a shape if it has the shape in all supported models
+	Supported Semantics = "supported"
+)
+
+// GetSemantics parses the name of a semantics, with the empty string selecting WellFounded
+func GetSemantics(name string) (Semantics, error) {
+	switch s := Semantics(name); s {
+	case "":
+		return WellFounded, nil
+	case WellFounded, StableBrave, StableCautious, Supported:
+		return s, nil
+	default:
+		return "", &UnsupportedFeatureError{Feature: "semantics " + name}
+	}
+}
+
+// solve computes the model of the program under the given semantics. If the program has no
+// stable, respectively supported, model, then no atom is true. The search for the models is
+// done separately for each independent component of the ground program, and stops once the
+// context is cancelled.
+func (p program) solve(ctx context.Context, semantics Semantics) (*lpModel, error) {
+	g, err := p.ground()
+	if err != nil {
+		return nil, err
+	}
+
+	switch semantics {
+	case WellFounded, "":
+		return g.wellFounded(), nil
+	case StableBrave, StableCautious, Supported:
+	default:
+		return nil, fmt.Errorf("unknown semantics %v", semantics)
+	}
+
+	out := &lpModel{atoms: g.atoms, truth: make([]lpValue, len(g.atoms))}
+	for _, c := range splitComponents(g.ground, len(g.atoms)) {
+		search := newModelSearch(c.rules, len(c.atoms), semantics)
+
+		start := make([]lpValue, len(c.atoms))
+		for i := range start {
+			start[i] = lpUndefined // used for atoms not yet decided during the search
+		}
+		if err := search.enumerate(ctx, start); err != nil {
+			return nil, err
+		}
+
+		if search.models == 0 { // neither has the whole program, so no atom is true
+			return &lpModel{atoms: g.atoms, truth: make([]lpValue, len(g.atoms))}, nil
+		}
+		for i, a := range c.atoms {
+			if (search.brave && search.inSome[i]) || (!search.brave && search.inAll[i]) {
+				out.truth[a] = lpTrue
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// lpComponent is a part of a ground program sharing no atoms with the rest of it, with the
+// atoms numbered anew. The models of a program combine the models of its components.
+type lpComponent struct {
+	atoms []int        // the atoms of the program, in the order of their numbers in the component
+	rules []groundRule // the rules of the component, over the new numbers
+}
+
+// splitComponents splits the ground rules over the given number of atoms into independent
+// components, connecting the atoms occurring in the same rule
+func splitComponents(rules []groundRule, numAtoms int) []lpComponent {
+	parent := make([]int, numAtoms)
+	for a := range parent {
+		parent[a] = a
+	}
+	find := func(a int) int {
+		for parent[a] != a {
+			parent[a] = parent[parent[a]]
+			a = parent[a]
+		}
+		return a
+	}
+	for _, r := range rules {
+		for _, a := range r.pos {
+			parent[find(a)] = find(r.head)
+		}
+		for _, a := range r.neg {
+			parent[find(a)] = find(r.head)
+		}
+	}
+
+	var out []lpComponent
+	byRoot := make(map[int]int)
+	local := make([]int, numAtoms)
+	for a := 0; a < numAtoms; a++ {
+		c, ok := byRoot[find(a)]
+		if !ok {
+			c = len(out)
+			byRoot[find(a)] = c
+			out = append(out, lpComponent{})
+		}
+		local[a] = len(out[c].atoms)
+		out[c].atoms = append(out[c].atoms, a)
+	}
+
+	for _, r := range rules {
+		renamed := groundRule{head: local[r.head]}
+		for _, a := range r.pos {
+			renamed.pos = append(renamed.pos, local[a])
+		}
+		for _, a := range r.neg {
+			renamed.neg = append(renamed.neg, local[a])
+		}
+		c := byRoot[find(r.head)]
+		out[c].rules = append(out[c].rules, renamed)
+	}
+
+	return out
+}
+
+// modelSearch enumerates the stable or supported models of a ground program, recording which
+// atoms are true in all, and which in some of them. For brave semantics only the latter, and
+// for the others only the former is needed, which lets the search skip models that cannot
+// change the answer.
+type modelSearch struct {
+	rules     []groundRule
+	watch     [][]int
+	byHead    [][]int // the rules deriving each atom
+	negated   []bool  // atoms occurring in negated literals
+	supported bool
+	brave     bool
+
+	models int
+	inAll  []bool
+	inSome []bool
+}
+
+func newModelSearch(rules []groundRule, numAtoms int, semantics Semantics) *modelSearch {
+	m := &modelSearch{
+		rules:     rules,
+		watch:     watchLists(rules, numAtoms),
+		byHead:    make([][]int, numAtoms),
+		negated:   make([]bool, numAtoms),
+		supported: semantics == Supported,
+		brave:     semantics == StableBrave,
+		inAll:     make([]bool, numAtoms),
+		inSome:    make([]bool, numAtoms),
+	}
+	for i, r := range rules {
+		m.byHead[r.head] = append(m.byHead[r.head], i)
+		for _, a := range r.neg {
+			m.negated[a] = true
+		}
+	}
+	for i := range m.inAll {
+		m.inAll[i] = true
+	}
+
+	return m
+}
+
+func (m *modelSearch) enumerate(ctx context.Context, val []lpValue) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var ok bool
+	if m.supported {
+		ok = m.propagateSupported(val)
+	} else {
+		ok = m.propagateStable(val)
+	}
+	if !ok || m.settled(val) {
+		return nil
+	}
+
+	// for stable models, guessing the negated atoms suffices, as the rest follows from them
+	branch := -1
+	for a := range val {
+		if val[a] == lpUndefined && (m.supported || m.negated[a]) {
+			branch = a
+			break
+		}
+	}
+
+	if branch == -1 {
+		m.models++
+		for a := range val {
+			m.inAll[a] = m.inAll[a] && val[a] == lpTrue
+			m.inSome[a] = m.inSome[a] || val[a] == lpTrue
+		}
+		return nil
+	}
+
+	for _, guess := range []lpValue{lpTrue, lpFalse} {
+		next := make([]lpValue, len(val))
+		copy(next, val)
+		next[branch] = guess
+		if err := m.enumerate(ctx, next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// settled determines whether the models extending the partial interpretation cannot change the
+// answer, since a model was found already and each atom is either settled, or decided in the
+// interpretation as in the answer: for brave semantics, atoms true in some model found so far
+// are settled, and for the others those false in some model.
+func (m *modelSearch) settled(val []lpValue) bool {
+	if m.models == 0 {
+		return false
+	}
+
+	for a := range val {
+		if m.brave && !m.inSome[a] && val[a] != lpFalse {
+			return false
+		}
+		if !m.brave && m.inAll[a] && val[a] != lpTrue {
+			return false
+		}
+	}
+	return true
+}
+
+// propagateStable extends the partial interpretation with the atoms that are true, resp. false,
+// in every stable model agreeing with it, as in the computation of the well-founded model. It
+// reports false if the interpretation cannot be extended to a stable model.
+func (m *modelSearch) propagateStable(val []lpValue) bool {
+	isTrue := make([]bool, len(val))
+	notFalse := make([]bool, len(val))
+
+	for {
+		for a := range val {
+			isTrue[a] = val[a] == lpTrue
+			notFalse[a] = val[a] != lpFalse
+		}
+
+		lower := leastModel(m.rules, m.watch, len(val), notFalse)
+		upper := leastModel(m.rules, m.watch, len(val), isTrue)
+
+		changed := false
+		for a := range val {
+			switch {
+			case lower[a] && val[a] == lpFalse, !upper[a] && val[a] == lpTrue:
+				return false
+			case lower[a] && val[a] == lpUndefined:
+				val[a] = lpTrue
+				changed = true
+			case !upper[a] && val[a] == lpUndefined:
+				val[a] = lpFalse
+				changed = true
+			}
+		}
+
+		if !changed {
+			return true
+		}
+	}
+}
+
+// propagateSupported applies the completion of the program to the partial interpretation: an
+// atom is true if the body of one of its rules is true, and false if all of them are false. It
+// reports false if the interpretation cannot be extended to a supported model.
+func (m *modelSearch) propagateSupported(val []lpValue) bool {
+	for {
+		changed := false
+
+		for a := range val {
+			derived := lpFalse
+			for _, i := range m.byHead[a] {
+				if body := m.bodyValue(m.rules[i], val); body > derived {
+					derived = body
+				}
+			}
+
+			switch {
+			case derived == lpTrue && val[a] == lpFalse, derived == lpFalse && val[a] == lpTrue:
+				return false
+			case derived != lpUndefined && val[a] == lpUndefined:
+				val[a] = derived
+				changed = true
+			}
+		}
+
+		if !changed {
+			return true
+		}
+	}
+}
+
+func (m *modelSearch) bodyValue(r groundRule, val []lpValue) lpValue {
+	out := lpTrue
+
+	for _, a := range r.pos {
+		if val[a] < out {
+			out = val[a]
+		}
+	}
+	for _, a := range r.neg {
+		if lpTrue-val[a] < out { // negation swaps true and false, keeping undefined
+			out = lpTrue - val[a]
+		}
+	}
+
+	return out
+}
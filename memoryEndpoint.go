@@ -0,0 +1,244 @@
+package shawell
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	rdf "github.com/cem-okulmus/rdf2go-1"
+)
+
+// MemoryEndpoint answers the queries produced during validation directly over RDF graphs held
+// in memory, making it possible to validate local files without access to a SPARQL server.
+// Like a typical triple store, the default graph is the union of all graphs loaded into it.
+type MemoryEndpoint struct {
+	data      *memDataset
+	fromGraph string
+	dataset   Dataset
+	debug     bool
+}
+
+// GetMemoryEndpoint produces a new in-memory endpoint, loading the given Turtle or N-Triples
+// files into it. If graph is non-empty, the files are loaded into that named graph, and the
+// queries of the validation are restricted to it.
+func GetMemoryEndpoint(files []string, graph string, debug bool) (*MemoryEndpoint, error) {
+	out := &MemoryEndpoint{
+		data:      newMemDataset(),
+		fromGraph: graph,
+		debug:     debug,
+	}
+
+	for _, file := range files {
+		err := out.LoadFile(file, graph)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// ReadFile parses a Turtle, N-Triples or JSON-LD file into a graph, choosing the format by the
+// extension of the file.
+func ReadFile(file string) (*rdf.Graph, error) {
+	var mime string
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".ttl", ".turtle", ".nt", ".ntriples", ".n3":
+		mime = "text/turtle" // N-Triples is a subset of Turtle
+	case ".jsonld", ".json":
+		mime = "application/ld+json"
+	default:
+		return nil, &UnsupportedFeatureError{Feature: "RDF serialisation", Term: file}
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	g := rdf.NewGraph("file://" + file)
+	err = g.Parse(f, mime)
+	if err != nil {
+		return nil, &ParseError{Term: file, Err: err}
+	}
+
+	return g, nil
+}
+
+// LoadFile parses a Turtle or N-Triples file and adds its triples to the given graph, or to the
+// default graph if none is given.
+func (m *MemoryEndpoint) LoadFile(file, graph string) error {
+	g, err := ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	return m.add(g, graph)
+}
+
+func (m *MemoryEndpoint) add(input *rdf.Graph, graph string) error {
+	name := strings.TrimSuffix(strings.TrimPrefix(graph, "<"), ">")
+
+	for triple := range input.IterTriples() {
+		s, err := memTermFromRDF(triple.Subject)
+		if err != nil {
+			return err
+		}
+		p, err := memTermFromRDF(triple.Predicate)
+		if err != nil {
+			return err
+		}
+		o, err := memTermFromRDF(triple.Object)
+		if err != nil {
+			return err
+		}
+		m.data.add(name, memTriple{s: s, p: p, o: o})
+	}
+
+	return nil
+}
+
+func (m *MemoryEndpoint) GetGraph() string { return m.fromGraph }
+
+// SetDataset restricts the queries produced during validation to the given dataset, which is
+// added to them as FROM and FROM NAMED clauses. Queries posed via QueryString are evaluated as is.
+func (m *MemoryEndpoint) SetDataset(d Dataset) { m.dataset = d }
+
+func (m *MemoryEndpoint) ClearGraph(ctx context.Context, fromGraph string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if fromGraph == "" {
+		return errors.New("need to provide a graph for the Clear command")
+	}
+
+	m.data.clear(strings.TrimSuffix(strings.TrimPrefix(fromGraph, "<"), ">"))
+
+	return nil
+}
+
+// Insert replaces the content of the named graph with the input graph. If no graph name is
+// given, and none was set before, the triples are added to the default graph.
+func (m *MemoryEndpoint) Insert(ctx context.Context, input *rdf.Graph, fromGraph string) error {
+	if fromGraph != "" {
+		m.fromGraph = fromGraph
+	}
+
+	if m.fromGraph != "" {
+		err := m.ClearGraph(ctx, m.fromGraph)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return m.add(input, m.fromGraph)
+}
+
+// Add inserts the triples of the input graph into the given named graph, keeping its previous
+// content. Unlike Insert, the graph used for validation is not changed.
+func (m *MemoryEndpoint) Add(ctx context.Context, input *rdf.Graph, graph string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return m.add(input, graph)
+}
+
+// Answer takes as input a NodeShape, and evaluates its Sparql query over the graphs in memory
+// In case of multiple targets, each target produces its own query, and results are concatenated
+// into a grouped table (see AddGroupedRows)
+func (m *MemoryEndpoint) Answer(ctx context.Context, ns Shape, targets []SparqlQueryFlat) (Table[rdf.Term], error) {
+	out := &GroupedTable[rdf.Term]{}
+
+	for i := range targets {
+		query := ns.ToSparql(m.fromGraph, targets[i])
+		query.dataset = m.dataset
+
+		if m.debug {
+			fmt.Println("Answer query:  \n", query)
+		}
+
+		runOf(ctx).storeQuery(query)
+		tmp, err := m.QueryString(ctx, query.text(ctx))
+		if err != nil {
+			return nil, err
+		}
+
+		err = out.AddGroupedRows(tmp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if m.debug {
+		fmt.Println("Output Final : \n, ", out)
+	}
+
+	return out, nil
+}
+
+func (m *MemoryEndpoint) Query(ctx context.Context, query SparqlQuery) (Table[rdf.Term], error) {
+	query.dataset = m.dataset
+	if m.debug {
+		fmt.Println("Query:  \n", query)
+	}
+
+	return m.QueryString(ctx, query.text(ctx))
+}
+
+func (m *MemoryEndpoint) QueryFlat(ctx context.Context, query SparqlQueryFlat) (Table[rdf.Term], error) {
+	query.dataset = m.dataset
+	if m.debug {
+		fmt.Println("QueryFlat:  \n", query)
+	}
+
+	return m.QueryString(ctx, query.text(ctx))
+}
+
+// QueryString evaluates the query in memory. As the evaluation itself cannot be interrupted, the
+// context is only checked before it starts.
+func (m *MemoryEndpoint) QueryString(ctx context.Context, query string) (Table[rdf.Term], error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	parsed, err := parseSparql(query)
+	if err != nil {
+		return nil, &EndpointError{Query: query, Err: err}
+	}
+
+	m.data.mu.RLock()
+	vars, rows, err := newSparqlEvaluator(m.data).evalQuery(parsed)
+	m.data.mu.RUnlock()
+	if err != nil {
+		return nil, &EndpointError{Query: query, Err: err}
+	}
+
+	out := &TableSimple[rdf.Term]{header: vars}
+
+	for _, row := range rows {
+		if len(vars) == 0 {
+			continue
+		}
+
+		tuple := make([]rdf.Term, len(vars))
+		for i, v := range vars {
+			tuple[i] = row[v].toRDF()
+		}
+		out.AddRow(tuple)
+	}
+
+	if m.debug {
+		fmt.Println("Output: \n, ", out)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,148 @@
+package shawell
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	rdf "github.com/cem-okulmus/rdf2go-1"
+)
+
+const memoryTestData = `
+@prefix ex: <http://example.org/> .
+@prefix xsd: <http://www.w3.org/2001/XMLSchema#> .
+
+ex:a ex:knows ex:b ; ex:age 42 ; ex:name "Anna"@en .
+ex:b ex:knows ex:c ; ex:age "old"^^xsd:integer .
+ex:c ex:name "Carl" .
+`
+
+// TestMemoryEndpoint checks the in-memory evaluation of the SPARQL features used by shaWell
+func TestMemoryEndpoint(t *testing.T) {
+	g := rdf.NewGraph("http://example.org/")
+	err := g.Parse(strings.NewReader(memoryTestData), "text/turtle")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ep, err := GetMemoryEndpoint(nil, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ep.Insert(context.Background(), g, "<http://example.org/graph>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"path", `SELECT ?x { <http://example.org/a> <http://example.org/knows>+ ?x }`,
+			[]string{"<http://example.org/b>", "<http://example.org/c>"}},
+		{"inverse", `SELECT ?x { <http://example.org/c> ^<http://example.org/knows>/^<http://example.org/knows> ?x }`,
+			[]string{"<http://example.org/a>"}},
+		{"optional", `SELECT ?x ?n { { SELECT ?x { ?x <http://example.org/knows> ?y } } OPTIONAL { ?x <http://example.org/name> ?n } FILTER(!bound(?n)) }`,
+			[]string{"<http://example.org/b>"}},
+		{"count", `SELECT ?x (COUNT(DISTINCT ?y) AS ?c) { ?x <http://example.org/knows>* ?y } GROUP BY ?x HAVING (?c >= 3)`,
+			[]string{"<http://example.org/a>"}},
+		{"cast", `PREFIX xsd: <http://www.w3.org/2001/XMLSchema#>
+			SELECT ?x { ?x <http://example.org/age> ?v . BIND (xsd:integer(str(?v)) AS ?i) FILTER (!BOUND(?i)) }`,
+			[]string{"<http://example.org/b>"}},
+		{"lang", `SELECT ?x { GRAPH <http://example.org/graph> { ?x <http://example.org/name> ?n FILTER (langMatches(lang(?n), "en")) } }`,
+			[]string{"<http://example.org/a>"}},
+		{"notExists", `SELECT ?x { ?x ?p ?o FILTER NOT EXISTS { ?x <http://example.org/age> ?a } }`,
+			[]string{"<http://example.org/c>"}},
+		{"from", `SELECT ?x FROM <http://example.org/graph> { ?x <http://example.org/age> 42 }`,
+			[]string{"<http://example.org/a>"}},
+		{"fromOther", `SELECT ?x FROM <http://example.org/other> { ?x ?p ?o }`, nil},
+		{"fromNamed", `SELECT ?g FROM NAMED <http://example.org/graph> { GRAPH ?g { <http://example.org/c> ?p ?o } }`,
+			[]string{"<http://example.org/graph>"}},
+		{"nested", `SELECT ?x { ?x <http://example.org/knows> ?y { FILTER(!bound(?x)) } }`,
+			[]string{"<http://example.org/a>", "<http://example.org/b>"}},
+		{"union", `SELECT ?x { ?x <http://example.org/age> ?a { FILTER(!bound(?a)) } UNION { ?x <http://example.org/name> ?n } }`,
+			[]string{"<http://example.org/a>", "<http://example.org/a>", "<http://example.org/b>"}},
+	}
+
+	for _, tc := range tests {
+		table, err := ep.QueryString(context.Background(), tc.query)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+
+		var got []string
+		for row := range table.IterRows() {
+			got = append(got, row[0].String())
+		}
+
+		if strings.Join(got, " ") != strings.Join(tc.want, " ") {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+const datasetTestShapes = `
+@prefix ex: <http://example.org/> .
+@prefix sh: <http://www.w3.org/ns/shacl#> .
+
+ex:PersonShape a sh:NodeShape ;
+	sh:targetClass ex:Person ;
+	sh:property [ sh:path ex:age ; sh:minCount 1 ] .
+`
+
+// TestDataset checks validating a selection of the named graphs of an endpoint, with the
+// shapes graph read from the endpoint as well
+func TestDataset(t *testing.T) {
+	ctx := context.Background()
+	ep, err := GetMemoryEndpoint(nil, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	graphs := map[string]string{
+		"<http://example.org/shapes>": datasetTestShapes,
+		"<http://example.org/g1>":     "<http://example.org/a> a <http://example.org/Person> .",
+		"<http://example.org/g2>": `<http://example.org/b> a <http://example.org/Person> .
+			<http://example.org/a> <http://example.org/age> 5 .`,
+	}
+	for name, content := range graphs {
+		g := rdf.NewGraph("http://example.org/")
+		if err := g.Parse(strings.NewReader(content), "text/turtle"); err != nil {
+			t.Fatal(err)
+		}
+		if err := ep.Add(ctx, g, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	shapes, err := LoadGraph(ctx, ep, "http://example.org/shapes")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		graphs []string
+		want   string
+	}{
+		{[]string{"http://example.org/g1"}, "<http://example.org/a>"},
+		{[]string{"http://example.org/g1", "http://example.org/g2"}, "<http://example.org/b>"},
+	}
+
+	for _, tc := range cases {
+		ep.SetDataset(Dataset{Default: tc.graphs})
+		report, err := Validate(ctx, shapes, ep, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, r := range report.Results() {
+			got = append(got, r.FocusNode().String())
+		}
+		if strings.Join(got, " ") != tc.want {
+			t.Errorf("%v: got focus nodes %v, want %v", tc.graphs, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package shawell
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	rdf "github.com/cem-okulmus/rdf2go-1"
+)
+
+// QueryOrigin describes what a query sent to the endpoint was produced for
+type QueryOrigin struct {
+	Shape      string // the shape being validated
+	Constraint string // the constraint being checked, or the stage of validation
+	Target     string // the target of the shape the query is restricted to, if any
+}
+
+type queryOriginKey struct{}
+
+// withQueryOrigin records the origin of the queries posed with the context. Fields left empty
+// are kept from the origin recorded before.
+func withQueryOrigin(ctx context.Context, o QueryOrigin) context.Context {
+	outer := queryOrigin(ctx)
+	if o.Shape == "" {
+		o.Shape = outer.Shape
+	}
+	if o.Constraint == "" {
+		o.Constraint = outer.Constraint
+	}
+	if o.Target == "" {
+		o.Target = outer.Target
+	}
+	return context.WithValue(ctx, queryOriginKey{}, o)
+}
+
+func queryOrigin(ctx context.Context) QueryOrigin {
+	o, _ := ctx.Value(queryOriginKey{}).(QueryOrigin)
+	return o
+}
+
+// queryBytesKey marks a context whose queries count the bytes of their results, as received
+// from a SparqlEndpoint
+type queryBytesKey struct{}
+
+// addQueryBytes adds the number of bytes received for a query to the counter of the context
+func addQueryBytes(ctx context.Context, n int64) {
+	if counter, ok := ctx.Value(queryBytesKey{}).(*int64); ok {
+		atomic.AddInt64(counter, n)
+	}
+}
+
+// countingReader counts the bytes read from a response
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// QueryStat records a single query answered by the endpoint during validation
+type QueryStat struct {
+	QueryOrigin
+	Query    string
+	Duration time.Duration
+	Rows     int
+	Bytes    int64 // size of the results received, zero for endpoints not using HTTP
+	Retries  int64 // attempts repeated after transient failures of the endpoint
+	Err      string
+}
+
+// ProfilingEndpoint wraps another endpoint, recording the time, size and origin of each query,
+// so that shapes producing expensive queries can be found. Queries taking at least the slow
+// threshold are logged as they complete.
+type ProfilingEndpoint struct {
+	inner   Endpoint
+	slow    time.Duration // no logging if zero
+	slowLog io.Writer
+
+	mu    sync.Mutex
+	stats []QueryStat
+}
+
+// GetProfilingEndpoint wraps the endpoint, logging queries taking at least slow to slowLog,
+// unless slow is zero
+func GetProfilingEndpoint(ep Endpoint, slow time.Duration, slowLog io.Writer) *ProfilingEndpoint {
+	return &ProfilingEndpoint{inner: ep, slow: slow, slowLog: slowLog}
+}
+
+// Unwrap returns the endpoint the queries are sent to
+func (p *ProfilingEndpoint) Unwrap() Endpoint { return p.inner }
+
+// Stats returns the queries recorded so far, in the order they completed
+func (p *ProfilingEndpoint) Stats() []QueryStat {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]QueryStat(nil), p.stats...)
+}
+
+func (p *ProfilingEndpoint) GetGraph() string { return p.inner.GetGraph() }
+
+func (p *ProfilingEndpoint) Answer(ctx context.Context, ns Shape, targets []SparqlQueryFlat) (Table[rdf.Term], error) {
+	var queries []string
+	for i := range targets {
+		queries = append(queries, ns.ToSparql(p.inner.GetGraph(), targets[i]).text(ctx))
+	}
+
+	return p.record(ctx, strings.Join(queries, "\n#\n"), func(ctx context.Context) (Table[rdf.Term], error) {
+		return p.inner.Answer(ctx, ns, targets)
+	})
+}
+
+func (p *ProfilingEndpoint) Query(ctx context.Context, query SparqlQuery) (Table[rdf.Term], error) {
+	return p.record(ctx, query.text(ctx), func(ctx context.Context) (Table[rdf.Term], error) {
+		return p.inner.Query(ctx, query)
+	})
+}
+
+func (p *ProfilingEndpoint) QueryFlat(ctx context.Context, query SparqlQueryFlat) (Table[rdf.Term], error) {
+	return p.record(ctx, query.text(ctx), func(ctx context.Context) (Table[rdf.Term], error) {
+		return p.inner.QueryFlat(ctx, query)
+	})
+}
+
+func (p *ProfilingEndpoint) QueryString(ctx context.Context, query string) (Table[rdf.Term], error) {
+	return p.record(ctx, query, func(ctx context.Context) (Table[rdf.Term], error) {
+		return p.inner.QueryString(ctx, query)
+	})
+}
+
+func (p *ProfilingEndpoint) Insert(ctx context.Context, input *rdf.Graph, fromGraph string) error {
+	return p.inner.Insert(ctx, input, fromGraph)
+}
+
+func (p *ProfilingEndpoint) Add(ctx context.Context, input *rdf.Graph, graph string) error {
+	return p.inner.Add(ctx, input, graph)
+}
+
+func (p *ProfilingEndpoint) ClearGraph(ctx context.Context, fromGraph string) error {
+	return p.inner.ClearGraph(ctx, fromGraph)
+}
+
+// record runs the query, recording its statistics
+func (p *ProfilingEndpoint) record(ctx context.Context, query string,
+	run func(ctx context.Context) (Table[rdf.Term], error),
+) (Table[rdf.Term], error) {
+	var bytes, retries int64
+	ctx = context.WithValue(ctx, queryBytesKey{}, &bytes)
+	ctx = context.WithValue(ctx, queryRetriesKey{}, &retries)
+
+	start := time.Now()
+	out, err := run(ctx)
+	stat := QueryStat{
+		QueryOrigin: queryOrigin(ctx),
+		Query:       query,
+		Duration:    time.Since(start),
+		Bytes:       atomic.LoadInt64(&bytes),
+		Retries:     atomic.LoadInt64(&retries),
+	}
+	if err != nil {
+		stat.Err = err.Error()
+	} else {
+		stat.Rows = out.Len()
+	}
+
+	p.mu.Lock()
+	p.stats = append(p.stats, stat)
+	if p.slow > 0 && stat.Duration >= p.slow && p.slowLog != nil {
+		fmt.Fprintf(p.slowLog, "Slow query (%v, %d rows) for shape %s, %s, target %s:\n%s\n\n",
+			stat.Duration, stat.Rows, stat.Shape, stat.Constraint, stat.Target, stat.Query)
+	}
+	p.mu.Unlock()
+
+	return out, err
+}
+
+// profileEntry is the form in which the statistics of a query are exported
+type profileEntry struct {
+	Shape        string  `json:"shape"`
+	Constraint   string  `json:"constraint"`
+	Target       string  `json:"target"`
+	Milliseconds float64 `json:"milliseconds"`
+	Rows         int     `json:"rows"`
+	Bytes        int64   `json:"bytes"`
+	Retries      int64   `json:"retries"`
+	Error        string  `json:"error,omitempty"`
+	Query        string  `json:"query"`
+}
+
+func (s QueryStat) entry() profileEntry {
+	return profileEntry{
+		Shape:        s.Shape,
+		Constraint:   s.Constraint,
+		Target:       s.Target,
+		Milliseconds: float64(s.Duration.Microseconds()) / 1000,
+		Rows:         s.Rows,
+		Bytes:        s.Bytes,
+		Retries:      s.Retries,
+		Error:        s.Err,
+		Query:        s.Query,
+	}
+}
+
+// WriteJSON exports the recorded queries as a JSON array
+func (p *ProfilingEndpoint) WriteJSON(w io.Writer) error {
+	entries := []profileEntry{}
+	for _, s := range p.Stats() {
+		entries = append(entries, s.entry())
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entries)
+}
+
+// WriteCSV exports the recorded queries as CSV, with one row per query
+func (p *ProfilingEndpoint) WriteCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	err := out.Write([]string{"shape", "constraint", "target", "milliseconds", "rows", "bytes", "retries", "error", "query"})
+	if err != nil {
+		return err
+	}
+
+	for _, s := range p.Stats() {
+		e := s.entry()
+		err = out.Write([]string{
+			e.Shape, e.Constraint, e.Target, strconv.FormatFloat(e.Milliseconds, 'f', 3, 64),
+			strconv.Itoa(e.Rows), strconv.FormatInt(e.Bytes, 10),
+			strconv.FormatInt(e.Retries, 10), e.Error, e.Query,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	out.Flush()
+	return out.Error()
+}
+
+// TimingComparison sums up the queries of a single origin in two runs of the same validation
+type TimingComparison struct {
+	QueryOrigin
+	Before, After               time.Duration
+	BeforeQueries, AfterQueries int
+}
+
+// CompareTimings sums up the durations of the queries recorded in two runs of the same
+// validation, such as without and with the optimization pass over the generated queries, for
+// each origin. The comparisons are sorted by origin.
+func CompareTimings(before, after []QueryStat) []TimingComparison {
+	sums := make(map[QueryOrigin]*TimingComparison)
+	get := func(o QueryOrigin) *TimingComparison {
+		if _, ok := sums[o]; !ok {
+			sums[o] = &TimingComparison{QueryOrigin: o}
+		}
+		return sums[o]
+	}
+
+	for _, s := range before {
+		c := get(s.QueryOrigin)
+		c.Before += s.Duration
+		c.BeforeQueries++
+	}
+	for _, s := range after {
+		c := get(s.QueryOrigin)
+		c.After += s.Duration
+		c.AfterQueries++
+	}
+
+	var out []TimingComparison
+	for _, c := range sums {
+		out = append(out, *c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i].QueryOrigin, out[j].QueryOrigin
+		if a.Shape != b.Shape {
+			return a.Shape < b.Shape
+		}
+		if a.Constraint != b.Constraint {
+			return a.Constraint < b.Constraint
+		}
+		return a.Target < b.Target
+	})
+
+	return out
+}
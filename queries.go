@@ -1,9 +1,8 @@
-package main
+package shawell
 
 import (
 	"fmt"
 	"strconv"
-	"strings"
 )
 
 // ToSparql produces a stand-alone sparql query that produces the list of nodes satisfying the
@@ -25,31 +24,34 @@ func (p *PropertyShape) ToSparql(fromGraph string, target SparqlQueryFlat) (out
 // ToSubquery is used to embedd the property shape into a node shape by way of a subquery in the
 // body, and number of variables in the head. The head variables are only included in the
 // presence of referential constraints (and,or,xone,node,not, qualifiedValueShape)
-func (p *PropertyShape) ToSubquery(num int) (head []string, body string, subquery *CountingSubQuery) {
+func (p *PropertyShape) ToSubquery(num int) (head []projection, body []patternElement, subquery *CountingSubQuery) {
 	objName := "?InnerObj" + strconv.Itoa(num)
 	path := p.path
 
 	if p.minCount > 0 || p.maxCount > -1 {
 		subquery = &CountingSubQuery{}
 	}
-	var bodyParts []string
+	var bodyParts []patternElement
 
 	// NON-LOGICAL CONSTRAINTS
 
 	for i := range p.shape.valuetypes {
-		bodyParts = append(bodyParts, p.shape.valuetypes[i].SparqlBody(objName, path))
+		bodyParts = append(bodyParts, p.shape.valuetypes[i].SparqlBody(objName, path)...)
 	}
 	for i := range p.shape.valueranges {
-		bodyParts = append(bodyParts, p.shape.valueranges[i].SparqlBody(objName, path))
+		bodyParts = append(bodyParts, p.shape.valueranges[i].SparqlBody(objName, path)...)
 	}
 	for i := range p.shape.stringconts {
-		bodyParts = append(bodyParts, p.shape.stringconts[i].SparqlBody(objName, path))
+		bodyParts = append(bodyParts, p.shape.stringconts[i].SparqlBody(objName, path)...)
 	}
 	for i := range p.shape.propairconts {
-		bodyParts = append(bodyParts, p.shape.propairconts[i].SparqlBody(objName, path))
+		bodyParts = append(bodyParts, p.shape.propairconts[i].SparqlBody(objName, path)...)
 	}
 	for i := range p.shape.others {
-		bodyParts = append(bodyParts, p.shape.others[i].SparqlBody(objName, path))
+		bodyParts = append(bodyParts, p.shape.others[i].SparqlBody(objName, path)...)
+	}
+	for i := range p.shape.sparqls {
+		bodyParts = append(bodyParts, p.shape.sparqls[i].SparqlBody(objName, path)...)
 	}
 
 	// Numerical Constraints
@@ -70,25 +72,15 @@ func (p *PropertyShape) ToSubquery(num int) (head []string, body string, subquer
 
 	// TODO: severity, message (not dealt here?)
 
-	var sb strings.Builder
+	var values patternElement = triple(queryVar("?sub"), p.path, queryVar(objName))
 
 	// if output && universalOnly {
 	if p.universalOnly {
-		sb.WriteString("OPTIONAL { \n")
-	}
-	sb.WriteString(fmt.Sprint("?sub", " ", p.path.PropertyString(), " ?InnerObj", num, " .\n\t"))
-
-	if p.universalOnly {
-		sb.WriteString("} \n")
+		values = optional(values)
 	}
 
 	// inner body parts
-	for i := range bodyParts {
-		sb.WriteString(bodyParts[i])
-		sb.WriteString("\n\t")
-	}
-
-	body = sb.String()
+	body = append([]patternElement{values}, bodyParts...)
 
 	return head, body, subquery
 }
@@ -99,20 +91,20 @@ func (p *PropertyShape) ToSubquery(num int) (head []string, body string, subquer
 // potential node is only satisfied if and only if the conditional nodes have
 // or do not have the specified shapes.
 func (n *NodeShape) ToSparql(fromGraph string, target SparqlQueryFlat) (out SparqlQuery) {
-	var head []string // variables and renamings appearing inside the SELECT statement
-	var body []string // statements that form the inside of the WHERE clause
+	var head []projection     // variables and renamings appearing inside the SELECT statement
+	var body []patternElement // statements that form the inside of the WHERE clause
 	// var group []string
 	var subqueries []CountingSubQuery
 
 	// var usedPaths []string // keep track of all (non-inverse) path constraints
 
-	head = append(head, "(?sub as ?"+n.GetQualName()+" )")
+	head = append(head, projectAs(exprVar("?sub"), n.GetQualName()))
 	// vars = append(vars, "?sub")
 	// group = append(group, "?sub")
 
 	// initial := "{?sub ?pred ?obj. }\n\tUNION\n\t{?objI ?predI ?sub.}"
 	// body = append(body, initial)
-	targetLine := fmt.Sprint("{\n\t", target.StringPrefix(false), "\n\t}")
+	targetLine := target.pattern()
 
 	out.target = targetLine
 	// body = append(body, targetLine)
@@ -120,19 +112,22 @@ func (n *NodeShape) ToSparql(fromGraph string, target SparqlQueryFlat) (out Spar
 	// UNIVERSAL
 
 	for i := range n.valuetypes {
-		body = append(body, n.valuetypes[i].SparqlBody("?sub", nil))
+		body = append(body, n.valuetypes[i].SparqlBody("?sub", nil)...)
 	}
 	for i := range n.valueranges {
-		body = append(body, n.valueranges[i].SparqlBody("?sub", nil))
+		body = append(body, n.valueranges[i].SparqlBody("?sub", nil)...)
 	}
 	for i := range n.stringconts {
-		body = append(body, n.stringconts[i].SparqlBody("?sub", nil))
+		body = append(body, n.stringconts[i].SparqlBody("?sub", nil)...)
 	}
 	for i := range n.others {
-		body = append(body, n.others[i].SparqlBody("?sub", nil))
+		body = append(body, n.others[i].SparqlBody("?sub", nil)...)
+	}
+	for i := range n.sparqls {
+		body = append(body, n.sparqls[i].SparqlBody("?sub", nil)...)
 	}
 	for i := range n.propairconts {
-		body = append(body, n.propairconts[i].SparqlBody("?sub", nil))
+		body = append(body, n.propairconts[i].SparqlBody("?sub", nil)...)
 	}
 
 	// leaving out property pair constraints; cannot appear inside node shape
@@ -146,7 +141,7 @@ func (n *NodeShape) ToSparql(fromGraph string, target SparqlQueryFlat) (out Spar
 		headP, bodyP, subquery := p.ToSubquery(i)
 
 		head = append(head, headP...)
-		body = append(body, bodyP)
+		body = append(body, bodyP...)
 
 		if subquery != nil {
 
@@ -160,7 +155,7 @@ func (n *NodeShape) ToSparql(fromGraph string, target SparqlQueryFlat) (out Spar
 			nameOfRef := p.GetQualName()
 
 			// head = append(head, fmt.Sprint("( GROUP_CONCAT(DISTINCT ?InnerObj", i, "; separator=' ') AS ?", nameOfRef, " )"))
-			head = append(head, fmt.Sprint("( ?InnerObj", i, " AS ?", nameOfRef, " )"))
+			head = append(head, projectAs(exprVar(fmt.Sprint("?InnerObj", i)), nameOfRef))
 		}
 
 	}
@@ -0,0 +1,414 @@
+package shawell
+
+// This file holds the optimization pass over the generated queries, run by assembleQuery on
+// the algebra. The answers of generated queries are only used as sets (see GetGroupedTable),
+// so the rewrites preserve the set of solutions of a query, though not their multiplicity.
+// User SPARQL, embedded as verbatimPattern, is neither rewritten nor moved.
+
+// optimizeQuery rewrites the generated query into one that is cheaper to evaluate:
+//   - counting sub-queries over the same target are merged into a single sub-query, evaluating
+//     the target once, and sharing the OPTIONAL pattern of sub-queries with the same path;
+//   - restrictions of the targets are pushed into the counting sub-queries, so that only the
+//     targets passing them are counted;
+//   - OPTIONAL patterns none of whose new variables are used elsewhere are removed.
+func optimizeQuery(q *sparqlQuery) {
+	mergeCountingSubqueries(q)
+	pushTargetRestrictions(q)
+	if !q.star && len(q.groupBy) == 0 && len(q.having) == 0 && !hasAggregate(q.project) {
+		removeRedundantOptionals(q)
+	}
+}
+
+// removeRedundantOptionals removes the OPTIONAL patterns of the WHERE clause whose variables
+// are either bound by the mandatory patterns before them or not used anywhere else in the
+// query. Such patterns only repeat solutions, without binding anything.
+func removeRedundantOptionals(q *sparqlQuery) {
+	for i := 0; i < len(q.where.elements); {
+		if _, ok := q.where.elements[i].(*optionalPattern); ok && redundantOptional(q, i) {
+			q.where.elements = append(q.where.elements[:i], q.where.elements[i+1:]...)
+			continue
+		}
+		i++
+	}
+}
+
+func redundantOptional(q *sparqlQuery, i int) bool {
+	elements := q.where.elements
+	optVars := make(map[string]bool)
+	groupVars(group(elements[i]), optVars, true)
+
+	rest := *q
+	rest.where = group(append(append([]patternElement{}, elements[:i]...), elements[i+1:]...)...)
+	used := make(map[string]bool)
+	allVars(&rest, used)
+
+	certain := make(map[string]bool)
+	certainVars(elements[:i], certain)
+
+	for v := range optVars {
+		if used[v] && !certain[v] {
+			return false
+		}
+	}
+	return true
+}
+
+// certainVars collects the variables bound in every solution of the patterns
+func certainVars(elements []patternElement, out map[string]bool) {
+	add := func(p patternTerm) {
+		if p.isVar() {
+			out[p.variable] = true
+		}
+	}
+
+	for _, e := range elements {
+		switch e := e.(type) {
+		case *triplesBlock:
+			for _, tp := range e.triples {
+				add(tp.subject)
+				add(tp.predicate)
+				add(tp.object)
+			}
+		case *groupPattern:
+			certainVars(e.elements, out)
+		case *graphPattern:
+			add(e.graph)
+			certainVars(e.group.elements, out)
+		case *subSelectPattern:
+			inner := make(map[string]bool)
+			certainVars(e.query.where.elements, inner)
+			if e.query.star {
+				for v := range inner {
+					out[v] = true
+				}
+				continue
+			}
+			for _, p := range e.query.project {
+				agg, isAgg := p.expr.(*aggregateExpr)
+				if (p.expr == nil && inner[p.variable]) || (isAgg && agg.name == "COUNT") {
+					out[p.variable] = true
+				}
+			}
+		case *valuesPattern:
+			for i, v := range e.vars {
+				bound := true
+				for _, row := range e.rows {
+					if row[i].kind == unboundKind {
+						bound = false
+					}
+				}
+				if bound {
+					out[v] = true
+				}
+			}
+		}
+	}
+}
+
+// countingSubquery is a sub-query counting, for each solution of its target, the distinct
+// values of variables bound by a single OPTIONAL pattern, as produced by CountingSubQuery
+type countingSubquery struct {
+	index    int          // position in the enclosing group
+	graph    *patternTerm // the GRAPH the sub-query is nested in, if any
+	query    *sparqlQuery
+	target   []patternElement
+	optional *groupPattern
+	key      string // the target, graph and grouping, which merged sub-queries share
+}
+
+// asCountingSubquery determines whether the element is a counting sub-query
+func asCountingSubquery(index int, e patternElement) (c countingSubquery, ok bool) {
+	c.index = index
+	if g, isGraph := e.(*graphPattern); isGraph && len(g.group.elements) == 1 {
+		c.graph = &g.graph
+		e = g.group.elements[0]
+	} else if g, isGroup := e.(*groupPattern); isGroup && len(g.elements) == 1 {
+		e = g.elements[0] // the braces of the sub-query
+	}
+	sub, isSub := e.(*subSelectPattern)
+	if !isSub {
+		return c, false
+	}
+	q := sub.query
+	if q.form != selectForm || q.distinct || q.star || len(q.having) > 0 || len(q.orderBy) > 0 ||
+		q.limit >= 0 || q.offset > 0 || len(q.from) > 0 || len(q.named) > 0 || len(q.groupBy) == 0 {
+		return c, false
+	}
+
+	n := len(q.where.elements)
+	if n < 2 {
+		return c, false
+	}
+	opt, isOpt := q.where.elements[n-1].(*optionalPattern)
+	if !isOpt {
+		return c, false
+	}
+	for _, e := range opt.group.elements {
+		if _, isFilter := e.(*filterPattern); isFilter { // scoped differently within a UNION
+			return c, false
+		}
+	}
+	c.query, c.target, c.optional = q, q.where.elements[:n-1], opt.group
+
+	grouping := make(map[string]bool)
+	for _, p := range q.groupBy {
+		if p.expr != nil {
+			return c, false
+		}
+		grouping[p.variable] = true
+	}
+	targetVars := make(map[string]bool)
+	groupVars(group(c.target...), targetVars, true)
+	optVars := make(map[string]bool)
+	groupVars(c.optional, optVars, true)
+
+	for _, p := range q.project {
+		if p.expr == nil {
+			if !grouping[p.variable] {
+				return c, false
+			}
+			continue
+		}
+		agg, isAgg := p.expr.(*aggregateExpr)
+		if !isAgg || agg.name != "COUNT" || !agg.distinct || agg.star {
+			return c, false
+		}
+		counted, isVar := agg.expr.(varExpr)
+		if !isVar || targetVars[counted.name] || grouping[counted.name] || !optVars[counted.name] {
+			return c, false
+		}
+	}
+
+	w := newSparqlWriter(nil)
+	if c.graph != nil {
+		w.sb.WriteString("GRAPH " + w.patternTerm(*c.graph) + " ")
+	}
+	w.group(group(c.target...))
+	for _, p := range q.groupBy {
+		w.sb.WriteString(" ?" + p.variable)
+	}
+	c.key = w.sb.String()
+
+	return c, true
+}
+
+// mergeCountingSubqueries merges the counting sub-queries of the WHERE clause sharing their target
+// into a single sub-query, whose OPTIONAL pattern is the UNION of theirs. Since the values of
+// each counted variable only stem from its own branch, the counts are unchanged, while the
+// target is evaluated only once. Sub-queries counting over the same pattern share a branch.
+func mergeCountingSubqueries(q *sparqlQuery) {
+	g := q.where
+	var keys []string
+	candidates := make(map[string][]countingSubquery)
+
+	for i, e := range g.elements {
+		switch e.(type) {
+		case *bindPattern, *minusPattern: // joins cannot be moved across these
+			return
+		}
+		if c, ok := asCountingSubquery(i, e); ok {
+			if _, seen := candidates[c.key]; !seen {
+				keys = append(keys, c.key)
+			}
+			candidates[c.key] = append(candidates[c.key], c)
+		}
+	}
+
+	used := make(map[string]bool)
+	allVars(q, used)
+
+	merged := make(map[int]patternElement)
+	removed := make(map[int]bool)
+	for _, key := range keys {
+		members := candidates[key]
+		if len(members) < 2 {
+			continue
+		}
+		sub, ok := mergeCounting(members, used)
+		if !ok {
+			continue
+		}
+
+		var e patternElement = group(subquery(sub))
+		if graph := members[0].graph; graph != nil {
+			e = &graphPattern{graph: *graph, group: group(subquery(sub))}
+		}
+		merged[members[0].index] = e
+		for _, m := range members[1:] {
+			removed[m.index] = true
+		}
+	}
+
+	var out []patternElement
+	for i, e := range g.elements {
+		if removed[i] {
+			continue
+		}
+		if m, ok := merged[i]; ok {
+			e = m
+		}
+		out = append(out, e)
+	}
+	g.elements = out
+}
+
+// mergeCounting produces the merged sub-query of counting sub-queries sharing their target. The
+// variables local to the OPTIONAL patterns are renamed apart.
+func mergeCounting(members []countingSubquery, used map[string]bool) (*sparqlQuery, bool) {
+	targetVars := make(map[string]bool)
+	groupVars(group(members[0].target...), targetVars, true)
+
+	var branches []*groupPattern
+	branchOf := make(map[string]renaming) // by the pattern of the branch
+	claimed := make(map[string]bool)      // the local variables of the branches so far
+
+	out := &sparqlQuery{form: selectForm, groupBy: members[0].query.groupBy, limit: -1}
+	projected := make(map[string]bool)
+
+	for _, m := range members {
+		w := newSparqlWriter(nil)
+		w.group(m.optional)
+		r, shared := branchOf[w.sb.String()]
+		if !shared {
+			local := make(map[string]bool)
+			groupVars(m.optional, local, true)
+
+			r = make(renaming)
+			for _, v := range sortedKeys(local) {
+				if targetVars[v] {
+					continue
+				}
+				if claimed[v] {
+					r[v] = freshVar(v, used)
+				}
+				claimed[r.name(v)] = true
+			}
+			branchOf[w.sb.String()] = r
+			branches = append(branches, r.group(m.optional, used))
+		}
+
+		for _, p := range m.query.project {
+			if projected[p.variable] {
+				if p.expr != nil { // the same count cannot be projected twice
+					return nil, false
+				}
+				continue
+			}
+			projected[p.variable] = true
+			out.project = append(out.project, projection{variable: p.variable, expr: r.expr(p.expr, used)})
+		}
+	}
+
+	counted := &optionalPattern{group: branches[0]}
+	if len(branches) > 1 {
+		counted = optional(&unionPattern{branches: branches})
+	}
+	where := append(append([]patternElement{}, members[0].target...), counted)
+	out.where = group(where...)
+
+	return out, true
+}
+
+// pushTargetRestrictions moves the restrictions of the targets in the WHERE clause into the
+// counting sub-queries binding the targets. Restrictions are FILTERs and triple patterns over
+// the grouping variable of the sub-queries and constants only; the variables local to their
+// EXISTS patterns must occur nowhere else. As the WHERE clause is not evaluated in the GRAPH the
+// sub-queries may be nested in, restrictions matching triples, including those within EXISTS,
+// are only moved into sub-queries outside of a GRAPH.
+func pushTargetRestrictions(q *sparqlQuery) {
+	g := q.where
+	var subs []countingSubquery
+	isSub := make(map[int]bool)
+	focus := ""
+
+	for i, e := range g.elements {
+		switch e.(type) {
+		case *bindPattern, *minusPattern: // joins cannot be moved across these
+			return
+		}
+		c, ok := asCountingSubquery(i, e)
+		if !ok {
+			continue
+		}
+		if len(c.query.groupBy) != 1 || (focus != "" && c.query.groupBy[0].variable != focus) {
+			return
+		}
+		focus = c.query.groupBy[0].variable
+
+		certain := make(map[string]bool)
+		certainVars([]patternElement{e}, certain)
+		if !certain[focus] {
+			return
+		}
+		subs = append(subs, c)
+		isSub[i] = true
+	}
+
+	var out []patternElement
+	for i, e := range g.elements {
+		vars := make(map[string]bool)
+		matching, kept := false, false
+		switch e := e.(type) {
+		case *filterPattern:
+			exprVars(e.expr, vars)
+			forEachExistsGroup(e.expr, func(g *groupPattern) {
+				matching = true
+				forEachGroup(g, func(g *groupPattern) {
+					for _, e := range g.elements {
+						if _, ok := e.(*verbatimPattern); ok { // user SPARQL stays in place
+							kept = true
+						}
+					}
+				})
+			})
+		case *triplesBlock:
+			matching = true
+			groupVars(group(e), vars, true)
+			for v := range vars {
+				if v != focus {
+					kept = true // joining further variables, rather than restricting
+				}
+			}
+		default:
+			kept = true // not a restriction
+		}
+		if isSub[i] || kept {
+			out = append(out, e)
+			continue
+		}
+
+		rest := *q
+		rest.where = group(append(append([]patternElement{}, g.elements[:i]...), g.elements[i+1:]...)...)
+		used := make(map[string]bool)
+		allVars(&rest, used)
+		local := false
+		for v := range vars {
+			if v != focus && used[v] {
+				local = true
+			}
+		}
+		if local || !vars[focus] {
+			out = append(out, e)
+			continue
+		}
+
+		pushed := false
+		for _, c := range subs {
+			if matching && c.graph != nil {
+				continue
+			}
+			n := len(c.query.where.elements)
+			restriction := e
+			if pushed { // a copy for each sub-query
+				restriction = renaming{}.element(e, used)
+			}
+			c.query.where.elements = append(append(append([]patternElement{},
+				c.query.where.elements[:n-1]...), restriction), c.query.where.elements[n-1])
+			pushed = true
+		}
+		if !pushed {
+			out = append(out, e)
+		}
+	}
+	g.elements = out
+}
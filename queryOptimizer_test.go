@@ -0,0 +1,102 @@
+package shawell
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	rdf "github.com/cem-okulmus/rdf2go-1"
+)
+
+// TestOptimizeQuery checks that the optimized query merges the counting sub-queries sharing
+// their target, pushes the restrictions of the targets into them and drops unused OPTIONAL
+// patterns, without changing the results of the query
+func TestOptimizeQuery(t *testing.T) {
+	ep := algebraTestEndpoint(t)
+
+	query := `SELECT ?sub {
+		{ SELECT ?sub (COUNT(DISTINCT ?obj) AS ?c0) { ?sub ?p ?o OPTIONAL { ?sub <http://example.org/knows> ?obj } } GROUP BY ?sub }
+		FILTER (?c0 <= 1)
+		{ SELECT ?sub (COUNT(DISTINCT ?obj) AS ?c1) { ?sub ?p ?o OPTIONAL { ?sub <http://example.org/name> ?obj } } GROUP BY ?sub }
+		FILTER (?c1 = 0)
+		{ SELECT ?sub (COUNT(DISTINCT ?obj) AS ?c2) { ?sub ?p ?o OPTIONAL { ?sub <http://example.org/knows> ?obj } } GROUP BY ?sub }
+		FILTER (?c2 >= 1)
+		OPTIONAL { ?sub <http://example.org/knows> ?unused }
+		FILTER (isIRI(?sub))
+		FILTER EXISTS { ?sub <http://example.org/age> ?age }
+	}`
+	q, err := parseSparql(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	optimizeQuery(q)
+	optimized := q.String()
+
+	if got := strings.Count(optimized, "SELECT"); got != 2 {
+		t.Errorf("got %d SELECTs, want the sub-queries merged into one, in query\n%s", got, optimized)
+	}
+	if got := strings.Count(optimized, "knows"); got != 1 {
+		t.Errorf("got path knows %d times, want it shared and the OPTIONAL removed, in query\n%s", got, optimized)
+	}
+	if len(q.where.elements) != 4 {
+		t.Errorf("got %d patterns, want the restrictions of the targets pushed into the sub-query, in query\n%s",
+			len(q.where.elements), optimized)
+	}
+	if got, want := queryResults(t, ep, optimized), queryResults(t, ep, query); got != want || want == "" {
+		t.Errorf("got results\n%v\nwant\n%v\nfor optimized query\n%s", got, want, optimized)
+	}
+
+	// the generated queries bind the targets before the OPTIONAL patterns extending them
+	knows := SimplePath{path: res("http://example.org/knows")}
+	target := group(values("?sub", []rdf.Term{res("http://example.org/a")}))
+	generated := SparqlQuery{
+		head:       project("?sub"),
+		target:     target,
+		body:       []patternElement{optional(triple(queryVar("?sub"), knows, queryVar("?obj")))},
+		subqueries: []CountingSubQuery{{target: target, min: true, numMin: 1, path: knows}},
+	}
+	if _, ok := generated.algebra(true).where.elements[0].(*optionalPattern); ok {
+		t.Errorf("got leading OPTIONAL in generated query\n%s", generated.algebra(true))
+	}
+}
+
+// TestValidateUnoptimized checks that the optimization pass does not change the report
+func TestValidateUnoptimized(t *testing.T) {
+	shapes := `
+@prefix ex: <http://example.org/> .
+@prefix sh: <http://www.w3.org/ns/shacl#> .
+
+ex:PersonShape a sh:NodeShape ;
+	sh:targetClass ex:Person ;
+	sh:property [ sh:path ex:age ; sh:minCount 1 ; sh:maxCount 1 ] ;
+	sh:property [ sh:path ex:name ; sh:minCount 1 ] ;
+	sh:property [ sh:path ex:age ; sh:maxCount 2 ] ;
+	sh:property [ sh:path ex:knows ; sh:maxCount 1 ; sh:class ex:Person ] .
+`
+	data := `
+@prefix ex: <http://example.org/> .
+
+ex:a a ex:Person ; ex:age 3 ; ex:name "a" ; ex:knows ex:b .
+ex:b a ex:Person ; ex:knows ex:a, ex:c .
+ex:c a ex:Person ; ex:age 1, 2, 3 ; ex:name "c" .
+`
+
+	var reports []string
+	for _, unoptimized := range []bool{true, false} {
+		report := validateTurtle(t, shapes, data, Options{Unoptimized: unoptimized})
+
+		var results []string
+		for _, r := range report.Results() {
+			results = append(results, r.FocusNode().String()+" "+r.SourceConstraintComponent().String())
+		}
+		sort.Strings(results)
+		reports = append(reports, strings.Join(results, "\n"))
+	}
+
+	if reports[0] != reports[1] {
+		t.Errorf("got results\n%v\nwant\n%v", reports[1], reports[0])
+	}
+	if reports[0] == "" {
+		t.Error("got no results")
+	}
+}
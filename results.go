@@ -0,0 +1,443 @@
+package shawell
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	rdf "github.com/cem-okulmus/rdf2go-1"
+)
+
+// This file implements the parsing of SPARQL query results. The results are read as a stream
+// and added to a table row by row, so that no further copy of a large result is held in memory
+// while it is being parsed.
+
+// ResultsFormat selects the format in which a SparqlEndpoint asks for the results of queries
+type ResultsFormat string
+
+const (
+	// ResultsJSON selects the SPARQL 1.1 Query Results JSON Format, the default
+	ResultsJSON ResultsFormat = "json"
+	// ResultsXML selects the SPARQL Query Results XML Format
+	ResultsXML ResultsFormat = "xml"
+	// ResultsTSV selects the SPARQL 1.1 Query Results TSV Format
+	ResultsTSV ResultsFormat = "tsv"
+)
+
+// The SPARQL 1.1 Query Results CSV Format is not supported: it does not tell IRIs from literals
+// and loses the datatypes and languages of literals, which the constraints are checked on.
+
+// resultsMediaTypes lists the media type of each format, in the order of preference among the
+// formats not asked for
+var resultsMediaTypes = []struct {
+	format    ResultsFormat
+	mediaType string
+}{
+	{ResultsJSON, "application/sparql-results+json"},
+	{ResultsXML, "application/sparql-results+xml"},
+	{ResultsTSV, "text/tab-separated-values"},
+}
+
+// GetResultsFormat parses the name of a results format, with the empty string selecting
+// ResultsJSON
+func GetResultsFormat(name string) (ResultsFormat, error) {
+	switch f := ResultsFormat(strings.ToLower(name)); f {
+	case "":
+		return ResultsJSON, nil
+	case ResultsJSON, ResultsXML, ResultsTSV:
+		return f, nil
+	case "csv":
+		return "", &UnsupportedFeatureError{Feature: "results format csv, as it loses the types of terms"}
+	default:
+		return "", &UnsupportedFeatureError{Feature: "results format " + name}
+	}
+}
+
+// accept produces the Accept header asking for results in the format. The other formats are
+// accepted as well, though with lower preference, as the results are parsed in whichever
+// format the endpoint answers with.
+func (f ResultsFormat) accept() string {
+	if f == "" {
+		f = ResultsJSON
+	}
+
+	var preferred string
+	var others []string
+	for _, m := range resultsMediaTypes {
+		if m.format == f {
+			preferred = m.mediaType
+		} else {
+			others = append(others, m.mediaType+";q=0.9")
+		}
+	}
+
+	return strings.Join(append([]string{preferred}, others...), ", ")
+}
+
+// readResults parses the results in the format given by the content type, adding them to the
+// table. If the table already has a header, the results must have the same variables.
+func readResults(contentType string, r io.Reader, out *TableSimple[rdf.Term]) error {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "" // assume JSON, the format asked for by default
+	}
+
+	switch mediaType {
+	case "application/sparql-results+xml", "application/xml", "text/xml":
+		return readXMLResults(r, out)
+	case "text/tab-separated-values":
+		return readTSVResults(r, out)
+	case "text/csv":
+		return &UnsupportedFeatureError{Feature: "query results in the CSV format, as it loses the types of terms"}
+	default:
+		return readJSONResults(r, out)
+	}
+}
+
+// setResultHeader sets the header of the table to the variables of the results
+func setResultHeader(out *TableSimple[rdf.Term], vars []string) error {
+	if out.header == nil {
+		out.header = vars
+		return nil
+	}
+	if strings.Join(out.header, " ") != strings.Join(vars, " ") {
+		return fmt.Errorf("results with variables %v added to table with header %v", vars, out.header)
+	}
+	return nil
+}
+
+// unboundTerm fills the cells of variables left unbound in a solution. It prints as a fresh
+// blank node, as these cells always did, but is told apart from the blank nodes of the data by
+// its type, via isUnbound.
+type unboundTerm struct{ rdf.BlankNode }
+
+// unbound returns a fresh term for a variable left unbound
+func unbound() rdf.Term {
+	return unboundTerm{rdf.BlankNode{ID: fmt.Sprint("blank", getCount())}}
+}
+
+// isUnbound reports if the term stands for a variable left unbound in a solution
+func isUnbound(term rdf.Term) bool {
+	_, ok := term.(unboundTerm)
+	return ok
+}
+
+// addResultRow adds a solution to the table, with unbound variables replaced by unbound terms,
+// as done by GetTable
+func addResultRow(out *TableSimple[rdf.Term], row []rdf.Term) {
+	if len(row) == 0 {
+		return
+	}
+	for i := range row {
+		if row[i] == nil {
+			row[i] = unbound()
+		}
+	}
+	out.AddRow(row)
+}
+
+// tableTerm converts a term of a query result into the form produced by GetTable, where
+// literals without language or datatype are typed as xsd:string, and those with a language as
+// rdf:langString
+func tableTerm(t memTerm) rdf.Term {
+	if t.kind != literalKind {
+		return t.toRDF()
+	}
+
+	datatype := t.datatype
+	switch {
+	case t.lang != "":
+		datatype = _rdf + "langString"
+	case datatype == "":
+		datatype = _xsd + "string"
+	}
+	return rdf.Literal{Value: t.value, Language: t.lang, Datatype: rdf.Resource{URI: datatype}}
+}
+
+// jsonTerm is a term of SPARQL results in JSON
+type jsonTerm struct {
+	Type     string `json:"type"`
+	Value    string `json:"value"`
+	Lang     string `json:"xml:lang"`
+	Datatype string `json:"datatype"`
+}
+
+func (t jsonTerm) term() (rdf.Term, error) {
+	switch t.Type {
+	case "uri":
+		return tableTerm(iriTerm(t.Value)), nil
+	case "bnode":
+		return tableTerm(memTerm{kind: blankKind, value: t.Value}), nil
+	case "literal", "typed-literal":
+		return tableTerm(literalTerm(t.Value, t.Lang, t.Datatype)), nil
+	}
+	return nil, fmt.Errorf("unknown kind of term %q in results", t.Type)
+}
+
+// readJSONResults parses results in the SPARQL 1.1 Query Results JSON Format, reading one
+// solution at a time
+func readJSONResults(r io.Reader, out *TableSimple[rdf.Term]) error {
+	dec := json.NewDecoder(r)
+
+	if err := expectJSONDelim(dec, '{'); err != nil {
+		return err
+	}
+
+	var vars []string
+	var pending []map[string]jsonTerm // solutions read before the head, if it comes last
+	headRead := false
+
+	addRow := func(solution map[string]jsonTerm) error {
+		row := make([]rdf.Term, len(vars))
+		for i, v := range vars {
+			if b, ok := solution[v]; ok {
+				term, err := b.term()
+				if err != nil {
+					return err
+				}
+				row[i] = term
+			}
+		}
+		addResultRow(out, row)
+		return nil
+	}
+
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		switch key {
+		case "head":
+			var head struct {
+				Vars []string `json:"vars"`
+			}
+			if err = dec.Decode(&head); err != nil {
+				return err
+			}
+			vars, headRead = head.Vars, true
+			if err = setResultHeader(out, vars); err != nil {
+				return err
+			}
+			for _, solution := range pending {
+				if err = addRow(solution); err != nil {
+					return err
+				}
+			}
+			pending = nil
+		case "results":
+			if err = expectJSONDelim(dec, '{'); err != nil {
+				return err
+			}
+			for dec.More() {
+				name, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				if name != "bindings" {
+					var skip json.RawMessage
+					if err = dec.Decode(&skip); err != nil {
+						return err
+					}
+					continue
+				}
+
+				if err = expectJSONDelim(dec, '['); err != nil {
+					return err
+				}
+				for dec.More() {
+					var solution map[string]jsonTerm
+					if err = dec.Decode(&solution); err != nil {
+						return err
+					}
+					if !headRead {
+						pending = append(pending, solution)
+						continue
+					}
+					if err = addRow(solution); err != nil {
+						return err
+					}
+				}
+				if err = expectJSONDelim(dec, ']'); err != nil {
+					return err
+				}
+			}
+			if err = expectJSONDelim(dec, '}'); err != nil {
+				return err
+			}
+		default: // e.g. the result of an ASK query
+			var skip json.RawMessage
+			if err = dec.Decode(&skip); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !headRead {
+		return errors.New("results without head")
+	}
+	return expectJSONDelim(dec, '}')
+}
+
+func expectJSONDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if t != delim {
+		return fmt.Errorf("malformed results: expected %v, found %v", delim, t)
+	}
+	return nil
+}
+
+// readXMLResults parses results in the SPARQL Query Results XML Format, reading one solution
+// at a time
+func readXMLResults(r io.Reader, out *TableSimple[rdf.Term]) error {
+	dec := xml.NewDecoder(r)
+
+	var vars []string
+	index := make(map[string]int)
+	headRead := false
+	var row []rdf.Term
+	binding := -1
+
+	for {
+		token, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "variable":
+				name := xmlAttr(t, "name")
+				index[name] = len(vars)
+				vars = append(vars, name)
+			case "results":
+				headRead = true
+				if err = setResultHeader(out, vars); err != nil {
+					return err
+				}
+			case "result":
+				row = make([]rdf.Term, len(vars))
+			case "binding":
+				i, ok := index[xmlAttr(t, "name")]
+				if !ok {
+					return fmt.Errorf("malformed results: binding of unknown variable %q", xmlAttr(t, "name"))
+				}
+				binding = i
+			case "uri", "bnode", "literal":
+				var value string
+				if err = dec.DecodeElement(&value, &t); err != nil {
+					return err
+				}
+				if row == nil || binding < 0 {
+					return fmt.Errorf("malformed results: %s outside of binding", t.Name.Local)
+				}
+
+				switch t.Name.Local {
+				case "uri":
+					row[binding] = tableTerm(iriTerm(value))
+				case "bnode":
+					row[binding] = tableTerm(memTerm{kind: blankKind, value: value})
+				default:
+					row[binding] = tableTerm(literalTerm(value, xmlAttr(t, "lang"), xmlAttr(t, "datatype")))
+				}
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "binding":
+				binding = -1
+			case "result":
+				addResultRow(out, row)
+				row = nil
+			}
+		}
+	}
+
+	if !headRead {
+		return errors.New("results without head")
+	}
+	return nil
+}
+
+// xmlAttr returns the value of the attribute of the element with the given local name
+func xmlAttr(e xml.StartElement, name string) string {
+	for _, a := range e.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// readTSVResults parses results in the SPARQL 1.1 Query Results TSV Format, where terms are
+// written as in SPARQL queries
+func readTSVResults(r io.Reader, out *TableSimple[rdf.Term]) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024) // literals may be long
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		return errors.New("results without head")
+	}
+	var vars []string
+	for _, v := range strings.Split(scanner.Text(), "\t") {
+		vars = append(vars, strings.TrimPrefix(strings.TrimPrefix(v, "?"), "$"))
+	}
+	if err := setResultHeader(out, vars); err != nil {
+		return err
+	}
+
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != len(vars) {
+			return fmt.Errorf("malformed results: %d values for %d variables", len(fields), len(vars))
+		}
+
+		row := make([]rdf.Term, len(vars))
+		for i, field := range fields {
+			if field == "" {
+				continue // unbound
+			}
+			term, err := parseResultTerm(field)
+			if err != nil {
+				return err
+			}
+			row[i] = tableTerm(term)
+		}
+		addResultRow(out, row)
+	}
+
+	return scanner.Err()
+}
+
+// parseResultTerm parses a single RDF term written as in SPARQL queries
+func parseResultTerm(field string) (memTerm, error) {
+	tokens, err := lexSparql(field)
+	if err != nil {
+		return memTerm{}, &ParseError{Term: field, Err: err}
+	}
+
+	p := sparqlParser{tokens: tokens, prefixes: make(map[string]string)}
+	term, err := p.parseTerm()
+	if err == nil && p.peek().kind != tokEOF {
+		err = p.unexpected("end of term")
+	}
+	if err != nil {
+		return memTerm{}, &ParseError{Term: field, Err: err}
+	}
+	return term, nil
+}
@@ -0,0 +1,223 @@
+package shawell
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy controls how a SparqlEndpoint deals with failing queries. Only queries are
+// retried, since updates are not guaranteed to be idempotent. A query is retried if the
+// endpoint is unreachable, drops the connection or reports being overloaded (status 429, 502,
+// 503 or 504), waiting InitialBackoff before the first retry and doubling the wait for each
+// further one, up to MaxBackoff.
+type RetryPolicy struct {
+	MaxRetries     int // retries per query; no retries if zero
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// once this many attempts have failed in a row, across all queries, the endpoint is
+	// considered down, and all further queries fail with ErrCircuitOpen; disabled if zero
+	BreakerThreshold int
+
+	// once the breaker has been open this long, a single query is let through again; if it
+	// succeeds, the breaker closes, otherwise it stays open for another cooldown. If zero, the
+	// breaker stays open until the next validation run.
+	BreakerCooldown time.Duration
+}
+
+// DefaultRetryPolicy is used by endpoints produced via GetSparqlEndpoint
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries:       3,
+	InitialBackoff:   500 * time.Millisecond,
+	MaxBackoff:       30 * time.Second,
+	BreakerThreshold: 10,
+	BreakerCooldown:  30 * time.Second,
+}
+
+// QueryRetries records how often a query had to be retried
+type QueryRetries struct {
+	Query   string
+	Retries int
+	Failed  bool // whether the query failed in the end
+}
+
+// RetryReporter is implemented by endpoints retrying failed queries, listing all queries that
+// needed retries
+type RetryReporter interface {
+	Retries() []QueryRetries
+}
+
+// retryCounts lists the number of retries of each retried query, shortened to its first lines
+// after the prefixes, for the timing composition
+func retryCounts(retries []QueryRetries) (out []labelCount) {
+	total := 0
+	for _, r := range retries {
+		total += r.Retries
+	}
+	out = append(out, labelCount{count: int64(len(retries)), label: "Retried queries"},
+		labelCount{count: int64(total), label: "Retries in total"})
+
+	for _, r := range retries {
+		var lines []string
+		for _, line := range strings.Split(r.Query, "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "PREFIX") {
+				lines = append(lines, line)
+			}
+		}
+		query := strings.Join(lines, " ")
+		if len(query) > 100 {
+			query = query[:100] + " ..."
+		}
+
+		label := "Retries of"
+		if r.Failed {
+			label = "Retries (failed) of"
+		}
+		out = append(out, labelCount{count: int64(r.Retries), label: fmt.Sprint(label, " ", abbr(query))})
+	}
+
+	return out
+}
+
+// queryRetriesKey marks a context whose queries count the retries they needed
+type queryRetriesKey struct{}
+
+// addQueryRetries adds the retries of a query to the counter of the context
+func addQueryRetries(ctx context.Context, n int) {
+	if counter, ok := ctx.Value(queryRetriesKey{}).(*int64); ok {
+		atomic.AddInt64(counter, int64(n))
+	}
+}
+
+// retryState holds the circuit breaker and the retry statistics of an endpoint, shared by all
+// queries running concurrently
+type retryState struct {
+	mu       sync.Mutex
+	failures int // attempts failed in a row
+	open     bool
+	openedAt time.Time
+	probing  bool // a query was let through the open breaker, and has not completed yet
+	retries  []QueryRetries
+}
+
+// SetRetryPolicy replaces the retry policy of the endpoint, closing the circuit breaker
+func (s *SparqlEndpoint) SetRetryPolicy(policy RetryPolicy) {
+	s.retryPolicy = policy
+	s.resetRetries()
+}
+
+// resetRetries closes the circuit breaker and forgets the retried queries, as done at the start
+// of each validation run
+func (s *SparqlEndpoint) resetRetries() {
+	s.retryState.mu.Lock()
+	defer s.retryState.mu.Unlock()
+	s.retryState.failures = 0
+	s.retryState.open = false
+	s.retryState.probing = false
+	s.retryState.retries = nil
+}
+
+// Retries lists the queries sent to the endpoint since the start of the last validation run
+// that needed retries
+func (s *SparqlEndpoint) Retries() []QueryRetries {
+	s.retryState.mu.Lock()
+	defer s.retryState.mu.Unlock()
+
+	out := make([]QueryRetries, len(s.retryState.retries))
+	copy(out, s.retryState.retries)
+	return out
+}
+
+// withRetries runs the attempt until it succeeds, fails with an error not worth retrying, or
+// the retries of the policy are used up
+func (s *SparqlEndpoint) withRetries(ctx context.Context, query string, attempt func() error) (err error) {
+	state := &s.retryState
+	backoff := s.retryPolicy.InitialBackoff
+
+	for retries := 0; ; retries++ {
+		state.mu.Lock()
+		probe := false
+		if state.open {
+			cooldown := s.retryPolicy.BreakerCooldown
+			if cooldown <= 0 || state.probing || time.Since(state.openedAt) < cooldown {
+				state.mu.Unlock()
+				return ErrCircuitOpen
+			}
+			state.probing, probe = true, true // half-open: let this attempt through
+		}
+		state.mu.Unlock()
+
+		err = attempt()
+		transient := err != nil && retryable(err)
+
+		state.mu.Lock()
+		if probe {
+			state.probing = false
+		}
+		switch {
+		case !transient: // the endpoint answered, even if with an error
+			state.failures, state.open = 0, false
+		case probe:
+			state.openedAt = time.Now()
+		default:
+			state.failures++
+			if s.retryPolicy.BreakerThreshold > 0 && state.failures >= s.retryPolicy.BreakerThreshold {
+				state.open, state.openedAt = true, time.Now()
+			}
+		}
+		done := !transient || retries >= s.retryPolicy.MaxRetries || state.open
+		if done && retries > 0 {
+			state.retries = append(state.retries, QueryRetries{Query: query, Retries: retries, Failed: err != nil})
+			addQueryRetries(ctx, retries)
+		}
+		state.mu.Unlock()
+
+		if done {
+			return err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if s.retryPolicy.MaxBackoff > 0 && backoff > s.retryPolicy.MaxBackoff {
+			backoff = s.retryPolicy.MaxBackoff
+		}
+	}
+}
+
+// retryable determines whether the failure of a request may be temporary
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var status *statusError
+	if errors.As(err, &status) {
+		switch status.code {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+
+	var urlErr *url.Error
+	return errors.As(err, &urlErr) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
@@ -0,0 +1,375 @@
+package shawell
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cem-okulmus/rdf2go-1"
+)
+
+// This file implements SHACL rules (sh:rule), as defined in the SHACL Advanced Features. Rules
+// derive triples from the focus nodes of the shapes they are attached to. They are executed
+// before validation, ordered by sh:order and repeated until no new triples are inferred, with
+// the inferred triples written into a named graph of the endpoint.
+
+// Rule is either a TripleRule or a SparqlRule
+type Rule interface {
+	Order() float64
+	Infer(ctx context.Context, ep Endpoint) ([]*rdf2go.Triple, error) // the triples derived from all focus nodes
+	String() string
+}
+
+type ruleBase struct {
+	node  rdf2go.Term // the node defining the rule
+	shape *NodeShape  // the shape whose focus nodes the rule applies to
+	order float64
+	id    int64 // used to create unique references in Sparql translation
+}
+
+func (r ruleBase) Order() float64 { return r.order }
+
+// query runs the body once for each target query of the shape, with ?sub bound to its targets,
+// and returns the solutions as maps from variable names to values
+func (r ruleBase) query(ctx context.Context, ep Endpoint, head []projection, body []patternElement) (out []map[string]rdf2go.Term, err error) {
+	ctx = withQueryOrigin(ctx, QueryOrigin{Shape: r.shape.GetIRI(), Constraint: "rule"})
+	for _, target := range TargetsToQueries(r.shape.GetValidationTargets()) {
+		checkQuery := SparqlQuery{
+			head:   head,
+			target: target.pattern(),
+			body:   body,
+		}
+
+		table, err := ep.Query(ctx, checkQuery)
+		if err != nil {
+			return nil, err
+		}
+		header := table.GetHeader()
+
+		for row := range table.IterRows() {
+			bindings := make(map[string]rdf2go.Term)
+			for i, h := range header {
+				if !isUnbound(row[i]) {
+					bindings[strings.TrimPrefix(h, "?")] = row[i]
+				}
+			}
+			out = append(out, bindings)
+		}
+	}
+
+	return out, nil
+}
+
+// TripleRule derives a single triple for each combination of values of its node expressions
+type TripleRule struct {
+	ruleBase
+	subject, predicate, object []patternElement // patterns binding ?ruleSubN, ?rulePredN and ?ruleObjN
+}
+
+func (r TripleRule) vars() (string, string, string) {
+	return fmt.Sprint("?ruleSub", r.id), fmt.Sprint("?rulePred", r.id), fmt.Sprint("?ruleObj", r.id)
+}
+
+func (r TripleRule) String() string {
+	return fmt.Sprint(_sh, "rule ", r.node, " (", _sh, "TripleRule, order ", r.order, ")")
+}
+
+func (r TripleRule) Infer(ctx context.Context, ep Endpoint) (out []*rdf2go.Triple, err error) {
+	s, p, o := r.vars()
+	body := append(append(append([]patternElement{}, r.subject...), r.predicate...), r.object...)
+
+	solutions, err := r.query(ctx, ep, project(s, p, o), body)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range solutions {
+		if t := validTriple(b[s[1:]], b[p[1:]], b[o[1:]]); t != nil {
+			out = append(out, t)
+		}
+	}
+
+	return out, nil
+}
+
+// SparqlRule derives the triples of its CONSTRUCT query. The query is evaluated as a SELECT
+// query over its WHERE clause, with the template being instantiated for each solution.
+type SparqlRule struct {
+	ruleBase
+	template []triplePattern
+	where    *verbatimPattern
+}
+
+func (r SparqlRule) String() string {
+	return fmt.Sprint(_sh, "rule ", r.node, " (", _sh, "SPARQLRule, order ", r.order, ")")
+}
+
+func (r SparqlRule) Infer(ctx context.Context, ep Endpoint) (out []*rdf2go.Triple, err error) {
+	solutions, err := r.query(ctx, ep, nil, []patternElement{r.where})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range solutions {
+		// blank nodes of the template are named after the solution, so that they are the same
+		// whenever the rule is applied again
+		h := fnv.New64a()
+		var names []string
+		for name := range b {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprint(h, name, "=", b[name], ";")
+		}
+
+		instantiate := func(p patternTerm) rdf2go.Term {
+			switch {
+			case p.isVar():
+				return b[p.variable]
+			case p.term.kind == blankKind:
+				return rdf2go.NewBlankNode(fmt.Sprintf("%s_%d_%x", p.term.value, r.id, h.Sum64()))
+			}
+			return p.term.toRDF()
+		}
+
+		for _, tp := range r.template {
+			if t := validTriple(instantiate(tp.subject), instantiate(tp.predicate), instantiate(tp.object)); t != nil {
+				out = append(out, t)
+			}
+		}
+	}
+
+	return out, nil
+}
+
+// validTriple returns the triple, unless one of its terms is unbound, the subject is a literal
+// or the predicate not an IRI
+func validTriple(s, p, o rdf2go.Term) *rdf2go.Triple {
+	if s == nil || p == nil || o == nil {
+		return nil
+	}
+	switch s.(type) {
+	case rdf2go.Literal, *rdf2go.Literal:
+		return nil
+	}
+	switch p.(type) {
+	case rdf2go.Resource, *rdf2go.Resource:
+	default:
+		return nil
+	}
+
+	return rdf2go.NewTriple(s, p, o)
+}
+
+var constructQuery = regexp.MustCompile(`(?is)^\s*CONSTRUCT\s*(\{[^{}]*\})\s*(?:WHERE\s*)?(\{.*\})\s*$`)
+
+// ExtractRule parses the rule that is the object of the given sh:rule triple. Deactivated
+// rules are returned as nil.
+func ExtractRule(graph *rdf2go.Graph, triple *rdf2go.Triple, shape *NodeShape) (out Rule, err error) {
+	base := ruleBase{node: triple.Object, shape: shape, id: getCount()}
+
+	if d := graph.One(base.node, res(_sh+"deactivated"), nil); d != nil && d.Object.RawValue() == "true" {
+		return nil, nil
+	}
+	if graph.One(base.node, res(_sh+"condition"), nil) != nil {
+		return nil, &UnsupportedFeatureError{Feature: "sh:condition of rules", Term: base.node.String()}
+	}
+	if o := graph.One(base.node, res(_sh+"order"), nil); o != nil {
+		base.order, err = strconv.ParseFloat(o.Object.RawValue(), 64)
+		if err != nil {
+			return nil, &ParseError{Term: base.node.String(), Err: err}
+		}
+	}
+
+	if graph.One(base.node, res(_sh+"construct"), nil) != nil {
+		query, err := extractSparqlQuery(graph, base.node, _sh+"construct")
+		if err != nil {
+			return nil, err
+		}
+		parts := constructQuery.FindStringSubmatch(query)
+		if parts == nil {
+			return nil, &ParseError{Term: base.node.String(), Err: errors.New("sh:construct is not a CONSTRUCT query")}
+		}
+
+		_, blankShape := shape.IRI.(*rdf2go.BlankNode)
+		prebind := func(query string) string {
+			return substituteVars(query, func(name string, _ byte) (string, bool) {
+				switch {
+				case name == "this":
+					return "?sub", true
+				case name == "sub": // would clash with the variable used for focus nodes
+					return fmt.Sprint("?sub", base.id), true
+				case name == "currentShape" && !blankShape:
+					return shape.IRI.String(), true
+				}
+				return "", false
+			})
+		}
+
+		parsed, err := parseSparql("SELECT * WHERE " + prebind(parts[1]))
+		if err != nil {
+			return nil, &ParseError{Term: base.node.String(), Err: err}
+		}
+		rule := SparqlRule{ruleBase: base, where: verbatim(prebind(parts[2]))}
+		for _, e := range parsed.where.elements {
+			block, ok := e.(*triplesBlock)
+			if !ok {
+				return nil, &ParseError{Term: base.node.String(), Err: errors.New("invalid CONSTRUCT template")}
+			}
+			for _, tp := range block.triples {
+				if tp.path != nil {
+					return nil, &ParseError{Term: base.node.String(), Err: errors.New("property path in CONSTRUCT template")}
+				}
+				rule.template = append(rule.template, tp)
+			}
+		}
+
+		return rule, nil
+	}
+
+	rule := TripleRule{ruleBase: base}
+	s, p, o := rule.vars()
+	parts := []struct {
+		predicate string
+		variable  string
+		pattern   *[]patternElement
+	}{
+		{_sh + "subject", s, &rule.subject},
+		{_sh + "predicate", p, &rule.predicate},
+		{_sh + "object", o, &rule.object},
+	}
+	for _, part := range parts {
+		expr := graph.One(base.node, res(part.predicate), nil)
+		if expr == nil {
+			return nil, &ParseError{Term: base.node.String(), Err: fmt.Errorf("rule without %v", abbr(part.predicate))}
+		}
+		*part.pattern, err = nodeExpression(graph, expr.Object, part.variable)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rule, nil
+}
+
+// nodeExpression translates the node expression into a pattern binding the variable to its
+// values, for the focus node ?sub. Supported are sh:this, constant terms and path expressions
+// (sh:path, optionally starting from the values of another node expression given via sh:nodes).
+func nodeExpression(graph *rdf2go.Graph, node rdf2go.Term, variable string) ([]patternElement, error) {
+	if node.RawValue() == _sh+"this" {
+		return []patternElement{bind(exprVar("?sub"), variable)}, nil
+	}
+	if _, ok := node.(*rdf2go.BlankNode); !ok {
+		return []patternElement{bind(constOf(node), variable)}, nil
+	}
+
+	path := graph.One(node, res(_sh+"path"), nil)
+	if path == nil {
+		return nil, &UnsupportedFeatureError{Feature: "node expression", Term: node.String()}
+	}
+	propertyPath, err := ExtractPropertyPath(graph, path.Object)
+	if err != nil {
+		return nil, err
+	}
+
+	start, before := "?sub", []patternElement(nil)
+	if nodes := graph.One(node, res(_sh+"nodes"), nil); nodes != nil {
+		start = variable + "Nodes"
+		before, err = nodeExpression(graph, nodes.Object, start)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return append(before, triple(queryVar(start), propertyPath, queryVar(variable))), nil
+}
+
+// Rules returns the rules of all shapes in the document, ordered by sh:order
+func (s *ShaclDocument) Rules() (out []Rule) {
+	var names []string
+	for name := range s.shapeNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if n, ok := s.shapeNames[name].(*NodeShape); ok && n.IsActive() {
+			out = append(out, n.rules...)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Order() < out[j].Order() })
+
+	return out
+}
+
+// maxInferenceRounds bounds the rounds of executing all rules, as rules creating new nodes may
+// never reach a fixpoint
+const maxInferenceRounds = 100
+
+// Infer executes the rules of the document until no new triples are derived, adding the
+// inferred triples to the given named graph of the endpoint, which is cleared beforehand. The
+// data graph must be the default graph of the endpoint, so that validation runs over the union
+// of the data and the inferred triples. If the queries of the endpoint are restricted to a
+// dataset, the named graph is added to its default graphs for the rest of the validation run,
+// leaving the endpoint as it is. It returns the number of inferred triples, and an error if the
+// rules still infer new triples after maxInferenceRounds rounds.
+func (s *ShaclDocument) Infer(ctx context.Context, ep Endpoint, graph string) (int, error) {
+	rules := s.Rules()
+	if len(rules) == 0 {
+		return 0, nil
+	}
+	if ep.GetGraph() != "" {
+		return 0, &UnsupportedFeatureError{Feature: "rules when validating the named graph " + ep.GetGraph()}
+	}
+
+	s.run.setInferenceGraph(strings.TrimSuffix(strings.TrimPrefix(graph, "<"), ">"))
+	ctx = withRun(ctx, s.run)
+
+	err := ep.ClearGraph(ctx, graph)
+	if err != nil {
+		return 0, err
+	}
+
+	seen := make(map[string]struct{})
+	for round := 0; ; round++ {
+		if round == maxInferenceRounds {
+			return len(seen), fmt.Errorf("rules still infer new triples after %d rounds", maxInferenceRounds)
+		}
+		added := 0
+
+		for _, r := range rules {
+			triples, err := r.Infer(ctx, ep)
+			if err != nil {
+				return len(seen), err
+			}
+
+			inferred := rdf2go.NewGraph("")
+			for _, t := range triples {
+				if _, ok := seen[t.String()]; ok {
+					continue
+				}
+				seen[t.String()] = Empty
+				inferred.Add(t)
+			}
+			if inferred.Len() == 0 {
+				continue
+			}
+
+			err = ep.Add(ctx, inferred, graph)
+			if err != nil {
+				return len(seen), err
+			}
+			added += inferred.Len()
+		}
+
+		if added == 0 {
+			return len(seen), nil
+		}
+	}
+}
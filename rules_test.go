@@ -0,0 +1,196 @@
+package shawell
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	rdf "github.com/cem-okulmus/rdf2go-1"
+)
+
+const rulesTestShapes = `
+@prefix sh: <http://www.w3.org/ns/shacl#> .
+@prefix ex: <http://example.org/> .
+
+ex:AreaShape a sh:NodeShape ;
+	sh:targetClass ex:Shape ;
+	sh:rule [
+		a sh:TripleRule ;
+		sh:order 2 ;
+		sh:subject sh:this ;
+		sh:predicate ex:hasArea ;
+		sh:object [ sh:path ex:area ] ;
+	] ;
+	sh:property [ sh:path ex:hasArea ; sh:minCount 1 ; sh:maxInclusive 20 ] .
+
+ex:RectangleShape a sh:NodeShape ;
+	sh:targetClass ex:Rectangle ;
+	sh:rule [
+		a sh:SPARQLRule ;
+		sh:order 1 ;
+		sh:prefixes [ sh:declare [ sh:prefix "ex" ; sh:namespace "http://example.org/" ] ] ;
+		sh:construct """
+			CONSTRUCT { $this ex:area ?area ; a ex:Shape . }
+			WHERE { $this ex:width ?w ; ex:height ?h . BIND (?w * ?h AS ?area) }""" ;
+	] .
+`
+
+const rulesTestData = `
+@prefix ex: <http://example.org/> .
+
+ex:r1 a ex:Rectangle ; ex:width 3 ; ex:height 4 .
+ex:r2 a ex:Rectangle ; ex:width 5 ; ex:height 5 .
+ex:r3 a ex:Rectangle, ex:Shape ; ex:width 1 .
+`
+
+// TestRules checks that triple and SPARQL rules are executed in order before validation, with
+// later rules seeing the triples inferred by earlier ones
+func TestRules(t *testing.T) {
+	tests := []struct {
+		rules bool
+		want  string
+	}{
+		{false, "MinCountConstraintComponent http://example.org/r3"},
+		{true, "MaxInclusiveConstraintComponent http://example.org/r2,MinCountConstraintComponent http://example.org/r3"},
+	}
+
+	for _, tc := range tests {
+		report := validateTurtle(t, rulesTestShapes, rulesTestData, Options{Rules: tc.rules})
+
+		var got []string
+		for _, r := range report.Results() {
+			got = append(got, fmt.Sprint(localName(r.SourceConstraintComponent().RawValue()), " ",
+				r.FocusNode().RawValue()))
+		}
+		sort.Strings(got)
+
+		if strings.Join(got, ",") != tc.want {
+			t.Errorf("rules %v: got results %v, want %v", tc.rules, got, tc.want)
+		}
+	}
+}
+
+// TestRuleLimits checks that only the variables of SPARQL rules are pre-bound, that the
+// inference graph is cleared with ClearGraph, and that rules without fixpoint are stopped
+func TestRuleLimits(t *testing.T) {
+	shapes := `
+@prefix sh: <http://www.w3.org/ns/shacl#> .
+@prefix ex: <http://example.org/> .
+
+ex:S a sh:NodeShape ;
+	sh:targetClass ex:C ;
+	sh:rule [
+		a sh:SPARQLRule ;
+		sh:construct "CONSTRUCT { $this <http://example.org/p?this=1> true } WHERE { $this a ?type }" ;
+	] ;
+	sh:property [ sh:path <http://example.org/p?this=1> ; sh:minCount 1 ] .
+`
+	data := `
+@prefix ex: <http://example.org/> .
+
+ex:a a ex:C .
+`
+	parse := func(turtle string) *rdf.Graph {
+		graph := rdf.NewGraph("http://example.org/")
+		err := graph.Parse(strings.NewReader(turtle), "text/turtle")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return graph
+	}
+
+	ep, err := GetMemoryEndpoint(nil, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ep.Insert(context.Background(), parse(data), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Validate(context.Background(), parse(shapes), ep, Options{Rules: true, ClearGraph: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Conforms() {
+		t.Errorf("got %d results, want the inferred triple to satisfy the shape", len(report.Results()))
+	}
+
+	inferred, err := ep.QueryString(context.Background(),
+		"SELECT ?s WHERE { GRAPH "+DefaultInferenceGraph+" { ?s ?p ?o } }")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inferred.Len() != 0 {
+		t.Errorf("got %d inferred triples after validation, want none", inferred.Len())
+	}
+
+	endless := `
+@prefix sh: <http://www.w3.org/ns/shacl#> .
+@prefix ex: <http://example.org/> .
+
+ex:S a sh:NodeShape ;
+	sh:targetClass ex:C ;
+	sh:rule [
+		a sh:SPARQLRule ;
+		sh:construct """CONSTRUCT { ?next a <http://example.org/C> }
+			WHERE { $this a ?type . BIND (IRI(CONCAT(STR($this), "x")) AS ?next) }""" ;
+	] .
+`
+	_, err = Validate(context.Background(), parse(endless), ep, Options{Rules: true})
+	if err == nil || !strings.Contains(err.Error(), "rounds") {
+		t.Errorf("got error %v, want rules stopped after %d rounds", err, maxInferenceRounds)
+	}
+}
+
+// TestRulesDataset checks that the inferred triples are seen by validation over a dataset,
+// without changing the dataset of the endpoint
+func TestRulesDataset(t *testing.T) {
+	shapes := `
+@prefix sh: <http://www.w3.org/ns/shacl#> .
+@prefix ex: <http://example.org/> .
+
+ex:S a sh:NodeShape ;
+	sh:targetClass ex:C ;
+	sh:rule [ a sh:TripleRule ; sh:subject sh:this ; sh:predicate ex:p ; sh:object ex:o ] ;
+	sh:property [ sh:path ex:p ; sh:minCount 1 ] .
+`
+	data := `
+@prefix ex: <http://example.org/> .
+
+ex:a a ex:C .
+`
+	parse := func(turtle string) *rdf.Graph {
+		graph := rdf.NewGraph("http://example.org/")
+		err := graph.Parse(strings.NewReader(turtle), "text/turtle")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return graph
+	}
+
+	for _, rules := range []bool{false, true} {
+		ep, err := GetMemoryEndpoint(nil, "", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ep.Add(context.Background(), parse(data), "http://g1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ep.SetDataset(Dataset{Default: []string{"http://g1"}})
+
+		report, err := Validate(context.Background(), parse(shapes), ep, Options{Rules: rules})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Conforms() != rules {
+			t.Errorf("rules %v: got conforms %v, want %v", rules, report.Conforms(), rules)
+		}
+		if len(ep.dataset.Default) != 1 {
+			t.Errorf("rules %v: got dataset %v after validation, want it left as it was", rules, ep.dataset)
+		}
+	}
+}
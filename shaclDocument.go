@@ -1,10 +1,11 @@
-package main
+package shawell
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"strings"
+	"sync"
 
 	"github.com/fatih/color"
 
@@ -41,13 +42,19 @@ type ShaclDocument struct {
 	shapeNames    map[string]Shape           // used to unwind references to shapes
 	condAnswers   map[string]Table[rdf.Term] // for each NodeShape, its (un)conditional answer
 	uncondAnswers map[string]Table[rdf.Term] // caches the results from unwinding
+	undefAnswers  map[string]Table[rdf.Term] // nodes whose shape is undefined in the well-founded model
 	targets       map[string]Table[rdf.Term] // the materialised targets of a given shape
+	targetNodes   map[string]Table[rdf.Term] // the materialised nodes of each target, by its query
 	depMap        map[string][]dependency    // stores for each shape the dependant shapes
+	components    []*ConstraintComponent     // custom constraint components declared in the document
 	answered      bool
 	materialised  bool
 	validated     bool
 	debug         bool
 	fromGraph     string
+	parallel      int // the number of queries computing conditional answers concurrently
+	targetChunk   int // the number of materialised targets bound per VALUES clause
+	run           *validationRun
 }
 
 func (s ShaclDocument) String() string {
@@ -104,7 +111,7 @@ func (s ShaclDocument) String() string {
 			}
 		}
 	}
-	if s.debug || demoLP {
+	if s.debug || s.run.names.plain {
 		sb.WriteString("\nQualnames: \n")
 		for k, v := range s.shapeNames {
 			sb.WriteString(fmt.Sprint(k, " : ", v.GetQualName(), " ", v.GetLogName(), "\n"))
@@ -113,7 +120,7 @@ func (s ShaclDocument) String() string {
 
 	// fmt.Println("BEFORE ABBR", sb.String())
 
-	return abbr(sb.String())
+	return s.abbr(sb.String())
 }
 
 func GetSubjectFromTriples(triples []*rdf.Triple) (subjects []rdf.Term) {
@@ -130,6 +137,7 @@ func GetNodeTerms(graph *rdf.Graph) []rdf.Term {
 	out = append(out, GetSubjectFromTriples(graph.All(nil, res(_sh+"targetNode"), nil))...)
 	out = append(out, GetSubjectFromTriples(graph.All(nil, res(_sh+"targetObjectsOf"), nil))...)
 	out = append(out, GetSubjectFromTriples(graph.All(nil, res(_sh+"targetSubjectsOf"), nil))...)
+	out = append(out, GetSubjectFromTriples(graph.All(nil, res(_sh+"target"), nil))...)
 	out = append(out, GetSubjectFromTriples(graph.All(nil, res(_sh+"class"), nil))...)
 	out = append(out, GetSubjectFromTriples(graph.All(nil, res(_sh+"datatype"), nil))...)
 	out = append(out, GetSubjectFromTriples(graph.All(nil, res(_sh+"nodeKind"), nil))...)
@@ -158,12 +166,20 @@ func GetNodeTerms(graph *rdf.Graph) []rdf.Term {
 	out = append(out, GetSubjectFromTriples(graph.All(nil, res(_sh+"severity"), nil))...)
 	out = append(out, GetSubjectFromTriples(graph.All(nil, res(_sh+"message"), nil))...)
 	out = append(out, GetSubjectFromTriples(graph.All(nil, res(_sh+"deactivated"), nil))...)
+	out = append(out, GetSubjectFromTriples(graph.All(nil, res(_sh+"sparql"), nil))...)
+	out = append(out, GetSubjectFromTriples(graph.All(nil, res(_sh+"rule"), nil))...)
 
 	out = removeDuplicate(out)
 
-	// remove anything that has path
+	// remove anything that has path, as well as SPARQL-based constraints and components
 
 	pathStuff := GetSubjectFromTriples(graph.All(nil, res(_sh+"path"), nil))
+	pathStuff = append(pathStuff, GetSubjectFromTriples(graph.All(nil, res(_sh+"select"), nil))...)
+	pathStuff = append(pathStuff, GetSubjectFromTriples(graph.All(nil, res(_sh+"ask"), nil))...)
+	pathStuff = append(pathStuff, GetSubjectFromTriples(graph.All(nil, res(_sh+"construct"), nil))...)
+	pathStuff = append(pathStuff, GetSubjectFromTriples(graph.All(nil, res(_sh+"subject"), nil))...)
+	pathStuff = append(pathStuff, GetSubjectFromTriples(graph.All(nil, ResA, res(_sh+"ConstraintComponent")))...)
+	pathStuff = append(pathStuff, GetSubjectFromTriples(graph.All(nil, ResA, res(_sh+"SPARQLTargetType")))...)
 
 	var finalOut []rdf.Term
 
@@ -180,15 +196,23 @@ Outer:
 	return finalOut
 }
 
-func GetShaclDocument(rdfGraph *rdf.Graph, fromGraph string, ep endpoint, debug bool) (out ShaclDocument) {
+func GetShaclDocument(rdfGraph *rdf.Graph, fromGraph string, ep Endpoint, debug bool) (out ShaclDocument, err error) {
 	// var detected bool = true
 	out.shapeNames = make(map[string]Shape)
 	out.condAnswers = make(map[string]Table[rdf.Term])
 	out.uncondAnswers = make(map[string]Table[rdf.Term])
+	out.undefAnswers = make(map[string]Table[rdf.Term])
 	out.targets = make(map[string]Table[rdf.Term])
+	out.targetNodes = make(map[string]Table[rdf.Term])
 	out.depMap = make(map[string][]dependency)
 	out.materialised = false
 	out.fromGraph = fromGraph
+	out.run = newValidationRun(Options{Debug: debug}) // replaced by that of the validation run
+
+	out.components, err = ExtractConstraintComponents(rdfGraph)
+	if err != nil {
+		return out, err
+	}
 
 	for _, t := range GetNodeTerms(rdfGraph) {
 		name := t.RawValue()
@@ -199,7 +223,10 @@ func GetShaclDocument(rdfGraph *rdf.Graph, fromGraph string, ep endpoint, debug
 			continue
 		}
 
-		out.GetNodeShape(rdfGraph, t, nil)
+		_, err = out.GetNodeShape(rdfGraph, t, nil)
+		if err != nil {
+			return out, &ParseError{Term: name, Err: err}
+		}
 	}
 
 	PropertyShapeTriples := rdfGraph.All(nil, res(_sh+"path"), nil)
@@ -214,8 +241,15 @@ func GetShaclDocument(rdfGraph *rdf.Graph, fromGraph string, ep endpoint, debug
 		if ok {
 			continue
 		}
+		// parameters of constraint components are not shapes
+		if rdfGraph.One(nil, res(_sh+"parameter"), t.Subject) != nil {
+			continue
+		}
 
-		out.GetPropertyShape(rdfGraph, t.Subject)
+		_, err = out.GetPropertyShape(rdfGraph, t.Subject)
+		if err != nil {
+			return out, &ParseError{Term: name, Err: err}
+		}
 	}
 
 	// compute transitive Closure of deps
@@ -247,7 +281,7 @@ func GetShaclDocument(rdfGraph *rdf.Graph, fromGraph string, ep endpoint, debug
 		}
 	}
 
-	return out
+	return out, nil
 }
 
 // func GetTransitiveClosure(depMap map[string][]dependency) map[string][]dependency {
@@ -510,14 +544,28 @@ func remove[T stringer](s [][]T, i int) [][]T {
 	return s[:len(s)-1]
 }
 
-func (s *ShaclDocument) AllCondAnswers(ep endpoint) {
+func (s *ShaclDocument) AllCondAnswers(ctx context.Context, ep Endpoint) error {
 	if s.debug {
 		fmt.Println("Started AllCondAnswers")
 	}
 
 	// don't repeat this for the same document
 	if s.answered {
-		return
+		return nil
+	}
+
+	// the queries of the shapes bind their targets via VALUES, as do those of the report
+	if err := s.MaterialiseTargets(ctx, ep); err != nil {
+		return err
+	}
+
+	if s.parallel > 1 {
+		err := s.allCondAnswersParallel(ctx, ep)
+		if err != nil {
+			return err
+		}
+		s.answered = true
+		return nil
 	}
 
 	for k, v := range s.shapeNames {
@@ -533,9 +581,16 @@ func (s *ShaclDocument) AllCondAnswers(ep endpoint) {
 			continue
 		}
 
-		targetQueries, _ := s.GetTargetShape(k)
+		targetQueries, err := s.GetTargetShape(k)
+		if err != nil {
+			return err
+		}
 
-		out := ep.Answer(v, targetQueries)
+		ctx := withQueryOrigin(ctx, QueryOrigin{Shape: k, Constraint: "conditional answers"})
+		out, err := ep.Answer(ctx, v, targetQueries)
+		if err != nil {
+			return err
+		}
 		if s.debug {
 			fmt.Println("For shape", k, " we got the Conditional Answers ", out.Limit(10))
 		}
@@ -543,6 +598,117 @@ func (s *ShaclDocument) AllCondAnswers(ep endpoint) {
 	}
 
 	s.answered = true
+
+	return nil
+}
+
+// allCondAnswersParallel computes the conditional answers with a pool of workers, answering
+// each target of each shape separately. The answers to the targets of a shape are combined as
+// in Answer, producing the same tables as the sequential computation.
+func (s *ShaclDocument) allCondAnswersParallel(ctx context.Context, ep Endpoint) error {
+	type job struct {
+		name   string
+		shape  Shape
+		index  int // the position of the target among those of the shape
+		target SparqlQueryFlat
+	}
+
+	var jobs []job
+	answers := make(map[string][]Table[rdf.Term])
+
+	for k, v := range s.shapeNames {
+		if !v.IsActive() || len(v.GetTargets()) == 0 {
+			continue
+		}
+
+		targetQueries, err := s.GetTargetShape(k)
+		if err != nil {
+			return err
+		}
+		answers[k] = make([]Table[rdf.Term], len(targetQueries))
+		for i := range targetQueries {
+			jobs = append(jobs, job{name: k, shape: v, index: i, target: targetQueries[i]})
+		}
+	}
+
+	var mu sync.Mutex
+	err := forEachParallel(ctx, s.parallel, len(jobs), func(ctx context.Context, i int) error {
+		ctx = withQueryOrigin(ctx, QueryOrigin{Shape: jobs[i].name, Constraint: "conditional answers"})
+		out, err := ep.Answer(ctx, jobs[i].shape, []SparqlQueryFlat{jobs[i].target})
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		answers[jobs[i].name][jobs[i].index] = out
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for k, tables := range answers {
+		out := &GroupedTable[rdf.Term]{}
+		for _, t := range tables {
+			err := out.AddGroupedRows(t)
+			if err != nil {
+				return err
+			}
+		}
+		out.Regroup()
+
+		if s.debug {
+			fmt.Println("For shape", k, " we got the Conditional Answers ", out.Limit(10))
+		}
+		s.condAnswers[k] = out
+	}
+
+	return nil
+}
+
+// forEachParallel calls f for each index from 0 to n-1, running at most workers calls at the
+// same time. The first error returned by a call cancels the context of all others, and is
+// returned once they have finished.
+func forEachParallel(ctx context.Context, workers, n int, f func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+
+	for w := 0; w < workers && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				if err := f(ctx, i); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := 0; i < n; i++ {
+		select {
+		case indices <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indices)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
 }
 
 func removeDuplicateVR(sliceList []ValidationResult) []ValidationResult {
@@ -611,7 +777,7 @@ func symmetricDiff[T comparable](sliceListA, sliceListB []T) []T {
 	return list
 }
 
-func (s *ShaclDocument) GetIndirectTargets(ref ShapeRef, dep dependency, condTable Table[rdf.Term]) (bool, int, bool) {
+func (s *ShaclDocument) GetIndirectTargets(ref ShapeRef, dep dependency, condTable Table[rdf.Term]) (bool, int, bool, error) {
 	// var indirectTargets []rdf.Term
 
 	var c int // column to compare
@@ -625,7 +791,7 @@ func (s *ShaclDocument) GetIndirectTargets(ref ShapeRef, dep dependency, condTab
 			}
 		}
 		if !found {
-			log.Panic("Couldn't find dep ", dep.name, " with origin ", dep.origin, " inside ", condTable.GetHeader())
+			return false, 0, false, fmt.Errorf("couldn't find dep %v with origin %v inside %v", dep.name, dep.origin, condTable.GetHeader())
 		}
 	} else {
 		c = 0 // intrinsic checks are made against the node shape itself
@@ -653,17 +819,21 @@ func (s *ShaclDocument) GetIndirectTargets(ref ShapeRef, dep dependency, condTab
 
 	}
 
-	return existIndirectTargets, c - 1, dep.external
+	return existIndirectTargets, c - 1, dep.external, nil
 }
 
-func (s *ShaclDocument) GetAffectedIndices(ref ShapeRef, dep dependency, uncondTable Table[rdf.Term], min, max int, siblings *[]Shape) []rdf.Term {
+func (s *ShaclDocument) GetAffectedIndices(ref ShapeRef, dep dependency, uncondTable Table[rdf.Term], min, max int, siblings *[]Shape) ([]rdf.Term, error) {
 	var affectedIndices []rdf.Term
 	var depTable Table[rdf.Term]
+	var err error
 
 	if _, ok := s.uncondAnswers[ref.name]; ok {
 		depTable = s.uncondAnswers[ref.name]
 	} else {
-		depTable = s.UnwindAnswer(ref.name) // recursively compute the needed uncond. answers
+		depTable, err = s.UnwindAnswer(ref.name) // recursively compute the needed uncond. answers
+		if err != nil {
+			return nil, err
+		}
 	}
 	if s.debug {
 		fmt.Println("Depending Table\n", depTable)
@@ -671,7 +841,7 @@ func (s *ShaclDocument) GetAffectedIndices(ref ShapeRef, dep dependency, uncondT
 	// NOTE: this only works for non-recursive shapes
 	// we now know that we deal with unconditional (unary) answers
 	if len(depTable.GetHeader()) > 1 {
-		log.Panic("Received non-unary uncond. Answer! ", depTable)
+		return nil, fmt.Errorf("received non-unary uncond. answer for %v", ref.name)
 	}
 
 	var c int // column to compare
@@ -700,7 +870,8 @@ func (s *ShaclDocument) GetAffectedIndices(ref ShapeRef, dep dependency, uncondT
 			}
 		}
 		if !found {
-			log.Panic("Couldn't find dep ", dep.name, " with origin ", dep.origin, " inside ", uncondTable.GetHeader())
+			return nil, fmt.Errorf("couldn't find dep %v with origin %v inside %v", dep.name, dep.origin,
+				uncondTable.GetHeader())
 		}
 	} else {
 		c = 0 // intrinsic checks are made against the node shape itself
@@ -717,7 +888,10 @@ func (s *ShaclDocument) GetAffectedIndices(ref ShapeRef, dep dependency, uncondT
 			if _, ok := s.uncondAnswers[name]; ok {
 				sibTable = s.uncondAnswers[name]
 			} else {
-				sibTable = s.UnwindAnswer(name) // recursively compute the needed uncond. answers
+				sibTable, err = s.UnwindAnswer(name) // recursively compute the needed uncond. answers
+				if err != nil {
+					return nil, err
+				}
 			}
 
 			// fmt.Println("GEAFF: UnCondAnsers: ", sibTable)
@@ -732,7 +906,7 @@ func (s *ShaclDocument) GetAffectedIndices(ref ShapeRef, dep dependency, uncondT
 	uncondTableGrouped, ok := uncondTable.(*GroupedTable[rdf.Term])
 
 	if !ok {
-		log.Panicln("Given a non-grouped Table for affected Index Check")
+		return nil, errors.New("given a non-grouped table for affected index check")
 	}
 
 	for target := range uncondTableGrouped.IterTargets() {
@@ -768,7 +942,10 @@ func (s *ShaclDocument) GetAffectedIndices(ref ShapeRef, dep dependency, uncondT
 				if _, ok := s.uncondAnswers[ref.name]; ok {
 					tmp = s.uncondAnswers[ref.name]
 				} else {
-					tmp = s.UnwindAnswer(ref.name) // recursively compute the needed uncond. answers
+					tmp, err = s.UnwindAnswer(ref.name) // recursively compute the needed uncond. answers
+					if err != nil {
+						return nil, err
+					}
 				}
 				depTableAll = append(depTableAll, tmp)
 			}
@@ -791,7 +968,10 @@ func (s *ShaclDocument) GetAffectedIndices(ref ShapeRef, dep dependency, uncondT
 				if _, ok := s.uncondAnswers[ref.name]; ok {
 					tmp = s.uncondAnswers[ref.name]
 				} else {
-					tmp = s.UnwindAnswer(ref.name) // recursively compute the needed uncond. answers
+					tmp, err = s.UnwindAnswer(ref.name) // recursively compute the needed uncond. answers
+					if err != nil {
+						return nil, err
+					}
 				}
 				depTableAll = append(depTableAll, tmp)
 			}
@@ -826,7 +1006,7 @@ func (s *ShaclDocument) GetAffectedIndices(ref ShapeRef, dep dependency, uncondT
 
 		}
 	}
-	return affectedIndices
+	return affectedIndices, nil
 }
 
 // IsRecursive checks for each shape whether it depends (in its transitive closure) on itself
@@ -843,27 +1023,27 @@ func (s *ShaclDocument) IsRecursive() bool {
 }
 
 // NodeIsShape checks if a given node has a given shape, or not
-func (s *ShaclDocument) NodeIsShape(node rdf.Term, shape string) bool {
+func (s *ShaclDocument) NodeIsShape(node rdf.Term, shape string) (bool, error) {
 	if !s.answered {
-		log.Panicln("Called method NodeIsShape before document was answered")
+		return false, errors.New("called method NodeIsShape before document was answered")
 	}
 
 	table, found := s.uncondAnswers[shape]
 
 	if !found { // empty shape contains no nodes
-		return false
+		return false, nil
 	}
 
 	for row := range table.IterRows() {
 		if row[0].RawValue() == node.RawValue() {
-			return true
+			return true, nil
 		}
 	}
 
 	if s.debug {
 		fmt.Println("Node ", node, " is not in shape ", shape)
 	}
-	return false
+	return false, nil
 }
 
 func intersect(one []int, other []int) (out []int) {
@@ -879,9 +1059,9 @@ func intersect(one []int, other []int) (out []int) {
 }
 
 // UnwindAnswer computes the unconditional answers
-func (s *ShaclDocument) UnwindAnswer(name string) Table[rdf.Term] {
+func (s *ShaclDocument) UnwindAnswer(name string) (Table[rdf.Term], error) {
 	if !s.answered {
-		return s.uncondAnswers[name] // just return empty table if answers not computed yet
+		return s.uncondAnswers[name], nil // just return empty table if answers not computed yet
 	}
 
 	// for k, v := range s.condAnswers {
@@ -892,13 +1072,13 @@ func (s *ShaclDocument) UnwindAnswer(name string) Table[rdf.Term] {
 
 	// check if result is already cached
 	if out, ok := s.uncondAnswers[name]; ok {
-		return out
+		return out, nil
 	}
 
 	shape, ok := s.shapeNames[name]
 
 	if !ok {
-		log.Panic(name, " is not a defined node  shape")
+		return nil, errors.New(name + " is not a defined node shape")
 	}
 
 	uncondTablePreCheck, found := s.condAnswers[name]
@@ -906,13 +1086,12 @@ func (s *ShaclDocument) UnwindAnswer(name string) Table[rdf.Term] {
 	if !found {
 		return &TableSimple[rdf.Term]{
 			header: []string{name},
-		}
+		}, nil
 	}
 
 	uncondTable, ok := uncondTablePreCheck.(*GroupedTable[rdf.Term])
 	if !ok {
-		fmt.Println(uncondTablePreCheck)
-		log.Panicln("Received uncondTable that is not grouped!")
+		return nil, errors.New("received uncondTable that is not grouped for shape " + name)
 	}
 
 	if s.debug {
@@ -925,7 +1104,10 @@ func (s *ShaclDocument) UnwindAnswer(name string) Table[rdf.Term] {
 	rec, _ := s.TransitiveClosure(name)
 	// check if recursive shape
 	if rec {
-		log.Panic(name, " is a recursive SHACL node  shape, as it depends on itself.")
+		return nil, &UnsupportedFeatureError{
+			Feature: "unwinding of recursive shapes (use the logic program translation instead)",
+			Term:    name,
+		}
 	}
 
 	for _, dep := range deps {
@@ -933,7 +1115,10 @@ func (s *ShaclDocument) UnwindAnswer(name string) Table[rdf.Term] {
 		case node, property:
 
 			ref := dep.name[0] // node has only single reference (current design)
-			affectedIndices := s.GetAffectedIndices(ref, dep, uncondTable, dep.min, dep.max, nil)
+			affectedIndices, err := s.GetAffectedIndices(ref, dep, uncondTable, dep.min, dep.max, nil)
+			if err != nil {
+				return nil, err
+			}
 
 			// only keep the affected indices in and case
 			temp := GroupedTable[rdf.Term]{
@@ -948,7 +1133,10 @@ func (s *ShaclDocument) UnwindAnswer(name string) Table[rdf.Term] {
 		case and:
 			for _, ref := range dep.name {
 				// filtering out answers from uncondTable
-				affectedIndices := s.GetAffectedIndices(ref, dep, uncondTable, dep.min, dep.max, nil)
+				affectedIndices, err := s.GetAffectedIndices(ref, dep, uncondTable, dep.min, dep.max, nil)
+				if err != nil {
+					return nil, err
+				}
 
 				// only keep the affected indices in and case
 				temp := GroupedTable[rdf.Term]{
@@ -964,7 +1152,10 @@ func (s *ShaclDocument) UnwindAnswer(name string) Table[rdf.Term] {
 		case not:
 			ref := dep.name[0] // not has only single reference (current design)
 
-			affectedIndices := s.GetAffectedIndices(ref, dep, uncondTable, dep.min, dep.max, nil)
+			affectedIndices, err := s.GetAffectedIndices(ref, dep, uncondTable, dep.min, dep.max, nil)
+			if err != nil {
+				return nil, err
+			}
 
 			// using reverse sort to "safely" remove indices from slice while iterating over them
 			// sort.Sort(sort.Reverse(sort.IntSlice(affectedIndices)))
@@ -973,7 +1164,10 @@ func (s *ShaclDocument) UnwindAnswer(name string) Table[rdf.Term] {
 			}
 
 		case or:
-			allAffected := s.GetAffectedIndices(dep.name[0], dep, uncondTable, dep.min, dep.max, nil)
+			allAffected, err := s.GetAffectedIndices(dep.name[0], dep, uncondTable, dep.min, dep.max, nil)
+			if err != nil {
+				return nil, err
+			}
 
 			// wonder if this will workdepTableAll
 
@@ -988,7 +1182,10 @@ func (s *ShaclDocument) UnwindAnswer(name string) Table[rdf.Term] {
 			uncondTable = &temp
 		case xone:
 			// similar to or, but compute the symmetric difference at every step
-			allAffected := s.GetAffectedIndices(dep.name[0], dep, uncondTable, dep.min, dep.max, nil)
+			allAffected, err := s.GetAffectedIndices(dep.name[0], dep, uncondTable, dep.min, dep.max, nil)
+			if err != nil {
+				return nil, err
+			}
 
 			// only keep those that match at least one dep
 			temp := GroupedTable[rdf.Term]{
@@ -1011,9 +1208,14 @@ func (s *ShaclDocument) UnwindAnswer(name string) Table[rdf.Term] {
 			ref := dep.name[0] // qualifiedValueShape too has only single reference
 
 			siblings, err := s.DefineSiblingValues(name, ref.name)
-			check(err)
+			if err != nil {
+				return nil, err
+			}
 
-			affectedIndices := s.GetAffectedIndices(ref, dep, uncondTable, dep.min, dep.max, siblings)
+			affectedIndices, err := s.GetAffectedIndices(ref, dep, uncondTable, dep.min, dep.max, siblings)
+			if err != nil {
+				return nil, err
+			}
 
 			// only keep the affected indices in and case
 			temp := GroupedTable[rdf.Term]{
@@ -1051,80 +1253,94 @@ func (s *ShaclDocument) UnwindAnswer(name string) Table[rdf.Term] {
 		fmt.Println("Shape ", name, "\n", newTable)
 	}
 
-	return s.uncondAnswers[name]
+	return s.uncondAnswers[name], nil
 }
 
 // GetTargetShape produces the subquery needed to reduce the focus nodes to those described
 // in the target expressions, understood as the union overall target expressions.
-func (s *ShaclDocument) GetTargetShape(name string) (out []SparqlQueryFlat, empty bool) {
+func (s *ShaclDocument) GetTargetShape(name string) (out []SparqlQueryFlat, err error) {
 	ns, ok := s.shapeNames[name]
 	if !ok {
-		log.Panic(name, " is not a defined node  shape")
+		return nil, errors.New(name + " is not a defined node  shape")
 	}
 
 	targets := ns.GetTargets()
+	if s.materialised {
+		var chunked []TargetExpression
+		for i := range targets {
+			chunked = append(chunked, s.chunkedTarget(targets[i])...)
+		}
+		if len(chunked) == 0 && len(targets) > 0 {
+			chunked = append(chunked, TargetValues{}) // still producing the header of the answer
+		}
+		targets = chunked
+	}
 
 	out = TargetsToQueries(targets)
 
-	return out, false
+	return out, nil
 }
 
-func (s *ShaclDocument) GetValidTargetShape(name string) (out []SparqlQueryFlat, empty bool) {
+func (s *ShaclDocument) GetValidTargetShape(name string) (out []SparqlQueryFlat, err error) {
 	ns, ok := s.shapeNames[name]
 	if !ok {
-		log.Panic(name, " is not a defined node  shape")
+		return nil, errors.New(name + " is not a defined node  shape")
 	}
 
 	targets := ns.GetValidationTargets()
 
 	out = TargetsToQueries(targets)
 
-	return out, false
+	return out, nil
 }
 
 func TargetsToQueries(targets []TargetExpression) (out []SparqlQueryFlat) {
-	var queries []string
-
 	for i := range targets {
-		term := GetTargetTerm(targets[i])
-		queries = append(queries, term)
-	}
-
-	for i := range queries {
 		out = append(out, SparqlQueryFlat{
-			head: "?sub ?indirect0",
-			body: []string{queries[i]},
+			head: project("?sub", "?indirect0"),
+			body: targetPattern(targets[i]),
 		})
 	}
 
 	return out
 }
 
-func (s *ShaclDocument) MaterialiseTargets(ep endpoint) {
+func (s *ShaclDocument) MaterialiseTargets(ctx context.Context, ep Endpoint) error {
 	if s.materialised { // don't repeat this for same document
-		return
+		return nil
+	}
+
+	if s.targetNodes == nil {
+		s.targetNodes = make(map[string]Table[rdf.Term])
 	}
 
-	for name := range s.shapeNames {
+	for name, shape := range s.shapeNames {
 		// fmt.Println("Getting targetes for shape ", name)
 		var out Table[rdf.Term]
 
-		targetQueries, empty := s.GetValidTargetShape(name)
-		if empty || len(targetQueries) == 0 {
+		targets := shape.GetValidationTargets()
+		if len(targets) == 0 {
 			s.targets[name] = &TableSimple[rdf.Term]{}
 			continue
 		}
 
-		for i := range targetQueries {
-			targetQueries[i].graph = ep.GetGraph()
-			tmp := ep.QueryFlat(targetQueries[i])
+		ctx := withQueryOrigin(ctx, QueryOrigin{Shape: name, Constraint: "targets"})
+		for i, targetQuery := range TargetsToQueries(targets) {
+			targetQuery.graph = ep.GetGraph()
+			tmp, err := ep.QueryFlat(ctx, targetQuery)
+			if err != nil {
+				return err
+			}
+			s.targetNodes[GetTargetTerm(targets[i])] = tmp
 
 			// out.content = append(out.content, tmp.content...)
 			if out == nil {
 				out = tmp
 			} else {
-				err := out.Merge(tmp)
-				check(err)
+				err = out.Merge(tmp)
+				if err != nil {
+					return err
+				}
 			}
 		}
 
@@ -1137,21 +1353,110 @@ func (s *ShaclDocument) MaterialiseTargets(ep endpoint) {
 	}
 
 	s.materialised = true
+
+	return nil
+}
+
+// DefaultTargetChunkSize is the number of materialised targets bound per VALUES clause
+const DefaultTargetChunkSize = 500
+
+// chunkedTargets returns the validation targets of the shape for the queries producing
+// the validation report. Once materialised, the targets are bound via VALUES clauses of at most
+// the chunk size, instead of embedding their target queries. The targets given are kept if
+// chunking is disabled by a negative size, or if a target is a blank node, as those cannot be
+// bound via VALUES.
+func (s ShaclDocument) chunkedTargets(name string, targets []TargetExpression) []TargetExpression {
+	table, ok := s.targets[name]
+	if !s.materialised || !ok || s.targetChunk < 0 {
+		return targets
+	}
+
+	out, ok := s.chunkValues(table)
+	if !ok {
+		return targets
+	}
+	return out
+}
+
+// chunkedTarget binds the materialised nodes of a single target of the queries producing the
+// conditional answers via VALUES clauses, as chunkedTargets does for the report. Indirect
+// targets are chunked by the target they are reached from. The target is kept if it was not
+// materialised, or if chunking does not apply to it.
+func (s ShaclDocument) chunkedTarget(target TargetExpression) []TargetExpression {
+	if indirect, ok := target.(TargetIndirect); ok {
+		var out []TargetExpression
+		for _, actual := range s.chunkedTarget(indirect.actual) {
+			out = append(out, TargetIndirect{indirection: indirect.indirection, actual: actual, level: indirect.level})
+		}
+		return out
+	}
+
+	table, ok := s.targetNodes[GetTargetTerm(target)]
+	if !s.materialised || !ok || s.targetChunk < 0 {
+		return []TargetExpression{target}
+	}
+
+	out, ok := s.chunkValues(table)
+	if !ok {
+		return []TargetExpression{target}
+	}
+	return out
+}
+
+// chunkValues splits the distinct nodes in the first column of the table into VALUES targets of
+// at most the chunk size. It fails if one of the nodes is a blank node.
+func (s ShaclDocument) chunkValues(table Table[rdf.Term]) ([]TargetExpression, bool) {
+	size := s.targetChunk
+	if size == 0 {
+		size = DefaultTargetChunkSize
+	}
+
+	var nodes []rdf.Term
+	seen := make(map[string]struct{})
+	for row := range table.IterRows() {
+		if _, blank := row[0].(rdf.BlankNode); blank || isUnbound(row[0]) {
+			return nil, false
+		}
+		if _, ok := seen[row[0].String()]; ok {
+			continue
+		}
+		seen[row[0].String()] = Empty
+		nodes = append(nodes, row[0])
+	}
+
+	out := []TargetExpression{}
+	for len(nodes) > 0 {
+		n := size
+		if n > len(nodes) {
+			n = len(nodes)
+		}
+		out = append(out, TargetValues{nodes: nodes[:n]})
+		nodes = nodes[n:]
+	}
+
+	return out, true
 }
 
 // InvalidTargets compares the targets of a node shape against the decorated graph and
 // returns those targets that do not have this shape
-func (s *ShaclDocument) InvalidTargets(shape string, ep endpoint) Table[rdf.Term] {
+func (s *ShaclDocument) InvalidTargets(ctx context.Context, shape string, ep Endpoint) (Table[rdf.Term], error) {
 	var out TableSimple[rdf.Term]
 	if !s.answered {
-		s.AllCondAnswers(ep)
+		if err := s.AllCondAnswers(ctx, ep); err != nil {
+			return nil, err
+		}
 	}
 
 	if !s.materialised {
-		s.MaterialiseTargets(ep)
+		if err := s.MaterialiseTargets(ctx, ep); err != nil {
+			return nil, err
+		}
 	}
 
-	nodesWithShape := s.UnwindAnswer(shape)
+	nodesWithShape, err := s.UnwindAnswer(shape)
+	if err != nil {
+		return nil, err
+	}
 	// fmt.Println("All nodes with shape: ", shape)
 	// fmt.Println(nodesWithShape)
 
@@ -1170,7 +1475,7 @@ func (s *ShaclDocument) InvalidTargets(shape string, ep endpoint) Table[rdf.Term
 
 	targets, ok := s.targets[shape]
 	if !ok {
-		log.Panicln("Cannot get Targets for undefined shape", shape)
+		return nil, errors.New("cannot get targets for undefined shape " + shape)
 	}
 	// fmt.Println("Targets of shape: ", shape)
 	// fmt.Println(targets)
@@ -1189,15 +1494,17 @@ outer:
 	// fmt.Println("My invalid targets for: ", shape)
 	// fmt.Println(out)
 
-	return &out
+	return &out, nil
 }
 
 // InvalidTargets compares the targets of a node shape against the decorated graph and
 // returns those targets that do not have this shape
-func (s *ShaclDocument) InvalidTargetLP(shape string, LPTables []Table[rdf.Term], ep endpoint) Table[rdf.Term] {
+func (s *ShaclDocument) InvalidTargetLP(ctx context.Context, shape string, LPTables []Table[rdf.Term], ep Endpoint) (Table[rdf.Term], error) {
 	var out TableSimple[rdf.Term]
 	if !s.materialised {
-		s.MaterialiseTargets(ep)
+		if err := s.MaterialiseTargets(ctx, ep); err != nil {
+			return nil, err
+		}
 	}
 
 	var nodesWithShape Table[rdf.Term] = &TableSimple[rdf.Term]{}
@@ -1208,7 +1515,7 @@ func (s *ShaclDocument) InvalidTargetLP(shape string, LPTables []Table[rdf.Term]
 
 	for i := range LPTables {
 		if len(LPTables[i].GetHeader()) != 1 {
-			log.Panicln("Logic Table with more than one result returned, somehow!")
+			return nil, errors.New("logic table with more than one column returned")
 		}
 
 		header := LPTables[i].GetHeader()[0]
@@ -1244,13 +1551,13 @@ outer:
 		out.content = append(out.content, []rdf.Term{t_row[0]})
 	}
 
-	return &out
+	return &out, nil
 }
 
 // Validate checks for each of the node shapes of a SHACL document, whether their target nodes
 // occur in the decorated graph with the shapes they are supposed to. If not, it returns false
 // as well as list of tables for each node shape of the nodes that fail validation.
-func (s *ShaclDocument) Validate(ep endpoint) (bool, map[string]Table[rdf.Term]) {
+func (s *ShaclDocument) Validate(ctx context.Context, ep Endpoint) (bool, map[string]Table[rdf.Term], error) {
 	out := make(map[string]Table[rdf.Term])
 	// var outExp map[string][]string = make(map[string][]string)
 	result := true
@@ -1260,7 +1567,10 @@ func (s *ShaclDocument) Validate(ep endpoint) (bool, map[string]Table[rdf.Term])
 		if shape.IsActive() { // deactivated shapes do not factor the validation
 			iri := shape.GetIRI()
 
-			invalidTargets := s.InvalidTargets(iri, ep)
+			invalidTargets, err := s.InvalidTargets(ctx, iri, ep)
+			if err != nil {
+				return false, nil, err
+			}
 			if invalidTargets.Len() > 0 {
 				out[iri] = invalidTargets
 				// outExp[iri] = abbrAll(explanations)
@@ -1271,13 +1581,14 @@ func (s *ShaclDocument) Validate(ep endpoint) (bool, map[string]Table[rdf.Term])
 
 	s.validated = true
 
-	return result, out
+	return result, out, nil
 }
 
-// Validate checks for each of the node shapes of a SHACL document, whether their target nodes
-// occur in the decorated graph with the shapes they are supposed to. If not, it returns false
-// as well as list of tables for each node shape of the nodes that fail validation.
-func (s *ShaclDocument) ValidateLP(LPTables []Table[rdf.Term], ep endpoint) (bool, map[string]Table[rdf.Term]) {
+// ValidateLP checks for each of the node shapes of a SHACL document, whether their target nodes
+// are true for the shapes they are supposed to in the answers of the logic program. If not, it
+// returns false as well as list of tables for each node shape of the nodes that fail validation.
+// If acceptUndefined is set, targets whose shape is undefined do not count as failures.
+func (s *ShaclDocument) ValidateLP(ctx context.Context, LPTables []Table[rdf.Term], ep Endpoint, acceptUndefined bool) (bool, map[string]Table[rdf.Term], error) {
 	out := make(map[string]Table[rdf.Term])
 	// var outExp map[string][]string = make(map[string][]string)
 	result := true
@@ -1286,7 +1597,13 @@ func (s *ShaclDocument) ValidateLP(LPTables []Table[rdf.Term], ep endpoint) (boo
 	for _, shape := range s.shapeNames {
 		if shape.IsActive() { // deactivated shapes do not factor the validation
 			iri := shape.GetIRI()
-			invalidTargets := s.InvalidTargetLP(iri, LPTables, ep)
+			invalidTargets, err := s.InvalidTargetLP(ctx, iri, LPTables, ep)
+			if err != nil {
+				return false, nil, err
+			}
+			if acceptUndefined {
+				invalidTargets = withoutRows(invalidTargets, s.undefAnswers[iri])
+			}
 			if invalidTargets.Len() > 0 {
 				out[iri] = invalidTargets
 				// outExp[iri] = abbrAll(explanations)
@@ -1297,7 +1614,81 @@ func (s *ShaclDocument) ValidateLP(LPTables []Table[rdf.Term], ep endpoint) (boo
 
 	s.validated = true
 
-	return result, out
+	return result, out, nil
+}
+
+// AdoptLPUndefined takes the undefined atoms of the logic program, and records for each shape
+// the nodes for which it is undefined. Tables of auxiliary predicates are ignored.
+func (s *ShaclDocument) AdoptLPUndefined(undefTables []Table[rdf.Term]) {
+	for i := range undefTables {
+		for name, shape := range s.shapeNames {
+			if shape.GetLogName() == undefTables[i].GetHeader()[0] {
+				undefTables[i].SetHeader([]string{shape.GetIRI()})
+				s.undefAnswers[name] = undefTables[i]
+			}
+		}
+	}
+}
+
+// UndefinedTargets returns for each active shape those of its targets for which the shape is
+// undefined in the well-founded model, omitting shapes without any such targets.
+func (s *ShaclDocument) UndefinedTargets() map[string]Table[rdf.Term] {
+	out := make(map[string]Table[rdf.Term])
+
+	for name, shape := range s.shapeNames {
+		undef, ok := s.undefAnswers[name]
+		if !ok || !shape.IsActive() {
+			continue
+		}
+
+		targets, ok := s.targets[name]
+		if !ok {
+			continue
+		}
+
+		undefNodes := rawValues(undef)
+
+		tmp := &TableSimple[rdf.Term]{header: []string{"Undefined " + shape.GetIRI()}}
+		for row := range targets.IterRows() {
+			if _, ok := undefNodes[row[0].RawValue()]; ok {
+				tmp.content = append(tmp.content, []rdf.Term{row[0]})
+			}
+		}
+
+		if tmp.Len() > 0 {
+			out[name] = tmp
+		}
+	}
+
+	return out
+}
+
+// withoutRows returns the rows of the unary table whose term does not occur in other
+func withoutRows(table, other Table[rdf.Term]) Table[rdf.Term] {
+	if other == nil {
+		return table
+	}
+
+	otherNodes := rawValues(other)
+
+	out := &TableSimple[rdf.Term]{header: table.GetHeader()}
+	for row := range table.IterRows() {
+		if _, ok := otherNodes[row[0].RawValue()]; !ok {
+			out.content = append(out.content, row)
+		}
+	}
+
+	return out
+}
+
+// rawValues collects the raw values of the first column of a table
+func rawValues(table Table[rdf.Term]) map[string]struct{} {
+	out := make(map[string]struct{})
+	for row := range table.IterRows() {
+		out[row[0].RawValue()] = Empty
+	}
+
+	return out
 }
 
 // AdoptLPAnswers takes the computed answers from the logic program and replaces entries
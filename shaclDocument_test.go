@@ -0,0 +1,138 @@
+package shawell
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	rdf "github.com/cem-okulmus/rdf2go-1"
+)
+
+// reportResults returns the results of the report in a fixed order
+func reportResults(report *ValidationReport) string {
+	var out []string
+	for _, r := range report.Results() {
+		out = append(out, r.String())
+	}
+	sort.Strings(out)
+	return strings.Join(out, "\n")
+}
+
+// TestParallelCondAnswers checks that computing the conditional answers concurrently produces
+// the same reports as the sequential computation
+func TestParallelCondAnswers(t *testing.T) {
+	cases := []struct {
+		shapes, data string
+		forceLP      bool
+	}{
+		{sparqlTestShapes, sparqlTestData, false},
+		{componentTestShapes, componentTestData, false},
+		{targetTestShapes, targetTestData, false},
+		{targetTestShapes, targetTestData, true},
+	}
+
+	for i, tc := range cases {
+		want := reportResults(validateTurtle(t, tc.shapes, tc.data, Options{ForceLP: tc.forceLP}))
+		got := reportResults(validateTurtle(t, tc.shapes, tc.data, Options{ForceLP: tc.forceLP, Parallel: 8}))
+		if got != want {
+			t.Errorf("case %d: got results\n%v\nwant\n%v", i, got, want)
+		}
+	}
+}
+
+// TestTargetChunks checks that binding the materialised targets via VALUES clauses, in the
+// queries of the shapes and of the report, produces the same reports as embedding the target
+// queries
+func TestTargetChunks(t *testing.T) {
+	cases := []struct{ shapes, data string }{
+		{sparqlTestShapes, sparqlTestData},
+		{componentTestShapes, componentTestData},
+		{targetTestShapes, targetTestData},
+	}
+
+	for i, tc := range cases {
+		want := reportResults(validateTurtle(t, tc.shapes, tc.data, Options{TargetChunkSize: -1}))
+		for _, size := range []int{0, 1} {
+			got := reportResults(validateTurtle(t, tc.shapes, tc.data, Options{TargetChunkSize: size}))
+			if got != want {
+				t.Errorf("case %d, chunk size %d: got results\n%v\nwant\n%v", i, size, got, want)
+			}
+		}
+	}
+
+	doc := ShaclDocument{materialised: true, targetChunk: 2, targets: map[string]Table[rdf.Term]{
+		"s": &TableSimple[rdf.Term]{header: []string{"sub"}, content: [][]rdf.Term{
+			{res("http://example.org/a")}, {res("http://example.org/b")}, {res("http://example.org/a")},
+			{res("http://example.org/c")},
+		}},
+		"blank": &TableSimple[rdf.Term]{header: []string{"sub"}, content: [][]rdf.Term{{rdf.BlankNode{ID: "x"}}}},
+	}}
+	own := []TargetExpression{TargetClass{class: res("http://example.org/C")}}
+
+	chunks := doc.chunkedTargets("s", own)
+	if len(chunks) != 2 || GetTargetTerm(chunks[1]) != "VALUES (?sub) { (<http://example.org/c>) }" {
+		t.Errorf("got chunks %v, want two chunks of the three distinct targets", chunks)
+	}
+	if got := doc.chunkedTargets("blank", own); len(got) != 1 || got[0] != own[0] {
+		t.Errorf("got targets %v for blank node targets, want the target queries", got)
+	}
+
+	// indirect targets are chunked by the target they are reached from
+	doc.targetNodes = map[string]Table[rdf.Term]{GetTargetTerm(own[0]): doc.targets["s"]}
+	var path PropertyPath = SimplePath{path: res("http://example.org/p")}
+	indirect := TargetIndirect{indirection: &path, actual: own[0], level: 1}
+	chunks = doc.chunkedTarget(indirect)
+	want := "VALUES (?indirect1) { (<http://example.org/c>) }\n?indirect1 <http://example.org/p> ?sub ."
+	if len(chunks) != 2 || GetTargetTerm(chunks[1]) != want {
+		t.Errorf("got chunks %v, want two chunks of the three distinct indirect targets", chunks)
+	}
+	if _, err := parseSparql("SELECT ?sub { " + GetTargetTerm(TargetValues{}) + " }"); err != nil {
+		t.Errorf("targets without nodes are not valid SPARQL: %v", err)
+	}
+}
+
+// TestForEachParallel checks that the first error stops the remaining calls
+func TestForEachParallel(t *testing.T) {
+	var calls int64
+	failure := errors.New("failure")
+
+	err := forEachParallel(context.Background(), 4, 1000, func(ctx context.Context, i int) error {
+		atomic.AddInt64(&calls, 1)
+		if i == 10 {
+			return failure
+		}
+		return ctx.Err()
+	})
+	if !errors.Is(err, failure) {
+		t.Errorf("got error %v, want %v", err, failure)
+	}
+	if calls == 1000 {
+		t.Error("remaining calls were not skipped after the error")
+	}
+}
+
+// TestDocumentErrors checks that misusing a document produces errors instead of panics
+func TestDocumentErrors(t *testing.T) {
+	graph := rdf.NewGraph("http://example.org/")
+	err := graph.Parse(strings.NewReader(targetTestShapes), "text/turtle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := GetShaclDocument(graph, "", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := doc.NodeIsShape(res("http://example.org/a"), "http://example.org/S"); err == nil {
+		t.Error("got no error for a document not yet answered")
+	}
+	if _, err := doc.GetTargetShape("http://example.org/Unknown"); err == nil {
+		t.Error("got no error for an unknown shape")
+	}
+	if _, err := doc.GetValidTargetShape("http://example.org/Unknown"); err == nil {
+		t.Error("got no error for an unknown shape")
+	}
+}
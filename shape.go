@@ -1,8 +1,9 @@
-package main
+package shawell
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"strings"
 
 	"github.com/fatih/color"
@@ -53,6 +54,8 @@ type NodeShape struct {
 	propairconts []PropertyPairConstraint // propertyConstraints
 	properties   []*PropertyShape         // list of property shapes the node must satisfy
 	others       []OtherConstraint        // hasValue, in, and closed Constraints
+	sparqls      []SparqlConstraint       // SPARQL-based constraints (sh:sparql)
+	rules        []Rule                   // rules deriving triples before validation (sh:rule)
 	// LOGICAL CONSTRAINTS
 	ands            AndListConstraint     // matched node must pos. match the given lists of shapes
 	ors             []OrShapeConstraint   // matched node must conform to one of the given list of shpes
@@ -182,6 +185,19 @@ func (n *NodeShape) GetConstraints(propertyName string, path PropertyPath, obj s
 		out = append(out, tmp)
 	}
 
+	for i := range n.sparqls {
+		tmp := ConstraintInstantiation{
+			constraint: n.sparqls[i],
+			path:       path,
+			obj:        obj,
+			shapeName:  shapeName,
+			targets:    targets,
+			severity:   n.severity,
+			message:    n.message,
+		}
+		out = append(out, tmp)
+	}
+
 	// // propertyShape Constraints
 	// for i, p := range n.properties {
 	// 	propertyConst := p.GetConstraints(i)
@@ -191,25 +207,23 @@ func (n *NodeShape) GetConstraints(propertyName string, path PropertyPath, obj s
 	return out
 }
 
-func (s ShaclDocument) GetValidationReport(n *NodeShape, ep endpoint) (result bool, reports []ValidationResult) {
-	constraints := n.GetConstraints("", nil, "?sub", nil)
+func (s ShaclDocument) GetValidationReport(ctx context.Context, n *NodeShape, ep Endpoint) (result bool, reports []ValidationResult, err error) {
+	targets := s.chunkedTargets(n.GetIRI(), n.GetValidationTargets())
+	constraints := n.GetConstraints("", nil, "?sub", &targets)
 
 	if s.debug {
 		fmt.Println("NodeShape: ", n.IRI, " number of constraints ", len(constraints))
 	}
 
-	// fmt.Println("Started computing all ValidationTargets")
-
-	targets := n.GetValidationTargets()
-
-	// fmt.Println("Computed all ValidationTargets")
-
 	result = true
 
 	// fmt.Println("Started to Compute all Constraints")
 	// handle non-logical constraints
 	for i := range constraints {
-		out, report := constraints[i].SparqlCheck(ep)
+		out, report, err := constraints[i].SparqlCheck(ctx, ep)
+		if err != nil {
+			return false, nil, err
+		}
 
 		// fmt.Println("Have a constraint of type ", reflect.TypeOf(constraints[i].constraint))
 		// fmt.Println("Number of reports produced: ", len(report))
@@ -238,7 +252,10 @@ func (s ShaclDocument) GetValidationReport(n *NodeShape, ep endpoint) (result bo
 			fmt.Println("\n To Property ", n.properties[i].GetIRI())
 		}
 
-		out, report := s.GetVRProperty(n.properties[i], ep, &targets, n.GetIRI())
+		out, report, err := s.GetVRProperty(ctx, n.properties[i], ep, &targets, n.GetIRI())
+		if err != nil {
+			return false, nil, err
+		}
 		// fmt.Println("Got VRs from property, ", n.properties[i].shape.GetIRI())
 
 		if s.debug {
@@ -258,7 +275,11 @@ func (s ShaclDocument) GetValidationReport(n *NodeShape, ep endpoint) (result bo
 	// fmt.Println("Computing needed Table")
 	// TODO: get rid of this and just use condTable, plus searching for the right attribute
 	targetQueries := TargetsToQueries(targets)
-	neededTable := GetTableForLogicalConstraints(ep, nil, "", targetQueries)
+	ctx = withQueryOrigin(ctx, QueryOrigin{Shape: n.GetIRI(), Constraint: "logical constraints"})
+	neededTable, err := GetTableForLogicalConstraints(ctx, ep, nil, "", targetQueries)
+	if err != nil {
+		return false, nil, err
+	}
 
 	// fmt.Println("Done Computing needed Table")
 
@@ -280,7 +301,11 @@ and:
 			if s.debug {
 				fmt.Println("Cheking if target is of shape ", n.ands.shapes[k].name)
 			}
-			if !s.NodeIsShape(targetNode, n.ands.shapes[k].name) {
+			isShape, err := s.NodeIsShape(targetNode, n.ands.shapes[k].name)
+			if err != nil {
+				return false, nil, err
+			}
+			if !isShape {
 				report := ValidationResult{
 					focusNode:                 targetNode,
 					pathName:                  nil,
@@ -313,7 +338,11 @@ or:
 
 			for j := range currOr.shapes {
 				// fmt.Println("Cheking if target is of shape ", currOr.shapes[j].name)
-				if s.NodeIsShape(targetNode, currOr.shapes[j].name) {
+				isShape, err := s.NodeIsShape(targetNode, currOr.shapes[j].name)
+				if err != nil {
+					return false, nil, err
+				}
+				if isShape {
 					satisfyAtLeastOne = true
 					break // skip early if one is already satisfied
 					// fmt.Println("TargetNode ", targetNode, " has shape ", currOr.shapes[j].name)
@@ -346,7 +375,11 @@ not:
 	for row := range neededTable.IterRows() {
 		targetNode := row[0]
 		for k := range n.nots {
-			if s.NodeIsShape(targetNode, n.nots[k].shape.name) {
+			isShape, err := s.NodeIsShape(targetNode, n.nots[k].shape.name)
+			if err != nil {
+				return false, nil, err
+			}
+			if isShape {
 				report := ValidationResult{
 					focusNode:                 targetNode,
 					pathName:                  nil,
@@ -377,7 +410,11 @@ xone:
 			numSatisfied := 0
 
 			for j := range currXone.shapes {
-				if s.NodeIsShape(targetNode, currXone.shapes[j].name) {
+				isShape, err := s.NodeIsShape(targetNode, currXone.shapes[j].name)
+				if err != nil {
+					return false, nil, err
+				}
+				if isShape {
 					numSatisfied++
 				}
 
@@ -412,7 +449,11 @@ node:
 	for row := range neededTable.IterRows() {
 		targetNode := row[0]
 		for k := range n.nodes {
-			if !s.NodeIsShape(targetNode, n.nodes[k].name) {
+			isShape, err := s.NodeIsShape(targetNode, n.nodes[k].name)
+			if err != nil {
+				return false, nil, err
+			}
+			if !isShape {
 
 				report := ValidationResult{
 					focusNode:                 targetNode,
@@ -431,7 +472,7 @@ node:
 		}
 	}
 
-	return result, reports
+	return result, reports, nil
 }
 
 func (n *NodeShape) GetValidationTargets() []TargetExpression {
@@ -517,6 +558,8 @@ func (n *NodeShape) StringTab(a int, insideProperty bool, debug bool) string {
 				sb.WriteString("(TargetClass) ")
 			case TargetNode:
 				sb.WriteString("(TargetNode) ")
+			case TargetSparql:
+				sb.WriteString("(TargetSparql) ")
 			case TargetIndirect:
 				if !debug {
 					continue
@@ -601,6 +644,12 @@ func (n *NodeShape) StringTab(a int, insideProperty bool, debug bool) string {
 	for i := range n.others {
 		sb.WriteString(n.others[i].String() + tab)
 	}
+	for i := range n.sparqls {
+		sb.WriteString(n.sparqls[i].String() + tab)
+	}
+	for i := range n.rules {
+		sb.WriteString(n.rules[i].String() + tab)
+	}
 
 	// and the rest ...
 
@@ -659,15 +708,14 @@ func (p *PropertyShape) GetConstraints(num int, targetsFromParent *[]TargetExpre
 
 // var someCount int = 1
 
-func (s ShaclDocument) GetVRProperty(p *PropertyShape, ep endpoint, targetsFromParent *[]TargetExpression, parent string) (result bool, reports []ValidationResult) {
-	constraints := p.GetConstraints(0, targetsFromParent)
-
+func (s ShaclDocument) GetVRProperty(ctx context.Context, p *PropertyShape, ep Endpoint, targetsFromParent *[]TargetExpression, parent string) (result bool, reports []ValidationResult, err error) {
 	var targets []TargetExpression
 	if targetsFromParent != nil {
 		targets = *targetsFromParent
 	} else {
-		targets = p.GetValidationTargets()
+		targets = s.chunkedTargets(p.GetIRI(), p.GetValidationTargets())
 	}
+	constraints := p.GetConstraints(0, &targets)
 	// fmt.Println("Started computing all ValidationTargets")
 
 	// fmt.Println("Computed all ValidationTargets")
@@ -723,7 +771,10 @@ func (s ShaclDocument) GetVRProperty(p *PropertyShape, ep endpoint, targetsFromP
 	// handle non-logical constraints
 	for i := range constraints {
 
-		out, report := constraints[i].SparqlCheck(ep)
+		out, report, err := constraints[i].SparqlCheck(ctx, ep)
+		if err != nil {
+			return false, nil, err
+		}
 		// for k := range report {
 		// 	fmt.Println("IN VR Report Property, ", report[k].sourceShape)
 		// 	fmt.Println("Strigner: ", report[k])
@@ -769,7 +820,10 @@ func (s ShaclDocument) GetVRProperty(p *PropertyShape, ep endpoint, targetsFromP
 		if s.debug {
 			fmt.Println("\n To Property ", p.shape.properties[i].GetIRI())
 		}
-		out, report := s.GetVRProperty(p.shape.properties[i], ep, &newTargets, p.GetIRI())
+		out, report, err := s.GetVRProperty(ctx, p.shape.properties[i], ep, &newTargets, p.GetIRI())
+		if err != nil {
+			return false, nil, err
+		}
 
 		// fmt.Println("Got VRs from property, ", p.shape.properties[i].shape.GetIRI())
 
@@ -788,11 +842,15 @@ func (s ShaclDocument) GetVRProperty(p *PropertyShape, ep endpoint, targetsFromP
 	// fmt.Println("Computing needed Table")
 
 	targetQueries := TargetsToQueries(targets)
-	neededTableBeforeCheck := GetTableForLogicalConstraints(ep, p.path, p.GetQualName(), targetQueries)
+	ctx = withQueryOrigin(ctx, QueryOrigin{Shape: p.GetIRI(), Constraint: "logical constraints"})
+	neededTableBeforeCheck, err := GetTableForLogicalConstraints(ctx, ep, p.path, p.GetQualName(), targetQueries)
+	if err != nil {
+		return false, nil, err
+	}
 
 	neededTable, ok := neededTableBeforeCheck.(*GroupedTable[rdf2go.Term])
 	if !ok {
-		log.Panicln("Received non-grouped table from GetTableForLogicalConstraints")
+		return false, nil, errors.New("received non-grouped table from GetTableForLogicalConstraints")
 	}
 
 	if s.debug {
@@ -815,7 +873,11 @@ func (s ShaclDocument) GetVRProperty(p *PropertyShape, ep endpoint, targetsFromP
 				if s.debug {
 					fmt.Println("For the value ", v, " checking if it is shape ", p.shape.ands.shapes[k].ref.GetQualName())
 				}
-				if !s.NodeIsShape(v, p.shape.ands.shapes[k].name) {
+				isShape, err := s.NodeIsShape(v, p.shape.ands.shapes[k].name)
+				if err != nil {
+					return false, nil, err
+				}
+				if !isShape {
 					report := ValidationResult{
 						focusNode:                 target,
 						pathName:                  p.path,
@@ -858,7 +920,11 @@ func (s ShaclDocument) GetVRProperty(p *PropertyShape, ep endpoint, targetsFromP
 					if s.debug {
 						fmt.Println("Cheking if,", v, " , is of shape ", currOr.shapes[j].name)
 					}
-					if s.NodeIsShape(v, currOr.shapes[j].name) {
+					isShape, err := s.NodeIsShape(v, currOr.shapes[j].name)
+					if err != nil {
+						return false, nil, err
+					}
+					if isShape {
 						satisfyAtLeastOne = true
 					}
 				}
@@ -890,7 +956,11 @@ func (s ShaclDocument) GetVRProperty(p *PropertyShape, ep endpoint, targetsFromP
 			values := neededTable.GetGroupOfTarget(target, 1)
 
 			for _, v := range values {
-				if s.NodeIsShape(v, p.shape.nots[k].shape.name) {
+				isShape, err := s.NodeIsShape(v, p.shape.nots[k].shape.name)
+				if err != nil {
+					return false, nil, err
+				}
+				if isShape {
 					report := ValidationResult{
 						focusNode:                 target,
 						pathName:                  p.path,
@@ -922,7 +992,11 @@ func (s ShaclDocument) GetVRProperty(p *PropertyShape, ep endpoint, targetsFromP
 
 				numSatisfied := 0
 				for j := range currXone.shapes {
-					if s.NodeIsShape(v, currXone.shapes[j].name) {
+					isShape, err := s.NodeIsShape(v, currXone.shapes[j].name)
+					if err != nil {
+						return false, nil, err
+					}
+					if isShape {
 						numSatisfied++
 					}
 
@@ -959,7 +1033,11 @@ func (s ShaclDocument) GetVRProperty(p *PropertyShape, ep endpoint, targetsFromP
 
 			// fmt.Println("In ", p.GetLogName(), "Lengh of vlues", len(values), "targert", target, "at shape", p.shape.nodes[k].name, " some", someCount)
 			for _, v := range values {
-				if !s.NodeIsShape(v, p.shape.nodes[k].name) {
+				isShape, err := s.NodeIsShape(v, p.shape.nodes[k].name)
+				if err != nil {
+					return false, nil, err
+				}
+				if !isShape {
 					report := ValidationResult{
 						focusNode:                 target,
 						pathName:                  p.path,
@@ -991,7 +1069,9 @@ func (s ShaclDocument) GetVRProperty(p *PropertyShape, ep endpoint, targetsFromP
 
 			if parent != "" {
 				siblings, err := s.DefineSiblingValues(parent, currQS.shape.name)
-				check(err)
+				if err != nil {
+					return false, nil, err
+				}
 				if siblings != nil {
 					for _, s := range *siblings {
 						siblingsNames = append(siblingsNames, s.GetIRI())
@@ -1000,7 +1080,9 @@ func (s ShaclDocument) GetVRProperty(p *PropertyShape, ep endpoint, targetsFromP
 
 			} else {
 				siblings, err := s.DefineSiblingValues(p.GetIRI(), currQS.shape.name)
-				check(err)
+				if err != nil {
+					return false, nil, err
+				}
 				if siblings != nil {
 					for _, s := range *siblings {
 						siblingsNames = append(siblingsNames, s.GetIRI())
@@ -1010,10 +1092,18 @@ func (s ShaclDocument) GetVRProperty(p *PropertyShape, ep endpoint, targetsFromP
 
 		outer:
 			for _, v := range values {
-				if s.NodeIsShape(v, currQS.shape.name) {
+				isShape, err := s.NodeIsShape(v, currQS.shape.name)
+				if err != nil {
+					return false, nil, err
+				}
+				if isShape {
 					if currQS.disjoint { // for disjoint QSConstraints, first check if not a sibling value
 						for _, sib := range siblingsNames {
-							if s.NodeIsShape(v, sib) {
+							isShape, err := s.NodeIsShape(v, sib)
+							if err != nil {
+								return false, nil, err
+							}
+							if isShape {
 								continue outer // don't count any value that satisfies
 							}
 						}
@@ -1054,7 +1144,7 @@ func (s ShaclDocument) GetVRProperty(p *PropertyShape, ep endpoint, targetsFromP
 		}
 	}
 
-	return result, reports
+	return result, reports, nil
 }
 
 func (p *PropertyShape) GetTargets() []TargetExpression { return p.shape.GetTargets() }
@@ -2,19 +2,20 @@
 // A research prototype for validating SHACL documents under well-founded
 // semantics.
 
-package main
+package shawell
 
 import (
 	"bufio"
-	"flag"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	"net/url"
 	"os"
-	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"text/tabwriter"
 	"time"
 
@@ -26,8 +27,7 @@ import (
 var theCount int64 // lord of all things counting
 
 func getCount() int64 {
-	theCount++
-	return theCount
+	return atomic.AddInt64(&theCount, 1)
 }
 
 func check(e error) {
@@ -40,7 +40,62 @@ func res(s string) rdf.Term {
 	return rdf.NewResource(s)
 }
 
-var prefixes map[string]string = make(map[string]string)
+// prefixMap maps prefixes (including the trailing colon) to their namespaces. It is safe for
+// concurrent use, as queries attaching the prefixes may be produced by several workers.
+type prefixMap struct {
+	mu sync.RWMutex
+	m  map[string]string
+}
+
+func (p *prefixMap) get(prefix string) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.m[prefix]
+}
+
+func (p *prefixMap) set(prefix, namespace string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.m[prefix] = namespace
+}
+
+// all returns a copy of the map, to be iterated over
+func (p *prefixMap) all() map[string]string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	out := make(map[string]string, len(p.m))
+	for k, v := range p.m {
+		out[k] = v
+	}
+	return out
+}
+
+// declarations returns the PREFIX declarations of a query, in a fixed order so that the same
+// query always produces the same text
+func (p *prefixMap) declarations() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var keys []string
+	for k := range p.m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for _, k := range keys {
+		sb.WriteString("PREFIX " + k + " <" + p.m[k] + ">\n")
+	}
+	return sb.String()
+}
+
+func (p *prefixMap) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.m = make(map[string]string)
+}
+
+var prefixes = &prefixMap{m: make(map[string]string)}
 
 // making it easier to define proper terms
 var (
@@ -48,19 +103,31 @@ var (
 	_rdf  = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
 	_rdfs = "http://www.w3.org/2000/01/rdf-schema#"
 	_xsd  = "http://www.w3.org/2001/XMLSchema#"
+
+	// vocabulary of shaWell, for results not covered by SHACL itself
+	_shawell = "https://github.com/cem-okulmus/shawell#"
 )
 
-func GetNameSpace(file *os.File) {
+// fix standard prefixes
+func setStandardPrefixes() {
+	prefixes.set("sh:", _sh)
+	prefixes.set("rdf:", _rdf)
+	prefixes.set("rdfs:", _rdfs)
+	prefixes.set("shawell:", _shawell)
+}
+
+// GetNameSpace reads the prefix declarations of a Turtle file, to be used for abbreviating
+// the output of the validator.
+func GetNameSpace(file *os.File) error {
 	// TODO: make this less crazy and ugly
 
-	// fix standard prefixes
-	prefixes["sh:"] = _sh
-	prefixes["rdf:"] = _rdf
-	prefixes["rdfs:"] = _rdfs
+	setStandardPrefixes()
 
 	// call the Seek method first
 	_, err := file.Seek(0, io.SeekStart)
-	check(err)
+	if err != nil {
+		return err
+	}
 
 	scanner := bufio.NewScanner(file)
 	validID := regexp.MustCompile(`<.*?>`)
@@ -81,18 +148,20 @@ func GetNameSpace(file *os.File) {
 			}
 			abbrOut = abbr[:getStart+1]
 			fullPath := validID.FindString(line)
-			_, ok := prefixes[abbrOut]
-			if !ok {
-				prefixes[abbrOut] = fullPath[1 : len(fullPath)-1]
+			if fullPath == "" {
+				return &ParseError{Term: line, Err: errors.New("prefix declaration without IRI")}
+			}
+			if prefixes.get(abbrOut) == "" {
+				prefixes.set(abbrOut, fullPath[1:len(fullPath)-1])
 			}
 		}
 	}
-}
 
-var activeDoc *ShaclDocument
+	return scanner.Err()
+}
 
 func abbr(in string) string {
-	for k, v := range prefixes {
+	for k, v := range prefixes.all() {
 
 		in = strings.ReplaceAll(in, " <> ", "👨‍🍳️")
 		in = strings.ReplaceAll(in, " > ", "🐭️")
@@ -110,17 +179,22 @@ func abbr(in string) string {
 		in = strings.ReplaceAll(in, v, k)
 	}
 
-	if activeDoc != nil {
-		for name, shape := range activeDoc.shapeNames {
-			in = strings.ReplaceAll(in, shape.GetQualName(), name)
-		}
+	return in
+}
+
+// abbr abbreviates the prefixes as abbr does, and further replaces the qualified names of the
+// shapes of the document by the names of the shapes
+func (s ShaclDocument) abbr(in string) string {
+	in = abbr(in)
+	for name, shape := range s.shapeNames {
+		in = strings.ReplaceAll(in, shape.GetQualName(), name)
 	}
 
 	return in
 }
 
 func removeAbbr(in string) string {
-	for _, v := range prefixes {
+	for _, v := range prefixes.all() {
 		in = strings.ReplaceAll(in, v, "")
 	}
 	return in
@@ -129,7 +203,7 @@ func removeAbbr(in string) string {
 func addAbbr() string {
 	var sb strings.Builder
 
-	for k, v := range prefixes {
+	for k, v := range prefixes.all() {
 		sb.WriteString(fmt.Sprint("@prefix ", k, " <", v, "> .\n"))
 	}
 	sb.WriteString("\n")
@@ -159,7 +233,8 @@ func removeAbbrAll(in []string) []string {
 var ResA = res(_rdf + "type")
 
 type timeComposer struct {
-	times []labelTime
+	times  []labelTime
+	counts []labelCount
 }
 
 func (t timeComposer) String() string {
@@ -169,6 +244,9 @@ func (t timeComposer) String() string {
 	for _, time := range t.times {
 		fmt.Fprint(w, time.String(), "\n")
 	}
+	for _, count := range t.counts {
+		fmt.Fprint(w, count.String(), "\n")
+	}
 	err := w.Flush()
 	check(err)
 	return sb.String()
@@ -183,6 +261,15 @@ func (l labelTime) String() string {
 	return fmt.Sprintf("%s \t: %.5f ms", l.label, l.time)
 }
 
+type labelCount struct {
+	count int64
+	label string
+}
+
+func (l labelCount) String() string {
+	return fmt.Sprintf("%s \t: %d", l.label, l.count)
+}
+
 // Done:
 //  *  get a better understanding of SHACL documents
 //      - how to read complex property elements
@@ -237,159 +324,407 @@ func (l labelTime) String() string {
 //   - result message
 //   - the various properties (value, source, path, focus, constraint)
 
-var QueryStore []string
+// Options collects the settings of a single validation run started via Validate.
+type Options struct {
+	Output       io.Writer // progress, results and timings are written here; nil means silent
+	ReportOutput io.Writer // if set, the validation report is written here in Turtle notation
+	Debug        bool      // activates debugging output, including blank shapes
+	OmitReport   bool      // skip the production of the validation report
+	ForceLP      bool      // force the translation into logic programs, even if not recursive
+	OnlyLP       bool      // only output the produced logic program, skipping validation
+	OnlyQueries  bool      // only output the produced SPARQL queries, skipping validation
+	ClearGraph   bool      // clear the named graph of the endpoint and the inference graph after validation
+	DLV          string    // location of a DLV binary; if empty, the built-in solver is used
+
+	// targets whose shape is undefined under well-founded semantics do not count as failures
+	AcceptUndefined bool
+
+	// the semantics used to evaluate recursive documents; WellFounded if left empty
+	Semantics Semantics
+
+	// execute the rules of the document before validation, adding the inferred triples to
+	// InferenceGraph, or to DefaultInferenceGraph if left empty. The inferred triples stay in
+	// the endpoint after validation, unless ClearGraph is set.
+	Rules          bool
+	InferenceGraph string
+
+	// the whole validation run is cancelled once Timeout has passed, unless it is zero; a limit
+	// for single queries is set on the endpoint instead
+	Timeout time.Duration
+
+	// the number of queries computing conditional answers that are sent to the endpoint
+	// concurrently, one for each shape and target; values below 2 keep the computation sequential
+	Parallel int
+
+	// send the generated queries without the optimization pass, which does not change their
+	// results
+	Unoptimized bool
+
+	// the queries of the shapes and those producing the validation report bind the
+	// materialised targets via VALUES clauses of at most this many targets, instead of
+	// embedding the target queries; DefaultTargetChunkSize if zero, and the target queries are
+	// embedded if negative
+	TargetChunkSize int
+
+	// the store validated against, whose problematic constructs the generated queries avoid;
+	// Generic if left empty
+	Dialect Dialect
+
+	// if positive, the closures p* and p+ of property paths are unrolled into this many steps,
+	// for stores evaluating them too slowly. Values reachable only via longer paths are missed,
+	// which can hide violations, so a warning is written to Output if any closure was unrolled.
+	ClosureDepth int
+}
+
+// DefaultInferenceGraph is the named graph receiving the triples inferred by rules
+const DefaultInferenceGraph = "<https://github.com/cem-okulmus/shawell#inferred>"
+
+// Validate parses the given shapes graph into a SHACL document and validates the data graph
+// of the endpoint against it. It returns the produced validation report, which is nil if no
+// report was requested via the options. Failures of the endpoint, of DLV or in parsing the
+// shapes graph are returned as EndpointError, DLVError and ParseError respectively. Once the
+// context is cancelled, or the timeout of the options has passed, all pending queries are
+// aborted and the error of the context is returned (possibly wrapped in an EndpointError).
+func Validate(ctx context.Context, shapesGraph *rdf.Graph, ep Endpoint, opts Options) (*ValidationReport, error) {
+	if shapesGraph == nil {
+		return nil, errors.New("no shapes graph provided")
+	}
+	if ep == nil {
+		return nil, errors.New("no endpoint provided")
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	run := newValidationRun(opts)
+	ctx = withRun(ctx, run)
+	if s, ok := innerEndpoint(ep).(*SparqlEndpoint); ok {
+		s.resetRetries() // a breaker opened in an earlier run does not fail this one
+	}
+
+	// fix standard prefixes, in case they were not read from a file before
+	setStandardPrefixes()
+
+	parsedDoc, err := GetShaclDocument(shapesGraph, ep.GetGraph(), ep, opts.Debug)
+	if err != nil {
+		return nil, err
+	}
+	parsedDoc.debug = opts.Debug
+	parsedDoc.run = run
+
+	if opts.Output != nil {
+		var addedText string
+		if !opts.Debug {
+			it := color.New(color.Italic)
+			addedText = it.Sprint("(use -debug to also show blank Shapes)")
+		}
+		fmt.Fprintln(opts.Output, "The parsed SHACL Document:", addedText, parsedDoc.String())
+	}
+
+	inferenceGraph := opts.InferenceGraph
+	if inferenceGraph == "" {
+		inferenceGraph = DefaultInferenceGraph
+	}
+	if opts.Rules {
+		inferred, err := parsedDoc.Infer(ctx, ep, inferenceGraph)
+		if err != nil {
+			return nil, err
+		}
+		if opts.Output != nil {
+			fmt.Fprintln(opts.Output, "Inferred", inferred, "triples from rules into", inferenceGraph)
+		}
+	}
+
+	report, err := answerShacl(ctx, ep, parsedDoc, opts)
+	if opts.Rules && opts.ClearGraph {
+		if err2 := ep.ClearGraph(ctx, inferenceGraph); err == nil {
+			err = err2
+		}
+	}
+	if n := run.unrolledClosures(); n > 0 && opts.Output != nil {
+		fmt.Fprintln(opts.Output, "Warning: unrolled", n, "closures of property paths to", opts.ClosureDepth,
+			"steps, so violations only reachable via longer paths are missed")
+	}
+	return report, err
+}
+
+// markUndefined replaces the results produced for targets whose shape is undefined under
+// well-founded semantics with a single result per such target, of severity shawell:Undefined.
+// The other results for these targets are dropped, as they rely on the undefined shapes being
+// false, when in fact they are neither true nor false.
+func markUndefined(doc ShaclDocument, reports []ValidationResult, undefinedTargets map[string]Table[rdf.Term]) (out []ValidationResult) {
+	undefNodes := make(map[string]map[string]struct{})
+	for name, table := range undefinedTargets {
+		undefNodes[name] = rawValues(table)
+	}
+
+	for i := range reports {
+		if reports[i].sourceShape != nil && reports[i].focusNode != nil {
+			if _, ok := undefNodes[reports[i].sourceShape.RawValue()][reports[i].focusNode.RawValue()]; ok {
+				continue
+			}
+		}
+		out = append(out, reports[i])
+	}
+
+	for name, table := range undefinedTargets {
+		var shapeIRI rdf.Term
+		switch shape := doc.shapeNames[name].(type) {
+		case *NodeShape:
+			shapeIRI = shape.IRI
+		case *PropertyShape:
+			shapeIRI = shape.shape.IRI
+		}
+
+		for row := range table.IterRows() {
+			out = append(out, ValidationResult{
+				focusNode:                 row[0],
+				sourceShape:               shapeIRI,
+				sourceConstraintComponent: res(_shawell + "UndefinedConstraintComponent"),
+				severity:                  res(_shawell + "Undefined"),
+			})
+		}
+	}
+
+	return out
+}
+
+// reconcileReports aligns the results of the report with the valid and invalid targets of a
+// semantics other than the well-founded one. Since their answers are combined from several
+// models, results computed from them are dropped for valid targets, and invalid targets left
+// without any result receive one stating the semantics.
+func reconcileReports(doc ShaclDocument, reports []ValidationResult, invalidTargets map[string]Table[rdf.Term], semantics Semantics) (out []ValidationResult) {
+	invalidNodes := make(map[string]map[string]struct{})
+	for name, table := range invalidTargets {
+		invalidNodes[name] = rawValues(table)
+	}
+
+	targetNodes := make(map[string]map[string]struct{})
+	for name, table := range doc.targets {
+		targetNodes[name] = rawValues(table)
+	}
+
+	reported := make(map[string]map[string]struct{})
+	for i := range reports {
+		if reports[i].sourceShape == nil || reports[i].focusNode == nil {
+			out = append(out, reports[i])
+			continue
+		}
+
+		shape, focus := reports[i].sourceShape.RawValue(), reports[i].focusNode.RawValue()
+		if _, target := targetNodes[shape][focus]; target {
+			if _, invalid := invalidNodes[shape][focus]; !invalid {
+				continue
+			}
+		}
+
+		if _, ok := reported[shape]; !ok {
+			reported[shape] = make(map[string]struct{})
+		}
+		reported[shape][focus] = Empty
+		out = append(out, reports[i])
+	}
+
+	for name, table := range invalidTargets {
+		var shapeIRI rdf.Term
+		switch shape := doc.shapeNames[name].(type) {
+		case *NodeShape:
+			shapeIRI = shape.IRI
+		case *PropertyShape:
+			shapeIRI = shape.shape.IRI
+		}
+
+		for row := range table.IterRows() {
+			if _, ok := reported[name][row[0].RawValue()]; ok {
+				continue
+			}
+			out = append(out, ValidationResult{
+				focusNode:                 row[0],
+				sourceShape:               shapeIRI,
+				sourceConstraintComponent: res(_shawell + "SemanticsConstraintComponent"),
+				message: map[string]rdf.Term{
+					"": rdf.NewLiteral(fmt.Sprint("shape not satisfied under ", semantics, " semantics")),
+				},
+			})
+		}
+	}
+
+	return out
+}
 
 // the main validation function, extracted here to be used for easy testing
-func answerShacl(ep *SparqlEndpoint, parsedDoc ShaclDocument, dataIncluded *bool, debug,
-	omitVR bool, vrOutFile *os.File, silent bool, forceLP bool, onlyLP bool, onlyQueries bool,
-) *ValidationReport {
-	// if onlyLP || onlyQueries {
-	// 	silent = true
-	// }
-	if !debug {
-		log.SetOutput(io.Discard)
-	} else {
-		log.SetOutput(os.Stderr)
+func answerShacl(ctx context.Context, ep Endpoint, parsedDoc ShaclDocument, opts Options) (*ValidationReport, error) {
+	debug := opts.Debug
+	silent := opts.Output == nil
+	out := opts.Output
+	if silent {
+		out = io.Discard
 	}
 
-	var c timeComposer
-	if !silent {
-		fmt.Println("Checking conditional answers ... ")
+	run, ok := ctx.Value(runKey{}).(*validationRun)
+	if !ok { // not called via Validate
+		run = newValidationRun(opts)
+		ctx = withRun(ctx, run)
 	}
+	parsedDoc.run = run
+
+	var c timeComposer
+	fmt.Fprintln(out, "Checking conditional answers ... ")
+	parsedDoc.parallel = opts.Parallel
+	parsedDoc.targetChunk = opts.TargetChunkSize
 
 	start := time.Now()
-	parsedDoc.AllCondAnswers(ep)
+	err := parsedDoc.AllCondAnswers(ctx, ep)
+	if err != nil {
+		return nil, err
+	}
 	d := time.Since(start)
 	msec := d.Seconds() * float64(time.Second/time.Millisecond)
 	c.times = append(c.times, labelTime{time: msec, label: "Conditional Table computation"})
-	if !silent {
-		fmt.Println("All conditinal answers found.")
-	}
+	fmt.Fprintln(out, "All conditinal answers found.")
 
-	// for k, v := range parsedDoc.condAnswers {
-	// 	fmt.Println("TABLE: ", k)
-	// 	fmt.Println(v.Limit(5))
-	// }
+	if opts.OnlyQueries {
+		fmt.Fprint(out, "The produced SPAQRL queries:  \n\n\n")
 
-	if onlyQueries {
-		fmt.Println("The produced SPAQRL queries:  \n\n")
-
-		for _, query := range QueryStore {
-			fmt.Println(abbr(query))
+		for _, query := range run.storedQueries() {
+			fmt.Fprintln(out, parsedDoc.abbr(query))
 		}
 
-		return nil
-
+		return nil, nil
 	}
 
-
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	var res bool
 	var invalidTargets map[string]Table[rdf.Term]
 	var lp program
 	var lpTables []Table[rdf.Term]
+	var undefTables []Table[rdf.Term]
+	var undefinedTargets map[string]Table[rdf.Term]
 
-	if parsedDoc.IsRecursive() || forceLP {
-		if !silent {
-			fmt.Println("Recursive document parsed, tranforming to LP and sending off to DLV.")
-		}
-		renameMap = make(map[string]string)
-		reverseMap = make(map[string]string)
+	if parsedDoc.IsRecursive() || opts.ForceLP {
+		fmt.Fprintln(out, "Recursive document parsed, tranforming to LP and solving it.")
 		start := time.Now()
-		lp = parsedDoc.GetAllLPs()
+		lp, err = parsedDoc.GetAllLPs()
+		if err != nil {
+			return nil, err
+		}
 		d := time.Since(start)
 		msec := d.Seconds() * float64(time.Second/time.Millisecond)
 		c.times = append(c.times, labelTime{time: msec, label: "Logic Program generation"})
 
-		if debug || onlyLP {
-			fmt.Println("The produced Logic Program:  \n\n")
-			fmt.Println(abbr(lp.String()))
-			if onlyLP {
-				return nil
+		if debug || opts.OnlyLP {
+			lpOut := out
+			if opts.OnlyLP && silent {
+				lpOut = os.Stdout // only producing the LP makes no sense without printing it
+			}
+			fmt.Fprint(lpOut, "The produced Logic Program:  \n\n\n")
+			fmt.Fprintln(lpOut, parsedDoc.abbr(lp.String()))
+			if opts.OnlyLP {
+				return nil, nil
 			}
 		}
 
 		start = time.Now()
-		lpTables = lp.Answer(debug)
+		lpTables, undefTables, err = lp.Answer(ctx, run.dlv, opts.Semantics, debug)
+		if err != nil {
+			return nil, err
+		}
 		d = time.Since(start)
 		msec = d.Seconds() * float64(time.Second/time.Millisecond)
-		c.times = append(c.times, labelTime{time: msec, label: "DLV solving"})
+		c.times = append(c.times, labelTime{time: msec, label: "LP solving"})
 
-		err := parsedDoc.AdoptLPAnswers(lpTables)
-		check(err)
+		err = parsedDoc.AdoptLPAnswers(lpTables)
+		if err != nil {
+			return nil, err
+		}
+		parsedDoc.AdoptLPUndefined(undefTables)
 
 		if debug {
-			fmt.Println("Answer from DLV: ")
+			fmt.Fprintln(out, "Answer from LP solver: ")
 			for i := range lpTables {
-				fmt.Println(lpTables[i].Limit(5))
+				fmt.Fprintln(out, lpTables[i].Limit(5))
 			}
 		}
 
 		start = time.Now()
-		res, invalidTargets = parsedDoc.ValidateLP(lpTables, ep)
+		res, invalidTargets, err = parsedDoc.ValidateLP(ctx, lpTables, ep, opts.AcceptUndefined)
+		if err != nil {
+			return nil, err
+		}
 		d = time.Since(start)
 		msec = d.Seconds() * float64(time.Second/time.Millisecond)
-		c.times = append(c.times, labelTime{time: msec, label: "Extracing answers from DLV"})
+		c.times = append(c.times, labelTime{time: msec, label: "Extracing answers from LP"})
 	} else {
 		start := time.Now()
-		res, invalidTargets = parsedDoc.Validate(ep)
+		res, invalidTargets, err = parsedDoc.Validate(ctx, ep)
+		if err != nil {
+			return nil, err
+		}
 		d := time.Since(start)
 		msec := d.Seconds() * float64(time.Second/time.Millisecond)
 		c.times = append(c.times, labelTime{time: msec, label: "Unwinding acyclic cond. tables"})
 	}
 
-	if !silent {
-		for _, v := range invalidTargets {
-			if v.Len() > 0 {
-				fmt.Println("Found a shape with invalid targets: \n", v.Limit(20))
-			}
+	for _, v := range invalidTargets {
+		if v.Len() > 0 {
+			fmt.Fprintln(out, "Found a shape with invalid targets: \n", v.Limit(20))
 		}
 	}
 
+	undefinedTargets = parsedDoc.UndefinedTargets()
+	for _, v := range undefinedTargets {
+		fmt.Fprintln(out, "Found a shape with undefined targets: \n", v.Limit(20))
+	}
+
 	green := color.New(color.FgGreen)
 	red := color.New(color.FgRed)
 
-	if !silent {
-		fmt.Println("----------------------------------")
-		fmt.Println("RESULT: --------------------------")
-
-		if res {
-			fmt.Println("Shacl Document valid: ", green.Sprint(res))
-		} else {
-			fmt.Println("Shacl Document valid: ", red.Sprint(res))
-		}
+	fmt.Fprintln(out, "----------------------------------")
+	fmt.Fprintln(out, "RESULT: --------------------------")
 
-		fmt.Println("----------------------------------")
+	if res {
+		fmt.Fprintln(out, "Shacl Document valid: ", green.Sprint(res))
+	} else {
+		fmt.Fprintln(out, "Shacl Document valid: ", red.Sprint(res))
 	}
-	// Producing a Validation Repot in case of failure
 
-	// fmt.Println("ValidationResult in XML form: ")
+	fmt.Fprintln(out, "----------------------------------")
+
+	// Producing a Validation Repot in case of failure
 
 	var actual *ValidationReport
 	var reports []ValidationResult
 
 	allValid := true
 
-	if !omitVR {
+	if !opts.OmitReport {
 		actual = &ValidationReport{}
 
 		start = time.Now()
 		for _, v := range parsedDoc.shapeNames {
-			// var reportsFromShape []ValidationResult
-
 			switch t := v.(type) {
 			case *NodeShape:
 				if t.deactivated {
 					continue
 				}
-				// fmt.Println("Computing VRs for shape ", t.GetIRI())
-				valid, reportsOfShape := parsedDoc.GetValidationReport(t, ep)
+				valid, reportsOfShape, err := parsedDoc.GetValidationReport(ctx, t, ep)
+				if err != nil {
+					return nil, err
+				}
 				if !valid {
 					allValid = false
 				}
 				if !valid && len(reportsOfShape) == 0 {
-					log.Panic("Reporting not valid for NodeSHape ", t.IRI,
-						" but no reports returned!")
+					return nil, fmt.Errorf("reporting not valid for node shape %v but no reports returned",
+						t.IRI)
 				}
 
 				reports = append(reports, reportsOfShape...)
@@ -397,212 +732,103 @@ func answerShacl(ep *SparqlEndpoint, parsedDoc ShaclDocument, dataIncluded *bool
 				if t.shape.deactivated {
 					continue
 				}
-				// fmt.Println("Computing VRs for shape ", t.GetIRI())
-				valid, repsOfShape := parsedDoc.GetVRProperty(t, ep, nil, "")
+				valid, repsOfShape, err := parsedDoc.GetVRProperty(ctx, t, ep, nil, "")
+				if err != nil {
+					return nil, err
+				}
 				if !valid {
 					allValid = false
 				}
 
 				if !valid && len(repsOfShape) == 0 {
-					log.Panic("Reporting not valid for PropertyShape ", t.name,
-						" but no reports returned!")
+					return nil, fmt.Errorf("reporting not valid for property shape %v but no reports returned",
+						t.name)
 				}
 
 				reports = append(reports, repsOfShape...)
 			}
 		}
-		// reports = removeDuplicateVR(reports)
 		d = time.Since(start)
 		msec = d.Seconds() * float64(time.Second/time.Millisecond)
 		c.times = append(c.times, labelTime{time: msec, label: "Validation Report creation"})
 
-		actual.results = reports
-		actual.conforms = res
-	}
-
-	if !omitVR && allValid != res {
-
-		if parsedDoc.IsRecursive() || forceLP {
-			fmt.Println("\nGenerated LP: ", lp)
+		if opts.Semantics != WellFounded && opts.Semantics != "" && (parsedDoc.IsRecursive() || opts.ForceLP) {
+			reports = reconcileReports(parsedDoc, reports, invalidTargets, opts.Semantics)
+			allValid = len(reports) == 0
+		}
 
-			fmt.Println("LP Tables: ")
-			for i := range lpTables {
-				fmt.Println(lpTables[i].Limit(10))
-			}
+		if len(undefinedTargets) > 0 {
+			reports = markUndefined(parsedDoc, reports, undefinedTargets)
 
-			fmt.Println("log names of shapes")
-			for name, shape := range parsedDoc.shapeNames {
-				fmt.Println(shape.GetLogName())
-				fmt.Println(parsedDoc.uncondAnswers[name])
-				fmt.Println("Invalid Targets: ", invalidTargets[name])
+			allValid = true
+			for i := range reports {
+				if !reports[i].Undefined() || !opts.AcceptUndefined {
+					allValid = false
+				}
 			}
 		}
 
-		fmt.Println("Number of reports: ", len(reports))
-
-		fmt.Println("VALIDATION REPORT: \n", actual)
-		log.Panicln("Mismatch between ValidationResult & ValidationReports result! ", allValid, res)
-	}
-
-	if !silent && !omitVR && vrOutFile == nil {
-		fmt.Println("VALIDATION REPORT: \n", abbr(actual.String()))
-	} else if vrOutFile != nil {
-		vrOutFile.WriteString(actual.String())
-	}
-
-	// Clean up the named graph afterwards
-	if *dataIncluded {
-		ep.ClearGraph(parsedDoc.fromGraph)
-	}
-
-	if !silent {
-		fmt.Println("\n\nTime Composition:")
-		fmt.Println(c)
+		actual.results = reports
+		actual.conforms = res
 	}
-	return actual
-}
-
-func main() {
-	// ==============================================
-	// Command-Line Argument Parsing
-
-	flagSet := flag.NewFlagSet("shawell", flag.ExitOnError)
-
-	// input flags
-	endpointAddress := flagSet.String("endpoint", "", "The URL to a SPARQL endpoint.")
-	endpointUpdateAddress := flagSet.String("endpointUpdate", "",
-		"The URL to a SPARQL endpoint used for updating the data.")
-	shaclDocPath := flagSet.String("shaclDoc", "", "The file path to a SHACL document.")
-	dlvLoc := flagSet.String("dlv", "bin/dlv",
-		"The location of the DLV binary used to evaluate recursive SHACL.")
-	dataIncluded := flagSet.Bool("dataIncluded", false,
-		"Set this to true if the SHACL document also contains the data to be checked.")
-	username := flagSet.String("user", "", "The username needed to access endpoint.")
-	password := flagSet.String("password", "", "The password needed to access endpoint.")
-	debug := flagSet.Bool("debug", false, "Activacting debugging features.")
-	poseQuery := flagSet.String("poseTestQuery", "",
-		"A query to run and return the results. Used for testing/debug purposes.")
-	omitVR := flagSet.Bool("omitVR", false,
-		"Omits outputting the Validation Report. Note that it will still be produced internally.")
-	outputVR := flagSet.String("outputVR", "",
-		"A filepath used to export the Validation Report in turtle notation. "+
-			"Using this and -omitVR at same time is superflous.")
-	forceLP := flagSet.Bool("forceLP", false, "Force the translation into logic programs.")
 
-	// input flags demo purposes
-
-	demoOutputOnlyLP := flagSet.Bool("demoOutputLP", false, "Outputs only the produced LPs.")
-
-	demoOutputQueries := flagSet.Bool("demoOutputQueries", false, "Outputs only the produced SPARQL queries.")
-
-	usingUpdateEndpoint := false
-
-	flagSet.Parse(os.Args[1:])
-
-	if *endpointAddress == "" || *shaclDocPath == "" {
-		fmt.Println("Input args: " + strings.Join(os.Args, " "))
-		flagSet.Usage()
-		os.Exit(-1)
-	}
+	if !opts.OmitReport && allValid != res {
 
-	if *endpointUpdateAddress != "" {
-		usingUpdateEndpoint = true // using a system like GraphDB that expects different endpoints
-	}
+		if debug {
+			if parsedDoc.IsRecursive() || opts.ForceLP {
+				fmt.Fprintln(out, "\nGenerated LP: ", lp)
 
-	// END Command-Line Argument Parsing
-	// ==============================================
+				fmt.Fprintln(out, "LP Tables: ")
+				for i := range lpTables {
+					fmt.Fprintln(out, lpTables[i].Limit(10))
+				}
 
-	// set DLV
-	dlv = *dlvLoc
+				fmt.Fprintln(out, "log names of shapes")
+				for name, shape := range parsedDoc.shapeNames {
+					fmt.Fprintln(out, shape.GetLogName())
+					fmt.Fprintln(out, parsedDoc.uncondAnswers[name])
+					fmt.Fprintln(out, "Invalid Targets: ", invalidTargets[name])
+				}
+			}
 
-	shaclDoc, err := os.Open(*shaclDocPath)
-	check(err)
-	defer shaclDoc.Close()
+			fmt.Fprintln(out, "Number of reports: ", len(reports))
 
-	var vrOUtFile *os.File
-	if *outputVR != "" {
-		vrOUtFile, err = os.OpenFile(*outputVR, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
-		check(err)
-		defer vrOUtFile.Close()
+			fmt.Fprintln(out, "VALIDATION REPORT: \n", actual)
+		}
+		return actual, fmt.Errorf("mismatch between validation result (%v) and validation report (%v)",
+			res, allValid)
 	}
 
-	g2 := rdf.NewGraph(_sh)
-
-	err = g2.Parse(shaclDoc, "text/turtle")
-	check(err)
-
-	// fmt.Println("Parsed Graph: ", g2)
-
-
-
-	endpoint := GetSparqlEndpoint(
-		*endpointAddress,
-		*endpointUpdateAddress,
-		*username,
-		*password,
-		*debug,
-		usingUpdateEndpoint,
-		"",
-	)
-
-	// Test Query routine
-	if *poseQuery != "" {
-		queryFile, err := os.ReadFile(*poseQuery)
-		check(err)
-
-		endpoint.QueryString(string(queryFile))
-
-		form := url.Values{}
-		form.Set("query", string(queryFile))
-		arg := form.Encode()
-
-		fmt.Println("Argument: ", arg)
-
-		os.Exit(0)
+	if !opts.OmitReport {
+		if opts.ReportOutput != nil {
+			_, err := io.WriteString(opts.ReportOutput, actual.String())
+			if err != nil {
+				return actual, err
+			}
+		} else {
+			fmt.Fprintln(out, "VALIDATION REPORT: \n", parsedDoc.abbr(actual.String()))
+		}
 	}
 
-	GetNameSpace(shaclDoc)
-
-	// var VR *ValidationReport
-
-	var graphName string
-
-	// check if data needs to be inserted into Endpoint
-	if *dataIncluded {
-		// VR, err = ExtractValidationReport(g2)
-		// check(err)
-
-		// fmt.Println("Extracted VR\n", VR)
-
-		basename := filepath.Base(*shaclDocPath)
-		fileName := strings.TrimSuffix(basename, filepath.Ext(basename))
-		res := endpoint.Insert(g2, "<"+_sh+fileName+">")
-		check(res)
-		graphName = "<" + _sh + fileName + ">"
+	// Clean up the named graph afterwards
+	if opts.ClearGraph && parsedDoc.fromGraph != "" {
+		err = ep.ClearGraph(ctx, parsedDoc.fromGraph)
+		if err != nil {
+			return actual, err
+		}
 	}
 
-
-
-	parsedDoc := GetShaclDocument(g2, graphName, endpoint, *debug)
-
-	if *forceLP || *demoOutputOnlyLP {
-		demoLP = true
+	if cache, ok := ep.(CacheReporter); ok {
+		hits, misses := cache.CacheStats()
+		c.counts = append(c.counts, labelCount{count: hits, label: "Query cache hits"},
+			labelCount{count: misses, label: "Query cache misses"})
 	}
-
-
-	parsedDoc.debug = *debug
-	var addedText string
-	if !*debug {
-		it := color.New(color.Italic)
-		addedText = it.Sprint("(use -debug to also show blank Shapes)")
+	if r, ok := innerEndpoint(ep).(RetryReporter); ok {
+		c.counts = append(c.counts, retryCounts(r.Retries())...)
 	}
-	fmt.Println("The parsed SHACL Document:", addedText, parsedDoc.String())
-
-
 
-	// set set active
-	activeDoc = &parsedDoc
+	fmt.Fprint(out, "\n\nTime Composition:\n")
+	fmt.Fprintln(out, c)
 
-	// Main Routine
-	answerShacl(endpoint, parsedDoc, dataIncluded, *debug, *omitVR, vrOUtFile, false, *forceLP, *demoOutputOnlyLP, *demoOutputQueries)
+	return actual, nil
 }
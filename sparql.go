@@ -1,6 +1,7 @@
-package main
+package shawell
 
 import (
+	"context"
 	"fmt"
 	"strings"
 )
@@ -45,7 +46,7 @@ import (
 
 type CountingSubQuery struct {
 	graph  string
-	target string
+	target *groupPattern
 	id     int
 	min    bool
 	max    bool
@@ -54,65 +55,147 @@ type CountingSubQuery struct {
 	path   PropertyPath
 }
 
-func (c CountingSubQuery) ProduceBody() string {
-	var sb strings.Builder
-
-	head := []string{"?sub", fmt.Sprint("( COUNT(DISTINCT ?obj) AS ?count", c.id, ")")}
-	core := "OPTIONAL {\n\t" + fmt.Sprint("?sub ", c.path.PropertyString(), " ?obj. ") + "\n\t}"
-	body := []string{c.target, core}
-	group := []string{"?sub"}
+// ProduceBody counts the values of the path for each target, in a sub-query evaluated in the
+// named graph if given, and filters the targets by their count
+func (c CountingSubQuery) ProduceBody(graph string) []patternElement {
+	count := fmt.Sprint("?count", c.id)
 
-	sb.WriteString("{\n")
-	sb.WriteString("SELECT  ")
-	sb.WriteString(strings.Join(head, " "))
-	sb.WriteString(" { \n\t")
+	var target patternElement = c.target
 	if c.graph != "" {
-		sb.WriteString(" GRAPH " + c.graph + " ")
+		target = &graphPattern{graph: namedGraph(c.graph), group: c.target}
 	}
-	sb.WriteString(strings.Join(body, "\n\t"))
-
-	sb.WriteString("} \n")
-	if len(group) > 0 {
-		sb.WriteString("GROUP BY ")
-		sb.WriteString(strings.Join(group, " "))
+	inner := selectQuery(group(target, optional(triple(queryVar("?sub"), c.path, queryVar("?obj")))))
+	inner.star = false
+	inner.project = append(project("?sub"), projectAs(&aggregateExpr{
+		name: "COUNT", distinct: true, expr: exprVar("?obj"), separator: " ",
+	}, count))
+	inner.groupBy = project("?sub")
+
+	var counted patternElement = group(subquery(inner))
+	if graph != "" {
+		counted = &graphPattern{graph: namedGraph(graph), group: group(subquery(inner))}
 	}
-	sb.WriteString("\n} ")
 
-	var inner []string
+	var bounds []sparqlExpr
 	if c.min {
-		inner = append(inner, fmt.Sprint("?count", c.id, " >= ", c.numMin))
+		bounds = append(bounds, compare(">=", exprVar(count), intOf(c.numMin)))
 	}
 	if c.max {
-		inner = append(inner, fmt.Sprint("?count", c.id, " <= ", c.numMax))
+		bounds = append(bounds, compare("<=", exprVar(count), intOf(c.numMax)))
 	}
-	sb.WriteString(fmt.Sprint("FILTER (", strings.Join(inner, " && "), ") . "))
 
-	return sb.String()
+	return []patternElement{counted, filter(andExpr(bounds...))}
 }
 
 type SparqlQuery struct {
-	head       []string
-	target     string   // make target explicit
-	body       []string // positive expressions that check for existance of some objects
+	head       []projection     // all variables if empty
+	target     *groupPattern    // make target explicit
+	body       []patternElement // positive expressions that check for existance of some objects
 	group      []string
 	graph      string // if non-empty, then we query terms inside this named graph only
+	dataset    Dataset
+	page       queryPage
 	subqueries []CountingSubQuery
 }
 
 // SparqlQueryFlat is used for the target restrictions, these need to be "flat"; meaning no form
 // of aggregation is allowed, this is achieved by rewritten non-flattened SparqlQueries
 type SparqlQueryFlat struct {
-	head  string   // only a single attribute in the head
-	body  []string // positive expressions that check for existance of some objects
-	graph string   // if non-empty, then we query terms inside this named graph only
+	head    []projection     // all variables if empty
+	body    []patternElement // positive expressions that check for existance of some objects
+	graph   string           // if non-empty, then we query terms inside this named graph only
+	dataset Dataset
+	page    queryPage
+}
+
+// Dataset selects the graphs a query is evaluated over, via FROM and FROM NAMED clauses. The
+// graphs listed in Default are merged into the default graph, while only those listed in Named
+// can be accessed via GRAPH patterns. If both are empty, the endpoint chooses the dataset, which
+// is typically the union of all its graphs.
+type Dataset struct {
+	Default []string
+	Named   []string
+}
+
+// IsEmpty determines whether the dataset is left to the endpoint
+func (d Dataset) IsEmpty() bool { return len(d.Default) == 0 && len(d.Named) == 0 }
+
+func (d Dataset) String() string {
+	var sb strings.Builder
+
+	for _, g := range d.Default {
+		sb.WriteString("FROM " + graphIRI(g) + "\n")
+	}
+	for _, g := range d.Named {
+		sb.WriteString("FROM NAMED " + graphIRI(g) + "\n")
+	}
+
+	return sb.String()
+}
+
+// queryPage selects a single page of the results of a query, so that large results can be
+// fetched in parts. If limit is zero, all results are selected.
+type queryPage struct {
+	limit  int
+	offset int
+}
+
+// apply restricts the query to the page. The solutions are ordered by all projected variables,
+// so that the pages partition the results. Queries projecting all variables are not restricted.
+func (p queryPage) apply(q *sparqlQuery) {
+	if p.limit <= 0 || q.star || q.form != selectForm {
+		return
+	}
+
+	q.orderBy = nil
+	for _, v := range q.projected() {
+		q.orderBy = append(q.orderBy, orderCondition{expr: varExpr{name: v}})
+	}
+	q.limit, q.offset = p.limit, p.offset
+}
+
+// graphIRI encloses the name of a graph in angle brackets, unless it already is
+func graphIRI(name string) string {
+	if strings.HasPrefix(name, "<") {
+		return name
+	}
+	return "<" + name + ">"
+}
+
+// bareIRI strips the angle brackets from the name of a graph
+func bareIRI(name string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(name, "<"), ">")
+}
+
+// datasetOf restricts the stand-alone query to the dataset. FROM clauses are not allowed in
+// sub-queries.
+func datasetOf(q *sparqlQuery, d Dataset) {
+	for _, g := range d.Default {
+		q.from = append(q.from, bareIRI(g))
+	}
+	for _, g := range d.Named {
+		q.named = append(q.named, bareIRI(g))
+	}
 }
 
 func (s SparqlQuery) String() string {
-	return s.StringPrefix(true) // by default, always include prefixes
+	return s.text(context.Background()) // by default, always include prefixes
 }
 
 func (s SparqlQueryFlat) String() string {
-	return s.StringPrefix(true) // by default, always include prefixes
+	return s.text(context.Background()) // by default, always include prefixes
+}
+
+// text returns the stand-alone query, as sent to an endpoint: assembled in the algebra with the
+// settings of the validation run of the context, or with the default ones outside of a run
+func (s SparqlQuery) text(ctx context.Context) string {
+	return runOf(ctx).assembleQuery(s.algebra(true), s.page)
+}
+
+// text returns the stand-alone query, as sent to an endpoint: assembled in the algebra with the
+// settings of the validation run of the context, or with the default ones outside of a run
+func (s SparqlQueryFlat) text(ctx context.Context) string {
+	return runOf(ctx).assembleQuery(s.algebra(true), s.page)
 }
 
 func (s SparqlQuery) JustPrefix() string {
@@ -120,9 +203,7 @@ func (s SparqlQuery) JustPrefix() string {
 
 	// attach prefixes
 
-	for k, v := range prefixes {
-		sb.WriteString("PREFIX " + k + " <" + v + ">\n")
-	}
+	sb.WriteString(prefixes.declarations())
 
 	return sb.String()
 }
@@ -132,118 +213,98 @@ func (s SparqlQueryFlat) JustPrefix() string {
 
 	// attach prefixes
 
-	for k, v := range prefixes {
-		sb.WriteString("PREFIX " + k + " <" + v + ">\n")
-	}
+	sb.WriteString(prefixes.declarations())
 
 	return sb.String()
 }
 
+// ProjectToVar produces a flat query over the query. If external, the values of the variable are
+// returned as ?sub, with the ?sub of the query renamed apart.
 func (s SparqlQueryFlat) ProjectToVar(variable string, external bool) (out SparqlQueryFlat) {
-	var head string
-
-	s.head = "*" // "free" the head from projection
-	newBody := s.StringPrefix(false)
+	s.head = nil // "free" the head from projection
+	inner := s.algebra(false)
 
 	if external {
-		newBody = strings.ReplaceAll(newBody, "?sub", "?OldSub")
-		head = fmt.Sprint("( ?", variable, " as ?sub)")
+		used := map[string]bool{variable: true}
+		allVars(inner, used)
+		target := "OldSub"
+		if used[target] {
+			target = freshVar(target, used)
+		}
+
+		inner = renameVars(inner, map[string]string{"sub": target})
+		out.head = []projection{projectAs(exprVar(variable), "?sub")}
 	} else {
-		head = "?sub"
+		out.head = project("?sub")
 	}
 
-	out.head = head
-	out.body = []string{newBody}
+	out.body = []patternElement{subquery(inner)}
 
 	return out
 }
 
-func (s SparqlQuery) StringPrefix(attachPrefix bool) string {
-	var sb strings.Builder
-
-	// attach prefixes
+// algebra builds the query. Only stand-alone queries are restricted to the dataset.
+func (s SparqlQuery) algebra(standAlone bool) *sparqlQuery {
+	var where []patternElement
 
-	if attachPrefix {
-		for k, v := range prefixes {
-			sb.WriteString("PREFIX " + k + " <" + v + ">\n")
+	if len(s.subqueries) == 0 && s.target != nil {
+		var target patternElement = s.target
+		if s.graph != "" {
+			target = &graphPattern{graph: namedGraph(s.graph), group: s.target}
 		}
+		where = append(where, target)
 	}
 
-	sb.WriteString("\n\n")
-
-	// // get extended header and body
-	// for i := range s.subqueries {
-	// 	renamedBody, renamedHead := s.subqueries[i].Rename(i)
-	// 	s.head = append(s.head, renamedHead...)
-	// 	s.body = append(s.body, renamedBody...)
-	// }
-
-	sb.WriteString("SELECT ")
-	sb.WriteString(strings.Join(s.head, " "))
-	sb.WriteString(" { \n\t")
-
-	if len(s.subqueries) == 0 {
-		if s.graph != "" {
-			sb.WriteString(" GRAPH " + s.graph + " ")
-		}
-		sb.WriteString(s.target + "\n\t")
+	// the counting sub-queries bind the targets, so they precede the OPTIONAL patterns of the
+	// body extending them
+	for _, c := range s.subqueries {
+		where = append(where, c.ProduceBody(s.graph)...)
 	}
 
-	sb.WriteString(strings.Join(s.body, "\n\t"))
+	where = append(where, s.body...)
 
-	if len(s.subqueries) > 0 {
-		for _, c := range s.subqueries {
-			if s.graph != "" {
-				sb.WriteString(" GRAPH " + s.graph + " ")
-			}
-			sb.WriteString(c.ProduceBody())
-		}
+	out := selectQuery(group(where...))
+	out.star, out.project = len(s.head) == 0, s.head
+	out.groupBy = project(s.group...)
+	if standAlone {
+		datasetOf(out, s.dataset)
 	}
+	return out
+}
 
-	sb.WriteString("} \n")
-	if len(s.group) > 0 {
-		sb.WriteString("GROUP BY ")
-		sb.WriteString(strings.Join(s.group, " "))
+// algebra builds the query. Only stand-alone queries are restricted to the dataset and to the
+// named graph.
+func (s SparqlQueryFlat) algebra(standAlone bool) *sparqlQuery {
+	where := group(s.body...)
+	if standAlone && s.graph != "" {
+		where = group(&graphPattern{graph: namedGraph(s.graph), group: where})
 	}
 
-	return sb.String()
+	out := selectQuery(where)
+	out.star, out.project = len(s.head) == 0, s.head
+	if standAlone {
+		datasetOf(out, s.dataset)
+	}
+	return out
 }
 
-func (s SparqlQueryFlat) StringPrefix(attachPrefix bool) string {
-	var sb strings.Builder
-
-	// attach prefixes
+// pattern embeds the query as a sub-query, as done for targets
+func (s SparqlQueryFlat) pattern() *groupPattern {
+	return group(subquery(s.algebra(false)))
+}
 
+func (s SparqlQuery) StringPrefix(attachPrefix bool) string {
 	if attachPrefix {
-		for k, v := range prefixes {
-			sb.WriteString("PREFIX " + k + " <" + v + ">\n")
-		}
-	}
-
-	sb.WriteString("\n\n")
-
-	// // get extended header and body
-	// for i := range s.subqueries {
-	// 	renamedBody, renamedHead := s.subqueries[i].Rename(i)
-	// 	s.head = append(s.head, renamedHead...)
-	// 	s.body = append(s.body, renamedBody...)
-	// }
-
-	sb.WriteString("SELECT ")
-	sb.WriteString(s.head)
-	sb.WriteString(" { \n\t")
-	if attachPrefix && s.graph != "" { // only attach if query used stand-alone
-		sb.WriteString(" GRAPH " + s.graph + " { \n\t")
+		return serializeQuery(s.algebra(true))
 	}
-	sb.WriteString(strings.Join(s.body, "\n\t"))
+	return s.algebra(false).String()
+}
 
-	if attachPrefix && s.graph != "" { // only attach if query used stand-alone
-		sb.WriteString("} \n } \n")
-	} else {
-		sb.WriteString("} \n ")
+func (s SparqlQueryFlat) StringPrefix(attachPrefix bool) string {
+	if attachPrefix {
+		return serializeQuery(s.algebra(true))
 	}
-
-	return sb.String()
+	return s.algebra(false).String()
 }
 
 // // Body produces the needed where statements (combined into single string) to intersect one query
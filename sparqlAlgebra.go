@@ -0,0 +1,996 @@
+package shawell
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	rdf "github.com/cem-okulmus/rdf2go-1"
+)
+
+// This file turns the AST of sparqlParser.go into the algebra in which the queries sent to the
+// endpoint are assembled. The constraints build their query parts in the algebra, which is
+// rewritten where needed and serialized once assembled. User SPARQL, as given by SPARQL-based
+// constraints, targets and rules, is embedded verbatim. Variables are renamed hygienically, so
+// that combining query parts never captures variables local to sub-queries.
+
+// builders, for the queries produced by the rewrites
+
+func variable(name string) patternTerm { return patternTerm{variable: name} }
+
+func group(elements ...patternElement) *groupPattern { return &groupPattern{elements: elements} }
+
+func optional(elements ...patternElement) *optionalPattern {
+	return &optionalPattern{group: group(elements...)}
+}
+
+func filter(expr sparqlExpr) *filterPattern { return &filterPattern{expr: expr} }
+
+func subquery(q *sparqlQuery) *subSelectPattern { return &subSelectPattern{query: q} }
+
+// selectQuery produces a SELECT query projecting the given variables, or all if none are given
+func selectQuery(where *groupPattern, vars ...string) *sparqlQuery {
+	out := &sparqlQuery{form: selectForm, where: where, limit: -1, star: len(vars) == 0}
+	for _, v := range vars {
+		out.project = append(out.project, projection{variable: v})
+	}
+	return out
+}
+
+// builders, for the generated queries. Variables are named as written in the queries, with
+// their question mark.
+
+// queryVar refers to the variable in a pattern
+func queryVar(name string) patternTerm { return variable(strings.TrimPrefix(name, "?")) }
+
+// exprVar refers to the variable in an expression
+func exprVar(name string) varExpr { return varExpr{name: strings.TrimPrefix(name, "?")} }
+
+// project produces the projections of the variables
+func project(names ...string) (out []projection) {
+	for _, n := range names {
+		out = append(out, projection{variable: strings.TrimPrefix(n, "?")})
+	}
+	return out
+}
+
+// projectAs produces the projection of the expression as the variable
+func projectAs(expr sparqlExpr, name string) projection {
+	return projection{variable: strings.TrimPrefix(name, "?"), expr: expr}
+}
+
+// termOf converts the term of the shapes graph. Terms of other kinds than IRIs, blank nodes and
+// literals do not occur in shapes, and are converted to the unbound term.
+func termOf(t rdf.Term) memTerm {
+	out, _ := memTermFromRDF(t)
+	return out
+}
+
+func constTerm(t rdf.Term) patternTerm { return patternTerm{term: termOf(t)} }
+
+// namedGraph refers to the named graph, given with or without angle brackets
+func namedGraph(name string) patternTerm {
+	return patternTerm{term: iriTerm(bareIRI(name))}
+}
+
+// pathOf converts the property path of a shape
+func pathOf(p PropertyPath) pathExpr {
+	convert := func(paths []PropertyPath) (out []pathExpr) {
+		for _, p := range paths {
+			out = append(out, pathOf(p))
+		}
+		return out
+	}
+
+	switch p := p.(type) {
+	case SimplePath:
+		return linkPath{iri: termOf(p.path)}
+	case InversePath:
+		return inversePath{path: pathOf(p.path)}
+	case SequencePath:
+		return sequencePath{paths: convert(p.paths)}
+	case AlternativePath:
+		return alternativePath{paths: convert(p.paths)}
+	case ZerOrMorePath:
+		return modPath{path: pathOf(p.path), mod: '*'}
+	case OneOrMorePath:
+		return modPath{path: pathOf(p.path), mod: '+'}
+	case ZerOrOnePath:
+		return modPath{path: pathOf(p.path), mod: '?'}
+	}
+	return nil
+}
+
+// triple produces the pattern of a single triple, with the path as its predicate
+func triple(subject patternTerm, path PropertyPath, object patternTerm) *triplesBlock {
+	tp := triplePattern{subject: subject, path: pathOf(path), object: object}
+	if link, ok := tp.path.(linkPath); ok {
+		tp.predicate, tp.path = patternTerm{term: link.iri}, nil
+	}
+	return &triplesBlock{triples: []triplePattern{tp}}
+}
+
+// classPath is the path from instances to all their classes
+var classPath = SequencePath{paths: []PropertyPath{
+	SimplePath{path: res(_rdf + "type")},
+	ZerOrMorePath{path: SimplePath{path: res(_rdfs + "subClassOf")}},
+}}
+
+func bind(expr sparqlExpr, name string) *bindPattern {
+	return &bindPattern{expr: expr, variable: strings.TrimPrefix(name, "?")}
+}
+
+// values binds the variable to each of the terms
+func values(name string, terms []rdf.Term) *valuesPattern {
+	out := &valuesPattern{vars: []string{strings.TrimPrefix(name, "?")}}
+	for _, t := range terms {
+		out.rows = append(out.rows, []memTerm{termOf(t)})
+	}
+	return out
+}
+
+func filterExists(elements ...patternElement) *filterPattern {
+	return filter(existsExpr{group: group(elements...)})
+}
+
+func filterNotExists(elements ...patternElement) *filterPattern {
+	return filter(existsExpr{group: group(elements...), negated: true})
+}
+
+func constOf(t rdf.Term) constExpr { return constExpr{term: termOf(t)} }
+
+func intOf(n int) constExpr {
+	return constExpr{term: literalTerm(strconv.Itoa(n), "", _xsd+"integer")}
+}
+
+func stringOf(s string) constExpr { return constExpr{term: literalTerm(s, "", "")} }
+
+// call produces the call of the built-in function, named in upper case
+func call(name string, args ...sparqlExpr) callExpr { return callExpr{name: name, args: args} }
+
+// cast produces the cast of the argument to the datatype
+func cast(datatype rdf.Term, arg sparqlExpr) callExpr {
+	return callExpr{name: datatype.RawValue(), args: []sparqlExpr{arg}, cast: true}
+}
+
+func compare(op string, left, right sparqlExpr) binaryExpr {
+	return binaryExpr{op: op, left: left, right: right}
+}
+
+func notExpr(expr sparqlExpr) unaryExpr { return unaryExpr{op: "!", expr: expr} }
+
+// andExpr produces the conjunction of the expressions, which is true if there are none
+func andExpr(exprs ...sparqlExpr) sparqlExpr { return fold("&&", boolTerm(true), exprs) }
+
+// orExpr produces the disjunction of the expressions, which is false if there are none
+func orExpr(exprs ...sparqlExpr) sparqlExpr { return fold("||", boolTerm(false), exprs) }
+
+func fold(op string, empty memTerm, exprs []sparqlExpr) sparqlExpr {
+	if len(exprs) == 0 {
+		return constExpr{term: empty}
+	}
+	out := exprs[0]
+	for _, e := range exprs[1:] {
+		out = binaryExpr{op: op, left: out, right: e}
+	}
+	return out
+}
+
+// inList tests the expression for membership in the terms
+func inList(expr sparqlExpr, terms []rdf.Term, negated bool) inExpr {
+	out := inExpr{expr: expr, negated: negated}
+	for _, t := range terms {
+		out.list = append(out.list, constOf(t))
+	}
+	return out
+}
+
+// verbatimPattern is a group of user SPARQL, embedded into the generated queries as it is. It is
+// left alone by the dialect rewrites and the optimizer; its variables are only collected, so
+// that the variables around it are renamed apart from them.
+type verbatimPattern struct {
+	text string   // enclosed in braces
+	vars []string // the variables occurring in the text
+}
+
+func (*verbatimPattern) patternElement() {}
+
+// verbatim embeds the group of user SPARQL. SELECT queries are embedded as sub-queries.
+func verbatim(text string) *verbatimPattern {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "{") {
+		text = "{\n" + text + "\n}"
+	}
+
+	out := &verbatimPattern{text: text}
+	tokens, _ := lexSparql(text) // lexed when extracted, so lexing cannot fail
+	seen := make(map[string]bool)
+	for _, t := range tokens {
+		if t.kind == tokVar && !seen[t.value] {
+			seen[t.value] = true
+			out.vars = append(out.vars, t.value)
+		}
+	}
+	return out
+}
+
+// projected returns the names of the variables projected by the query, or nil for SELECT *
+func (q *sparqlQuery) projected() []string {
+	var out []string
+	for _, p := range q.project {
+		out = append(out, p.variable)
+	}
+	return out
+}
+
+// serialization
+
+// pnameLocal matches the local parts of IRIs that can be abbreviated as prefixed names
+var pnameLocal = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// sparqlWriter serializes the algebra into query text, abbreviating IRIs by the prefixes
+type sparqlWriter struct {
+	sb         strings.Builder
+	namespaces []prefixNamespace // longest namespaces first
+	indent     int
+}
+
+type prefixNamespace struct{ prefix, namespace string }
+
+func newSparqlWriter(prefixes map[string]string) *sparqlWriter {
+	w := &sparqlWriter{}
+	for p, ns := range prefixes {
+		w.namespaces = append(w.namespaces, prefixNamespace{p, ns})
+	}
+	sort.Slice(w.namespaces, func(i, j int) bool {
+		a, b := w.namespaces[i], w.namespaces[j]
+		if len(a.namespace) != len(b.namespace) {
+			return len(a.namespace) > len(b.namespace)
+		}
+		return a.prefix < b.prefix
+	})
+	return w
+}
+
+// String serializes the query, with all IRIs written in full
+func (q *sparqlQuery) String() string {
+	w := newSparqlWriter(nil)
+	w.query(q)
+	return w.sb.String()
+}
+
+// serializeQuery serializes the query, abbreviating IRIs by the prefixes of the shapes graph,
+// whose declarations are attached
+func serializeQuery(q *sparqlQuery) string {
+	w := newSparqlWriter(prefixes.all())
+	w.sb.WriteString(prefixes.declarations())
+	w.sb.WriteString("\n")
+	w.query(q)
+	return w.sb.String()
+}
+
+func (w *sparqlWriter) line() {
+	w.sb.WriteString("\n")
+	w.sb.WriteString(strings.Repeat("\t", w.indent))
+}
+
+func (w *sparqlWriter) query(q *sparqlQuery) {
+	if q.form == askForm {
+		w.sb.WriteString("ASK")
+	} else {
+		w.sb.WriteString("SELECT ")
+		if q.distinct {
+			w.sb.WriteString("DISTINCT ")
+		}
+		if q.star {
+			w.sb.WriteString("*")
+		}
+		for i, p := range q.project {
+			if i > 0 {
+				w.sb.WriteString(" ")
+			}
+			w.projection(p)
+		}
+	}
+
+	for _, g := range q.from {
+		w.line()
+		w.sb.WriteString("FROM " + w.iri(g))
+	}
+	for _, g := range q.named {
+		w.line()
+		w.sb.WriteString("FROM NAMED " + w.iri(g))
+	}
+
+	w.line()
+	w.sb.WriteString("WHERE ")
+	w.group(q.where)
+
+	if len(q.groupBy) > 0 {
+		w.line()
+		w.sb.WriteString("GROUP BY")
+		for _, p := range q.groupBy {
+			w.sb.WriteString(" ")
+			if p.expr == nil {
+				w.sb.WriteString("?" + p.variable)
+				continue
+			}
+			w.sb.WriteString("(")
+			w.expr(p.expr)
+			if p.variable != "" {
+				w.sb.WriteString(" AS ?" + p.variable)
+			}
+			w.sb.WriteString(")")
+		}
+	}
+	if len(q.having) > 0 {
+		w.line()
+		w.sb.WriteString("HAVING")
+		for _, e := range q.having {
+			w.sb.WriteString(" (")
+			w.expr(e)
+			w.sb.WriteString(")")
+		}
+	}
+	if len(q.orderBy) > 0 {
+		w.line()
+		w.sb.WriteString("ORDER BY")
+		for _, c := range q.orderBy {
+			w.sb.WriteString(" ")
+			if v, ok := c.expr.(varExpr); ok && !c.descending {
+				w.sb.WriteString("?" + v.name)
+				continue
+			}
+			if c.descending {
+				w.sb.WriteString("DESC")
+			} else {
+				w.sb.WriteString("ASC")
+			}
+			w.sb.WriteString("(")
+			w.expr(c.expr)
+			w.sb.WriteString(")")
+		}
+	}
+	if q.limit >= 0 {
+		w.line()
+		w.sb.WriteString(fmt.Sprint("LIMIT ", q.limit))
+	}
+	if q.offset > 0 {
+		w.line()
+		w.sb.WriteString(fmt.Sprint("OFFSET ", q.offset))
+	}
+}
+
+func (w *sparqlWriter) projection(p projection) {
+	if p.expr == nil {
+		w.sb.WriteString("?" + p.variable)
+		return
+	}
+	w.sb.WriteString("(")
+	w.expr(p.expr)
+	w.sb.WriteString(" AS ?" + p.variable + ")")
+}
+
+func (w *sparqlWriter) group(g *groupPattern) {
+	if len(g.elements) == 1 {
+		if sub, ok := g.elements[0].(*subSelectPattern); ok { // the braces of the sub-query
+			w.subSelect(sub)
+			return
+		}
+	}
+
+	w.sb.WriteString("{")
+	w.indent++
+	for _, e := range g.elements {
+		w.element(e)
+	}
+	w.indent--
+	w.line()
+	w.sb.WriteString("}")
+}
+
+func (w *sparqlWriter) subSelect(s *subSelectPattern) {
+	w.sb.WriteString("{")
+	w.indent++
+	w.line()
+	w.query(s.query)
+	w.indent--
+	w.line()
+	w.sb.WriteString("}")
+}
+
+func (w *sparqlWriter) element(e patternElement) {
+	switch e := e.(type) {
+	case *triplesBlock:
+		for _, tp := range e.triples {
+			w.line()
+			w.sb.WriteString(w.patternTerm(tp.subject) + " ")
+			if tp.path != nil {
+				w.path(tp.path)
+			} else {
+				w.sb.WriteString(w.patternTerm(tp.predicate))
+			}
+			w.sb.WriteString(" " + w.patternTerm(tp.object) + " .")
+		}
+	case *groupPattern:
+		w.line()
+		w.group(e)
+	case *subSelectPattern:
+		w.line()
+		w.subSelect(e)
+	case *optionalPattern:
+		w.line()
+		w.sb.WriteString("OPTIONAL ")
+		w.group(e.group)
+	case *minusPattern:
+		w.line()
+		w.sb.WriteString("MINUS ")
+		w.group(e.group)
+	case *unionPattern:
+		w.line()
+		for i, b := range e.branches {
+			if i > 0 {
+				w.sb.WriteString(" UNION ")
+			}
+			w.group(b)
+		}
+	case *graphPattern:
+		w.line()
+		w.sb.WriteString("GRAPH " + w.patternTerm(e.graph) + " ")
+		w.group(e.group)
+	case *filterPattern:
+		w.line()
+		w.sb.WriteString("FILTER (")
+		w.expr(e.expr)
+		w.sb.WriteString(")")
+	case *bindPattern:
+		w.line()
+		w.sb.WriteString("BIND (")
+		w.expr(e.expr)
+		w.sb.WriteString(" AS ?" + e.variable + ")")
+	case *valuesPattern:
+		w.line()
+		w.sb.WriteString("VALUES (")
+		for i, v := range e.vars {
+			if i > 0 {
+				w.sb.WriteString(" ")
+			}
+			w.sb.WriteString("?" + v)
+		}
+		w.sb.WriteString(") {")
+		for _, row := range e.rows {
+			w.sb.WriteString(" (")
+			for i, t := range row {
+				if i > 0 {
+					w.sb.WriteString(" ")
+				}
+				w.sb.WriteString(w.term(t))
+			}
+			w.sb.WriteString(")")
+		}
+		w.sb.WriteString(" }")
+	case *verbatimPattern:
+		w.line()
+		w.sb.WriteString(e.text)
+	}
+}
+
+func (w *sparqlWriter) path(p pathExpr) {
+	switch p := p.(type) {
+	case linkPath:
+		w.sb.WriteString(w.term(p.iri))
+	case inversePath:
+		w.sb.WriteString("^(")
+		w.path(p.path)
+		w.sb.WriteString(")")
+	case sequencePath:
+		w.pathList(p.paths, "/")
+	case alternativePath:
+		w.pathList(p.paths, "|")
+	case modPath:
+		w.sb.WriteString("(")
+		w.path(p.path)
+		w.sb.WriteString(")" + string(p.mod))
+	case negatedPath:
+		var parts []string
+		for _, iri := range p.forward {
+			parts = append(parts, w.term(iri))
+		}
+		for _, iri := range p.inverse {
+			parts = append(parts, "^"+w.term(iri))
+		}
+		w.sb.WriteString("!(" + strings.Join(parts, "|") + ")")
+	}
+}
+
+func (w *sparqlWriter) pathList(paths []pathExpr, sep string) {
+	w.sb.WriteString("(")
+	for i, p := range paths {
+		if i > 0 {
+			w.sb.WriteString(sep)
+		}
+		w.path(p)
+	}
+	w.sb.WriteString(")")
+}
+
+func (w *sparqlWriter) expr(e sparqlExpr) {
+	switch e := e.(type) {
+	case varExpr:
+		w.sb.WriteString("?" + e.name)
+	case constExpr:
+		w.sb.WriteString(w.term(e.term))
+	case binaryExpr:
+		w.sb.WriteString("(")
+		w.expr(e.left)
+		w.sb.WriteString(" " + e.op + " ")
+		w.expr(e.right)
+		w.sb.WriteString(")")
+	case unaryExpr:
+		w.sb.WriteString(e.op + "(")
+		w.expr(e.expr)
+		w.sb.WriteString(")")
+	case inExpr:
+		w.sb.WriteString("(")
+		w.expr(e.expr)
+		if e.negated {
+			w.sb.WriteString(" NOT")
+		}
+		w.sb.WriteString(" IN ")
+		w.exprList(e.list)
+		w.sb.WriteString(")")
+	case callExpr:
+		if e.cast {
+			w.sb.WriteString(w.iri(e.name))
+		} else {
+			w.sb.WriteString(e.name)
+		}
+		w.exprList(e.args)
+	case existsExpr:
+		if e.negated {
+			w.sb.WriteString("NOT ")
+		}
+		w.sb.WriteString("EXISTS ")
+		w.group(e.group)
+	case *aggregateExpr:
+		w.sb.WriteString(e.name + "(")
+		if e.distinct {
+			w.sb.WriteString("DISTINCT ")
+		}
+		if e.star {
+			w.sb.WriteString("*")
+		} else {
+			w.expr(e.expr)
+		}
+		if e.name == "GROUP_CONCAT" && e.separator != " " {
+			w.sb.WriteString(" ; SEPARATOR = " + rdf.Literal{Value: e.separator}.String())
+		}
+		w.sb.WriteString(")")
+	}
+}
+
+func (w *sparqlWriter) exprList(list []sparqlExpr) {
+	w.sb.WriteString("(")
+	for i, e := range list {
+		if i > 0 {
+			w.sb.WriteString(", ")
+		}
+		w.expr(e)
+	}
+	w.sb.WriteString(")")
+}
+
+func (w *sparqlWriter) patternTerm(p patternTerm) string {
+	if p.isVar() {
+		return "?" + p.variable
+	}
+	return w.term(p.term)
+}
+
+// iri writes the IRI as a prefixed name if possible
+func (w *sparqlWriter) iri(iri string) string {
+	for _, n := range w.namespaces {
+		if strings.HasPrefix(iri, n.namespace) && pnameLocal.MatchString(iri[len(n.namespace):]) {
+			return n.prefix + iri[len(n.namespace):]
+		}
+	}
+	return "<" + iri + ">"
+}
+
+// bareLiterals matches the lexical forms of numbers and booleans that can be written without
+// their datatype
+var bareLiterals = map[string]*regexp.Regexp{
+	_xsd + "integer": regexp.MustCompile(`^[0-9]+$`),
+	_xsd + "decimal": regexp.MustCompile(`^[0-9]*\.[0-9]+$`),
+	_xsd + "double":  regexp.MustCompile(`^([0-9]+\.?[0-9]*|\.[0-9]+)[eE][+-]?[0-9]+$`),
+	_xsd + "boolean": regexp.MustCompile(`^(true|false)$`),
+}
+
+// term writes the constant term. Strings are written without datatype, as stores not following
+// RDF 1.1 tell them apart from literals typed as xsd:string.
+func (w *sparqlWriter) term(t memTerm) string {
+	switch t.kind {
+	case iriKind:
+		return w.iri(t.value)
+	case blankKind:
+		return "_:" + t.value
+	case literalKind:
+		if re, ok := bareLiterals[t.datatype]; ok && re.MatchString(t.value) {
+			return t.value
+		}
+		lit := rdf.Literal{Value: t.value, Language: t.lang}
+		s := lit.String()
+		if t.lang == "" && t.datatype != "" && t.datatype != _xsd+"string" {
+			s += "^^" + w.iri(t.datatype)
+		}
+		return s
+	}
+	return "UNDEF"
+}
+
+// variables
+
+// renaming maps variables to their new names
+type renaming map[string]string
+
+func (r renaming) name(v string) string {
+	if n, ok := r[v]; ok {
+		return n
+	}
+	return v
+}
+
+// renameVars renames the variables of the query as given by the mapping, producing a new query.
+// Other variables named like one of the new names are renamed to fresh ones, so that no
+// variable is captured, and so are the variables local to sub-queries.
+func renameVars(q *sparqlQuery, mapping map[string]string) *sparqlQuery {
+	used := make(map[string]bool)
+	allVars(q, used)
+	targets := make(map[string]bool)
+	for _, n := range mapping {
+		targets[n] = true
+		used[n] = true
+	}
+
+	r := make(renaming)
+	for v, n := range mapping {
+		r[v] = n
+	}
+	for _, v := range sortedKeys(used) {
+		if _, renamed := mapping[v]; !renamed && targets[v] {
+			r[v] = freshVar(v, used)
+		}
+	}
+
+	return r.query(q, used)
+}
+
+// freshVar returns a variable name based on the given one that is not used yet, marking it as
+// used
+func freshVar(base string, used map[string]bool) string {
+	for i := 0; ; i++ {
+		name := fmt.Sprint(base, "_", i)
+		if !used[name] {
+			used[name] = true
+			return name
+		}
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	var out []string
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// allVars collects the names of all variables occurring in the query, including those local
+// to its sub-queries
+func allVars(q *sparqlQuery, out map[string]bool) {
+	for _, p := range q.project {
+		out[p.variable] = true
+		exprVars(p.expr, out)
+	}
+	groupVars(q.where, out, true)
+	for _, p := range q.groupBy {
+		if p.variable != "" {
+			out[p.variable] = true
+		}
+		exprVars(p.expr, out)
+	}
+	for _, e := range q.having {
+		exprVars(e, out)
+	}
+	for _, c := range q.orderBy {
+		exprVars(c.expr, out)
+	}
+}
+
+// groupVars collects the variables of the group pattern. If local is false, the variables
+// local to sub-queries and the variables only occurring in expressions are skipped, giving the
+// variables in scope, as projected by SELECT *.
+func groupVars(g *groupPattern, out map[string]bool, local bool) {
+	add := func(p patternTerm) {
+		if p.isVar() {
+			out[p.variable] = true
+		}
+	}
+
+	for _, e := range g.elements {
+		switch e := e.(type) {
+		case *triplesBlock:
+			for _, tp := range e.triples {
+				add(tp.subject)
+				add(tp.predicate)
+				add(tp.object)
+			}
+		case *groupPattern:
+			groupVars(e, out, local)
+		case *subSelectPattern:
+			if local {
+				allVars(e.query, out)
+			} else if e.query.star {
+				groupVars(e.query.where, out, false)
+			} else {
+				for _, v := range e.query.projected() {
+					out[v] = true
+				}
+			}
+		case *optionalPattern:
+			groupVars(e.group, out, local)
+		case *minusPattern:
+			if local {
+				groupVars(e.group, out, local)
+			}
+		case *unionPattern:
+			for _, b := range e.branches {
+				groupVars(b, out, local)
+			}
+		case *graphPattern:
+			add(e.graph)
+			groupVars(e.group, out, local)
+		case *filterPattern:
+			if local {
+				exprVars(e.expr, out)
+			}
+		case *bindPattern:
+			out[e.variable] = true
+			if local {
+				exprVars(e.expr, out)
+			}
+		case *valuesPattern:
+			for _, v := range e.vars {
+				out[v] = true
+			}
+		case *verbatimPattern:
+			for _, v := range e.vars {
+				out[v] = true
+			}
+		}
+	}
+}
+
+func exprVars(e sparqlExpr, out map[string]bool) {
+	switch e := e.(type) {
+	case varExpr:
+		out[e.name] = true
+	case binaryExpr:
+		exprVars(e.left, out)
+		exprVars(e.right, out)
+	case unaryExpr:
+		exprVars(e.expr, out)
+	case inExpr:
+		exprVars(e.expr, out)
+		for _, l := range e.list {
+			exprVars(l, out)
+		}
+	case callExpr:
+		for _, a := range e.args {
+			exprVars(a, out)
+		}
+	case existsExpr:
+		groupVars(e.group, out, true)
+	case *aggregateExpr:
+		exprVars(e.expr, out)
+	}
+}
+
+// query renames the variables throughout the query, producing a copy
+func (r renaming) query(q *sparqlQuery, used map[string]bool) *sparqlQuery {
+	out := *q
+	out.project = r.projections(q.project, used)
+	out.where = r.group(q.where, used)
+	out.groupBy = r.projections(q.groupBy, used)
+	out.having = nil
+	for _, e := range q.having {
+		out.having = append(out.having, r.expr(e, used))
+	}
+	out.orderBy = nil
+	for _, c := range q.orderBy {
+		out.orderBy = append(out.orderBy, orderCondition{expr: r.expr(c.expr, used), descending: c.descending})
+	}
+	return &out
+}
+
+// subquery renames the variables projected by the sub-query, while its local variables are
+// renamed to fresh names if they would be captured by the new names
+func (r renaming) subquery(q *sparqlQuery, used map[string]bool) *sparqlQuery {
+	visible := make(map[string]bool)
+	if q.star {
+		groupVars(q.where, visible, false)
+	} else {
+		for _, v := range q.projected() {
+			visible[v] = true
+		}
+	}
+
+	inner := make(renaming)
+	targets := make(map[string]bool)
+	for v := range visible {
+		if n, ok := r[v]; ok {
+			inner[v] = n
+			targets[n] = true
+		}
+	}
+
+	local := make(map[string]bool)
+	allVars(q, local)
+	for _, v := range sortedKeys(local) {
+		if !visible[v] && targets[v] {
+			inner[v] = freshVar(v, used)
+		}
+	}
+
+	return inner.query(q, used)
+}
+
+func (r renaming) projections(ps []projection, used map[string]bool) []projection {
+	var out []projection
+	for _, p := range ps {
+		renamed := projection{expr: r.expr(p.expr, used)}
+		if p.variable != "" {
+			renamed.variable = r.name(p.variable)
+		}
+		out = append(out, renamed)
+	}
+	return out
+}
+
+func (r renaming) patternTerm(p patternTerm) patternTerm {
+	if p.isVar() {
+		return variable(r.name(p.variable))
+	}
+	return p
+}
+
+func (r renaming) group(g *groupPattern, used map[string]bool) *groupPattern {
+	out := &groupPattern{}
+	for _, e := range g.elements {
+		out.elements = append(out.elements, r.element(e, used))
+	}
+	return out
+}
+
+func (r renaming) element(e patternElement, used map[string]bool) patternElement {
+	switch e := e.(type) {
+	case *triplesBlock:
+		out := &triplesBlock{}
+		for _, tp := range e.triples {
+			out.triples = append(out.triples, triplePattern{
+				subject:   r.patternTerm(tp.subject),
+				predicate: r.patternTerm(tp.predicate),
+				path:      tp.path,
+				object:    r.patternTerm(tp.object),
+			})
+		}
+		return out
+	case *groupPattern:
+		return r.group(e, used)
+	case *subSelectPattern:
+		return subquery(r.subquery(e.query, used))
+	case *optionalPattern:
+		return &optionalPattern{group: r.group(e.group, used)}
+	case *minusPattern:
+		return &minusPattern{group: r.group(e.group, used)}
+	case *unionPattern:
+		out := &unionPattern{}
+		for _, b := range e.branches {
+			out.branches = append(out.branches, r.group(b, used))
+		}
+		return out
+	case *graphPattern:
+		return &graphPattern{graph: r.patternTerm(e.graph), group: r.group(e.group, used)}
+	case *filterPattern:
+		return filter(r.expr(e.expr, used))
+	case *bindPattern:
+		return &bindPattern{expr: r.expr(e.expr, used), variable: r.name(e.variable)}
+	case *valuesPattern:
+		out := &valuesPattern{rows: e.rows}
+		for _, v := range e.vars {
+			out.vars = append(out.vars, r.name(v))
+		}
+		return out
+	case *verbatimPattern:
+		out := &verbatimPattern{}
+		out.text = substituteVars(e.text, func(name string, _ byte) (string, bool) {
+			n, ok := r[name]
+			return "?" + n, ok
+		})
+		for _, v := range e.vars {
+			out.vars = append(out.vars, r.name(v))
+		}
+		return out
+	}
+	return e
+}
+
+func (r renaming) expr(e sparqlExpr, used map[string]bool) sparqlExpr {
+	switch e := e.(type) {
+	case varExpr:
+		return varExpr{name: r.name(e.name)}
+	case binaryExpr:
+		return binaryExpr{op: e.op, left: r.expr(e.left, used), right: r.expr(e.right, used)}
+	case unaryExpr:
+		return unaryExpr{op: e.op, expr: r.expr(e.expr, used)}
+	case inExpr:
+		out := inExpr{expr: r.expr(e.expr, used), negated: e.negated}
+		for _, l := range e.list {
+			out.list = append(out.list, r.expr(l, used))
+		}
+		return out
+	case callExpr:
+		out := callExpr{name: e.name, cast: e.cast}
+		for _, a := range e.args {
+			out.args = append(out.args, r.expr(a, used))
+		}
+		return out
+	case existsExpr:
+		return existsExpr{group: r.group(e.group, used), negated: e.negated}
+	case *aggregateExpr:
+		out := *e
+		out.expr = r.expr(e.expr, used)
+		return &out
+	}
+	return e
+}
+
+// assembleQuery serializes the generated query for the page, as assembled by assembledQuery
+func (r *validationRun) assembleQuery(q *sparqlQuery, page queryPage) string {
+	paged := *r.assembledQuery(q) // the assembled query is shared by all pages
+	page.apply(&paged)
+	return serializeQuery(&paged)
+}
+
+// assembledQuery rewrites the generated query for the dialect of the run and optimizes it
+// unless disabled. Each query is assembled only once in a run, however often it is sent, paged,
+// profiled or printed.
+func (r *validationRun) assembledQuery(q *sparqlQuery) *sparqlQuery {
+	key := q.String()
+	r.mu.Lock()
+	out, ok := r.assembled[key]
+	r.mu.Unlock()
+	if ok {
+		return out
+	}
+
+	out = renameVars(q, nil) // a copy, as the generators share parts between queries
+	r.addInferenceGraph(out)
+	unrolled := r.dialect.rewrite(out)
+	if r.optimize {
+		optimizeQuery(out)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if prev, ok := r.assembled[key]; ok { // assembled concurrently, and counted there
+		return prev
+	}
+	r.assembled[key] = out
+	atomic.AddInt64(&r.unrolled, int64(unrolled))
+	return out
+}
@@ -0,0 +1,146 @@
+package shawell
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	rdf "github.com/cem-okulmus/rdf2go-1"
+)
+
+// algebraTestQueries cover the constructs of the algebra
+var algebraTestQueries = []string{
+	`SELECT ?x { <http://example.org/a> (<http://example.org/knows>/^<http://example.org/knows>)* ?x }`,
+	`SELECT ?x ?y { ?x !(<http://example.org/age>|^<http://example.org/knows>) ?y }`,
+	`SELECT DISTINCT ?x ?n { { SELECT ?x { ?x <http://example.org/knows> ?y } } OPTIONAL { ?x <http://example.org/name> ?n } FILTER(!bound(?n) || ?n IN ("Carl", "x\ty"@de)) }`,
+	`SELECT ?x (COUNT(DISTINCT ?y) AS ?c) (GROUP_CONCAT(str(?y); SEPARATOR=", ") AS ?all) { ?x <http://example.org/knows>* ?y } GROUP BY ?x HAVING (?c >= 2 && ?c * 2 - 1 > 0) ORDER BY DESC(?c) ?x`,
+	`PREFIX xsd: <http://www.w3.org/2001/XMLSchema#>
+	SELECT ?x ?i { ?x <http://example.org/age> ?v . BIND (xsd:integer(str(?v)) AS ?i) FILTER (?i NOT IN (1.5, -3, 4e2, true)) }`,
+	`SELECT ?x { { ?x <http://example.org/age> 42 } UNION { ?x <http://example.org/name> "Carl" } MINUS { ?x <http://example.org/knows> ?y } }`,
+	`SELECT ?x ?v { VALUES (?x ?v) { (<http://example.org/a> UNDEF) (<http://example.org/c> "Carl") } ?x ?p ?o }`,
+	`SELECT ?x { GRAPH ?g { ?x ?p ?o FILTER NOT EXISTS { ?x <http://example.org/age> ?a } } } LIMIT 5 OFFSET 0`,
+}
+
+// TestSerializeQuery checks that serialized queries parse into the same query again, and
+// produce the same results
+func TestSerializeQuery(t *testing.T) {
+	ep := algebraTestEndpoint(t)
+
+	for _, query := range algebraTestQueries {
+		q, err := parseSparql(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serialized := serializeQuery(q)
+
+		again, err := parseSparql(serialized)
+		if err != nil {
+			t.Errorf("%v\nfor serialized query\n%s", err, serialized)
+			continue
+		}
+		if got := serializeQuery(again); got != serialized {
+			t.Errorf("serialized query changed when parsed again:\n%s\n\n%s", serialized, got)
+		}
+
+		if got, want := queryResults(t, ep, serialized), queryResults(t, ep, query); got != want {
+			t.Errorf("got results\n%v\nwant\n%v\nfor serialized query\n%s", got, want, serialized)
+		}
+	}
+}
+
+// TestRenameVars checks that renaming a variable neither captures other variables of the query
+// nor those local to its sub-queries
+func TestRenameVars(t *testing.T) {
+	ep := algebraTestEndpoint(t)
+
+	query := `SELECT ?sub ?y ?c {
+		?sub <http://example.org/knows> ?y .
+		{ SELECT ?sub (COUNT(?y) AS ?c) { ?sub ?p ?y } GROUP BY ?sub }
+		FILTER EXISTS { ?y ?q ?o }
+	}`
+	q, err := parseSparql(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renamed := renameVars(q, map[string]string{"sub": "y"})
+	if got := strings.Join(renamed.projected(), " "); got != "y y_0 c" {
+		t.Errorf("got projection %v, want y y_0 c", got)
+	}
+
+	// apart from the header, the results are unchanged
+	want := queryResults(t, ep, query)
+	got := queryResults(t, ep, renamed.String())
+	if got[strings.Index(got, "\n"):] != want[strings.Index(want, "\n"):] {
+		t.Errorf("got results\n%v\nwant\n%v\nfor renamed query\n%s", got, want, renamed)
+	}
+}
+
+// TestProjectToVar checks that projecting a target query to another variable only renames its
+// variable ?sub
+func TestProjectToVar(t *testing.T) {
+	target := SparqlQueryFlat{head: project("?sub"), body: []patternElement{
+		triple(queryVar("?sub"), SimplePath{path: res("http://example.org/knows")}, queryVar("?subject")),
+		verbatim("?subject <http://example.org/name> ?sub"),
+	}}
+
+	out := target.ProjectToVar("obj", true).String()
+	for _, want := range []string{"?subject", "?OldSub", "(?obj AS ?sub)", "<http://example.org/name> ?OldSub"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %s in query\n%s", want, out)
+		}
+	}
+}
+
+func algebraTestEndpoint(t *testing.T) *MemoryEndpoint {
+	g := rdf.NewGraph("http://example.org/")
+	err := g.Parse(strings.NewReader(memoryTestData), "text/turtle")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ep, err := GetMemoryEndpoint(nil, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ep.Insert(context.Background(), g, "<http://example.org/graph>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ep
+}
+
+func queryResults(t *testing.T, ep Endpoint, query string) string {
+	t.Helper()
+
+	table, err := ep.QueryString(context.Background(), query)
+	if err != nil {
+		t.Fatalf("%v\nfor query\n%s", err, query)
+	}
+	return resultsString(table)
+}
+
+// TestAssembleVerbatim checks that user SPARQL, even if not understood by the parser, is sent
+// as given, while the query around it is assembled and paged
+func TestAssembleVerbatim(t *testing.T) {
+	run := newValidationRun(Options{})
+	user := "{ ?sub <http://example.org/p> ?y . SERVICE <http://example.org/s> { ?y ?p ?o } }"
+	if _, err := parseSparql("SELECT * " + user); err == nil {
+		t.Fatal("the user SPARQL of the test is understood by the parser")
+	}
+
+	query := SparqlQuery{
+		head:   project("?sub"),
+		target: group(values("?sub", []rdf.Term{res("http://example.org/a")})),
+		body:   []patternElement{verbatim(user)},
+	}
+	first := run.assembleQuery(query.algebra(true), queryPage{limit: 10})
+	if !strings.Contains(first, user) || !strings.Contains(first, "LIMIT 10") {
+		t.Errorf("got query\n%s\nwant the user SPARQL kept and the query paged", first)
+	}
+
+	again := run.assembleQuery(query.algebra(true), queryPage{limit: 10, offset: 10})
+	if !strings.Contains(again, "OFFSET 10") || run.assembleQuery(query.algebra(true), queryPage{limit: 10}) != first {
+		t.Errorf("got pages\n%s\n%s\nwant the second one offset only", first, again)
+	}
+}
@@ -0,0 +1,392 @@
+package shawell
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cem-okulmus/rdf2go-1"
+)
+
+// SparqlConstraint implements SHACL-SPARQL constraints (sh:sparql), as defined in Section 5 of
+// the SHACL standard. Each solution of the SELECT query, with $this bound to a focus node,
+// produces a validation result. As the shapes graph is not held by the endpoint, $shapesGraph
+// is left unbound. The instances of custom constraint components are represented the same way.
+type SparqlConstraint struct {
+	node        rdf2go.Term            // the node defining the constraint
+	shape       rdf2go.Term            // the shape the constraint belongs to, bound to $currentShape
+	component   rdf2go.Term            // the constraint component reported in the results
+	params      map[string]rdf2go.Term // values bound to the parameters of a custom component
+	query       string                 // the SELECT query, or the pattern of an ASK query
+	ask         bool                   // if set, the pattern must hold for each value node
+	message     map[string]rdf2go.Term // the sh:message templates, by language
+	deactivated bool
+	id          int64 // used to create unique references in Sparql translation
+}
+
+var (
+	prefixDecl = regexp.MustCompile(`^\s*(?i:PREFIX)\s+([A-Za-z0-9_.-]*:)\s*<([^>]*)>`)
+	messageVar = regexp.MustCompile(`\{[?$]([A-Za-z0-9_]+)\}`)
+	askQuery   = regexp.MustCompile(`(?is)^\s*ASK\s*(?:WHERE\s*)?(\{.*\})\s*$`)
+)
+
+// ExtractSparqlConstraint parses the SPARQL-based constraint that is the object of the given
+// sh:sparql triple.
+func ExtractSparqlConstraint(graph *rdf2go.Graph, triple *rdf2go.Triple) (out SparqlConstraint, err error) {
+	out.node = triple.Object
+	out.shape = triple.Subject
+	out.component = res(_sh + "SPARQLConstraintComponent")
+
+	out.query, err = extractSparqlQuery(graph, out.node, _sh+"select")
+	if err != nil {
+		return out, err
+	}
+	if !usesVar(out.query, "this") {
+		return out, &ParseError{Term: out.node.String(), Err: errors.New("SPARQL constraint does not use $this")}
+	}
+
+	out.message = extractMessages(graph, out.node)
+
+	if d := graph.One(out.node, res(_sh+"deactivated"), nil); d != nil {
+		out.deactivated = d.Object.RawValue() == "true"
+	}
+
+	out.id = getCount()
+	return out, nil
+}
+
+// extractSparqlQuery reads the query given via the predicate (sh:select or sh:ask) of the node.
+// Names using the prefixes declared via sh:prefixes, or in the query itself, are expanded to
+// full IRIs, since the query is embedded into larger ones.
+func extractSparqlQuery(graph *rdf2go.Graph, node rdf2go.Term, predicate string) (string, error) {
+	queries := graph.All(node, res(predicate), nil)
+	if len(queries) != 1 {
+		return "", &ParseError{
+			Term: node.String(),
+			Err:  fmt.Errorf("expected exactly one %v, found %d", abbr(predicate), len(queries)),
+		}
+	}
+
+	declared := make(map[string]string)
+	declare := func(prefix, namespace string) error {
+		if v, ok := declared[prefix]; ok && v != namespace {
+			return &ParseError{
+				Term: node.String(),
+				Err:  fmt.Errorf("prefix %v declared both for %v and %v", prefix, v, namespace),
+			}
+		}
+		declared[prefix] = namespace
+		return nil
+	}
+
+	for _, p := range graph.All(node, res(_sh+"prefixes"), nil) {
+		for _, d := range graph.All(p.Object, res(_sh+"declare"), nil) {
+			prefix := graph.One(d.Object, res(_sh+"prefix"), nil)
+			namespace := graph.One(d.Object, res(_sh+"namespace"), nil)
+			if prefix == nil || namespace == nil {
+				return "", &ParseError{
+					Term: p.Object.String(),
+					Err:  errors.New("sh:declare without sh:prefix and sh:namespace"),
+				}
+			}
+			err := declare(prefix.Object.RawValue()+":", namespace.Object.RawValue())
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	query := queries[0].Object.RawValue()
+	for {
+		decl := prefixDecl.FindStringSubmatch(query)
+		if decl == nil {
+			break
+		}
+		err := declare(decl[1], decl[2])
+		if err != nil {
+			return "", err
+		}
+		query = query[len(decl[0]):]
+	}
+
+	query, err := expandPrefixes(query, declared)
+	if err != nil {
+		return "", &ParseError{Term: node.String(), Err: err}
+	}
+
+	return query, nil
+}
+
+// extractMessages reads the sh:message values of the node, by language
+func extractMessages(graph *rdf2go.Graph, node rdf2go.Term) (out map[string]rdf2go.Term) {
+	for _, m := range graph.All(node, res(_sh+"message"), nil) {
+		if out == nil {
+			out = make(map[string]rdf2go.Term)
+		}
+		if l, ok := m.Object.(*rdf2go.Literal); ok && l.Language != "" {
+			out[l.Language] = m.Object
+		} else {
+			out["en"] = m.Object
+		}
+	}
+	return out
+}
+
+// expandPrefixes replaces the prefixed names in the query that use one of the given prefixes
+// by the full IRIs
+func expandPrefixes(query string, declared map[string]string) (string, error) {
+	tokens, err := lexSparql(query)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	last := 0
+	for _, t := range tokens {
+		if t.kind != tokPName {
+			continue
+		}
+		idx := strings.Index(t.value, ":")
+		namespace, ok := declared[t.value[:idx+1]]
+		if !ok {
+			continue
+		}
+
+		// find the end of the name in the query, whose local part may contain escapes
+		end := t.pos
+		for matched := 0; matched < len(t.value); end++ {
+			if query[end] != '\\' {
+				matched++
+			}
+		}
+
+		sb.WriteString(query[last:t.pos])
+		sb.WriteString("<" + namespace + t.value[idx+1:] + ">")
+		last = end
+	}
+	sb.WriteString(query[last:])
+
+	return sb.String(), nil
+}
+
+// substituteVars replaces the variables of the query for which bind returns a substitute. It
+// works on the tokens of the query, so that IRIs, strings and comments are left untouched. The
+// sigil ('?' or '$') is passed along, for variables that are only pre-bound in one form. As the
+// queries are lexed when extracted, lexing cannot fail here; if it does, the query is returned
+// as it is.
+func substituteVars(query string, bind func(name string, sigil byte) (string, bool)) string {
+	tokens, err := lexSparql(query)
+	if err != nil {
+		return query
+	}
+
+	var sb strings.Builder
+	last := 0
+	for _, t := range tokens {
+		if t.kind != tokVar {
+			continue
+		}
+		with, ok := bind(t.value, query[t.pos])
+		if !ok {
+			continue
+		}
+
+		sb.WriteString(query[last:t.pos])
+		sb.WriteString(with)
+		last = t.pos + 1 + len(t.value)
+	}
+	sb.WriteString(query[last:])
+
+	return sb.String()
+}
+
+// usesVar reports whether the variable occurs in the query
+func usesVar(query, name string) bool {
+	tokens, err := lexSparql(query)
+	if err != nil {
+		return false
+	}
+	for _, t := range tokens {
+		if t.kind == tokVar && t.value == name {
+			return true
+		}
+	}
+	return false
+}
+
+// prebind substitutes the pre-bound variables of the query, with $this becoming ?sub, the
+// variable used for focus nodes throughout the generated queries. For ASK queries, $value is
+// bound to the focus node in node shapes, and to the variable of the value nodes otherwise.
+func (v SparqlConstraint) prebind(path PropertyPath) string {
+	_, blankShape := v.shape.(*rdf2go.BlankNode)
+
+	return substituteVars(v.query, func(name string, sigil byte) (string, bool) {
+		switch {
+		case name == "this":
+			return "?sub", true
+		case name == "sub": // would clash with the variable used for focus nodes
+			return fmt.Sprint("?sub", v.id), true
+		case name == "value" && v.ask:
+			if path == nil {
+				return "?sub", true
+			}
+			return v.valueName(), true
+		case v.params[name] != nil:
+			return v.params[name].String(), true
+		case name == "PATH" && sigil == '$' && path != nil:
+			return path.PropertyString(), true
+		case name == "currentShape" && !blankShape:
+			return v.shape.String(), true
+		}
+		return "", false
+	})
+}
+
+// valueName is the variable used for the value nodes of ASK queries in property shapes
+func (v SparqlConstraint) valueName() string {
+	return fmt.Sprint("?value", v.id)
+}
+
+func (v SparqlConstraint) String() string {
+	if v.component.RawValue() == _sh+"SPARQLConstraintComponent" {
+		return fmt.Sprint(_sh, "sparql ", strings.Join(strings.Fields(v.query), " "))
+	}
+
+	var params []string
+	for name, value := range v.params {
+		params = append(params, fmt.Sprint(name, " ", value))
+	}
+	sort.Strings(params)
+
+	return fmt.Sprint(v.component, " (", strings.Join(params, ", "), ")")
+}
+
+// SparqlBody only keeps the focus nodes for which the SELECT query has no solution, or for
+// which the ASK query holds on all value nodes
+func (v SparqlConstraint) SparqlBody(obj string, path PropertyPath) (out []patternElement) {
+	if v.deactivated {
+		return nil
+	}
+
+	switch {
+	case !v.ask:
+		out = append(out, filterNotExists(verbatim(v.prebind(path))))
+	case path == nil:
+		out = append(out, filterExists(verbatim(v.prebind(path))))
+	default:
+		out = append(out, filterNotExists(triple(queryVar("?sub"), path, queryVar(v.valueName())),
+			filterNotExists(verbatim(v.prebind(path)))))
+	}
+
+	return out
+}
+
+func (v SparqlConstraint) SparqlCheck(ctx context.Context, ep Endpoint, obj string, path PropertyPath, shapeName rdf2go.Term, target SparqlQueryFlat) (result bool, reports []ValidationResult, err error) {
+	result = true
+	if v.deactivated {
+		return result, reports, nil
+	}
+
+	targetLine := target.pattern()
+
+	var body []patternElement
+	switch {
+	case !v.ask:
+		body = append(body, verbatim(v.prebind(path)))
+	case path == nil:
+		body = append(body, filterNotExists(verbatim(v.prebind(path))))
+	default:
+		body = append(body, triple(queryVar("?sub"), path, queryVar(v.valueName())),
+			filterNotExists(verbatim(v.prebind(path))))
+	}
+
+	checkQuery := SparqlQuery{
+		target: targetLine,
+		body:   body,
+		graph:  ep.GetGraph(),
+	}
+
+	table, err := ep.Query(ctx, checkQuery)
+	if err != nil {
+		return false, nil, err
+	}
+	header := table.GetHeader()
+
+	for row := range table.IterRows() {
+		bindings := make(map[string]rdf2go.Term)
+		for name, value := range v.params {
+			bindings[name] = value
+		}
+		for i, h := range header {
+			name := strings.TrimPrefix(h, "?")
+			if v.ask && name == v.valueName()[1:] {
+				name = "value"
+			}
+			if !isUnbound(row[i]) {
+				bindings[name] = row[i]
+			}
+		}
+		focus, ok := bindings["sub"]
+		if !ok {
+			continue
+		}
+		if f, ok := bindings["failure"]; ok && f.RawValue() == "true" {
+			return false, nil, fmt.Errorf("SPARQL constraint %v reported a failure for %v", v.node, focus)
+		}
+		bindings["this"] = focus
+		bindings["currentShape"] = shapeName
+
+		var report ValidationResult
+		report.focusNode = focus
+		report.sourceShape = shapeName
+		report.sourceConstraintComponent = v.component
+
+		report.pathName = path
+		if p, ok := bindings["path"]; ok {
+			report.pathName = SimplePath{path: p}
+		}
+		if value, ok := bindings["value"]; ok {
+			report.value = value
+		} else if path == nil {
+			report.value = focus
+		}
+
+		if m, ok := bindings["message"]; ok {
+			report.message = map[string]rdf2go.Term{"en": m}
+		} else if len(v.message) > 0 {
+			report.message = make(map[string]rdf2go.Term)
+			for lang, m := range v.message {
+				report.message[lang] = templateMessage(m, lang, bindings)
+			}
+		}
+
+		reports = append(reports, report)
+		result = false
+	}
+
+	return result, reports, nil
+}
+
+// templateMessage replaces the {$var} and {?var} placeholders in the message with the values
+// bound to these variables
+func templateMessage(message rdf2go.Term, lang string, bindings map[string]rdf2go.Term) rdf2go.Term {
+	text := messageVar.ReplaceAllStringFunc(message.RawValue(), func(s string) string {
+		b, ok := bindings[messageVar.FindStringSubmatch(s)[1]]
+		if !ok {
+			return s
+		}
+		switch b.(type) {
+		case rdf2go.Literal, *rdf2go.Literal:
+			return b.RawValue()
+		}
+		return b.String()
+	})
+
+	if l, ok := message.(*rdf2go.Literal); ok && l.Language != "" {
+		return rdf2go.NewLiteralWithLanguage(text, lang)
+	}
+	return rdf2go.NewLiteral(text)
+}
@@ -0,0 +1,443 @@
+package shawell
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	rdf "github.com/cem-okulmus/rdf2go-1"
+)
+
+const sparqlTestShapes = `
+@prefix sh: <http://www.w3.org/ns/shacl#> .
+@prefix ex: <http://example.org/> .
+
+ex:prefixes sh:declare [ sh:prefix "ex" ; sh:namespace "http://example.org/" ] .
+
+ex:PersonShape a sh:NodeShape ;
+	sh:targetClass ex:Person ;
+	sh:sparql [
+		a sh:SPARQLConstraint ;
+		sh:message "{$this} has the non-English label {?value}" ;
+		sh:prefixes ex:prefixes ;
+		sh:select """
+			PREFIX rdfs: <http://www.w3.org/2000/01/rdf-schema#>
+			SELECT $this ?value WHERE {
+				$this rdfs:label ?value .
+				FILTER (!langMatches(lang(?value), "en"))
+			}""" ;
+	] ;
+	sh:property [
+		sh:path ex:age ;
+		sh:sparql [
+			sh:select "SELECT $this ?value WHERE { $this $PATH ?value . FILTER (?value < 18) }" ;
+		] ;
+	] .
+`
+
+const sparqlTestData = `
+@prefix ex: <http://example.org/> .
+@prefix rdfs: <http://www.w3.org/2000/01/rdf-schema#> .
+
+ex:Alice a ex:Person ; rdfs:label "Alice"@en ; ex:age 30 .
+ex:Bob a ex:Person ; rdfs:label "Bob"@de ; ex:age 12 .
+`
+
+// validateTurtle validates the data against the shapes, both given in Turtle, in memory
+func validateTurtle(t *testing.T, shapesTurtle, dataTurtle string, opts Options) *ValidationReport {
+	t.Helper()
+
+	shapes := rdf.NewGraph("http://example.org/")
+	err := shapes.Parse(strings.NewReader(shapesTurtle), "text/turtle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := rdf.NewGraph("http://example.org/")
+	err = data.Parse(strings.NewReader(dataTurtle), "text/turtle")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ep, err := GetMemoryEndpoint(nil, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ep.Insert(context.Background(), data, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Validate(context.Background(), shapes, ep, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+// TestSparqlConstraint checks SPARQL-based constraints, with pre-bound variables and message
+// templating, in both node and property shapes
+func TestSparqlConstraint(t *testing.T) {
+	report := validateTurtle(t, sparqlTestShapes, sparqlTestData, Options{})
+	if report.Conforms() {
+		t.Fatal("expected report not to conform")
+	}
+
+	var got []string
+	for _, r := range report.Results() {
+		if r.SourceConstraintComponent().RawValue() != _sh+"SPARQLConstraintComponent" {
+			t.Errorf("unexpected constraint component %v", r.SourceConstraintComponent())
+		}
+		got = append(got, r.FocusNode().RawValue()+" "+r.Value().RawValue())
+		if r.ResultPath() == nil {
+			want := "<http://example.org/Bob> has the non-English label Bob"
+			if m := r.Messages()["en"]; m == nil || m.RawValue() != want {
+				t.Errorf("got message %v, want %v", m, want)
+			}
+		}
+	}
+	sort.Strings(got)
+
+	want := "http://example.org/Bob 12,http://example.org/Bob Bob"
+	if strings.Join(got, ",") != want {
+		t.Errorf("got results %v, want %v", got, want)
+	}
+}
+
+// TestSparqlPrebind checks that only the variables of SPARQL-based constraints are pre-bound,
+// leaving IRIs and strings that merely look like them intact, and that constraints without
+// $this are rejected
+func TestSparqlPrebind(t *testing.T) {
+	shapes := `
+@prefix sh: <http://www.w3.org/ns/shacl#> .
+@prefix ex: <http://example.org/> .
+
+ex:S a sh:NodeShape ;
+	sh:targetNode ex:a ;
+	sh:sparql [
+		sh:select """SELECT $this ?value WHERE {
+			$this <http://example.org/search?sub=1&this=2> ?value .
+			FILTER (?value != "$this ?sub")
+		}""" ;
+	] .
+`
+	data := `
+@prefix ex: <http://example.org/> .
+
+ex:a <http://example.org/search?sub=1&this=2> "x", "$this ?sub" .
+`
+	report := validateTurtle(t, shapes, data, Options{})
+
+	var got []string
+	for _, r := range report.Results() {
+		got = append(got, r.Value().RawValue())
+	}
+	if len(got) != 1 || got[0] != "x" {
+		t.Errorf("got values %v, want x", got)
+	}
+
+	noThis := `
+@prefix sh: <http://www.w3.org/ns/shacl#> .
+@prefix ex: <http://example.org/> .
+
+ex:S a sh:NodeShape ;
+	sh:targetNode ex:a ;
+	sh:sparql [ sh:select "SELECT ?value WHERE { ?x <http://example.org/p?this> ?value }" ] .
+`
+	graph := rdf.NewGraph("http://example.org/")
+	err := graph.Parse(strings.NewReader(noThis), "text/turtle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := GetMemoryEndpoint(nil, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Validate(context.Background(), graph, ep, Options{})
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		t.Errorf("got error %v, want a ParseError", err)
+	}
+}
+
+const componentTestShapes = `
+@prefix sh: <http://www.w3.org/ns/shacl#> .
+@prefix ex: <http://example.org/> .
+
+ex:LanguageComponent a sh:ConstraintComponent ;
+	sh:parameter [ sh:path ex:lang ] ;
+	sh:validator [
+		a sh:SPARQLAskValidator ;
+		sh:message "Values are literals with language {$lang}" ;
+		sh:ask "ASK { FILTER (isLiteral($value) && langMatches(lang($value), $lang)) }" ;
+	] .
+
+ex:MaxAgeComponent a sh:ConstraintComponent ;
+	sh:parameter [ sh:path ex:maxAge ] ;
+	sh:parameter [ sh:path ex:unused ; sh:optional true ] ;
+	sh:nodeValidator [
+		a sh:SPARQLSelectValidator ;
+		sh:prefixes [ sh:declare [ sh:prefix "e" ; sh:namespace "http://example.org/" ] ] ;
+		sh:select "SELECT $this ?value WHERE { $this e:age ?value . FILTER (?value > $maxAge) }" ;
+	] .
+
+ex:PersonShape a sh:NodeShape ;
+	sh:targetClass ex:Person ;
+	ex:maxAge 65 ;
+	sh:property [ sh:path ex:label ; ex:lang "en" ] .
+
+ex:LabelShape a sh:NodeShape ;
+	sh:targetObjectsOf ex:label ;
+	ex:lang "en" .
+`
+
+const componentTestData = `
+@prefix ex: <http://example.org/> .
+
+ex:Alice a ex:Person ; ex:label "Alice"@en ; ex:age 30 .
+ex:Bob a ex:Person ; ex:label "Bob"@de, "Bobby"@en ; ex:age 70 .
+`
+
+// TestConstraintComponent checks custom constraint components, using ASK validators in node and
+// property shapes, as well as SELECT validators with parameters
+func TestConstraintComponent(t *testing.T) {
+	report := validateTurtle(t, componentTestShapes, componentTestData, Options{})
+
+	var got []string
+	for _, r := range report.Results() {
+		got = append(got, fmt.Sprint(localName(r.SourceConstraintComponent().RawValue()), " ",
+			r.FocusNode().RawValue(), " ", r.Value().RawValue()))
+
+		if r.ResultPath() != nil {
+			want := "Values are literals with language en"
+			if m := r.Messages()["en"]; m == nil || m.RawValue() != want {
+				t.Errorf("got message %v, want %v", m, want)
+			}
+		}
+	}
+	sort.Strings(got)
+
+	want := []string{
+		"LanguageComponent Bob Bob",
+		"LanguageComponent http://example.org/Bob Bob",
+		"MaxAgeComponent http://example.org/Bob 70",
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got results %v, want %v", got, want)
+	}
+}
+
+// TestComponentParameters checks that only the parameter variables of custom constraint
+// components are pre-bound, and that components without a validator for the shape are rejected
+func TestComponentParameters(t *testing.T) {
+	shapes := `
+@prefix sh: <http://www.w3.org/ns/shacl#> .
+@prefix ex: <http://example.org/> .
+
+ex:MaxComponent a sh:ConstraintComponent ;
+	sh:parameter [ sh:path ex:max ] ;
+	sh:validator [
+		a sh:SPARQLSelectValidator ;
+		sh:select """SELECT $this ?value WHERE {
+			$this <http://example.org/value?max=1> ?value .
+			FILTER (?value > $max)
+		}""" ;
+	] .
+
+ex:S a sh:NodeShape ;
+	sh:targetNode ex:a ;
+	ex:max 3 .
+`
+	data := `
+@prefix ex: <http://example.org/> .
+
+ex:a <http://example.org/value?max=1> 2, 5 .
+`
+	report := validateTurtle(t, shapes, data, Options{})
+
+	var got []string
+	for _, r := range report.Results() {
+		got = append(got, r.Value().RawValue())
+	}
+	if len(got) != 1 || got[0] != "5" {
+		t.Errorf("got values %v, want 5", got)
+	}
+
+	noValidator := `
+@prefix sh: <http://www.w3.org/ns/shacl#> .
+@prefix ex: <http://example.org/> .
+
+ex:MaxComponent a sh:ConstraintComponent ;
+	sh:parameter [ sh:path ex:max ] ;
+	sh:propertyValidator [ sh:select "SELECT $this ?value WHERE { $this $PATH ?value }" ] .
+
+ex:S a sh:NodeShape ;
+	sh:targetNode ex:a ;
+	ex:max 3 .
+`
+	graph := rdf.NewGraph("http://example.org/")
+	err := graph.Parse(strings.NewReader(noValidator), "text/turtle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := GetMemoryEndpoint(nil, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Validate(context.Background(), graph, ep, Options{})
+	var unsupported *UnsupportedFeatureError
+	if !errors.As(err, &unsupported) {
+		t.Errorf("got error %v, want an UnsupportedFeatureError", err)
+	}
+}
+
+const targetTestShapes = `
+@prefix sh: <http://www.w3.org/ns/shacl#> .
+@prefix ex: <http://example.org/> .
+
+ex:PersonCountryTarget a sh:SPARQLTargetType ;
+	sh:parameter [ sh:path ex:country ] ;
+	sh:select """
+		PREFIX ex: <http://example.org/>
+		SELECT ?this WHERE { ?this a ex:Person ; ex:country $country . }""" .
+
+ex:GermanShape a sh:NodeShape ;
+	sh:target [ a ex:PersonCountryTarget ; ex:country ex:Germany ] ;
+	sh:property [ sh:path ex:knows ; sh:node ex:NamedShape ] .
+
+ex:NamedShape a sh:NodeShape ;
+	sh:property [ sh:path ex:name ; sh:minCount 1 ] .
+
+ex:AdultShape a sh:NodeShape ;
+	sh:target [
+		a sh:SPARQLTarget ;
+		sh:select "SELECT $this WHERE { $this <http://example.org/age> ?a . FILTER (?a >= 18) }" ;
+	] ;
+	sh:class ex:Person .
+`
+
+const targetTestData = `
+@prefix ex: <http://example.org/> .
+
+ex:Alice a ex:Person ; ex:country ex:Germany ; ex:knows ex:Dan ; ex:age 30 .
+ex:Carl a ex:Person ; ex:country ex:France ; ex:knows ex:Dan .
+ex:Dan ex:age 40 .
+`
+
+// TestSparqlTarget checks SPARQL-based targets and target types, including the propagation of
+// the targets to referenced shapes
+func TestSparqlTarget(t *testing.T) {
+	for _, forceLP := range []bool{false, true} {
+		report := validateTurtle(t, targetTestShapes, targetTestData, Options{ForceLP: forceLP})
+
+		var got []string
+		for _, r := range report.Results() {
+			got = append(got, fmt.Sprint(localName(r.SourceConstraintComponent().RawValue()), " ",
+				r.FocusNode().RawValue()))
+		}
+		sort.Strings(got)
+
+		want := "ClassConstraintComponent http://example.org/Dan,NodeConstraintComponent http://example.org/Alice"
+		if strings.Join(got, ",") != want {
+			t.Errorf("forceLP %v: got results %v, want %v", forceLP, got, want)
+		}
+	}
+}
+
+// TestSparqlTargetPrebind checks that only the variables of SPARQL-based targets are pre-bound,
+// and that targets not selecting $this are rejected
+func TestSparqlTargetPrebind(t *testing.T) {
+	shapes := `
+@prefix sh: <http://www.w3.org/ns/shacl#> .
+@prefix ex: <http://example.org/> .
+
+ex:S a sh:NodeShape ;
+	sh:target [
+		a sh:SPARQLTarget ;
+		sh:select "SELECT $this WHERE { $this <http://example.org/p?this=1> ?sub }" ;
+	] ;
+	sh:class ex:C .
+`
+	data := `
+@prefix ex: <http://example.org/> .
+
+ex:a <http://example.org/p?this=1> ex:b .
+`
+	report := validateTurtle(t, shapes, data, Options{})
+
+	var got []string
+	for _, r := range report.Results() {
+		got = append(got, r.FocusNode().RawValue())
+	}
+	if len(got) != 1 || got[0] != "http://example.org/a" {
+		t.Errorf("got focus nodes %v, want ex:a", got)
+	}
+
+	noThis := `
+@prefix sh: <http://www.w3.org/ns/shacl#> .
+@prefix ex: <http://example.org/> .
+
+ex:S a sh:NodeShape ;
+	sh:target [ a sh:SPARQLTarget ; sh:select "SELECT ?x WHERE { ?x <http://example.org/p?this=1> ?y }" ] ;
+	sh:class ex:C .
+`
+	graph := rdf.NewGraph("http://example.org/")
+	err := graph.Parse(strings.NewReader(noThis), "text/turtle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := GetMemoryEndpoint(nil, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Validate(context.Background(), graph, ep, Options{})
+	var parseErr *ParseError
+	if !errors.As(err, &parseErr) {
+		t.Errorf("got error %v, want a ParseError", err)
+	}
+}
+
+// TestUnboundCells checks that blank nodes of the data are not mistaken for unbound variables,
+// even when named like the terms filling unbound cells
+func TestUnboundCells(t *testing.T) {
+	shapes := rdf.NewGraph("http://example.org/")
+	err := shapes.Parse(strings.NewReader(`
+@prefix sh: <http://www.w3.org/ns/shacl#> .
+@prefix ex: <http://example.org/> .
+
+ex:S a sh:NodeShape ;
+	sh:targetNode ex:a ;
+	sh:sparql [ sh:select "SELECT $this ?value WHERE { $this <http://example.org/p> ?value }" ] .
+`), "text/turtle")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := rdf.NewGraph("http://example.org/")
+	data.AddTriple(rdf.NewResource("http://example.org/a"), rdf.NewResource("http://example.org/p"),
+		rdf.NewBlankNode("blank1"))
+	ep, err := GetMemoryEndpoint(nil, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ep.Insert(context.Background(), data, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Validate(context.Background(), shapes, ep, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Results()) != 1 {
+		t.Fatalf("got %d results, want 1", len(report.Results()))
+	}
+	if v := report.Results()[0].Value(); v == nil || !strings.Contains(v.RawValue(), "blank1") {
+		t.Errorf("got value %v, want the blank node", v)
+	}
+}
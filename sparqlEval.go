@@ -0,0 +1,2066 @@
+package shawell
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	rdf "github.com/cem-okulmus/rdf2go-1"
+)
+
+// This file contains the evaluation of parsed SPARQL queries over in-memory RDF graphs, as used
+// by the MemoryEndpoint. Results follow the same conventions as those returned by a SPARQL
+// server via GetTable, so that the rest of shaWell cannot tell the two apart.
+
+type termKind int8
+
+const (
+	unboundKind termKind = iota
+	iriKind
+	blankKind
+	literalKind
+)
+
+// memTerm is the comparable representation of an RDF term used during evaluation
+type memTerm struct {
+	kind     termKind
+	value    string // IRI, blank node label or lexical form
+	lang     string
+	datatype string // always set for literals
+}
+
+func iriTerm(iri string) memTerm { return memTerm{kind: iriKind, value: iri} }
+
+func literalTerm(value, lang, datatype string) memTerm {
+	if lang != "" {
+		datatype = _rdf + "langString"
+	} else if datatype == "" {
+		datatype = _xsd + "string"
+	}
+	return memTerm{kind: literalKind, value: value, lang: lang, datatype: datatype}
+}
+
+func boolTerm(b bool) memTerm { return literalTerm(strconv.FormatBool(b), "", _xsd+"boolean") }
+
+func (t memTerm) String() string {
+	switch t.kind {
+	case iriKind:
+		return "<" + t.value + ">"
+	case blankKind:
+		return "_:" + t.value
+	case literalKind:
+		lit := rdf.Literal{Value: t.value, Language: t.lang}
+		if t.lang == "" {
+			lit.Datatype = rdf.Resource{URI: t.datatype}
+		}
+		return lit.String()
+	}
+	return "UNDEF"
+}
+
+// toRDF converts the term into the form produced by GetTable for SPARQL results
+func (t memTerm) toRDF() rdf.Term {
+	switch t.kind {
+	case iriKind:
+		return rdf.Resource{URI: t.value}
+	case blankKind:
+		return rdf.BlankNode{ID: t.value}
+	case literalKind:
+		return rdf.Literal{Value: t.value, Language: t.lang, Datatype: rdf.Resource{URI: t.datatype}}
+	}
+	return unbound()
+}
+
+// memTermFromRDF converts a term of an rdf2go graph into its evaluation form
+func memTermFromRDF(term rdf.Term) (memTerm, error) {
+	switch t := term.(type) {
+	case *rdf.Resource:
+		return iriTerm(t.URI), nil
+	case rdf.Resource:
+		return iriTerm(t.URI), nil
+	case *rdf.BlankNode:
+		return memTerm{kind: blankKind, value: t.ID}, nil
+	case rdf.BlankNode:
+		return memTerm{kind: blankKind, value: t.ID}, nil
+	case unboundTerm:
+		return memTerm{}, nil
+	case *rdf.Literal:
+		return memLiteralFromRDF(*t), nil
+	case rdf.Literal:
+		return memLiteralFromRDF(t), nil
+	}
+	return memTerm{}, fmt.Errorf("unknown kind of RDF term %v", term)
+}
+
+func memLiteralFromRDF(l rdf.Literal) memTerm {
+	var datatype string
+	if l.Datatype != nil {
+		datatype = l.Datatype.RawValue()
+	}
+	return literalTerm(l.Value, strings.TrimPrefix(l.Language, "@"), datatype)
+}
+
+type memTriple struct {
+	s, p, o memTerm
+}
+
+// memGraph is an indexed set of triples
+type memGraph struct {
+	triples     map[memTriple]struct{}
+	order       []memTriple
+	bySubject   map[memTerm][]memTriple
+	byPredicate map[memTerm][]memTriple
+	byObject    map[memTerm][]memTriple
+}
+
+func newMemGraph() *memGraph {
+	return &memGraph{
+		triples:     make(map[memTriple]struct{}),
+		bySubject:   make(map[memTerm][]memTriple),
+		byPredicate: make(map[memTerm][]memTriple),
+		byObject:    make(map[memTerm][]memTriple),
+	}
+}
+
+func (g *memGraph) add(t memTriple) {
+	if _, ok := g.triples[t]; ok {
+		return
+	}
+	g.triples[t] = Empty
+	g.order = append(g.order, t)
+	g.bySubject[t.s] = append(g.bySubject[t.s], t)
+	g.byPredicate[t.p] = append(g.byPredicate[t.p], t)
+	g.byObject[t.o] = append(g.byObject[t.o], t)
+}
+
+// match returns all triples agreeing with the given terms; unbound terms act as wildcards
+func (g *memGraph) match(s, p, o memTerm) []memTriple {
+	candidates := g.order
+	if s.kind != unboundKind {
+		candidates = g.bySubject[s]
+	}
+	if o.kind != unboundKind && len(g.byObject[o]) < len(candidates) {
+		candidates = g.byObject[o]
+	}
+	if p.kind != unboundKind && len(g.byPredicate[p]) < len(candidates) {
+		candidates = g.byPredicate[p]
+	}
+
+	var out []memTriple
+	for _, t := range candidates {
+		if (s.kind == unboundKind || t.s == s) && (p.kind == unboundKind || t.p == p) &&
+			(o.kind == unboundKind || t.o == o) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// nodes returns all subjects and objects of the graph
+func (g *memGraph) nodes() []memTerm {
+	seen := make(map[memTerm]struct{})
+	var out []memTerm
+	for _, t := range g.order {
+		for _, n := range []memTerm{t.s, t.o} {
+			if _, ok := seen[n]; !ok {
+				seen[n] = Empty
+				out = append(out, n)
+			}
+		}
+	}
+	return out
+}
+
+// memDataset is a collection of named graphs, plus the default graph stored under the empty
+// name. Queries not restricted to a named graph run against the union of all graphs.
+type memDataset struct {
+	mu      sync.RWMutex // held for reading while queries are evaluated
+	graphs  map[string]*memGraph
+	unionMu sync.Mutex // guards the construction of the union by concurrent queries
+	union   *memGraph  // cached union of all graphs, nil if outdated
+}
+
+func newMemDataset() *memDataset {
+	return &memDataset{graphs: make(map[string]*memGraph)}
+}
+
+func (d *memDataset) add(graph string, t memTriple) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	g, ok := d.graphs[graph]
+	if !ok {
+		g = newMemGraph()
+		d.graphs[graph] = g
+	}
+	g.add(t)
+	d.union = nil
+}
+
+func (d *memDataset) clear(graph string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.graphs, graph)
+	d.union = nil
+}
+
+func (d *memDataset) defaultGraph() *memGraph {
+	d.unionMu.Lock()
+	defer d.unionMu.Unlock()
+
+	if d.union != nil {
+		return d.union
+	}
+	d.union = newMemGraph()
+	for _, name := range d.names(true) {
+		for _, t := range d.graphs[name].order {
+			d.union.add(t)
+		}
+	}
+	return d.union
+}
+
+// names returns the names of all graphs in a fixed order
+func (d *memDataset) names(withDefault bool) []string {
+	var out []string
+	for name := range d.graphs {
+		if name != "" || withDefault {
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// view produces the dataset given by the FROM and FROM NAMED clauses of a query: its default
+// graph is the merge of the graphs listed in from, and only those listed in named are kept as
+// named graphs. Graphs not found in the dataset are taken as empty.
+func (d *memDataset) view(from, named []string) *memDataset {
+	out := newMemDataset()
+
+	out.union = newMemGraph()
+	for _, name := range from {
+		if g, ok := d.graphs[name]; ok {
+			for _, t := range g.order {
+				out.union.add(t)
+			}
+		}
+	}
+	for _, name := range named {
+		if g, ok := d.graphs[name]; ok && name != "" {
+			out.graphs[name] = g
+		}
+	}
+
+	return out
+}
+
+func (d *memDataset) namedGraph(name string) *memGraph {
+	if g, ok := d.graphs[name]; ok && name != "" {
+		return g
+	}
+	return newMemGraph()
+}
+
+// binding maps variable names (without the leading '?') to their values
+type binding map[string]memTerm
+
+func (b binding) extend(variable string, value memTerm) binding {
+	out := make(binding, len(b)+1)
+	for k, v := range b {
+		out[k] = v
+	}
+	out[variable] = value
+	return out
+}
+
+func compatible(a, b binding) bool {
+	for k, v := range a {
+		if w, ok := b[k]; ok && w != v {
+			return false
+		}
+	}
+	return true
+}
+
+func merge(a, b binding) binding {
+	out := make(binding, len(a)+len(b))
+	for k, v := range a {
+		out[k] = v
+	}
+	for k, v := range b {
+		out[k] = v
+	}
+	return out
+}
+
+var (
+	errTypeError = errors.New("type error")
+	errUnbound   = errors.New("unbound variable")
+)
+
+type subSelectKey struct {
+	query *sparqlQuery
+	graph *memGraph
+}
+
+type subSelectResult struct {
+	vars []string
+	rows []binding
+}
+
+// sparqlEvaluator evaluates queries over a dataset, caching results that do not depend on the
+// solution they are evaluated in
+type sparqlEvaluator struct {
+	data       *memDataset
+	subSelects map[subSelectKey]subSelectResult
+	regexes    map[string]*regexp.Regexp
+}
+
+func newSparqlEvaluator(data *memDataset) *sparqlEvaluator {
+	return &sparqlEvaluator{
+		data:       data,
+		subSelects: make(map[subSelectKey]subSelectResult),
+		regexes:    make(map[string]*regexp.Regexp),
+	}
+}
+
+// evalQuery returns the projected variables and the solutions of a query. ASK queries
+// produce a single solution if the pattern matches, and none otherwise. If the query lists
+// FROM or FROM NAMED clauses, it is evaluated over the dataset they describe instead.
+func (ev *sparqlEvaluator) evalQuery(q *sparqlQuery) ([]string, []binding, error) {
+	if len(q.from) > 0 || len(q.named) > 0 {
+		ev.data = ev.data.view(q.from, q.named)
+	}
+	g := ev.data.defaultGraph()
+
+	if q.form == askForm {
+		sols, err := ev.evalGroup(q.where, g, binding{})
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(sols) > 0 {
+			return nil, []binding{{}}, nil
+		}
+		return nil, nil, nil
+	}
+
+	return ev.evalSelect(q, g)
+}
+
+func (ev *sparqlEvaluator) evalSelect(q *sparqlQuery, g *memGraph) ([]string, []binding, error) {
+	sols, err := ev.evalGroup(q.where, g, binding{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var vars []string
+	if q.star {
+		vars = patternVars(q.where, nil)
+	} else {
+		for _, p := range q.project {
+			vars = append(vars, p.variable)
+		}
+	}
+
+	var rows []binding
+
+	if len(q.groupBy) > 0 || len(q.having) > 0 || hasAggregate(q.project) {
+		rows, err = ev.aggregate(q, g, sols)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		for _, sol := range sols {
+			row := sol
+			for _, p := range q.project {
+				if p.expr == nil {
+					continue
+				}
+				if v, err := ev.eval(p.expr, row, g, nil); err == nil {
+					row = row.extend(p.variable, v)
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	if len(q.orderBy) > 0 {
+		keys := make([][]memTerm, len(rows))
+		for i, row := range rows {
+			for _, cond := range q.orderBy {
+				v, _ := ev.eval(cond.expr, row, g, nil)
+				keys[i] = append(keys[i], v)
+			}
+		}
+		idx := make([]int, len(rows))
+		for i := range idx {
+			idx[i] = i
+		}
+		sort.SliceStable(idx, func(a, b int) bool {
+			for j, cond := range q.orderBy {
+				c := orderTerms(keys[idx[a]][j], keys[idx[b]][j])
+				if c != 0 {
+					return (c < 0) != cond.descending
+				}
+			}
+			return false
+		})
+		sorted := make([]binding, len(rows))
+		for i := range idx {
+			sorted[i] = rows[idx[i]]
+		}
+		rows = sorted
+	}
+
+	// project
+	var out []binding
+	seen := make(map[string]struct{})
+	for _, row := range rows {
+		projected := make(binding, len(vars))
+		for _, v := range vars {
+			if value, ok := row[v]; ok {
+				projected[v] = value
+			}
+		}
+		if q.distinct {
+			key := bindingKey(projected, vars)
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = Empty
+		}
+		out = append(out, projected)
+	}
+
+	if q.offset > 0 {
+		if q.offset >= len(out) {
+			out = nil
+		} else {
+			out = out[q.offset:]
+		}
+	}
+	if q.limit >= 0 && q.limit < len(out) {
+		out = out[:q.limit]
+	}
+
+	return vars, out, nil
+}
+
+func hasAggregate(project []projection) bool {
+	for _, p := range project {
+		if p.expr != nil && containsAggregate(p.expr) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAggregate(e sparqlExpr) bool {
+	switch e := e.(type) {
+	case *aggregateExpr:
+		return true
+	case binaryExpr:
+		return containsAggregate(e.left) || containsAggregate(e.right)
+	case unaryExpr:
+		return containsAggregate(e.expr)
+	case inExpr:
+		if containsAggregate(e.expr) {
+			return true
+		}
+		for _, l := range e.list {
+			if containsAggregate(l) {
+				return true
+			}
+		}
+	case callExpr:
+		for _, a := range e.args {
+			if containsAggregate(a) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (ev *sparqlEvaluator) aggregate(q *sparqlQuery, g *memGraph, sols []binding) ([]binding, error) {
+	type group struct {
+		key  binding
+		sols []binding
+	}
+
+	var groups []*group
+	index := make(map[string]*group)
+
+	for _, sol := range sols {
+		key := make(binding)
+		var sb strings.Builder
+		for i, cond := range q.groupBy {
+			var v memTerm
+			if cond.expr == nil {
+				v = sol[cond.variable]
+			} else {
+				v, _ = ev.eval(cond.expr, sol, g, nil)
+			}
+			if v.kind != unboundKind && cond.variable != "" {
+				key[cond.variable] = v
+			}
+			sb.WriteString(fmt.Sprint(i, v.kind, v.value, "\x00", v.lang, "\x00", v.datatype, "\x00"))
+		}
+		grp, ok := index[sb.String()]
+		if !ok {
+			grp = &group{key: key}
+			index[sb.String()] = grp
+			groups = append(groups, grp)
+		}
+		grp.sols = append(grp.sols, sol)
+	}
+
+	// without grouping, aggregates are computed over a single (possibly empty) group
+	if len(q.groupBy) == 0 && len(groups) == 0 {
+		groups = append(groups, &group{key: binding{}})
+	}
+
+	var out []binding
+
+outer:
+	for _, grp := range groups {
+		row := grp.key
+		for _, p := range q.project {
+			if p.expr == nil {
+				if _, ok := row[p.variable]; !ok && len(grp.sols) > 0 {
+					if v, ok := grp.sols[0][p.variable]; ok {
+						row = row.extend(p.variable, v)
+					}
+				}
+				continue
+			}
+			if v, err := ev.eval(p.expr, row, g, grp.sols); err == nil {
+				row = row.extend(p.variable, v)
+			}
+		}
+
+		// as many stores do, allow HAVING to refer to the aliases of the projection
+		for _, h := range q.having {
+			v, err := ev.eval(h, row, g, grp.sols)
+			if err != nil {
+				continue outer
+			}
+			if b, err := effectiveBool(v); err != nil || !b {
+				continue outer
+			}
+		}
+
+		out = append(out, row)
+	}
+
+	return out, nil
+}
+
+func bindingKey(b binding, vars []string) string {
+	var sb strings.Builder
+	for _, v := range vars {
+		t := b[v]
+		sb.WriteString(fmt.Sprint(t.kind, t.value, "\x00", t.lang, "\x00", t.datatype, "\x00"))
+	}
+	return sb.String()
+}
+
+// patternVars collects the variables of a group pattern in order of their first appearance
+func patternVars(gp *groupPattern, vars []string) []string {
+	addVar := func(v string) {
+		if v == "" {
+			return
+		}
+		for _, w := range vars {
+			if w == v {
+				return
+			}
+		}
+		vars = append(vars, v)
+	}
+
+	for _, el := range gp.elements {
+		switch e := el.(type) {
+		case *triplesBlock:
+			for _, t := range e.triples {
+				addVar(t.subject.variable)
+				addVar(t.predicate.variable)
+				addVar(t.object.variable)
+			}
+		case *groupPattern:
+			vars = patternVars(e, vars)
+		case *optionalPattern:
+			vars = patternVars(e.group, vars)
+		case *unionPattern:
+			for _, b := range e.branches {
+				vars = patternVars(b, vars)
+			}
+		case *graphPattern:
+			addVar(e.graph.variable)
+			vars = patternVars(e.group, vars)
+		case *bindPattern:
+			addVar(e.variable)
+		case *valuesPattern:
+			for _, v := range e.vars {
+				addVar(v)
+			}
+		case *subSelectPattern:
+			if e.query.star {
+				vars = patternVars(e.query.where, vars)
+			} else {
+				for _, p := range e.query.project {
+					addVar(p.variable)
+				}
+			}
+		}
+	}
+
+	return vars
+}
+
+// evalGroup evaluates a group graph pattern over the graph g, bottom-up as in the SPARQL
+// algebra: nested groups are evaluated on their own and joined with the solutions of the
+// patterns before them. The input solution is substituted into the group and all groups nested
+// within it, as done for EXISTS, and is empty otherwise.
+func (ev *sparqlEvaluator) evalGroup(gp *groupPattern, g *memGraph, in binding) ([]binding, error) {
+	sols, filters, err := ev.evalPatterns(gp, g, in)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(filters) == 0 {
+		return sols, nil
+	}
+
+	var out []binding
+	for _, sol := range sols {
+		if ev.satisfies(sol, filters, g) {
+			out = append(out, sol)
+		}
+	}
+
+	return out, nil
+}
+
+// evalPatterns evaluates the patterns of the group, returning their solutions and the filters
+// of the group, which are left to the caller
+func (ev *sparqlEvaluator) evalPatterns(gp *groupPattern, g *memGraph, in binding) ([]binding, []sparqlExpr, error) {
+	sols := []binding{in}
+	var filters []sparqlExpr
+
+	for _, el := range gp.elements {
+		if f, ok := el.(*filterPattern); ok {
+			filters = append(filters, f.expr)
+			continue
+		}
+		if len(sols) == 0 {
+			continue
+		}
+
+		var next []binding
+
+		switch e := el.(type) {
+		case *triplesBlock:
+			next = sols
+			for _, t := range e.triples {
+				var tmp []binding
+				for _, sol := range next {
+					tmp = append(tmp, ev.matchTriple(t, g, sol)...)
+				}
+				next = tmp
+			}
+		case *groupPattern:
+			res, err := ev.evalGroup(e, g, in)
+			if err != nil {
+				return nil, nil, err
+			}
+			next = joinSolutions(sols, res, patternVars(e, nil))
+		case *optionalPattern:
+			res, optFilters, err := ev.evalPatterns(e.group, g, in)
+			if err != nil {
+				return nil, nil, err
+			}
+			// the filters of the optional group are the condition of the left join
+			joinMatches(sols, res, patternVars(e.group, nil), func(sol binding, matches []binding) {
+				matched := false
+				for _, r := range matches {
+					if joined := merge(sol, r); ev.satisfies(joined, optFilters, g) {
+						next = append(next, joined)
+						matched = true
+					}
+				}
+				if !matched {
+					next = append(next, sol)
+				}
+			})
+		case *unionPattern:
+			var res []binding
+			var vars []string
+			for _, branch := range e.branches {
+				branchRes, err := ev.evalGroup(branch, g, in)
+				if err != nil {
+					return nil, nil, err
+				}
+				res = append(res, branchRes...)
+				vars = patternVars(branch, vars)
+			}
+			next = joinSolutions(sols, res, vars)
+		case *minusPattern:
+			res, err := ev.evalGroup(e.group, g, binding{})
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, sol := range sols {
+				removed := false
+				for _, r := range res {
+					if compatible(sol, r) && sharesVariable(sol, r) {
+						removed = true
+						break
+					}
+				}
+				if !removed {
+					next = append(next, sol)
+				}
+			}
+		case *graphPattern:
+			var res []binding
+			vars := patternVars(e.group, nil)
+			if e.graph.isVar() {
+				vars = append(vars, e.graph.variable)
+				for _, name := range ev.data.names(false) {
+					graphIRI := iriTerm(name)
+					if bound, ok := in[e.graph.variable]; ok && bound != graphIRI {
+						continue
+					}
+					graphRes, err := ev.evalGroup(e.group, ev.data.namedGraph(name), in.extend(e.graph.variable, graphIRI))
+					if err != nil {
+						return nil, nil, err
+					}
+					res = append(res, graphRes...)
+				}
+			} else if e.graph.term.kind == iriKind {
+				graphRes, err := ev.evalGroup(e.group, ev.data.namedGraph(e.graph.term.value), in)
+				if err != nil {
+					return nil, nil, err
+				}
+				res = graphRes
+			}
+			next = joinSolutions(sols, res, vars)
+		case *bindPattern:
+			for _, sol := range sols {
+				v, err := ev.eval(e.expr, sol, g, nil)
+				if err == nil && v.kind != unboundKind {
+					sol = sol.extend(e.variable, v)
+				}
+				next = append(next, sol)
+			}
+		case *valuesPattern:
+			var rows []binding
+			for _, values := range e.rows {
+				row := make(binding)
+				for i, v := range values {
+					if v.kind != unboundKind {
+						row[e.vars[i]] = v
+					}
+				}
+				rows = append(rows, row)
+			}
+			next = joinSolutions(sols, rows, e.vars)
+		case *subSelectPattern:
+			key := subSelectKey{query: e.query, graph: g}
+			res, ok := ev.subSelects[key]
+			if !ok {
+				vars, rows, err := ev.evalSelect(e.query, g)
+				if err != nil {
+					return nil, nil, err
+				}
+				res = subSelectResult{vars: vars, rows: rows}
+				ev.subSelects[key] = res
+			}
+			next = joinSolutions(sols, res.rows, res.vars)
+		}
+
+		sols = next
+	}
+
+	return sols, filters, nil
+}
+
+// satisfies determines whether all filters hold for the solution; filters raising an error
+// do not hold
+func (ev *sparqlEvaluator) satisfies(sol binding, filters []sparqlExpr, g *memGraph) bool {
+	for _, f := range filters {
+		v, err := ev.eval(f, sol, g, nil)
+		if err != nil {
+			return false
+		}
+		if b, err := effectiveBool(v); err != nil || !b {
+			return false
+		}
+	}
+	return true
+}
+
+func sharesVariable(a, b binding) bool {
+	for k := range a {
+		if _, ok := b[k]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// joinSolutions joins two lists of solutions
+func joinSolutions(left, right []binding, rightVars []string) []binding {
+	var out []binding
+	joinMatches(left, right, rightVars, func(l binding, matches []binding) {
+		for _, r := range matches {
+			out = append(out, merge(l, r))
+		}
+	})
+
+	return out
+}
+
+// joinMatches calls f for each solution on the left, in order, with the solutions on the right
+// compatible with it. The matches are found via a hash index over those variables that are
+// bound in every solution on the right.
+func joinMatches(left, right []binding, rightVars []string, f func(l binding, matches []binding)) {
+	var keyVars []string
+	for _, v := range rightVars {
+		always := true
+		for _, r := range right {
+			if _, ok := r[v]; !ok {
+				always = false
+				break
+			}
+		}
+		if always {
+			keyVars = append(keyVars, v)
+		}
+	}
+
+	indices := make(map[string]map[string][]binding) // per set of shared vars
+
+	for _, l := range left {
+		var shared []string
+		for _, v := range keyVars {
+			if _, ok := l[v]; ok {
+				shared = append(shared, v)
+			}
+		}
+		mask := strings.Join(shared, " ")
+		index, ok := indices[mask]
+		if !ok {
+			index = make(map[string][]binding)
+			for _, r := range right {
+				k := bindingKey(r, shared)
+				index[k] = append(index[k], r)
+			}
+			indices[mask] = index
+		}
+
+		var matches []binding
+		for _, r := range index[bindingKey(l, shared)] {
+			if compatible(l, r) {
+				matches = append(matches, r)
+			}
+		}
+		f(l, matches)
+	}
+}
+
+func (ev *sparqlEvaluator) matchTriple(t triplePattern, g *memGraph, sol binding) []binding {
+	resolve := func(p patternTerm) memTerm {
+		if p.isVar() {
+			return sol[p.variable]
+		}
+		return p.term
+	}
+
+	s := resolve(t.subject)
+	o := resolve(t.object)
+
+	var out []binding
+
+	if t.path == nil {
+		for _, triple := range g.match(s, resolve(t.predicate), o) {
+			b, ok := bindTerm(sol, t.subject, triple.s)
+			if ok {
+				b, ok = bindTerm(b, t.predicate, triple.p)
+			}
+			if ok {
+				b, ok = bindTerm(b, t.object, triple.o)
+			}
+			if ok {
+				out = append(out, b)
+			}
+		}
+		return out
+	}
+
+	switch {
+	case s.kind != unboundKind:
+		for _, end := range pathForward(g, t.path, s) {
+			if b, ok := bindTerm(sol, t.object, end); ok {
+				out = append(out, b)
+			}
+		}
+	case o.kind != unboundKind:
+		for _, start := range pathBackward(g, t.path, o) {
+			if b, ok := bindTerm(sol, t.subject, start); ok {
+				out = append(out, b)
+			}
+		}
+	default:
+		for _, start := range pathStarts(g, t.path) {
+			for _, end := range pathForward(g, t.path, start) {
+				b, ok := bindTerm(sol, t.subject, start)
+				if ok {
+					b, ok = bindTerm(b, t.object, end)
+				}
+				if ok {
+					out = append(out, b)
+				}
+			}
+		}
+	}
+
+	return out
+}
+
+func bindTerm(b binding, p patternTerm, value memTerm) (binding, bool) {
+	if !p.isVar() {
+		return b, p.term == value
+	}
+	if existing, ok := b[p.variable]; ok {
+		return b, existing == value
+	}
+	return b.extend(p.variable, value), true
+}
+
+// property paths
+
+type termSet struct {
+	seen  map[memTerm]struct{}
+	terms []memTerm
+}
+
+func (s *termSet) add(t memTerm) bool {
+	if s.seen == nil {
+		s.seen = make(map[memTerm]struct{})
+	}
+	if _, ok := s.seen[t]; ok {
+		return false
+	}
+	s.seen[t] = Empty
+	s.terms = append(s.terms, t)
+	return true
+}
+
+// pathForward returns all nodes reachable from x via the path
+func pathForward(g *memGraph, p pathExpr, x memTerm) []memTerm {
+	return pathStep(g, p, []memTerm{x}, false)
+}
+
+// pathBackward returns all nodes from which x is reachable via the path
+func pathBackward(g *memGraph, p pathExpr, x memTerm) []memTerm {
+	return pathStep(g, p, []memTerm{x}, true)
+}
+
+func pathStep(g *memGraph, p pathExpr, from []memTerm, backward bool) []memTerm {
+	var out termSet
+
+	switch p := p.(type) {
+	case linkPath:
+		for _, x := range from {
+			if backward {
+				for _, t := range g.match(memTerm{}, p.iri, x) {
+					out.add(t.s)
+				}
+			} else {
+				for _, t := range g.match(x, p.iri, memTerm{}) {
+					out.add(t.o)
+				}
+			}
+		}
+	case inversePath:
+		return pathStep(g, p.path, from, !backward)
+	case sequencePath:
+		current := from
+		for i := range p.paths {
+			step := p.paths[i]
+			if backward {
+				step = p.paths[len(p.paths)-1-i]
+			}
+			current = pathStep(g, step, current, backward)
+		}
+		return current
+	case alternativePath:
+		for _, alt := range p.paths {
+			for _, t := range pathStep(g, alt, from, backward) {
+				out.add(t)
+			}
+		}
+	case negatedPath:
+		forward, inverse := p.forward, p.inverse
+		if backward {
+			forward, inverse = inverse, forward
+		}
+		for _, x := range from {
+			if len(p.forward) > 0 || len(p.inverse) == 0 {
+				for _, t := range g.bySubject[x] {
+					if !containsTerm(forward, t.p) {
+						out.add(t.o)
+					}
+				}
+			}
+			if len(p.inverse) > 0 {
+				for _, t := range g.byObject[x] {
+					if !containsTerm(inverse, t.p) {
+						out.add(t.s)
+					}
+				}
+			}
+		}
+	case modPath:
+		frontier := from
+		if p.mod != '+' {
+			for _, x := range from {
+				out.add(x)
+			}
+		} else {
+			frontier = pathStep(g, p.path, from, backward)
+			for _, x := range frontier {
+				out.add(x)
+			}
+		}
+		if p.mod == '?' {
+			for _, x := range pathStep(g, p.path, from, backward) {
+				out.add(x)
+			}
+			break
+		}
+		for len(frontier) > 0 {
+			var next []memTerm
+			for _, x := range pathStep(g, p.path, frontier, backward) {
+				if out.add(x) {
+					next = append(next, x)
+				}
+			}
+			frontier = next
+		}
+	}
+
+	return out.terms
+}
+
+func containsTerm(list []memTerm, t memTerm) bool {
+	for _, l := range list {
+		if l == t {
+			return true
+		}
+	}
+	return false
+}
+
+// pathStarts returns candidate start nodes of the path, used if neither end is bound
+func pathStarts(g *memGraph, p pathExpr) []memTerm {
+	return pathEnds(g, p, false)
+}
+
+func pathEnds(g *memGraph, p pathExpr, end bool) []memTerm {
+	var out termSet
+
+	switch p := p.(type) {
+	case linkPath:
+		for _, t := range g.byPredicate[p.iri] {
+			if end {
+				out.add(t.o)
+			} else {
+				out.add(t.s)
+			}
+		}
+	case inversePath:
+		return pathEnds(g, p.path, !end)
+	case sequencePath:
+		if end {
+			return pathEnds(g, p.paths[len(p.paths)-1], end)
+		}
+		return pathEnds(g, p.paths[0], end)
+	case alternativePath:
+		for _, alt := range p.paths {
+			for _, t := range pathEnds(g, alt, end) {
+				out.add(t)
+			}
+		}
+	case modPath:
+		if p.mod == '+' {
+			return pathEnds(g, p.path, end)
+		}
+		return g.nodes()
+	default:
+		return g.nodes()
+	}
+
+	return out.terms
+}
+
+// expressions
+
+func (ev *sparqlEvaluator) eval(e sparqlExpr, b binding, g *memGraph, group []binding) (memTerm, error) {
+	switch e := e.(type) {
+	case varExpr:
+		if v, ok := b[e.name]; ok {
+			return v, nil
+		}
+		return memTerm{}, errUnbound
+	case constExpr:
+		return e.term, nil
+	case unaryExpr:
+		v, err := ev.eval(e.expr, b, g, group)
+		if err != nil {
+			return memTerm{}, err
+		}
+		switch e.op {
+		case "!":
+			bv, err := effectiveBool(v)
+			if err != nil {
+				return memTerm{}, err
+			}
+			return boolTerm(!bv), nil
+		case "-":
+			return arithmetic("-", literalTerm("0", "", _xsd+"integer"), v)
+		default:
+			return arithmetic("+", literalTerm("0", "", _xsd+"integer"), v)
+		}
+	case binaryExpr:
+		if e.op == "||" || e.op == "&&" {
+			return ev.evalLogical(e, b, g, group)
+		}
+		left, err := ev.eval(e.left, b, g, group)
+		if err != nil {
+			return memTerm{}, err
+		}
+		right, err := ev.eval(e.right, b, g, group)
+		if err != nil {
+			return memTerm{}, err
+		}
+		switch e.op {
+		case "=", "!=":
+			eq, err := equalTerms(left, right)
+			if err != nil {
+				return memTerm{}, err
+			}
+			return boolTerm(eq == (e.op == "=")), nil
+		case "<", ">", "<=", ">=":
+			c, err := compareTerms(left, right)
+			if err != nil {
+				return memTerm{}, err
+			}
+			switch e.op {
+			case "<":
+				return boolTerm(c == -1), nil
+			case ">":
+				return boolTerm(c == 1), nil
+			case "<=":
+				return boolTerm(c == -1 || c == 0), nil
+			default:
+				return boolTerm(c == 1 || c == 0), nil
+			}
+		default:
+			return arithmetic(e.op, left, right)
+		}
+	case inExpr:
+		v, err := ev.eval(e.expr, b, g, group)
+		if err != nil {
+			return memTerm{}, err
+		}
+		var lastErr error
+		for _, item := range e.list {
+			w, err := ev.eval(item, b, g, group)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			eq, err := equalTerms(v, w)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if eq {
+				return boolTerm(!e.negated), nil
+			}
+		}
+		if lastErr != nil {
+			return memTerm{}, lastErr
+		}
+		return boolTerm(e.negated), nil
+	case existsExpr:
+		res, err := ev.evalGroup(e.group, g, b)
+		if err != nil {
+			return memTerm{}, err
+		}
+		return boolTerm((len(res) > 0) != e.negated), nil
+	case *aggregateExpr:
+		if group == nil {
+			return memTerm{}, errors.New("aggregate used outside of a group")
+		}
+		return ev.evalAggregate(e, g, group)
+	case callExpr:
+		if e.cast {
+			if len(e.args) != 1 {
+				return memTerm{}, fmt.Errorf("cast to %s expects one argument", e.name)
+			}
+			v, err := ev.eval(e.args[0], b, g, group)
+			if err != nil {
+				return memTerm{}, err
+			}
+			return castTerm(e.name, v)
+		}
+		return ev.evalCall(e, b, g, group)
+	}
+
+	return memTerm{}, fmt.Errorf("cannot evaluate expression %v", e)
+}
+
+func (ev *sparqlEvaluator) evalLogical(e binaryExpr, b binding, g *memGraph, group []binding) (memTerm, error) {
+	ebv := func(expr sparqlExpr) (bool, error) {
+		v, err := ev.eval(expr, b, g, group)
+		if err != nil {
+			return false, err
+		}
+		return effectiveBool(v)
+	}
+
+	left, errL := ebv(e.left)
+	if e.op == "||" && errL == nil && left {
+		return boolTerm(true), nil
+	}
+	if e.op == "&&" && errL == nil && !left {
+		return boolTerm(false), nil
+	}
+
+	right, errR := ebv(e.right)
+	if e.op == "||" {
+		if errR == nil && right {
+			return boolTerm(true), nil
+		}
+	} else if errR == nil && !right {
+		return boolTerm(false), nil
+	}
+
+	if errL != nil {
+		return memTerm{}, errL
+	}
+	if errR != nil {
+		return memTerm{}, errR
+	}
+
+	return boolTerm(e.op == "&&"), nil
+}
+
+func (ev *sparqlEvaluator) evalAggregate(e *aggregateExpr, g *memGraph, group []binding) (memTerm, error) {
+	var values []memTerm
+	var seen termSet
+
+	for _, sol := range group {
+		if e.star {
+			values = append(values, memTerm{kind: literalKind})
+			continue
+		}
+		v, err := ev.eval(e.expr, sol, g, nil)
+		if err != nil {
+			if e.name == "COUNT" {
+				continue
+			}
+			return memTerm{}, err
+		}
+		if e.distinct && !seen.add(v) {
+			continue
+		}
+		values = append(values, v)
+	}
+
+	if e.star && e.distinct {
+		keys := make(map[string]struct{})
+		var vars []string
+		for _, sol := range group {
+			for k := range sol {
+				vars = append(vars, k)
+			}
+		}
+		sort.Strings(vars)
+		for _, sol := range group {
+			keys[bindingKey(sol, vars)] = Empty
+		}
+		return literalTerm(strconv.Itoa(len(keys)), "", _xsd+"integer"), nil
+	}
+
+	switch e.name {
+	case "COUNT":
+		return literalTerm(strconv.Itoa(len(values)), "", _xsd+"integer"), nil
+	case "SUM", "AVG":
+		sum := literalTerm("0", "", _xsd+"integer")
+		for _, v := range values {
+			var err error
+			sum, err = arithmetic("+", sum, v)
+			if err != nil {
+				return memTerm{}, err
+			}
+		}
+		if e.name == "AVG" {
+			if len(values) == 0 {
+				return literalTerm("0", "", _xsd+"integer"), nil
+			}
+			return arithmetic("/", sum, literalTerm(strconv.Itoa(len(values)), "", _xsd+"integer"))
+		}
+		return sum, nil
+	case "MIN", "MAX":
+		if len(values) == 0 {
+			return memTerm{}, errUnbound
+		}
+		best := values[0]
+		for _, v := range values[1:] {
+			c := orderTerms(v, best)
+			if (e.name == "MIN" && c < 0) || (e.name == "MAX" && c > 0) {
+				best = v
+			}
+		}
+		return best, nil
+	case "SAMPLE":
+		if len(values) == 0 {
+			return memTerm{}, errUnbound
+		}
+		return values[0], nil
+	case "GROUP_CONCAT":
+		var parts []string
+		for _, v := range values {
+			if v.kind == blankKind {
+				return memTerm{}, errTypeError
+			}
+			parts = append(parts, v.value)
+		}
+		return literalTerm(strings.Join(parts, e.separator), "", ""), nil
+	}
+
+	return memTerm{}, fmt.Errorf("unknown aggregate %s", e.name)
+}
+
+func isStringLiteral(t memTerm) bool {
+	return t.kind == literalKind && (t.datatype == _xsd+"string" || t.datatype == _rdf+"langString")
+}
+
+func (ev *sparqlEvaluator) evalCall(e callExpr, b binding, g *memGraph, group []binding) (memTerm, error) {
+	// functions with special evaluation of their arguments
+	switch e.name {
+	case "BOUND":
+		if len(e.args) != 1 {
+			return memTerm{}, errors.New("BOUND expects a single variable")
+		}
+		v, ok := e.args[0].(varExpr)
+		if !ok {
+			return memTerm{}, errors.New("BOUND expects a single variable")
+		}
+		_, bound := b[v.name]
+		return boolTerm(bound), nil
+	case "IF":
+		if len(e.args) != 3 {
+			return memTerm{}, errors.New("IF expects three arguments")
+		}
+		c, err := ev.eval(e.args[0], b, g, group)
+		if err != nil {
+			return memTerm{}, err
+		}
+		cond, err := effectiveBool(c)
+		if err != nil {
+			return memTerm{}, err
+		}
+		if cond {
+			return ev.eval(e.args[1], b, g, group)
+		}
+		return ev.eval(e.args[2], b, g, group)
+	case "COALESCE":
+		for _, a := range e.args {
+			if v, err := ev.eval(a, b, g, group); err == nil {
+				return v, nil
+			}
+		}
+		return memTerm{}, errUnbound
+	}
+
+	args := make([]memTerm, len(e.args))
+	for i := range e.args {
+		v, err := ev.eval(e.args[i], b, g, group)
+		if err != nil {
+			return memTerm{}, err
+		}
+		args[i] = v
+	}
+
+	arity := map[string]int{
+		"STR": 1, "LANG": 1, "DATATYPE": 1, "IRI": 1, "URI": 1, "ISIRI": 1, "ISURI": 1,
+		"ISBLANK": 1, "ISLITERAL": 1, "ISNUMERIC": 1, "STRLEN": 1, "UCASE": 1, "LCASE": 1,
+		"LANGMATCHES": 2, "SAMETERM": 2, "CONTAINS": 2, "STRSTARTS": 2, "STRENDS": 2,
+		"STRDT": 2, "STRLANG": 2,
+	}
+	if n, ok := arity[e.name]; ok && len(args) != n {
+		return memTerm{}, fmt.Errorf("%s expects %d arguments", e.name, n)
+	}
+
+	switch e.name {
+	case "STR":
+		if args[0].kind == blankKind {
+			return memTerm{}, errTypeError
+		}
+		return literalTerm(args[0].value, "", ""), nil
+	case "LANG":
+		if args[0].kind != literalKind {
+			return memTerm{}, errTypeError
+		}
+		return literalTerm(args[0].lang, "", ""), nil
+	case "DATATYPE":
+		if args[0].kind != literalKind {
+			return memTerm{}, errTypeError
+		}
+		return iriTerm(args[0].datatype), nil
+	case "IRI", "URI":
+		switch {
+		case args[0].kind == iriKind:
+			return args[0], nil
+		case isStringLiteral(args[0]):
+			return iriTerm(args[0].value), nil
+		}
+		return memTerm{}, errTypeError
+	case "ISIRI", "ISURI":
+		return boolTerm(args[0].kind == iriKind), nil
+	case "ISBLANK":
+		return boolTerm(args[0].kind == blankKind), nil
+	case "ISLITERAL":
+		return boolTerm(args[0].kind == literalKind), nil
+	case "ISNUMERIC":
+		_, err := numericValue(args[0])
+		return boolTerm(err == nil), nil
+	case "STRLEN":
+		if !isStringLiteral(args[0]) {
+			return memTerm{}, errTypeError
+		}
+		return literalTerm(strconv.Itoa(utf8.RuneCountInString(args[0].value)), "", _xsd+"integer"), nil
+	case "UCASE", "LCASE":
+		if !isStringLiteral(args[0]) {
+			return memTerm{}, errTypeError
+		}
+		out := args[0]
+		if e.name == "UCASE" {
+			out.value = strings.ToUpper(out.value)
+		} else {
+			out.value = strings.ToLower(out.value)
+		}
+		return out, nil
+	case "LANGMATCHES":
+		if args[0].kind != literalKind || args[1].kind != literalKind {
+			return memTerm{}, errTypeError
+		}
+		tag, lRange := strings.ToLower(args[0].value), strings.ToLower(args[1].value)
+		if lRange == "*" {
+			return boolTerm(tag != ""), nil
+		}
+		return boolTerm(tag == lRange || strings.HasPrefix(tag, lRange+"-")), nil
+	case "SAMETERM":
+		return boolTerm(args[0] == args[1]), nil
+	case "CONTAINS", "STRSTARTS", "STRENDS":
+		if !isStringLiteral(args[0]) || !isStringLiteral(args[1]) {
+			return memTerm{}, errTypeError
+		}
+		switch e.name {
+		case "CONTAINS":
+			return boolTerm(strings.Contains(args[0].value, args[1].value)), nil
+		case "STRSTARTS":
+			return boolTerm(strings.HasPrefix(args[0].value, args[1].value)), nil
+		}
+		return boolTerm(strings.HasSuffix(args[0].value, args[1].value)), nil
+	case "CONCAT":
+		var sb strings.Builder
+		for _, a := range args {
+			if !isStringLiteral(a) {
+				return memTerm{}, errTypeError
+			}
+			sb.WriteString(a.value)
+		}
+		return literalTerm(sb.String(), "", ""), nil
+	case "SUBSTR":
+		if len(args) < 2 || len(args) > 3 || !isStringLiteral(args[0]) {
+			return memTerm{}, errTypeError
+		}
+		runes := []rune(args[0].value)
+		start, err := numericValue(args[1])
+		if err != nil {
+			return memTerm{}, err
+		}
+		from := int(math.Round(start.float())) - 1
+		to := len(runes)
+		if len(args) == 3 {
+			length, err := numericValue(args[2])
+			if err != nil {
+				return memTerm{}, err
+			}
+			to = from + int(math.Round(length.float()))
+		}
+		if from < 0 {
+			from = 0
+		}
+		if to > len(runes) {
+			to = len(runes)
+		}
+		out := args[0]
+		out.value = ""
+		if from < to {
+			out.value = string(runes[from:to])
+		}
+		return out, nil
+	case "STRDT":
+		if args[0].kind != literalKind || args[0].datatype != _xsd+"string" || args[1].kind != iriKind {
+			return memTerm{}, errTypeError
+		}
+		return literalTerm(args[0].value, "", args[1].value), nil
+	case "STRLANG":
+		if args[0].kind != literalKind || args[0].datatype != _xsd+"string" || args[1].kind != literalKind {
+			return memTerm{}, errTypeError
+		}
+		return literalTerm(args[0].value, args[1].value, ""), nil
+	case "REGEX":
+		if len(args) < 2 || len(args) > 3 {
+			return memTerm{}, errors.New("REGEX expects two or three arguments")
+		}
+		if !isStringLiteral(args[0]) || args[1].kind != literalKind {
+			return memTerm{}, errTypeError
+		}
+		flags := ""
+		if len(args) == 3 {
+			flags = args[2].value
+		}
+		re, err := ev.compileRegex(args[1].value, flags)
+		if err != nil {
+			return memTerm{}, err
+		}
+		return boolTerm(re.MatchString(args[0].value)), nil
+	}
+
+	return memTerm{}, &UnsupportedFeatureError{Feature: "SPARQL function " + e.name}
+}
+
+func (ev *sparqlEvaluator) compileRegex(pattern, flags string) (*regexp.Regexp, error) {
+	key := flags + "\x00" + pattern
+	if re, ok := ev.regexes[key]; ok {
+		return re, nil
+	}
+
+	var goFlags string
+	for _, f := range flags {
+		switch f {
+		case 'i', 's', 'm':
+			goFlags += string(f)
+		case 'x':
+			pattern = strings.Join(strings.Fields(pattern), "")
+		case 'q':
+			pattern = regexp.QuoteMeta(pattern)
+		default:
+			return nil, fmt.Errorf("invalid regex flag %q", f)
+		}
+	}
+	if goFlags != "" {
+		pattern = "(?" + goFlags + ")" + pattern
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	ev.regexes[key] = re
+
+	return re, nil
+}
+
+// effectiveBool computes the effective boolean value of a term
+func effectiveBool(t memTerm) (bool, error) {
+	if t.kind != literalKind {
+		return false, errTypeError
+	}
+	switch {
+	case t.datatype == _xsd+"boolean":
+		return t.value == "true" || t.value == "1", nil
+	case isStringLiteral(t):
+		return t.value != "", nil
+	case numericTypes[t.datatype]:
+		n, err := numericValue(t)
+		if err != nil {
+			return false, nil // ill-typed numbers are false
+		}
+		f := n.float()
+		return f != 0 && !math.IsNaN(f), nil
+	}
+	return false, errTypeError
+}
+
+// datatypes
+
+var numericTypes = map[string]bool{
+	_xsd + "integer": true, _xsd + "decimal": true, _xsd + "float": true, _xsd + "double": true,
+	_xsd + "nonPositiveInteger": true, _xsd + "negativeInteger": true, _xsd + "long": true,
+	_xsd + "int": true, _xsd + "short": true, _xsd + "byte": true,
+	_xsd + "nonNegativeInteger": true, _xsd + "unsignedLong": true, _xsd + "unsignedInt": true,
+	_xsd + "unsignedShort": true, _xsd + "unsignedByte": true, _xsd + "positiveInteger": true,
+}
+
+var (
+	tzPattern      = `(Z|[+-]\d{2}:\d{2})?`
+	lexicalPattern = map[string]*regexp.Regexp{
+		"boolean":           regexp.MustCompile(`^(true|false|1|0)$`),
+		"decimal":           regexp.MustCompile(`^[+-]?(\d+(\.\d*)?|\.\d+)$`),
+		"integer":           regexp.MustCompile(`^[+-]?\d+$`),
+		"double":            regexp.MustCompile(`^([+-]?(\d+(\.\d*)?|\.\d+)([eE][+-]?\d+)?|[+-]?INF|NaN)$`),
+		"date":              regexp.MustCompile(`^-?\d{4,}-\d{2}-\d{2}` + tzPattern + `$`),
+		"time":              regexp.MustCompile(`^\d{2}:\d{2}:\d{2}(\.\d+)?` + tzPattern + `$`),
+		"dateTime":          regexp.MustCompile(`^-?\d{4,}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?` + tzPattern + `$`),
+		"dateTimeStamp":     regexp.MustCompile(`^-?\d{4,}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})$`),
+		"gYear":             regexp.MustCompile(`^-?\d{4,}` + tzPattern + `$`),
+		"gMonth":            regexp.MustCompile(`^--\d{2}` + tzPattern + `$`),
+		"gDay":              regexp.MustCompile(`^---\d{2}` + tzPattern + `$`),
+		"gYearMonth":        regexp.MustCompile(`^-?\d{4,}-\d{2}` + tzPattern + `$`),
+		"gMonthDay":         regexp.MustCompile(`^--\d{2}-\d{2}` + tzPattern + `$`),
+		"duration":          regexp.MustCompile(`^-?P(\d+Y)?(\d+M)?(\d+D)?(T(\d+H)?(\d+M)?(\d+(\.\d+)?S)?)?$`),
+		"yearMonthDuration": regexp.MustCompile(`^-?P(\d+Y)?(\d+M)?$`),
+		"dayTimeDuration":   regexp.MustCompile(`^-?P(\d+D)?(T(\d+H)?(\d+M)?(\d+(\.\d+)?S)?)?$`),
+		"hexBinary":         regexp.MustCompile(`^([0-9a-fA-F]{2})*$`),
+		"language":          regexp.MustCompile(`^[a-zA-Z]{1,8}(-[a-zA-Z0-9]{1,8})*$`),
+		"NMTOKEN":           regexp.MustCompile(`^[\w.\-:]+$`),
+		"Name":              regexp.MustCompile(`^[\pL_:][\w.\-:]*$`),
+		"NCName":            regexp.MustCompile(`^[\pL_][\w.\-]*$`),
+	}
+	integerRanges = map[string][2]string{ // inclusive bounds, empty if unbounded
+		"nonPositiveInteger": {"", "0"},
+		"negativeInteger":    {"", "-1"},
+		"long":               {"-9223372036854775808", "9223372036854775807"},
+		"int":                {"-2147483648", "2147483647"},
+		"short":              {"-32768", "32767"},
+		"byte":               {"-128", "127"},
+		"nonNegativeInteger": {"0", ""},
+		"unsignedLong":       {"0", "18446744073709551615"},
+		"unsignedInt":        {"0", "4294967295"},
+		"unsignedShort":      {"0", "65535"},
+		"unsignedByte":       {"0", "255"},
+		"positiveInteger":    {"1", ""},
+	}
+)
+
+// validLexical reports whether the string is a valid lexical form of the given datatype. The
+// second return value is false if the datatype is not known.
+func validLexical(datatype, lexical string) (bool, bool) {
+	if !strings.HasPrefix(datatype, _xsd) {
+		if datatype == _rdf+"langString" {
+			return true, true
+		}
+		return false, false
+	}
+	local := strings.TrimPrefix(datatype, _xsd)
+
+	if bounds, ok := integerRanges[local]; ok {
+		if !lexicalPattern["integer"].MatchString(lexical) {
+			return false, true
+		}
+		n, _ := new(big.Int).SetString(strings.TrimPrefix(lexical, "+"), 10)
+		if bounds[0] != "" {
+			min, _ := new(big.Int).SetString(bounds[0], 10)
+			if n.Cmp(min) < 0 {
+				return false, true
+			}
+		}
+		if bounds[1] != "" {
+			max, _ := new(big.Int).SetString(bounds[1], 10)
+			if n.Cmp(max) > 0 {
+				return false, true
+			}
+		}
+		return true, true
+	}
+
+	switch local {
+	case "string", "anyURI":
+		return true, true
+	case "float":
+		return lexicalPattern["double"].MatchString(lexical), true
+	case "normalizedString":
+		return !strings.ContainsAny(lexical, "\t\n\r"), true
+	case "token":
+		return !strings.ContainsAny(lexical, "\t\n\r") && !strings.Contains(lexical, "  ") &&
+			strings.TrimSpace(lexical) == lexical, true
+	case "base64Binary":
+		_, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(lexical), ""))
+		return err == nil, true
+	case "date", "dateTime", "dateTimeStamp":
+		if !lexicalPattern[local].MatchString(lexical) {
+			return false, true
+		}
+		_, err := parseDateTime(datatype, lexical)
+		return err == nil, true
+	case "time":
+		if !lexicalPattern[local].MatchString(lexical) {
+			return false, true
+		}
+		_, err := parseDateTime(datatype, lexical)
+		return err == nil || strings.HasPrefix(lexical, "24:00:00"), true
+	case "duration", "dayTimeDuration":
+		return lexicalPattern[local].MatchString(lexical) && !strings.HasSuffix(lexical, "P") &&
+			!strings.HasSuffix(lexical, "T"), true
+	case "yearMonthDuration":
+		return lexicalPattern[local].MatchString(lexical) && !strings.HasSuffix(lexical, "P"), true
+	}
+
+	if re, ok := lexicalPattern[local]; ok {
+		return re.MatchString(lexical), true
+	}
+
+	return false, false
+}
+
+func parseDateTime(datatype, lexical string) (time.Time, error) {
+	var layouts []string
+	switch datatype {
+	case _xsd + "date":
+		layouts = []string{"2006-01-02Z07:00", "2006-01-02"}
+	case _xsd + "time":
+		layouts = []string{"15:04:05Z07:00", "15:04:05"}
+	case _xsd + "dateTime", _xsd + "dateTimeStamp":
+		layouts = []string{"2006-01-02T15:04:05Z07:00", "2006-01-02T15:04:05"}
+	default:
+		return time.Time{}, errTypeError
+	}
+
+	var err error
+	for _, layout := range layouts {
+		var t time.Time
+		t, err = time.Parse(layout, lexical)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// numeric values are kept exact, unless a float or double is involved
+type numeric struct {
+	rat     *big.Rat
+	f       float64
+	isFloat bool
+}
+
+func (n numeric) float() float64 {
+	if n.isFloat {
+		return n.f
+	}
+	f, _ := n.rat.Float64()
+	return f
+}
+
+func numericValue(t memTerm) (numeric, error) {
+	if t.kind != literalKind || !numericTypes[t.datatype] {
+		return numeric{}, errTypeError
+	}
+	if valid, _ := validLexical(t.datatype, t.value); !valid {
+		return numeric{}, errTypeError
+	}
+
+	if t.datatype == _xsd+"float" || t.datatype == _xsd+"double" {
+		lexical := strings.Replace(t.value, "INF", "Inf", 1)
+		f, err := strconv.ParseFloat(lexical, 64)
+		if err != nil && !errors.Is(err, strconv.ErrRange) {
+			return numeric{}, errTypeError
+		}
+		return numeric{f: f, isFloat: true}, nil
+	}
+
+	r, ok := new(big.Rat).SetString(strings.TrimPrefix(t.value, "+"))
+	if !ok {
+		return numeric{}, errTypeError
+	}
+	return numeric{rat: r}, nil
+}
+
+func isIntegerType(datatype string) bool {
+	_, ok := integerRanges[strings.TrimPrefix(datatype, _xsd)]
+	return ok || datatype == _xsd+"integer"
+}
+
+func arithmetic(op string, a, b memTerm) (memTerm, error) {
+	x, err := numericValue(a)
+	if err != nil {
+		return memTerm{}, err
+	}
+	y, err := numericValue(b)
+	if err != nil {
+		return memTerm{}, err
+	}
+
+	if x.isFloat || y.isFloat {
+		var f float64
+		switch op {
+		case "+":
+			f = x.float() + y.float()
+		case "-":
+			f = x.float() - y.float()
+		case "*":
+			f = x.float() * y.float()
+		case "/":
+			f = x.float() / y.float()
+		}
+		return literalTerm(strconv.FormatFloat(f, 'E', -1, 64), "", _xsd+"double"), nil
+	}
+
+	r := new(big.Rat)
+	switch op {
+	case "+":
+		r.Add(x.rat, y.rat)
+	case "-":
+		r.Sub(x.rat, y.rat)
+	case "*":
+		r.Mul(x.rat, y.rat)
+	case "/":
+		if y.rat.Sign() == 0 {
+			return memTerm{}, errors.New("division by zero")
+		}
+		r.Quo(x.rat, y.rat)
+	}
+
+	if op != "/" && isIntegerType(a.datatype) && isIntegerType(b.datatype) {
+		return literalTerm(r.Num().String(), "", _xsd+"integer"), nil
+	}
+
+	lexical := strings.TrimRight(r.FloatString(20), "0")
+	if strings.HasSuffix(lexical, ".") {
+		lexical += "0"
+	}
+	return literalTerm(lexical, "", _xsd+"decimal"), nil
+}
+
+// equalTerms implements the SPARQL '=' operator
+func equalTerms(a, b memTerm) (bool, error) {
+	if a == b {
+		return true, nil
+	}
+	if a.kind != literalKind || b.kind != literalKind {
+		return false, nil
+	}
+
+	if numericTypes[a.datatype] && numericTypes[b.datatype] {
+		c, err := compareTerms(a, b)
+		if err != nil {
+			return false, err
+		}
+		return c == 0, nil
+	}
+
+	if a.datatype == b.datatype {
+		switch a.datatype {
+		case _rdf + "langString":
+			return a.value == b.value && strings.EqualFold(a.lang, b.lang), nil
+		case _xsd + "boolean", _xsd + "date", _xsd + "time", _xsd + "dateTime", _xsd + "dateTimeStamp":
+			c, err := compareTerms(a, b)
+			if err != nil {
+				return false, err
+			}
+			return c == 0, nil
+		}
+		if valid, known := validLexical(a.datatype, a.value); known && !valid {
+			return false, errTypeError
+		}
+		if valid, known := validLexical(b.datatype, b.value); known && !valid {
+			return false, errTypeError
+		}
+		return false, nil
+	}
+
+	return false, nil
+}
+
+// compareTerms orders two literals according to the SPARQL operator mapping; it returns -1, 0
+// or 1, and 2 if the values are incomparable (such as NaN)
+func compareTerms(a, b memTerm) (int, error) {
+	if a.kind != literalKind || b.kind != literalKind {
+		return 0, errTypeError
+	}
+
+	switch {
+	case numericTypes[a.datatype] && numericTypes[b.datatype]:
+		x, err := numericValue(a)
+		if err != nil {
+			return 0, err
+		}
+		y, err := numericValue(b)
+		if err != nil {
+			return 0, err
+		}
+		if !x.isFloat && !y.isFloat {
+			return x.rat.Cmp(y.rat), nil
+		}
+		fx, fy := x.float(), y.float()
+		switch {
+		case math.IsNaN(fx) || math.IsNaN(fy):
+			return 2, nil
+		case fx < fy:
+			return -1, nil
+		case fx > fy:
+			return 1, nil
+		}
+		return 0, nil
+	case a.datatype == _xsd+"string" && b.datatype == _xsd+"string":
+		return strings.Compare(a.value, b.value), nil
+	case a.datatype == _xsd+"boolean" && b.datatype == _xsd+"boolean":
+		x, err := effectiveBool(a)
+		if err != nil {
+			return 0, err
+		}
+		y, err := effectiveBool(b)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case x == y:
+			return 0, nil
+		case y:
+			return -1, nil
+		}
+		return 1, nil
+	case a.datatype == b.datatype || isDateTimeType(a.datatype) && isDateTimeType(b.datatype):
+		x, err := parseDateTime(a.datatype, a.value)
+		if err != nil {
+			return 0, errTypeError
+		}
+		y, err := parseDateTime(b.datatype, b.value)
+		if err != nil {
+			return 0, errTypeError
+		}
+		return x.Compare(y), nil
+	}
+
+	return 0, errTypeError
+}
+
+func isDateTimeType(datatype string) bool {
+	return datatype == _xsd+"dateTime" || datatype == _xsd+"dateTimeStamp"
+}
+
+// orderTerms provides the total order used by ORDER BY, MIN and MAX
+func orderTerms(a, b memTerm) int {
+	if a.kind != b.kind {
+		if a.kind < b.kind {
+			return -1
+		}
+		return 1
+	}
+	if a.kind == literalKind {
+		if c, err := compareTerms(a, b); err == nil && c != 2 {
+			return c
+		}
+		if c := strings.Compare(a.value, b.value); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.datatype, b.datatype); c != 0 {
+			return c
+		}
+		return strings.Compare(a.lang, b.lang)
+	}
+	return strings.Compare(a.value, b.value)
+}
+
+// castTerm implements the XSD constructor functions, such as xsd:integer(?x)
+func castTerm(datatype string, t memTerm) (memTerm, error) {
+	if t.kind == blankKind {
+		return memTerm{}, errTypeError
+	}
+	if t.kind == iriKind {
+		if datatype != _xsd+"string" {
+			return memTerm{}, errTypeError
+		}
+		return literalTerm(t.value, "", ""), nil
+	}
+
+	if datatype == _xsd+"string" {
+		return literalTerm(t.value, "", ""), nil
+	}
+
+	lexical := t.value
+
+	switch {
+	case numericTypes[t.datatype] && numericTypes[datatype]:
+		n, err := numericValue(t)
+		if err != nil {
+			return memTerm{}, err
+		}
+		switch {
+		case datatype == _xsd+"float" || datatype == _xsd+"double":
+			lexical = strconv.FormatFloat(n.float(), 'E', -1, 64)
+		case isIntegerType(datatype):
+			if n.isFloat {
+				if math.IsNaN(n.f) || math.IsInf(n.f, 0) {
+					return memTerm{}, errTypeError
+				}
+				lexical = strconv.FormatFloat(math.Trunc(n.f), 'f', 0, 64)
+			} else {
+				q := new(big.Int).Quo(n.rat.Num(), n.rat.Denom())
+				lexical = q.String()
+			}
+		default:
+			if n.isFloat {
+				if math.IsNaN(n.f) || math.IsInf(n.f, 0) {
+					return memTerm{}, errTypeError
+				}
+				lexical = strconv.FormatFloat(n.f, 'f', -1, 64)
+			} else {
+				lexical = n.rat.FloatString(20)
+			}
+		}
+	case t.datatype == _xsd+"boolean" && numericTypes[datatype]:
+		b, err := effectiveBool(t)
+		if err != nil {
+			return memTerm{}, err
+		}
+		lexical = "0"
+		if b {
+			lexical = "1"
+		}
+	case numericTypes[t.datatype] && datatype == _xsd+"boolean":
+		n, err := numericValue(t)
+		if err != nil {
+			return memTerm{}, err
+		}
+		f := n.float()
+		lexical = strconv.FormatBool(f != 0 && !math.IsNaN(f))
+	case t.datatype == _xsd+"string" || t.datatype == datatype:
+		if datatype != _xsd+"normalizedString" {
+			lexical = strings.TrimSpace(lexical)
+		}
+	default:
+		return memTerm{}, errTypeError
+	}
+
+	valid, known := validLexical(datatype, lexical)
+	if !known {
+		return memTerm{}, &UnsupportedFeatureError{Feature: "cast to datatype " + datatype}
+	}
+	if !valid {
+		return memTerm{}, errTypeError
+	}
+
+	return literalTerm(lexical, "", datatype), nil
+}
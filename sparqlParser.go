@@ -0,0 +1,1512 @@
+package shawell
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// This file contains a parser for the fragment of SPARQL 1.1 that is produced by shaWell when
+// translating SHACL documents into queries. It is used by the MemoryEndpoint, which evaluates
+// these queries directly over an in-memory RDF graph instead of sending them to a server.
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIRI
+	tokPName
+	tokVar
+	tokString
+	tokLang
+	tokNumber
+	tokBlank
+	tokName
+	tokPunct
+)
+
+type token struct {
+	kind  tokenKind
+	value string // the IRI, prefixed name, variable name, string content, or symbol
+	dt    string // datatype of numeric tokens
+	pos   int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of query"
+	case tokIRI:
+		return "<" + t.value + ">"
+	case tokVar:
+		return "?" + t.value
+	case tokString:
+		return strconv.Quote(t.value)
+	case tokLang:
+		return "@" + t.value
+	case tokBlank:
+		return "_:" + t.value
+	}
+	return t.value
+}
+
+// lexSparql splits a query string into tokens
+func lexSparql(input string) ([]token, error) {
+	var out []token
+	i := 0
+
+	for i < len(input) {
+		c := input[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case c == '#':
+			for i < len(input) && input[i] != '\n' {
+				i++
+			}
+			continue
+		}
+
+		start := i
+
+		switch {
+		case c == '<':
+			end := strings.IndexByte(input[i+1:], '>')
+			if end >= 0 && isIRIRef(input[i+1:i+1+end]) {
+				out = append(out, token{kind: tokIRI, value: input[i+1 : i+1+end], pos: start})
+				i = i + end + 2
+				continue
+			}
+			if strings.HasPrefix(input[i:], "<=") {
+				out = append(out, token{kind: tokPunct, value: "<=", pos: start})
+				i += 2
+			} else {
+				out = append(out, token{kind: tokPunct, value: "<", pos: start})
+				i++
+			}
+		case c == '?' || c == '$':
+			j := i + 1
+			for j < len(input) {
+				r, size := utf8.DecodeRuneInString(input[j:])
+				if !isNameRune(r) || r == '-' || r == '.' {
+					break
+				}
+				j += size
+			}
+			if j == i+1 {
+				out = append(out, token{kind: tokPunct, value: "?", pos: start})
+				i++
+			} else {
+				out = append(out, token{kind: tokVar, value: input[i+1 : j], pos: start})
+				i = j
+			}
+		case c == '"' || c == '\'':
+			value, next, err := lexString(input, i)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, token{kind: tokString, value: value, pos: start})
+			i = next
+		case c == '@':
+			j := i + 1
+			for j < len(input) && (isAlpha(input[j]) || isDigit(input[j]) || input[j] == '-') {
+				j++
+			}
+			if j == i+1 {
+				return nil, fmt.Errorf("invalid language tag at position %d", i)
+			}
+			out = append(out, token{kind: tokLang, value: input[i+1 : j], pos: start})
+			i = j
+		case isDigit(c) || (c == '.' && i+1 < len(input) && isDigit(input[i+1])):
+			value, dt, next := lexNumber(input, i)
+			out = append(out, token{kind: tokNumber, value: value, dt: dt, pos: start})
+			i = next
+		case c == '_' && strings.HasPrefix(input[i:], "_:"):
+			j := i + 2
+			for j < len(input) {
+				r, size := utf8.DecodeRuneInString(input[j:])
+				if !isNameRune(r) {
+					break
+				}
+				j += size
+			}
+			for j > i+2 && input[j-1] == '.' {
+				j--
+			}
+			out = append(out, token{kind: tokBlank, value: input[i+2 : j], pos: start})
+			i = j
+		case c == ':' || isAlpha(c) || c >= utf8.RuneSelf:
+			j := i
+			for j < len(input) {
+				r, size := utf8.DecodeRuneInString(input[j:])
+				if !isNameRune(r) {
+					break
+				}
+				j += size
+			}
+			for j > i && input[j-1] == '.' {
+				j--
+			}
+			if j < len(input) && input[j] == ':' {
+				// prefixed name: consume the local part
+				j++
+				for j < len(input) {
+					if input[j] == '\\' && j+1 < len(input) {
+						j += 2
+						continue
+					}
+					r, size := utf8.DecodeRuneInString(input[j:])
+					if !isNameRune(r) && r != ':' && r != '%' {
+						break
+					}
+					j += size
+				}
+				for input[j-1] == '.' {
+					j--
+				}
+				local := input[i:j]
+				local = strings.ReplaceAll(local, "\\", "")
+				out = append(out, token{kind: tokPName, value: local, pos: start})
+				i = j
+				continue
+			}
+			if j == i {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+			}
+			out = append(out, token{kind: tokName, value: input[i:j], pos: start})
+			i = j
+		default:
+			two := ""
+			if i+1 < len(input) {
+				two = input[i : i+2]
+			}
+			switch two {
+			case "^^", "&&", "||", "!=", ">=":
+				out = append(out, token{kind: tokPunct, value: two, pos: start})
+				i += 2
+				continue
+			}
+			if strings.IndexByte("{}()[].;,*+-/|^!=>", c) < 0 {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+			}
+			out = append(out, token{kind: tokPunct, value: string(c), pos: start})
+			i++
+		}
+	}
+
+	out = append(out, token{kind: tokEOF, pos: len(input)})
+
+	return out, nil
+}
+
+func isAlpha(c byte) bool { return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') }
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isNameRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.' ||
+		r == '·'
+}
+
+func isIRIRef(s string) bool {
+	for _, r := range s {
+		if r <= ' ' || strings.ContainsRune("<>\"{}|^`\\", r) {
+			return false
+		}
+	}
+	return true
+}
+
+func lexString(input string, i int) (string, int, error) {
+	quote := input[i]
+	long := strings.HasPrefix(input[i:], strings.Repeat(string(quote), 3))
+
+	j := i + 1
+	if long {
+		j = i + 3
+	}
+
+	var sb strings.Builder
+
+	for j < len(input) {
+		c := input[j]
+		switch {
+		case long && strings.HasPrefix(input[j:], strings.Repeat(string(quote), 3)):
+			return sb.String(), j + 3, nil
+		case !long && c == quote:
+			return sb.String(), j + 1, nil
+		case !long && (c == '\n' || c == '\r'):
+			return "", 0, fmt.Errorf("unterminated string at position %d", i)
+		case c == '\\':
+			if j+1 >= len(input) {
+				return "", 0, fmt.Errorf("unterminated string at position %d", i)
+			}
+			j++
+			switch input[j] {
+			case 't':
+				sb.WriteByte('\t')
+			case 'n':
+				sb.WriteByte('\n')
+			case 'r':
+				sb.WriteByte('\r')
+			case 'b':
+				sb.WriteByte('\b')
+			case 'f':
+				sb.WriteByte('\f')
+			case '"', '\'', '\\':
+				sb.WriteByte(input[j])
+			case 'u', 'U':
+				size := 4
+				if input[j] == 'U' {
+					size = 8
+				}
+				if j+size >= len(input) {
+					return "", 0, fmt.Errorf("invalid escape sequence at position %d", j)
+				}
+				code, err := strconv.ParseUint(input[j+1:j+1+size], 16, 32)
+				if err != nil {
+					return "", 0, fmt.Errorf("invalid escape sequence at position %d", j)
+				}
+				sb.WriteRune(rune(code))
+				j += size
+			default:
+				return "", 0, fmt.Errorf("invalid escape sequence at position %d", j)
+			}
+			j++
+		default:
+			sb.WriteByte(c)
+			j++
+		}
+	}
+
+	return "", 0, fmt.Errorf("unterminated string at position %d", i)
+}
+
+func lexNumber(input string, i int) (string, string, int) {
+	j := i
+	dt := _xsd + "integer"
+
+	for j < len(input) && isDigit(input[j]) {
+		j++
+	}
+	if j < len(input) && input[j] == '.' && j+1 < len(input) && isDigit(input[j+1]) {
+		dt = _xsd + "decimal"
+		j++
+		for j < len(input) && isDigit(input[j]) {
+			j++
+		}
+	}
+	if j < len(input) && (input[j] == 'e' || input[j] == 'E') {
+		k := j + 1
+		if k < len(input) && (input[k] == '+' || input[k] == '-') {
+			k++
+		}
+		if k < len(input) && isDigit(input[k]) {
+			for k < len(input) && isDigit(input[k]) {
+				k++
+			}
+			dt = _xsd + "double"
+			j = k
+		}
+	}
+
+	return input[i:j], dt, j
+}
+
+// AST of the supported SPARQL fragment
+
+type queryForm int
+
+const (
+	selectForm queryForm = iota
+	askForm
+)
+
+type sparqlQuery struct {
+	form     queryForm
+	distinct bool
+	star     bool
+	project  []projection
+	from     []string // the dataset given via FROM and FROM NAMED, if any
+	named    []string
+	where    *groupPattern
+	groupBy  []projection
+	having   []sparqlExpr
+	orderBy  []orderCondition
+	limit    int // -1 if not set
+	offset   int
+}
+
+type projection struct {
+	variable string
+	expr     sparqlExpr // nil if the plain variable is projected
+}
+
+type orderCondition struct {
+	expr       sparqlExpr
+	descending bool
+}
+
+type patternElement interface {
+	patternElement()
+}
+
+type groupPattern struct {
+	elements []patternElement
+}
+
+type triplePattern struct {
+	subject   patternTerm
+	predicate patternTerm // only used if path is nil
+	path      pathExpr
+	object    patternTerm
+}
+
+type triplesBlock struct {
+	triples []triplePattern
+}
+
+type optionalPattern struct{ group *groupPattern }
+type minusPattern struct{ group *groupPattern }
+type unionPattern struct{ branches []*groupPattern }
+type filterPattern struct{ expr sparqlExpr }
+type subSelectPattern struct{ query *sparqlQuery }
+
+type graphPattern struct {
+	graph patternTerm
+	group *groupPattern
+}
+
+type bindPattern struct {
+	expr     sparqlExpr
+	variable string
+}
+
+type valuesPattern struct {
+	vars []string
+	rows [][]memTerm // the zero memTerm is used for UNDEF
+}
+
+func (*groupPattern) patternElement()     {}
+func (*triplesBlock) patternElement()     {}
+func (*optionalPattern) patternElement()  {}
+func (*minusPattern) patternElement()     {}
+func (*unionPattern) patternElement()     {}
+func (*filterPattern) patternElement()    {}
+func (*subSelectPattern) patternElement() {}
+func (*graphPattern) patternElement()     {}
+func (*bindPattern) patternElement()      {}
+func (*valuesPattern) patternElement()    {}
+
+// patternTerm is either a variable or a constant term inside a graph pattern
+type patternTerm struct {
+	variable string
+	term     memTerm
+}
+
+func (p patternTerm) isVar() bool { return p.variable != "" }
+
+// property paths
+
+type pathExpr interface {
+	pathExpr()
+}
+
+type linkPath struct{ iri memTerm }
+type inversePath struct{ path pathExpr }
+type sequencePath struct{ paths []pathExpr }
+type alternativePath struct{ paths []pathExpr }
+type negatedPath struct{ forward, inverse []memTerm }
+
+type modPath struct {
+	path pathExpr
+	mod  byte // one of '?', '*', '+'
+}
+
+func (linkPath) pathExpr()        {}
+func (inversePath) pathExpr()     {}
+func (sequencePath) pathExpr()    {}
+func (alternativePath) pathExpr() {}
+func (negatedPath) pathExpr()     {}
+func (modPath) pathExpr()         {}
+
+// expressions
+
+type sparqlExpr interface {
+	sparqlExpr()
+}
+
+type varExpr struct{ name string }
+type constExpr struct{ term memTerm }
+
+type binaryExpr struct {
+	op          string
+	left, right sparqlExpr
+}
+
+type unaryExpr struct {
+	op   string
+	expr sparqlExpr
+}
+
+type inExpr struct {
+	expr    sparqlExpr
+	list    []sparqlExpr
+	negated bool
+}
+
+type callExpr struct {
+	name string // upper case name of the built-in, or the IRI of a cast
+	args []sparqlExpr
+	cast bool
+}
+
+type existsExpr struct {
+	group   *groupPattern
+	negated bool
+}
+
+type aggregateExpr struct {
+	name      string // upper case
+	distinct  bool
+	star      bool
+	expr      sparqlExpr
+	separator string
+}
+
+func (varExpr) sparqlExpr()        {}
+func (constExpr) sparqlExpr()      {}
+func (binaryExpr) sparqlExpr()     {}
+func (unaryExpr) sparqlExpr()      {}
+func (inExpr) sparqlExpr()         {}
+func (callExpr) sparqlExpr()       {}
+func (existsExpr) sparqlExpr()     {}
+func (*aggregateExpr) sparqlExpr() {}
+
+// defaultQueryPrefixes are assumed to be known even when not declared in the query, mirroring
+// the namespaces most triple stores predefine
+var defaultQueryPrefixes = map[string]string{
+	"rdf:":  _rdf,
+	"rdfs:": _rdfs,
+	"xsd:":  _xsd,
+	"sh:":   _sh,
+	"owl:":  "http://www.w3.org/2002/07/owl#",
+}
+
+type sparqlParser struct {
+	tokens   []token
+	pos      int
+	prefixes map[string]string
+}
+
+// parseSparql parses a query string into its AST
+func parseSparql(query string) (*sparqlQuery, error) {
+	tokens, err := lexSparql(query)
+	if err != nil {
+		return nil, &ParseError{Term: "SPARQL query", Err: err}
+	}
+
+	p := sparqlParser{tokens: tokens, prefixes: make(map[string]string)}
+	for k, v := range defaultQueryPrefixes {
+		p.prefixes[k] = v
+	}
+
+	out, err := p.parseQuery()
+	if err != nil {
+		return nil, &ParseError{Term: "SPARQL query", Err: err}
+	}
+
+	return out, nil
+}
+
+func (p *sparqlParser) peek() token { return p.tokens[p.pos] }
+
+func (p *sparqlParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *sparqlParser) isPunct(symbol string) bool {
+	t := p.peek()
+	return t.kind == tokPunct && t.value == symbol
+}
+
+func (p *sparqlParser) isKeyword(word string) bool {
+	t := p.peek()
+	return t.kind == tokName && strings.EqualFold(t.value, word)
+}
+
+func (p *sparqlParser) acceptPunct(symbol string) bool {
+	if p.isPunct(symbol) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *sparqlParser) acceptKeyword(word string) bool {
+	if p.isKeyword(word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *sparqlParser) expectPunct(symbol string) error {
+	if !p.acceptPunct(symbol) {
+		return p.unexpected(fmt.Sprint("'", symbol, "'"))
+	}
+	return nil
+}
+
+func (p *sparqlParser) expectKeyword(word string) error {
+	if !p.acceptKeyword(word) {
+		return p.unexpected(word)
+	}
+	return nil
+}
+
+func (p *sparqlParser) unexpected(expected string) error {
+	t := p.peek()
+	return fmt.Errorf("expected %s at position %d, found %s", expected, t.pos, t)
+}
+
+func (p *sparqlParser) parseQuery() (*sparqlQuery, error) {
+	for {
+		if p.acceptKeyword("PREFIX") {
+			name := p.next()
+			if name.kind != tokPName || !strings.HasSuffix(name.value, ":") {
+				return nil, fmt.Errorf("invalid prefix declaration at position %d", name.pos)
+			}
+			iri := p.next()
+			if iri.kind != tokIRI {
+				return nil, fmt.Errorf("invalid prefix declaration at position %d", iri.pos)
+			}
+			p.prefixes[name.value] = iri.value
+			continue
+		}
+		if p.acceptKeyword("BASE") {
+			if p.next().kind != tokIRI {
+				return nil, p.unexpected("IRI")
+			}
+			continue
+		}
+		break
+	}
+
+	var out *sparqlQuery
+	var err error
+
+	switch {
+	case p.isKeyword("SELECT"):
+		out, err = p.parseSelect()
+	case p.acceptKeyword("ASK"):
+		out = &sparqlQuery{form: askForm, limit: -1}
+		if err = p.parseDataset(out); err != nil {
+			return nil, err
+		}
+		p.acceptKeyword("WHERE")
+		out.where, err = p.parseGroup()
+	default:
+		return nil, p.unexpected("SELECT or ASK")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek().kind != tokEOF {
+		return nil, p.unexpected("end of query")
+	}
+
+	return out, nil
+}
+
+func (p *sparqlParser) parseSelect() (*sparqlQuery, error) {
+	if err := p.expectKeyword("SELECT"); err != nil {
+		return nil, err
+	}
+
+	out := &sparqlQuery{form: selectForm, limit: -1}
+
+	if p.acceptKeyword("DISTINCT") {
+		out.distinct = true
+	} else {
+		p.acceptKeyword("REDUCED")
+	}
+
+	if p.acceptPunct("*") {
+		out.star = true
+	} else {
+		for {
+			t := p.peek()
+			if t.kind == tokVar {
+				p.next()
+				out.project = append(out.project, projection{variable: t.value})
+				continue
+			}
+			if t.kind == tokPunct && t.value == "(" {
+				p.next()
+				expr, err := p.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				if err = p.expectKeyword("AS"); err != nil {
+					return nil, err
+				}
+				v := p.next()
+				if v.kind != tokVar {
+					return nil, fmt.Errorf("expected variable at position %d", v.pos)
+				}
+				if err = p.expectPunct(")"); err != nil {
+					return nil, err
+				}
+				out.project = append(out.project, projection{variable: v.value, expr: expr})
+				continue
+			}
+			break
+		}
+		if len(out.project) == 0 {
+			return nil, p.unexpected("projection")
+		}
+	}
+
+	if err := p.parseDataset(out); err != nil {
+		return nil, err
+	}
+
+	p.acceptKeyword("WHERE")
+
+	var err error
+	out.where, err = p.parseGroup()
+	if err != nil {
+		return nil, err
+	}
+
+	// solution modifiers
+	if p.acceptKeyword("GROUP") {
+		if err = p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			t := p.peek()
+			if t.kind == tokVar {
+				p.next()
+				out.groupBy = append(out.groupBy, projection{variable: t.value})
+				continue
+			}
+			if t.kind == tokPunct && t.value == "(" {
+				p.next()
+				expr, err := p.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				var name string
+				if p.acceptKeyword("AS") {
+					v := p.next()
+					if v.kind != tokVar {
+						return nil, fmt.Errorf("expected variable at position %d", v.pos)
+					}
+					name = v.value
+				}
+				if err = p.expectPunct(")"); err != nil {
+					return nil, err
+				}
+				out.groupBy = append(out.groupBy, projection{variable: name, expr: expr})
+				continue
+			}
+			break
+		}
+		if len(out.groupBy) == 0 {
+			return nil, p.unexpected("grouping condition")
+		}
+	}
+
+	if p.acceptKeyword("HAVING") {
+		for p.isPunct("(") || (p.peek().kind == tokName && !p.isKeyword("ORDER") &&
+			!p.isKeyword("LIMIT") && !p.isKeyword("OFFSET")) {
+			expr, err := p.parseConstraint()
+			if err != nil {
+				return nil, err
+			}
+			out.having = append(out.having, expr)
+		}
+	}
+
+	if p.acceptKeyword("ORDER") {
+		if err = p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			var cond orderCondition
+			switch {
+			case p.isKeyword("ASC") || p.isKeyword("DESC"):
+				cond.descending = strings.EqualFold(p.next().value, "DESC")
+				expr, err := p.parseBracketted()
+				if err != nil {
+					return nil, err
+				}
+				cond.expr = expr
+			case p.peek().kind == tokVar:
+				cond.expr = varExpr{name: p.next().value}
+			case p.isPunct("("):
+				expr, err := p.parseBracketted()
+				if err != nil {
+					return nil, err
+				}
+				cond.expr = expr
+			default:
+				if len(out.orderBy) == 0 {
+					return nil, p.unexpected("order condition")
+				}
+			}
+			if cond.expr == nil {
+				break
+			}
+			out.orderBy = append(out.orderBy, cond)
+		}
+	}
+
+	for p.isKeyword("LIMIT") || p.isKeyword("OFFSET") {
+		limit := p.next()
+		n := p.next()
+		if n.kind != tokNumber {
+			return nil, fmt.Errorf("expected integer at position %d", n.pos)
+		}
+		num, err := strconv.Atoi(n.value)
+		if err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(limit.value, "LIMIT") {
+			out.limit = num
+		} else {
+			out.offset = num
+		}
+	}
+
+	return out, nil
+}
+
+// parseDataset parses the FROM and FROM NAMED clauses of a query
+func (p *sparqlParser) parseDataset(q *sparqlQuery) error {
+	for p.acceptKeyword("FROM") {
+		named := p.acceptKeyword("NAMED")
+		t := p.peek()
+		if t.kind != tokIRI && t.kind != tokPName {
+			return p.unexpected("graph IRI")
+		}
+		graph, err := p.parseTerm()
+		if err != nil {
+			return err
+		}
+		if named {
+			q.named = append(q.named, graph.value)
+		} else {
+			q.from = append(q.from, graph.value)
+		}
+	}
+	return nil
+}
+
+func (p *sparqlParser) parseGroup() (*groupPattern, error) {
+	if err := p.expectPunct("{"); err != nil {
+		return nil, err
+	}
+
+	out := &groupPattern{}
+
+	if p.isKeyword("SELECT") {
+		sub, err := p.parseSelect()
+		if err != nil {
+			return nil, err
+		}
+		if len(sub.from) > 0 || len(sub.named) > 0 {
+			return nil, errors.New("dataset clauses are not allowed in sub-queries")
+		}
+		out.elements = append(out.elements, &subSelectPattern{query: sub})
+		if err = p.expectPunct("}"); err != nil {
+			return nil, err
+		}
+		return out, nil
+	}
+
+	for {
+		t := p.peek()
+
+		switch {
+		case t.kind == tokPunct && t.value == "}":
+			p.next()
+			return out, nil
+		case t.kind == tokPunct && t.value == ".":
+			p.next() // tolerate stray separators
+		case t.kind == tokPunct && t.value == "{":
+			first, err := p.parseGroup()
+			if err != nil {
+				return nil, err
+			}
+			if !p.isKeyword("UNION") {
+				out.elements = append(out.elements, first)
+				continue
+			}
+			union := &unionPattern{branches: []*groupPattern{first}}
+			for p.acceptKeyword("UNION") {
+				branch, err := p.parseGroup()
+				if err != nil {
+					return nil, err
+				}
+				union.branches = append(union.branches, branch)
+			}
+			out.elements = append(out.elements, union)
+		case p.acceptKeyword("OPTIONAL"):
+			group, err := p.parseGroup()
+			if err != nil {
+				return nil, err
+			}
+			out.elements = append(out.elements, &optionalPattern{group: group})
+		case p.acceptKeyword("MINUS"):
+			group, err := p.parseGroup()
+			if err != nil {
+				return nil, err
+			}
+			out.elements = append(out.elements, &minusPattern{group: group})
+		case p.acceptKeyword("GRAPH"):
+			graph, err := p.parseVarOrTerm()
+			if err != nil {
+				return nil, err
+			}
+			group, err := p.parseGroup()
+			if err != nil {
+				return nil, err
+			}
+			out.elements = append(out.elements, &graphPattern{graph: graph, group: group})
+		case p.acceptKeyword("FILTER"):
+			expr, err := p.parseConstraint()
+			if err != nil {
+				return nil, err
+			}
+			out.elements = append(out.elements, &filterPattern{expr: expr})
+		case p.acceptKeyword("BIND"):
+			if err := p.expectPunct("("); err != nil {
+				return nil, err
+			}
+			expr, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expectKeyword("AS"); err != nil {
+				return nil, err
+			}
+			v := p.next()
+			if v.kind != tokVar {
+				return nil, fmt.Errorf("expected variable at position %d", v.pos)
+			}
+			if err = p.expectPunct(")"); err != nil {
+				return nil, err
+			}
+			out.elements = append(out.elements, &bindPattern{expr: expr, variable: v.value})
+		case p.acceptKeyword("VALUES"):
+			values, err := p.parseValues()
+			if err != nil {
+				return nil, err
+			}
+			out.elements = append(out.elements, values)
+		case t.kind == tokEOF:
+			return nil, p.unexpected("'}'")
+		default:
+			block, err := p.parseTriplesBlock()
+			if err != nil {
+				return nil, err
+			}
+			out.elements = append(out.elements, block)
+		}
+	}
+}
+
+func (p *sparqlParser) parseValues() (*valuesPattern, error) {
+	out := &valuesPattern{}
+
+	single := false
+	if p.peek().kind == tokVar {
+		single = true
+		out.vars = []string{p.next().value}
+	} else {
+		if err := p.expectPunct("("); err != nil {
+			return nil, err
+		}
+		for p.peek().kind == tokVar {
+			out.vars = append(out.vars, p.next().value)
+		}
+		if err := p.expectPunct(")"); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.expectPunct("{"); err != nil {
+		return nil, err
+	}
+
+	for !p.acceptPunct("}") {
+		var row []memTerm
+		if !single {
+			if err := p.expectPunct("("); err != nil {
+				return nil, err
+			}
+		}
+		for len(row) < len(out.vars) {
+			if p.acceptKeyword("UNDEF") {
+				row = append(row, memTerm{})
+				continue
+			}
+			term, err := p.parseTerm()
+			if err != nil {
+				return nil, err
+			}
+			row = append(row, term)
+		}
+		if !single {
+			if err := p.expectPunct(")"); err != nil {
+				return nil, err
+			}
+		}
+		out.rows = append(out.rows, row)
+	}
+
+	return out, nil
+}
+
+func (p *sparqlParser) parseTriplesBlock() (*triplesBlock, error) {
+	out := &triplesBlock{}
+
+	for {
+		subject, err := p.parseVarOrTerm()
+		if err != nil {
+			return nil, err
+		}
+
+		for {
+			var tp triplePattern
+			tp.subject = subject
+
+			if p.peek().kind == tokVar {
+				tp.predicate = patternTerm{variable: p.next().value}
+			} else {
+				path, err := p.parsePath()
+				if err != nil {
+					return nil, err
+				}
+				if link, ok := path.(linkPath); ok {
+					tp.predicate = patternTerm{term: link.iri}
+				} else {
+					tp.path = path
+				}
+			}
+
+			for {
+				object, err := p.parseVarOrTerm()
+				if err != nil {
+					return nil, err
+				}
+				tp.object = object
+				out.triples = append(out.triples, tp)
+				if !p.acceptPunct(",") {
+					break
+				}
+			}
+
+			if !p.acceptPunct(";") {
+				break
+			}
+			for p.acceptPunct(";") {
+			}
+			if p.isPunct(".") || p.isPunct("}") {
+				break
+			}
+		}
+
+		if !p.acceptPunct(".") {
+			return out, nil
+		}
+		t := p.peek()
+		if t.kind != tokVar && t.kind != tokIRI && t.kind != tokPName && t.kind != tokBlank &&
+			t.kind != tokString && t.kind != tokNumber {
+			return out, nil
+		}
+	}
+}
+
+func (p *sparqlParser) parsePath() (pathExpr, error) {
+	var alts []pathExpr
+
+	for {
+		var seq []pathExpr
+		for {
+			elt, err := p.parsePathElt()
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, elt)
+			if !p.acceptPunct("/") {
+				break
+			}
+		}
+		if len(seq) == 1 {
+			alts = append(alts, seq[0])
+		} else {
+			alts = append(alts, sequencePath{paths: seq})
+		}
+		if !p.acceptPunct("|") {
+			break
+		}
+	}
+
+	if len(alts) == 1 {
+		return alts[0], nil
+	}
+	return alternativePath{paths: alts}, nil
+}
+
+func (p *sparqlParser) parsePathElt() (pathExpr, error) {
+	inverse := p.acceptPunct("^")
+
+	var out pathExpr
+
+	switch {
+	case p.acceptPunct("("):
+		inner, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expectPunct(")"); err != nil {
+			return nil, err
+		}
+		out = inner
+	case p.acceptPunct("!"):
+		neg := negatedPath{}
+		parseOne := func() error {
+			inv := p.acceptPunct("^")
+			iri, err := p.parsePathIRI()
+			if err != nil {
+				return err
+			}
+			if inv {
+				neg.inverse = append(neg.inverse, iri)
+			} else {
+				neg.forward = append(neg.forward, iri)
+			}
+			return nil
+		}
+		if p.acceptPunct("(") {
+			for {
+				if err := parseOne(); err != nil {
+					return nil, err
+				}
+				if !p.acceptPunct("|") {
+					break
+				}
+			}
+			if err := p.expectPunct(")"); err != nil {
+				return nil, err
+			}
+		} else if err := parseOne(); err != nil {
+			return nil, err
+		}
+		out = neg
+	default:
+		iri, err := p.parsePathIRI()
+		if err != nil {
+			return nil, err
+		}
+		out = linkPath{iri: iri}
+	}
+
+	for {
+		t := p.peek()
+		if t.kind != tokPunct || (t.value != "*" && t.value != "+" && t.value != "?") {
+			break
+		}
+		p.next()
+		out = modPath{path: out, mod: t.value[0]}
+	}
+
+	if inverse {
+		out = inversePath{path: out}
+	}
+
+	return out, nil
+}
+
+func (p *sparqlParser) parsePathIRI() (memTerm, error) {
+	if p.isKeyword("a") {
+		p.next()
+		return iriTerm(_rdf + "type"), nil
+	}
+	t := p.peek()
+	if t.kind != tokIRI && t.kind != tokPName {
+		return memTerm{}, p.unexpected("property path")
+	}
+	return p.parseTerm()
+}
+
+func (p *sparqlParser) parseVarOrTerm() (patternTerm, error) {
+	if p.peek().kind == tokVar {
+		return patternTerm{variable: p.next().value}, nil
+	}
+	term, err := p.parseTerm()
+	if err != nil {
+		return patternTerm{}, err
+	}
+	return patternTerm{term: term}, nil
+}
+
+func (p *sparqlParser) resolve(pname string) (string, error) {
+	idx := strings.Index(pname, ":")
+	prefix, ok := p.prefixes[pname[:idx+1]]
+	if !ok {
+		return "", fmt.Errorf("undeclared prefix in %s", pname)
+	}
+	return prefix + pname[idx+1:], nil
+}
+
+// parseTerm parses a constant RDF term: an IRI, a blank node label or a literal
+func (p *sparqlParser) parseTerm() (memTerm, error) {
+	t := p.next()
+
+	switch t.kind {
+	case tokIRI:
+		return iriTerm(t.value), nil
+	case tokPName:
+		iri, err := p.resolve(t.value)
+		if err != nil {
+			return memTerm{}, err
+		}
+		return iriTerm(iri), nil
+	case tokBlank:
+		return memTerm{kind: blankKind, value: t.value}, nil
+	case tokNumber:
+		return literalTerm(t.value, "", t.dt), nil
+	case tokPunct:
+		if t.value == "-" || t.value == "+" {
+			n := p.next()
+			if n.kind != tokNumber {
+				return memTerm{}, fmt.Errorf("expected number at position %d", n.pos)
+			}
+			value := n.value
+			if t.value == "-" {
+				value = "-" + value
+			}
+			return literalTerm(value, "", n.dt), nil
+		}
+	case tokName:
+		switch strings.ToLower(t.value) {
+		case "true", "false":
+			return literalTerm(strings.ToLower(t.value), "", _xsd+"boolean"), nil
+		case "a":
+			return iriTerm(_rdf + "type"), nil
+		}
+	case tokString:
+		if lang := p.peek(); lang.kind == tokLang {
+			p.next()
+			if p.acceptPunct("^^") { // tolerate redundant datatype on language-tagged literals
+				if _, err := p.parseTerm(); err != nil {
+					return memTerm{}, err
+				}
+			}
+			return literalTerm(t.value, lang.value, ""), nil
+		}
+		if p.acceptPunct("^^") {
+			dt, err := p.parseTerm()
+			if err != nil {
+				return memTerm{}, err
+			}
+			if dt.kind != iriKind {
+				return memTerm{}, fmt.Errorf("invalid datatype at position %d", t.pos)
+			}
+			return literalTerm(t.value, "", dt.value), nil
+		}
+		return literalTerm(t.value, "", ""), nil
+	}
+
+	return memTerm{}, fmt.Errorf("expected RDF term at position %d, found %s", t.pos, t)
+}
+
+// parseConstraint parses the argument of FILTER and HAVING
+func (p *sparqlParser) parseConstraint() (sparqlExpr, error) {
+	if p.isPunct("(") {
+		return p.parseBracketted()
+	}
+	return p.parsePrimary()
+}
+
+func (p *sparqlParser) parseBracketted() (sparqlExpr, error) {
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if err = p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+	return expr, nil
+}
+
+func (p *sparqlParser) parseExpr() (sparqlExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptPunct("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *sparqlParser) parseAnd() (sparqlExpr, error) {
+	left, err := p.parseRelational()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptPunct("&&") {
+		right, err := p.parseRelational()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *sparqlParser) parseRelational() (sparqlExpr, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	switch {
+	case t.kind == tokPunct && (t.value == "=" || t.value == "!=" || t.value == "<" ||
+		t.value == ">" || t.value == "<=" || t.value == ">="):
+		p.next()
+		right, err := p.parseAdditive()
+		if err != nil {
+			return nil, err
+		}
+		return binaryExpr{op: t.value, left: left, right: right}, nil
+	case p.isKeyword("IN"):
+		p.next()
+		list, err := p.parseExprList()
+		if err != nil {
+			return nil, err
+		}
+		return inExpr{expr: left, list: list}, nil
+	case p.isKeyword("NOT"):
+		p.next()
+		if err := p.expectKeyword("IN"); err != nil {
+			return nil, err
+		}
+		list, err := p.parseExprList()
+		if err != nil {
+			return nil, err
+		}
+		return inExpr{expr: left, list: list, negated: true}, nil
+	}
+
+	return left, nil
+}
+
+func (p *sparqlParser) parseExprList() ([]sparqlExpr, error) {
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	var out []sparqlExpr
+	if p.acceptPunct(")") {
+		return out, nil
+	}
+	for {
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, expr)
+		if !p.acceptPunct(",") {
+			break
+		}
+	}
+	if err := p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (p *sparqlParser) parseAdditive() (sparqlExpr, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for p.isPunct("+") || p.isPunct("-") {
+		op := p.next().value
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *sparqlParser) parseMultiplicative() (sparqlExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isPunct("*") || p.isPunct("/") {
+		op := p.next().value
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *sparqlParser) parseUnary() (sparqlExpr, error) {
+	if p.isPunct("!") || p.isPunct("-") || p.isPunct("+") {
+		op := p.next().value
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return unaryExpr{op: op, expr: expr}, nil
+	}
+	return p.parsePrimary()
+}
+
+var aggregateNames = map[string]bool{
+	"COUNT": true, "SUM": true, "MIN": true, "MAX": true, "AVG": true, "SAMPLE": true,
+	"GROUP_CONCAT": true,
+}
+
+func (p *sparqlParser) parsePrimary() (sparqlExpr, error) {
+	t := p.peek()
+
+	switch t.kind {
+	case tokVar:
+		p.next()
+		return varExpr{name: t.value}, nil
+	case tokPunct:
+		if t.value == "(" {
+			return p.parseBracketted()
+		}
+	case tokIRI, tokPName:
+		term, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		if p.isPunct("(") {
+			args, err := p.parseExprList()
+			if err != nil {
+				return nil, err
+			}
+			return callExpr{name: term.value, args: args, cast: true}, nil
+		}
+		return constExpr{term: term}, nil
+	case tokName:
+		name := strings.ToUpper(t.value)
+		switch name {
+		case "TRUE", "FALSE":
+			term, err := p.parseTerm()
+			if err != nil {
+				return nil, err
+			}
+			return constExpr{term: term}, nil
+		case "EXISTS":
+			p.next()
+			group, err := p.parseGroup()
+			if err != nil {
+				return nil, err
+			}
+			return existsExpr{group: group}, nil
+		case "NOT":
+			p.next()
+			if err := p.expectKeyword("EXISTS"); err != nil {
+				return nil, err
+			}
+			group, err := p.parseGroup()
+			if err != nil {
+				return nil, err
+			}
+			return existsExpr{group: group, negated: true}, nil
+		}
+		p.next()
+		if aggregateNames[name] {
+			return p.parseAggregate(name)
+		}
+		if !p.isPunct("(") {
+			return nil, fmt.Errorf("unexpected %s at position %d", t, t.pos)
+		}
+		args, err := p.parseExprList()
+		if err != nil {
+			return nil, err
+		}
+		return callExpr{name: name, args: args}, nil
+	default:
+		term, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		return constExpr{term: term}, nil
+	}
+
+	return nil, fmt.Errorf("unexpected %s at position %d", t, t.pos)
+}
+
+func (p *sparqlParser) parseAggregate(name string) (sparqlExpr, error) {
+	out := &aggregateExpr{name: name, separator: " "}
+
+	if err := p.expectPunct("("); err != nil {
+		return nil, err
+	}
+	out.distinct = p.acceptKeyword("DISTINCT")
+
+	if name == "COUNT" && p.acceptPunct("*") {
+		out.star = true
+	} else {
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		out.expr = expr
+	}
+
+	if name == "GROUP_CONCAT" && p.acceptPunct(";") {
+		if err := p.expectKeyword("SEPARATOR"); err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct("="); err != nil {
+			return nil, err
+		}
+		sep := p.next()
+		if sep.kind != tokString {
+			return nil, errors.New("expected string as separator")
+		}
+		out.separator = sep.value
+	}
+
+	if err := p.expectPunct(")"); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
@@ -0,0 +1,105 @@
+package shawell
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cem-okulmus/rdf2go-1"
+)
+
+// TargetSparql is a SPARQL-based target (sh:target), as defined in the SHACL Advanced Features.
+// The target is either a sh:SPARQLTarget with its own SELECT query, or an instance of a
+// sh:SPARQLTargetType, whose query is pre-bound with the parameter values of the target. The
+// focus nodes are the bindings of $this.
+type TargetSparql struct {
+	node   rdf2go.Term            // the node defining the target
+	shape  rdf2go.Term            // the shape the target belongs to, bound to $currentShape
+	query  string                 // the SELECT query
+	params map[string]rdf2go.Term // values bound to the parameters of the target type
+	id     int64                  // used to create unique references in Sparql translation
+}
+
+func (t TargetSparql) Target() {}
+
+func (t TargetSparql) String() string {
+	return t.node.RawValue()
+}
+
+// ExtractSparqlTarget parses the SPARQL-based target that is the object of the given sh:target
+// triple
+func ExtractSparqlTarget(graph *rdf2go.Graph, triple *rdf2go.Triple) (out TargetSparql, err error) {
+	out.node = triple.Object
+	out.shape = triple.Subject
+	out.id = getCount()
+
+	if graph.One(out.node, res(_sh+"select"), nil) != nil {
+		out.query, err = extractSparqlQuery(graph, out.node, _sh+"select")
+		if err != nil {
+			return out, err
+		}
+	} else {
+		var targetType rdf2go.Term
+		for _, t := range graph.All(out.node, ResA, nil) {
+			if graph.One(t.Object, ResA, res(_sh+"SPARQLTargetType")) != nil {
+				targetType = t.Object
+				break
+			}
+		}
+		if targetType == nil {
+			return out, &UnsupportedFeatureError{Feature: "sh:target without SPARQL query", Term: out.node.String()}
+		}
+
+		out.query, err = extractSparqlQuery(graph, targetType, _sh+"select")
+		if err != nil {
+			return out, err
+		}
+
+		out.params = make(map[string]rdf2go.Term)
+		for _, p := range graph.All(targetType, res(_sh+"parameter"), nil) {
+			path := graph.One(p.Object, res(_sh+"path"), nil)
+			if path == nil {
+				return out, &ParseError{Term: targetType.String(), Err: errors.New("parameter without sh:path")}
+			}
+			value := graph.One(out.node, path.Object, nil)
+			if value == nil {
+				if o := graph.One(p.Object, res(_sh+"optional"), nil); o != nil && o.Object.RawValue() == "true" {
+					continue
+				}
+				return out, &ParseError{
+					Term: out.node.String(),
+					Err:  fmt.Errorf("missing value for parameter %v of target type %v", path.Object, targetType),
+				}
+			}
+			out.params[localName(path.Object.RawValue())] = value.Object
+		}
+	}
+
+	if !usesVar(out.query, "this") {
+		return out, &ParseError{Term: out.node.String(), Err: errors.New("SPARQL target does not select $this")}
+	}
+
+	return out, nil
+}
+
+// prebind substitutes the pre-bound variables of the query, with $this becoming ?sub, the
+// variable used for targets throughout the generated queries
+func (t TargetSparql) prebind() string {
+	_, blankShape := t.shape.(*rdf2go.BlankNode)
+
+	query := substituteVars(t.query, func(name string, _ byte) (string, bool) {
+		switch {
+		case name == "this":
+			return "?sub", true
+		case name == "sub": // would clash with the variable used for the targets
+			return fmt.Sprint("?sub", t.id), true
+		case t.params[name] != nil:
+			return t.params[name].String(), true
+		case name == "currentShape" && !blankShape:
+			return t.shape.String(), true
+		}
+		return "", false
+	})
+
+	return strings.TrimSpace(query)
+}
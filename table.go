@@ -1,9 +1,8 @@
-package main
+package shawell
 
 import (
 	"errors"
 	"fmt"
-	"log"
 	"sort"
 	"strings"
 	"text/tabwriter"
@@ -176,10 +175,9 @@ func GetTable(r *sparql.Results) *TableSimple[rdf.Term] {
 		for _, s := range r.Head.Vars {
 
 			v := t[s]
-			var err error
 			if v == nil {
-				v, err = rdfA.NewBlank(fmt.Sprint("blank", getCount()))
-				check(err)
+				tupleOrdered[ordering[s]] = unbound()
+				continue
 			}
 
 			// if v.String() == "" {
@@ -219,8 +217,15 @@ func GetTable(r *sparql.Results) *TableSimple[rdf.Term] {
 type GroupedTable[T stringer] struct {
 	header  []string
 	content [][]T
-	group   map[T](map[int][]T) // the grouping map
-	key     map[T]int           // the grouping map
+	group   map[T](map[int][]T)      // the grouping map
+	key     map[T]int                // the grouping map
+	seen    map[groupedValue[T]]bool // the values in the groups, while adding rows via AddGroupedRows
+}
+
+// groupedValue is a value in the group of a key, for one of the attributes
+type groupedValue[T stringer] struct {
+	key, value T
+	attribute  int
 }
 
 func (t *GroupedTable[T]) String() string {
@@ -360,7 +365,7 @@ func (t *GroupedTable[T]) GetIndex(key T) (int, error) {
 		return -1, errors.New("key not present in GroupedTable")
 	}
 	if val > len(t.content) {
-		log.Panicln("Key Map is wrong")
+		return -1, errors.New("key map of GroupedTable is wrong")
 	}
 
 	return val, nil
@@ -423,6 +428,7 @@ func (t *GroupedTable[T]) Regroup() {
 
 	t.group = make(map[T](map[int][]T))
 	t.key = make(map[T]int)
+	t.seen = nil
 
 	var attributesToGroup []int
 
@@ -462,6 +468,58 @@ func (t *GroupedTable[T]) Regroup() {
 	}
 }
 
+// AddGroupedRows adds the rows of the other table, which must have the same header, updating
+// the groups as it goes. As grouped tables are only used via their groups, rows that add no new
+// value to any group of their key are dropped, so that a table built from the pages of a
+// result holds each value of a key only once, instead of the whole result.
+func (t *GroupedTable[T]) AddGroupedRows(other Table[T]) error {
+	if t.header == nil {
+		t.header = other.GetHeader()
+	} else if strings.Join(t.header, " ") != strings.Join(other.GetHeader(), " ") {
+		return errors.New("incompatible tables to merge")
+	}
+
+	if t.key == nil {
+		t.Regroup()
+	}
+	if t.seen == nil {
+		t.seen = make(map[groupedValue[T]]bool)
+		for key, groups := range t.group {
+			for a, values := range groups {
+				for _, v := range values {
+					t.seen[groupedValue[T]{key: key, value: v, attribute: a}] = true
+				}
+			}
+		}
+	}
+
+	for row := range other.IterRows() {
+		key := row[0]
+		needed := false
+		if _, ok := t.key[key]; !ok {
+			t.key[key] = len(t.content)
+			needed = true
+		}
+		for a := 1; a < len(row); a++ {
+			v := groupedValue[T]{key: key, value: row[a], attribute: a}
+			if t.seen[v] {
+				continue
+			}
+			t.seen[v] = true
+			if t.group[key] == nil {
+				t.group[key] = make(map[int][]T)
+			}
+			t.group[key][a] = append(t.group[key][a], row[a])
+			needed = true
+		}
+		if needed {
+			t.content = append(t.content, row)
+		}
+	}
+
+	return nil
+}
+
 func GetGroupedTable[T stringer](inputToCheck Table[T]) *GroupedTable[T] {
 	// fmt.Println("Calling Group on Table", inputToCheck)
 	input, ok := inputToCheck.(*TableSimple[T])
@@ -0,0 +1,273 @@
+package shawell
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	rdf "github.com/cem-okulmus/rdf2go-1"
+)
+
+// DefaultBatchSize is the number of triples sent to a SPARQL endpoint in a single request
+const DefaultBatchSize = 10000
+
+// UploadOptions controls how a SparqlEndpoint uploads graphs, as done by Insert and Add. The
+// triples are sent in batches, either as INSERT DATA updates or, if the address of a SPARQL 1.1
+// Graph Store HTTP Protocol endpoint is given, as N-Triples documents. Should the store not
+// support the protocol, the endpoint falls back to INSERT DATA updates.
+type UploadOptions struct {
+	BatchSize  int    // triples per request; DefaultBatchSize if zero
+	GraphStore string // the address of the Graph Store Protocol endpoint, if any
+}
+
+// SetUpload replaces the upload options of the endpoint
+func (s *SparqlEndpoint) SetUpload(opts UploadOptions) {
+	s.upload = opts
+}
+
+// uploadGraph sends the triples of the graph to the store, replacing the content of the named
+// graph if replace is set
+func (s *SparqlEndpoint) uploadGraph(ctx context.Context, input *rdf.Graph, graph string, replace bool) error {
+	size := s.upload.BatchSize
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+	batches := tripleBatches(input, size)
+
+	if s.upload.GraphStore != "" {
+		err := s.storeGraph(ctx, batches, graph, replace)
+		var status *statusError
+		if !errors.As(err, &status) || !graphStoreUnsupported(status.code) {
+			return err
+		}
+		if s.debug {
+			fmt.Println("Graph Store Protocol not supported, falling back to INSERT DATA: ", err)
+		}
+		s.upload.GraphStore = ""
+	}
+
+	if replace {
+		err := s.ClearGraph(ctx, graph)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, batch := range batches {
+		var sb strings.Builder
+		sb.WriteString("INSERT DATA {\n")
+		if graph != "" {
+			sb.WriteString(fmt.Sprint("GRAPH ", graph, " {\n"))
+		}
+		writeNTriples(&sb, batch)
+		if graph != "" {
+			sb.WriteString("}\n")
+		}
+		sb.WriteString("}")
+
+		if s.debug {
+			fmt.Println("INSERT String \n ", sb.String())
+		}
+
+		err := s.update(ctx, sb.String())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// storeGraph uploads the batches via the Graph Store HTTP Protocol, the first one via PUT if
+// the graph is to be replaced, and all others via POST
+func (s *SparqlEndpoint) storeGraph(ctx context.Context, batches [][]*rdf.Triple, graph string, replace bool) error {
+	address, err := url.Parse(s.upload.GraphStore)
+	if err != nil {
+		return err
+	}
+	query := address.Query()
+	if graph == "" {
+		query.Set("default", "")
+	} else {
+		query.Set("graph", strings.TrimSuffix(strings.TrimPrefix(graph, "<"), ">"))
+	}
+	address.RawQuery = query.Encode()
+
+	if replace && len(batches) == 0 {
+		batches = [][]*rdf.Triple{nil} // an empty document clears the graph
+	}
+
+	for i, batch := range batches {
+		method := http.MethodPost
+		if replace && i == 0 {
+			method = http.MethodPut
+		}
+
+		var sb strings.Builder
+		writeNTriples(&sb, batch)
+
+		// N-Triples is a subset of Turtle, which all stores implementing the protocol accept
+		_, err := s.send(ctx, method, address.String(), "text/turtle", "", sb.String())
+		if err != nil {
+			return &EndpointError{Query: fmt.Sprint(method, " ", address), Err: err}
+		}
+	}
+
+	return nil
+}
+
+// graphStoreUnsupported determines whether the status signals that the store does not offer
+// the Graph Store HTTP Protocol at the address
+func graphStoreUnsupported(code int) bool {
+	switch code {
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusUnsupportedMediaType,
+		http.StatusNotImplemented:
+		return true
+	}
+	return false
+}
+
+// tripleBatches splits the triples of the graph into batches of about the given size. Triples
+// connected via blank nodes are kept in the same batch, since blank nodes sent in different
+// requests would denote different nodes; such a group may thus exceed the size of a batch.
+func tripleBatches(input *rdf.Graph, size int) (out [][]*rdf.Triple) {
+	// union-find over the blank nodes, to group the triples sharing them
+	parent := make(map[string]string)
+	var find func(string) string
+	find = func(n string) string {
+		if p, ok := parent[n]; ok && p != n {
+			root := find(p)
+			parent[n] = root
+			return root
+		}
+		parent[n] = n
+		return n
+	}
+
+	var plain []*rdf.Triple
+	var withBlanks []*rdf.Triple
+	for triple := range input.IterTriples() {
+		var blanks []string
+		for _, t := range []rdf.Term{triple.Subject, triple.Object} {
+			if isBlank(t) {
+				blanks = append(blanks, t.RawValue())
+			}
+		}
+		if len(blanks) == 0 {
+			plain = append(plain, triple)
+			continue
+		}
+		withBlanks = append(withBlanks, triple)
+		if len(blanks) == 2 {
+			parent[find(blanks[0])] = find(blanks[1])
+		} else {
+			find(blanks[0])
+		}
+	}
+
+	groups := make(map[string][]*rdf.Triple)
+	var roots []string
+	for _, triple := range withBlanks {
+		node := triple.Subject
+		if !isBlank(node) {
+			node = triple.Object
+		}
+		root := find(node.RawValue())
+		if _, ok := groups[root]; !ok {
+			roots = append(roots, root)
+		}
+		groups[root] = append(groups[root], triple)
+	}
+
+	var current []*rdf.Triple
+	add := func(triples []*rdf.Triple) {
+		if len(current) > 0 && len(current)+len(triples) > size {
+			out = append(out, current)
+			current = nil
+		}
+		current = append(current, triples...)
+	}
+	for _, root := range roots {
+		add(groups[root])
+	}
+	for _, triple := range plain {
+		add([]*rdf.Triple{triple})
+	}
+	if len(current) > 0 {
+		out = append(out, current)
+	}
+
+	return out
+}
+
+func isBlank(t rdf.Term) bool {
+	switch t.(type) {
+	case rdf.BlankNode, *rdf.BlankNode:
+		return true
+	}
+	return false
+}
+
+// writeNTriples writes the triples in N-Triples notation
+func writeNTriples(sb *strings.Builder, triples []*rdf.Triple) {
+	for _, t := range triples {
+		sb.WriteString(fmt.Sprint(ntriplesTerm(t.Subject), " ", ntriplesTerm(t.Predicate), " ",
+			ntriplesTerm(t.Object), " .\n"))
+	}
+}
+
+// ntriplesTerm serialises the term in N-Triples notation, escaping IRIs and literals and
+// restricting blank node labels to the allowed characters
+func ntriplesTerm(t rdf.Term) string {
+	switch term := t.(type) {
+	case rdf.Literal:
+		return ntriplesLiteral(term)
+	case *rdf.Literal:
+		return ntriplesLiteral(*term)
+	case rdf.BlankNode, *rdf.BlankNode:
+		var sb strings.Builder
+		sb.WriteString("_:")
+		for _, r := range strings.TrimPrefix(t.RawValue(), "_:") {
+			switch {
+			case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+				sb.WriteRune(r)
+			default:
+				fmt.Fprintf(&sb, "_%X_", r)
+			}
+		}
+		return sb.String()
+	default:
+		return ntriplesIRI(t.RawValue())
+	}
+}
+
+func ntriplesIRI(iri string) string {
+	var sb strings.Builder
+	sb.WriteString("<")
+	for _, r := range iri {
+		if r <= 0x20 || strings.ContainsRune("<>\"{}|^`\\", r) {
+			fmt.Fprintf(&sb, "\\u%04X", r)
+		} else {
+			sb.WriteRune(r)
+		}
+	}
+	sb.WriteString(">")
+	return sb.String()
+}
+
+var literalEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+
+func ntriplesLiteral(l rdf.Literal) string {
+	out := `"` + literalEscaper.Replace(l.Value) + `"`
+
+	switch {
+	case l.Language != "":
+		return out + "@" + l.Language
+	case l.Datatype != nil && l.Datatype.RawValue() != "" && l.Datatype.RawValue() != _xsd+"string":
+		return out + "^^" + ntriplesIRI(l.Datatype.RawValue())
+	}
+	return out
+}
@@ -0,0 +1,200 @@
+package shawell
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	rdf "github.com/cem-okulmus/rdf2go-1"
+)
+
+// validationRun holds the state of a single validation run, built from its Options. Nothing of
+// it is shared between runs, so that several runs can be started concurrently via Validate.
+type validationRun struct {
+	dlv           string  // the address to DLV; if empty, the built-in solver is used instead
+	optimize      bool    // run the optimization pass over the generated queries
+	dialect       Dialect // the dialect the generated queries are rewritten for
+	recordQueries bool    // keep the queries computing conditional answers, to print them
+	debug         bool
+
+	// the named graph holding the triples inferred by rules, added to the default graphs of the
+	// queries over a dataset once set
+	inferenceGraph string
+
+	unrolled int64 // the closures unrolled so far, accessed atomically
+
+	mu          sync.Mutex
+	targetCache map[string]Table[rdf.Term] // answers of the queries over the targets of logical constraints
+	queries     []string
+	assembled   map[string]*sparqlQuery // the generated queries assembled so far
+
+	names *lpNames
+}
+
+// newValidationRun sets up the state of a run with the given options
+func newValidationRun(opts Options) *validationRun {
+	dialect := opts.Dialect
+	if dialect.Name == "" {
+		dialect = Generic
+	}
+	dialect.closureDepth = opts.ClosureDepth
+
+	return &validationRun{
+		dlv:           opts.DLV,
+		optimize:      !opts.Unoptimized,
+		dialect:       dialect,
+		recordQueries: opts.OnlyQueries,
+		debug:         opts.Debug,
+		targetCache:   make(map[string]Table[rdf.Term]),
+		assembled:     make(map[string]*sparqlQuery),
+		names:         newLPNames(opts.OnlyLP), // only printed, so kept readable
+	}
+}
+
+type runKey struct{}
+
+// withRun returns a context carrying the run, through which the endpoints assemble the queries
+// they are sent
+func withRun(ctx context.Context, run *validationRun) context.Context {
+	return context.WithValue(ctx, runKey{}, run)
+}
+
+// runOf returns the run carried by the context, or a run with the default options if there is
+// none, as for queries sent outside of Validate
+func runOf(ctx context.Context) *validationRun {
+	if run, ok := ctx.Value(runKey{}).(*validationRun); ok {
+		return run
+	}
+	return newValidationRun(Options{})
+}
+
+// storeQuery keeps the query, if the queries of the run are to be printed
+func (r *validationRun) storeQuery(query SparqlQuery) {
+	if !r.recordQueries {
+		return
+	}
+	text := r.assembleQuery(query.algebra(true), queryPage{})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queries = append(r.queries, text)
+}
+
+// storedQueries returns the queries kept so far, in the order they were sent
+func (r *validationRun) storedQueries() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]string(nil), r.queries...)
+}
+
+// cachedTable returns the answer cached for the query, if there is one
+func (r *validationRun) cachedTable(query string) (Table[rdf.Term], bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	table, ok := r.targetCache[query]
+	return table, ok
+}
+
+// cacheTable caches the answer of the query for the rest of the run
+func (r *validationRun) cacheTable(query string, table Table[rdf.Term]) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.targetCache[query] = table
+}
+
+// setInferenceGraph sets the graph of the inferred triples, to be added to the queries assembled
+// from now on
+func (r *validationRun) setInferenceGraph(graph string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.inferenceGraph = graph
+	r.assembled = make(map[string]*sparqlQuery) // assembled without it
+}
+
+// addInferenceGraph adds the graph of the inferred triples to the default graphs of the query,
+// if it is restricted to a dataset. Queries left to the dataset of the endpoint see it anyway.
+func (r *validationRun) addInferenceGraph(q *sparqlQuery) {
+	if r.inferenceGraph == "" || len(q.from) == 0 && len(q.named) == 0 {
+		return
+	}
+	for _, g := range q.from {
+		if g == r.inferenceGraph {
+			return
+		}
+	}
+	q.from = append(q.from, r.inferenceGraph)
+}
+
+// unrolledClosures returns the number of closures unrolled so far
+func (r *validationRun) unrolledClosures() int64 {
+	return atomic.LoadInt64(&r.unrolled)
+}
+
+// lpNames encodes the RDF terms into the constants of the logic programs, as DLV does not
+// accept IRIs and literals, and decodes the constants of the answers again. The counters name
+// the auxiliary predicates of the programs.
+type lpNames struct {
+	plain bool // terms are used as they are, for readable programs
+
+	mu     sync.Mutex
+	encode map[string]string
+	decode map[string]string
+
+	qual    int
+	xoneVar int
+	orVar   int
+}
+
+func newLPNames(plain bool) *lpNames {
+	return &lpNames{
+		plain:   plain,
+		encode:  make(map[string]string),
+		decode:  make(map[string]string),
+		qual:    1,
+		xoneVar: 1,
+		orVar:   1,
+	}
+}
+
+// rewrite returns the constant encoding the term
+func (n *lpNames) rewrite(term rdf.Term) string {
+	if n.plain {
+		return term.RawValue()
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// check if already encoded
+	if encoded, ok := n.encode[term.RawValue()]; ok {
+		return encoded
+	}
+
+	newTerm := fmt.Sprint("term", getCount())
+
+	n.encode[term.RawValue()] = newTerm
+	n.decode[newTerm] = term.RawValue()
+
+	return newTerm
+}
+
+// original returns the value of the term encoded by the constant, or the constant itself if it
+// encodes none, as for plain programs
+func (n *lpNames) original(constant string) string {
+	if n == nil {
+		return constant
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if value, ok := n.decode[constant]; ok {
+		return value
+	}
+	return constant
+}
@@ -0,0 +1,66 @@
+package shawell
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestConcurrentRuns checks that validation runs with different options, started one after the
+// other and concurrently, do not affect each other
+func TestConcurrentRuns(t *testing.T) {
+	shapes := `
+@prefix ex: <http://example.org/> .
+@prefix sh: <http://www.w3.org/ns/shacl#> .
+
+ex:S a sh:NodeShape ;
+	sh:targetClass ex:C ;
+	sh:property [ sh:path ex:name ; sh:node ex:T ] .
+
+ex:T a sh:NodeShape ;
+	sh:minLength 3 .
+`
+	data := `
+@prefix ex: <http://example.org/> .
+
+ex:a a ex:C ; ex:name "Hallo" .
+ex:b a ex:C ; ex:name "Hi" .
+`
+
+	var out bytes.Buffer
+	if report := validateTurtle(t, shapes, data, Options{ForceLP: true, OnlyLP: true, Output: &out}); report != nil {
+		t.Error("got a report when only producing the logic program")
+	}
+	if !strings.Contains(out.String(), "(Hallo)") {
+		t.Errorf("got logic program without the plain terms\n%s", out.String())
+	}
+
+	runs := map[string]Options{
+		"default":     {},
+		"lp":          {ForceLP: true},
+		"virtuoso":    {ForceLP: true, Dialect: Virtuoso, Unoptimized: true},
+		"blazegraph":  {Dialect: Blazegraph, ClosureDepth: 2},
+		"onlyQueries": {OnlyQueries: true, Output: &bytes.Buffer{}},
+	}
+	for name, opts := range runs {
+		name, opts := name, opts
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			for i := 0; i < 3; i++ {
+				report := validateTurtle(t, shapes, data, opts)
+				if opts.OnlyQueries {
+					continue
+				}
+
+				var focus []string
+				for _, r := range report.Results() {
+					focus = append(focus, r.FocusNode().String())
+				}
+				if len(focus) != 1 || focus[0] != "<http://example.org/b>" {
+					t.Errorf("got results for %v, want ex:b only", focus)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,546 @@
+package shawell
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	rdf "github.com/cem-okulmus/rdf2go-1"
+)
+
+// This file contains the built-in solver for the logic programs produced from recursive SHACL
+// documents. The program is first grounded over the atoms it can possibly derive, and then
+// its well-founded model is computed via the alternating fixpoint of Van Gelder.
+
+// lpArg is an argument of an atom, either a constant or a variable. A variable may carry an
+// offset, as in Z+1, used for counting in the rules of qualified value shapes.
+type lpArg struct {
+	name     string
+	variable bool
+	offset   int
+}
+
+type lpAtom struct {
+	pred string
+	args []lpArg
+}
+
+type lpLiteral struct {
+	atom    lpAtom
+	negated bool
+}
+
+type lpRule struct {
+	head lpAtom
+	body []lpLiteral
+}
+
+// parseAtom reads atoms of the form pred(a, B, C+1), as they are written by expandRules
+func parseAtom(input string) (lpAtom, error) {
+	input = strings.TrimSpace(input)
+
+	open := strings.Index(input, "(")
+	if open == -1 {
+		return lpAtom{pred: input}, nil // propositional atom
+	}
+	if !strings.HasSuffix(input, ")") {
+		return lpAtom{}, errors.New("missing closing parenthesis")
+	}
+
+	out := lpAtom{pred: strings.TrimSpace(input[:open])}
+	if out.pred == "" {
+		return lpAtom{}, errors.New("missing predicate")
+	}
+
+	for _, a := range strings.Split(input[open+1:len(input)-1], ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			return lpAtom{}, errors.New("empty argument")
+		}
+
+		arg := lpArg{name: a}
+		if name, offset, found := strings.Cut(a, "+"); found && isLPVariable(name) {
+			n, err := strconv.Atoi(offset)
+			if err != nil {
+				return lpAtom{}, err
+			}
+			arg = lpArg{name: name, variable: true, offset: n}
+		} else if isLPVariable(a) {
+			arg.variable = true
+		}
+		out.args = append(out.args, arg)
+	}
+
+	return out, nil
+}
+
+// isLPVariable follows the convention of DLV, where variables start with an upper case letter
+func isLPVariable(s string) bool {
+	if s == "" || s[0] < 'A' || s[0] > 'Z' {
+		return false
+	}
+	for _, c := range s {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func parseRule(r rule) (lpRule, error) {
+	head, err := parseAtom(r.head)
+	if err != nil {
+		return lpRule{}, &ParseError{Term: r.head, Err: err}
+	}
+	out := lpRule{head: head}
+
+	for _, b := range r.body {
+		b = strings.TrimSpace(b)
+		if b == "" {
+			continue // produced for trivially satisfied conditions
+		}
+
+		var lit lpLiteral
+		if strings.HasPrefix(b, "not ") {
+			lit.negated = true
+			b = strings.TrimPrefix(b, "not ")
+		}
+
+		lit.atom, err = parseAtom(b)
+		if err != nil {
+			return lpRule{}, &ParseError{Term: b, Err: err}
+		}
+		out.body = append(out.body, lit)
+	}
+
+	return out, nil
+}
+
+// lpGround is a ground atom, with all arguments being constants
+type lpGround struct {
+	pred string
+	args []string
+}
+
+func (g lpGround) String() string {
+	if len(g.args) == 0 {
+		return g.pred
+	}
+	return fmt.Sprint(g.pred, "(", strings.Join(g.args, ","), ")")
+}
+
+type groundRule struct {
+	head int
+	pos  []int
+	neg  []int
+}
+
+// grounder instantiates the rules of a program over all atoms that are derivable when
+// ignoring negation, which is sufficient since no other atom can ever become true.
+type grounder struct {
+	rules   []lpRule
+	atoms   []lpGround
+	index   map[string]int
+	byPred  map[string][]int // only the derivable atoms
+	derived []bool
+
+	ground    []groundRule
+	seenRules map[string]struct{}
+	queue     []int
+}
+
+func (g *grounder) atomID(atom lpGround) int {
+	key := atom.String()
+	if id, ok := g.index[key]; ok {
+		return id
+	}
+
+	id := len(g.atoms)
+	g.atoms = append(g.atoms, atom)
+	g.derived = append(g.derived, false)
+	g.index[key] = id
+
+	return id
+}
+
+// derivable registers an atom occurring in the head of a ground rule
+func (g *grounder) derivable(atom lpGround) int {
+	id := g.atomID(atom)
+	if g.derived[id] {
+		return id
+	}
+	g.derived[id] = true
+	g.byPred[atom.pred] = append(g.byPred[atom.pred], id)
+	g.queue = append(g.queue, id)
+
+	return id
+}
+
+func instantiate(atom lpAtom, sub map[string]string) (lpGround, error) {
+	out := lpGround{pred: atom.pred, args: make([]string, len(atom.args))}
+
+	for i, a := range atom.args {
+		if !a.variable {
+			out.args[i] = a.name
+			continue
+		}
+
+		val, ok := sub[a.name]
+		if !ok {
+			return lpGround{}, fmt.Errorf("unsafe variable %v in atom %v", a.name, atom.pred)
+		}
+		if a.offset != 0 {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return lpGround{}, fmt.Errorf("cannot add %v to non-integer %v", a.offset, val)
+			}
+			val = strconv.Itoa(n + a.offset)
+		}
+		out.args[i] = val
+	}
+
+	return out, nil
+}
+
+// unify extends the substitution, such that the atom matches the ground atom. The returned
+// substitution is a copy, if it was extended.
+func unify(atom lpAtom, ground lpGround, sub map[string]string) (map[string]string, bool) {
+	if len(atom.args) != len(ground.args) {
+		return nil, false
+	}
+
+	out := sub
+	copied := false
+
+	for i, a := range atom.args {
+		val := ground.args[i]
+		if !a.variable {
+			if a.name != val {
+				return nil, false
+			}
+			continue
+		}
+
+		if a.offset != 0 {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, false
+			}
+			val = strconv.Itoa(n - a.offset)
+		}
+
+		if bound, ok := out[a.name]; ok {
+			if bound != val {
+				return nil, false
+			}
+			continue
+		}
+
+		if !copied {
+			out = make(map[string]string, len(sub)+1)
+			for k, v := range sub {
+				out[k] = v
+			}
+			copied = true
+		}
+		out[a.name] = val
+	}
+
+	return out, true
+}
+
+// join matches the remaining positive body literals of the rule against the derivable atoms,
+// and adds a ground rule for every complete match
+func (g *grounder) join(r lpRule, skip int, next int, sub map[string]string) error {
+	for next < len(r.body) && (next == skip || r.body[next].negated) {
+		next++
+	}
+
+	if next == len(r.body) {
+		return g.addGround(r, sub)
+	}
+
+	lit := r.body[next].atom
+	candidates := g.byPred[lit.pred]
+	for i := 0; i < len(candidates); i++ {
+		newSub, ok := unify(lit, g.atoms[candidates[i]], sub)
+		if !ok {
+			continue
+		}
+		err := g.join(r, skip, next+1, newSub)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (g *grounder) addGround(r lpRule, sub map[string]string) error {
+	head, err := instantiate(r.head, sub)
+	if err != nil {
+		return err
+	}
+
+	var out groundRule
+	var key strings.Builder
+	key.WriteString(head.String())
+
+	for _, lit := range r.body {
+		atom, err := instantiate(lit.atom, sub)
+		if err != nil {
+			return err
+		}
+		id := g.atomID(atom)
+
+		if lit.negated {
+			out.neg = append(out.neg, id)
+			key.WriteString(" -")
+		} else {
+			out.pos = append(out.pos, id)
+			key.WriteString(" +")
+		}
+		key.WriteString(strconv.Itoa(id))
+	}
+
+	if _, ok := g.seenRules[key.String()]; ok {
+		return nil
+	}
+	g.seenRules[key.String()] = Empty
+
+	out.head = g.derivable(head)
+	g.ground = append(g.ground, out)
+
+	return nil
+}
+
+// ground parses the rules of the program and instantiates them
+func (p program) ground() (*grounder, error) {
+	g := &grounder{
+		index:     make(map[string]int),
+		byPred:    make(map[string][]int),
+		seenRules: make(map[string]struct{}),
+	}
+
+	watch := make(map[string][][2]int) // predicate -> (rule, position of positive literal)
+
+	for i := range p.rules {
+		r, err := parseRule(p.rules[i])
+		if err != nil {
+			return nil, err
+		}
+		g.rules = append(g.rules, r)
+
+		hasPositive := false
+		for j, lit := range r.body {
+			if !lit.negated {
+				hasPositive = true
+				watch[lit.atom.pred] = append(watch[lit.atom.pred], [2]int{len(g.rules) - 1, j})
+			}
+		}
+
+		if !hasPositive {
+			err = g.addGround(r, map[string]string{})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// every instance of a rule is found once the last of its positive body atoms is processed
+	for len(g.queue) > 0 {
+		id := g.queue[0]
+		g.queue = g.queue[1:]
+		atom := g.atoms[id]
+
+		for _, w := range watch[atom.pred] {
+			r := g.rules[w[0]]
+			sub, ok := unify(r.body[w[1]].atom, atom, map[string]string{})
+			if !ok {
+				continue
+			}
+			err := g.join(r, w[1], 0, sub)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return g, nil
+}
+
+// watchLists lists for each atom the ground rules it occurs in positively
+func (g *grounder) watchLists() [][]int {
+	return watchLists(g.ground, len(g.atoms))
+}
+
+// watchLists lists for each of the atoms the rules it occurs in positively
+func watchLists(rules []groundRule, numAtoms int) [][]int {
+	watch := make([][]int, numAtoms)
+	for i, r := range rules {
+		for _, a := range r.pos {
+			watch[a] = append(watch[a], i) // duplicates are fine, as they are counted as well
+		}
+	}
+
+	return watch
+}
+
+// lpValue is the truth value of an atom in the well-founded model
+type lpValue int8
+
+const (
+	lpFalse lpValue = iota
+	lpUndefined
+	lpTrue
+)
+
+// lpModel assigns each atom of a ground program one of the three truth values. Atoms not
+// listed are false. Only the well-founded semantics leaves atoms undefined.
+type lpModel struct {
+	atoms []lpGround
+	truth []lpValue
+}
+
+// leastModel computes the least model of the reduct of the ground program w.r.t. the given
+// interpretation, i.e. rules with a negated atom in the interpretation are dropped, and all
+// other negated atoms are treated as satisfied.
+func leastModel(rules []groundRule, watch [][]int, numAtoms int, interp []bool) []bool {
+	out := make([]bool, numAtoms)
+	missing := make([]int, len(rules))
+	var queue []int
+
+	derive := func(atom int) {
+		if !out[atom] {
+			out[atom] = true
+			queue = append(queue, atom)
+		}
+	}
+
+	for i, r := range rules {
+		missing[i] = -1 // marks dropped rules
+		blocked := false
+		for _, n := range r.neg {
+			if interp[n] {
+				blocked = true
+				break
+			}
+		}
+		if blocked {
+			continue
+		}
+
+		missing[i] = len(r.pos)
+		if missing[i] == 0 {
+			derive(r.head)
+		}
+	}
+
+	for len(queue) > 0 {
+		atom := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+
+		for _, i := range watch[atom] {
+			if missing[i] <= 0 {
+				continue
+			}
+			missing[i]--
+			if missing[i] == 0 {
+				derive(rules[i].head)
+			}
+		}
+	}
+
+	return out
+}
+
+// wellFounded computes the well-founded model of the ground program, as the alternating
+// fixpoint of the operator mapping an interpretation to the least model of the reduct w.r.t.
+// it. The sequence of underestimates yields the true atoms, and the one of overestimates all
+// atoms that are not false.
+func (g *grounder) wellFounded() *lpModel {
+	numAtoms := len(g.atoms)
+	watch := g.watchLists()
+
+	count := func(interp []bool) (n int) {
+		for _, v := range interp {
+			if v {
+				n++
+			}
+		}
+		return n
+	}
+
+	under := make([]bool, numAtoms)
+	over := leastModel(g.ground, watch, numAtoms, under)
+	prev := -1
+
+	for count(under) != prev {
+		prev = count(under)
+		under = leastModel(g.ground, watch, numAtoms, over)
+		over = leastModel(g.ground, watch, numAtoms, under)
+	}
+
+	out := &lpModel{atoms: g.atoms, truth: make([]lpValue, numAtoms)}
+	for i := range out.truth {
+		switch {
+		case under[i]:
+			out.truth[i] = lpTrue
+		case over[i]:
+			out.truth[i] = lpUndefined
+		}
+	}
+
+	return out
+}
+
+// ToTables returns the atoms with the given truth value as unary tables, one per predicate,
+// translating the constants back into the RDF terms they encode.
+func (w lpModel) ToTables(value lpValue, names *lpNames) (out []Table[rdf.Term]) {
+	answerMap := make(map[string][]rdf.Term)
+	var preds []string
+
+	for i, atom := range w.atoms {
+		if w.truth[i] != value || len(atom.args) == 0 {
+			continue
+		}
+
+		actualValue := names.original(atom.args[0])
+
+		if _, ok := answerMap[atom.pred]; !ok {
+			preds = append(preds, atom.pred)
+		}
+		answerMap[atom.pred] = append(answerMap[atom.pred], res(actualValue))
+	}
+
+	sort.Strings(preds)
+
+	for _, pred := range preds {
+		tmp := &TableSimple[rdf.Term]{header: []string{pred}}
+		for _, term := range answerMap[pred] {
+			tmp.content = append(tmp.content, []rdf.Term{term})
+		}
+		out = append(out, tmp)
+	}
+
+	return out
+}
+
+// String lists the true and undefined atoms, in the style of the output of DLV
+func (w lpModel) String() string {
+	var trueAtoms, undefAtoms []string
+
+	for i, atom := range w.atoms {
+		switch w.truth[i] {
+		case lpTrue:
+			trueAtoms = append(trueAtoms, atom.String())
+		case lpUndefined:
+			undefAtoms = append(undefAtoms, atom.String())
+		}
+	}
+
+	return fmt.Sprint("True: {", strings.Join(trueAtoms, ", "), "}\nUndefined: {",
+		strings.Join(undefAtoms, ", "), "}")
+}
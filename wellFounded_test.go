@@ -0,0 +1,259 @@
+package shawell
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWellFounded checks the built-in solver against programs with known well-founded models
+func TestWellFounded(t *testing.T) {
+	tests := []struct {
+		name      string
+		rules     []rule
+		only      string // if set, only atoms of this predicate are compared
+		want      string
+		undefined string
+	}{
+		{
+			"stratified",
+			[]rule{
+				{head: "edge(a, b)"}, {head: "edge(b, c)"},
+				{head: "reach(X, Y)", body: []string{"edge(X, Y)"}},
+				{head: "reach(X, Z)", body: []string{"reach(X, Y)", "edge(Y, Z)"}},
+				{head: "node(a)"}, {head: "node(c)"},
+				{head: "isolated(X)", body: []string{"node(X)", "not reach(X, c)"}},
+			},
+			"",
+			"edge(a,b) edge(b,c) isolated(c) node(a) node(c) reach(a,b) reach(a,c) reach(b,c)",
+			"",
+		},
+		{
+			"evenLoop",
+			[]rule{
+				{head: "p", body: []string{"not q"}},
+				{head: "q", body: []string{"not p"}},
+				{head: "r", body: []string{"not s"}},
+			},
+			"",
+			"r",
+			"p q",
+		},
+		{
+			"unfoundedLoop",
+			[]rule{
+				{head: "Shape1( term1 )", body: []string{"Shape2( term1 )"}},
+				{head: "Shape2( term1 )", body: []string{"Shape1( term1 )"}},
+				{head: "Shape3( term1 )", body: []string{" not Shape1( term1 )"}},
+			},
+			"",
+			"Shape3(term1)",
+			"",
+		},
+		{
+			"counting",
+			[]rule{
+				{head: "Qual1(0, term1)"}, {head: "Qual1(term1, term2)"}, {head: "Qual1(term2, 1)"},
+				{head: "ref(term1)"}, {head: "ref(term2)"},
+				{head: "AtLeast1(X,0)", body: []string{"Qual1(0,X)"}},
+				{head: "AtLeast1(X,1)", body: []string{"Qual1(0,X) ", "ref(X)"}},
+				{head: "AtLeast1(Y,Z)", body: []string{"Qual1(X,Y) ", "AtLeast1(X,Z)"}},
+				{head: "AtLeast1(Y,Z+1)", body: []string{"Qual1(X,Y) ", "AtLeast1(X,Z)", "ref(Y)"}},
+				{head: "AtLeast1Un(Y)", body: []string{"AtLeast1(X,Y)"}},
+				{head: "ok(term1)", body: []string{"AtLeast1Un(2)", "not AtLeast1Un(3)"}},
+			},
+			"ok",
+			"ok(term1)",
+			"",
+		},
+	}
+
+	for _, tc := range tests {
+		model, err := program{rules: tc.rules}.solve(context.Background(), WellFounded)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+
+		var got, undefined []string
+		for i, atom := range model.atoms {
+			if tc.only != "" && atom.pred != tc.only {
+				continue
+			}
+			switch model.truth[i] {
+			case lpTrue:
+				got = append(got, atom.String())
+			case lpUndefined:
+				undefined = append(undefined, atom.String())
+			}
+		}
+
+		sort.Strings(got)
+		sort.Strings(undefined)
+
+		if strings.Join(got, " ") != tc.want {
+			t.Errorf("%s: got true atoms %v, want %v", tc.name, got, tc.want)
+		}
+		if strings.Join(undefined, " ") != tc.undefined {
+			t.Errorf("%s: got undefined atoms %v, want %v", tc.name, undefined, tc.undefined)
+		}
+	}
+}
+
+// TestSemantics checks the alternative semantics on a program with two stable models, and a
+// positive loop that is true in some supported models, but in no stable one
+func TestSemantics(t *testing.T) {
+	rules := []rule{
+		{head: "p", body: []string{"not q"}},
+		{head: "q", body: []string{"not p"}},
+		{head: "r", body: []string{"p"}},
+		{head: "r", body: []string{"q"}},
+		{head: "s", body: []string{"s"}},
+		{head: "u", body: []string{"s", "not p"}},
+	}
+
+	tests := []struct {
+		semantics Semantics
+		want      string
+	}{
+		{StableBrave, "p q r"},
+		{StableCautious, "r"},
+		{Supported, "r"},
+	}
+
+	for _, tc := range tests {
+		model, err := program{rules: rules}.solve(context.Background(), tc.semantics)
+		if err != nil {
+			t.Errorf("%s: %v", tc.semantics, err)
+			continue
+		}
+
+		var got []string
+		for i, atom := range model.atoms {
+			if model.truth[i] == lpTrue {
+				got = append(got, atom.String())
+			}
+		}
+		sort.Strings(got)
+
+		if strings.Join(got, " ") != tc.want {
+			t.Errorf("%s: got true atoms %v, want %v", tc.semantics, got, tc.want)
+		}
+	}
+}
+
+// TestSemanticsComponents checks that the models of independent parts of a program are searched
+// separately, that a part without model leaves the whole program without one, and that the
+// search stops once cancelled
+func TestSemanticsComponents(t *testing.T) {
+	const n = 40 // 2^40 models, if not split into components
+	var rules []rule
+	for i := 0; i < n; i++ {
+		rules = append(rules,
+			rule{head: fmt.Sprint("s", i), body: []string{fmt.Sprint("not t", i)}},
+			rule{head: fmt.Sprint("t", i), body: []string{fmt.Sprint("not s", i)}},
+		)
+	}
+
+	countTrue := func(model *lpModel) (count int) {
+		for i := range model.atoms {
+			if model.truth[i] == lpTrue {
+				count++
+			}
+		}
+		return count
+	}
+
+	for semantics, want := range map[Semantics]int{StableBrave: 2 * n, StableCautious: 0, Supported: 0} {
+		model, err := program{rules: rules}.solve(context.Background(), semantics)
+		if err != nil {
+			t.Fatalf("%s: %v", semantics, err)
+		}
+		if got := countTrue(model); got != want {
+			t.Errorf("%s: got %d true atoms, want %d", semantics, got, want)
+		}
+	}
+
+	noModel := append([]rule{{head: "x", body: []string{"not x"}}}, rules...)
+	model, err := program{rules: noModel}.solve(context.Background(), StableBrave)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := countTrue(model); got != 0 {
+		t.Errorf("got %d true atoms, want none for a program without stable model", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := (program{rules: rules}).solve(ctx, StableBrave); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want the search cancelled", err)
+	}
+}
+
+// TestDLVCancelled checks that DLV is killed once the context is cancelled
+func TestDLVCancelled(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script standing in for DLV")
+	}
+	dlv := filepath.Join(t.TempDir(), "dlv")
+	err := os.WriteFile(dlv, []byte("#!/bin/sh\nexec sleep 10\n"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, _, err = program{rules: []rule{{head: "a"}}}.Answer(ctx, dlv, WellFounded, false)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want DLV cancelled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("DLV was only stopped after %v", elapsed)
+	}
+}
+
+// TestValidateUndefined checks that a target whose shape is undefined under well-founded
+// semantics is reported as such, and only counts as a failure unless accepted
+func TestValidateUndefined(t *testing.T) {
+	shapes := `
+@prefix ex: <http://example.org/> .
+@prefix sh: <http://www.w3.org/ns/shacl#> .
+
+ex:S a sh:NodeShape ;
+	sh:targetNode ex:a ;
+	sh:not ex:S .
+`
+	data := `
+@prefix ex: <http://example.org/> .
+
+ex:a ex:p ex:b .
+`
+
+	report := validateTurtle(t, shapes, data, Options{})
+	if report.Conforms() {
+		t.Error("got conforming report, want the undefined target to fail")
+	}
+	if len(report.Results()) != 1 || len(report.Undefined()) != 1 {
+		t.Fatalf("got %d results, %d undefined, want a single undefined one", len(report.Results()), len(report.Undefined()))
+	}
+	if r := report.Undefined()[0]; !r.Undefined() || r.FocusNode().RawValue() != "http://example.org/a" {
+		t.Errorf("got undefined result %v, want one for ex:a", r)
+	}
+
+	report = validateTurtle(t, shapes, data, Options{AcceptUndefined: true})
+	if !report.Conforms() {
+		t.Error("got non-conforming report, want the undefined target accepted")
+	}
+	if len(report.Undefined()) != 1 {
+		t.Errorf("got %d undefined results, want the accepted one still reported", len(report.Undefined()))
+	}
+}
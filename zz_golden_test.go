@@ -0,0 +1,70 @@
+package shawell
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	rdf "github.com/cem-okulmus/rdf2go-1"
+)
+
+func TestZZGolden(t *testing.T) {
+	dir := os.Getenv("GOLDEN")
+	if dir == "" {
+		t.Skip()
+	}
+	os.MkdirAll(dir, 0o755)
+	for _, opts := range []Options{{ClearGraph: true}, {ForceLP: true, ClearGraph: true}, {Unoptimized: true, ClearGraph: true}, {Dialect: Virtuoso, ClearGraph: true}} {
+		mem, _ := GetMemoryEndpoint(nil, "", false)
+		endpoint := GetProfilingEndpoint(mem, 0, nil)
+		for _, tc := range CoreTests() {
+			testString := "resources/W3_SHACL_Test_Suite_Core" + tc + ".ttl"
+			f, _ := os.Open(testString)
+			g2 := rdf.NewGraph(_sh)
+			check(g2.Parse(f, "text/turtle"))
+			prefixes.reset()
+			check(GetNameSpace(f))
+			f.Close()
+			basename := filepath.Base(testString)
+			fileName := strings.TrimSuffix(basename, filepath.Ext(basename))
+			check(endpoint.Insert(context.Background(), g2, "<"+_sh+fileName+">"))
+			doc, err := GetShaclDocument(g2, "<"+_sh+fileName+">", endpoint, false)
+			check(err)
+			actual, err := answerShacl(context.Background(), endpoint, doc, opts)
+			out := ""
+			if err != nil {
+				out = "ERR " + err.Error()
+			} else {
+				lines := strings.Split(actual.String(), "\n")
+				sort.Strings(lines)
+				out = strings.Join(lines, "\n")
+			}
+			name := fmt.Sprintf("%s/%v-%v-%v-%s", dir, opts.ForceLP, opts.Unoptimized, opts.Dialect.Name, strings.ReplaceAll(tc, "/", "_"))
+			os.WriteFile(name, []byte(out), 0o644)
+			var qs []string
+			for _, st := range endpoint.Stats() {
+				for _, q := range strings.Split(st.Query, "\n#\n") {
+					qs = append(qs, regexp.MustCompile(`indirect[0-9]+`).ReplaceAllString(regexp.MustCompile(`[0-9]{3,}`).ReplaceAllString(q, "N"), "indirectX"))
+				}
+			}
+			sort.Strings(qs)
+			var uniq []string
+			for i, q := range qs {
+				if i == 0 || q != qs[i-1] {
+					uniq = append(uniq, q)
+				}
+			}
+			qs = uniq
+			os.MkdirAll(dir+"/q", 0o755)
+			os.WriteFile(strings.Replace(name, dir, dir+"/q", 1), []byte(strings.Join(qs, "\n=====\n")), 0o644)
+			endpoint.mu.Lock()
+			endpoint.stats = nil
+			endpoint.mu.Unlock()
+		}
+	}
+}